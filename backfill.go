@@ -0,0 +1,575 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRangeSteps bounds the steps of each range query, well below the points metrics servers return per series
+const maxRangeSteps = 1000
+
+// JobVersion is a version of a job spec along with when it was submitted, in Unix nanoseconds
+type JobVersion struct {
+	JobSpec
+	Version    uint64
+	SubmitTime int64
+}
+
+type JobVersions struct {
+	Versions []JobVersion
+}
+
+// Requests holds the resources requested by all allocations of a job
+type Requests struct {
+	CPU           float64
+	MemoryMB      float64
+	DiskMB        float64
+	IOPS          float64
+	MBits         float64
+	ReservedPorts float64
+	DynamicPorts  float64
+	MemoryMaxMB   float64
+	Cores         float64
+	CoresMHz      float64
+}
+
+// backfillJob is a job to backfill along with the versions of its spec and the allocations Nomad still keeps
+type backfillJob struct {
+	Desc      JobDesc
+	Cluster   *NomadCluster
+	Namespace string
+	Versions  []JobVersion
+	Allocs    []Alloc
+}
+
+// rangeUsage holds the history of used resources of every job over a range of steps
+type rangeUsage struct {
+	RSS        map[MetricType]map[int64]float64
+	Cache      map[MetricType]map[int64]float64
+	Ticks      map[MetricType]map[int64]float64
+	TicksStats map[MetricType]map[int64]UsageStats
+	RSSStats   map[MetricType]map[int64]UsageStats
+}
+
+// getJobVersions lists the versions of a job Nomad still keeps, oldest first
+func getJobVersions(ctx context.Context, cluster *NomadCluster, jobID string) ([]JobVersion, error) {
+	response, err := cluster.get(ctx, "/v1/job/"+jobID+"/versions")
+	if err != nil {
+		return nil, fmt.Errorf("Error in getting API response: %v", err)
+	}
+	defer response.Body.Close()
+
+	var versions JobVersions
+	err = json.NewDecoder(response.Body).Decode(&versions)
+	if err != nil {
+		return nil, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+	sort.Slice(versions.Versions, func(i, j int) bool {
+		return versions.Versions[i].SubmitTime < versions.Versions[j].SubmitTime
+	})
+
+	return versions.Versions, nil
+}
+
+// specAt returns the spec of the latest version submitted by t, or of the oldest version kept when every version
+// was submitted after t
+func specAt(versions []JobVersion, t time.Time) JobSpec {
+	if len(versions) == 0 {
+		return JobSpec{}
+	}
+
+	spec := versions[0].JobSpec
+	for _, version := range versions {
+		if version.SubmitTime > t.UnixNano() {
+			break
+		}
+		spec = version.JobSpec
+	}
+
+	return spec
+}
+
+// isAlive tells whether an allocation existed and had not terminated at t
+func isAlive(alloc Alloc, t time.Time) bool {
+	if alloc.CreateTime > t.UnixNano() {
+		return false
+	}
+	return !isTerminal(alloc.ClientStatus) || alloc.ModifyTime > t.UnixNano()
+}
+
+// allocsAt returns the allocations alive at t as a cycle would have listed them then, still running
+func allocsAt(allocs []Alloc, t time.Time) []Alloc {
+	var alive []Alloc
+
+	for _, alloc := range allocs {
+		if isAlive(alloc, t) {
+			alloc.ClientStatus = "running"
+			alive = append(alive, alloc)
+		}
+	}
+
+	return alive
+}
+
+// countsAt returns the number of allocations requesting resources for each task group at t, like getTaskGroupCounts
+// for a cycle run at t
+func countsAt(jobType string, jobSpec JobSpec, allocs []Alloc, t time.Time) map[string]float64 {
+	return getTaskGroupCounts(jobType, jobSpec, allocsAt(allocs, t))
+}
+
+// specRequests sums the resources requested by the tasks of a job spec, weighted by task group counts, converting
+// reserved cores to MHz on the nodes of allocs
+func specRequests(ctx context.Context, cluster *NomadCluster, jobSpec JobSpec, mapTaskGroupCount map[string]float64, allocs []Alloc) Requests {
+	var requests Requests
+
+	requests.CPU, requests.MemoryMB, requests.DiskMB, requests.IOPS = aggRequested(jobSpec, mapTaskGroupCount)
+	requests.MBits, requests.ReservedPorts, requests.DynamicPorts = aggNetworks(jobSpec, mapTaskGroupCount)
+	requests.MemoryMaxMB, requests.Cores, requests.CoresMHz = aggLimits(ctx, cluster, jobSpec, mapTaskGroupCount, allocs)
+
+	return requests
+}
+
+// parentOf returns the ID of the periodic or parameterized job a child job was launched by, empty for other jobs
+func parentOf(jobID string) string {
+	for _, marker := range []string{"/periodic-", "/dispatch-"} {
+		if i := strings.LastIndex(jobID, marker); i > 0 {
+			return jobID[:i]
+		}
+	}
+	return ""
+}
+
+// rangeValue looks a job up at a Unix time in a range query grouped by job and namespace, like jobValue
+func rangeValue(usage map[MetricType]map[int64]float64, jobName, namespace string, t int64) (float64, bool) {
+	if value, ok := usage[MetricType{Job: jobName, Namespace: namespace}][t]; ok {
+		return value, true
+	}
+	value, ok := usage[MetricType{Job: jobName}][t]
+	return value, ok
+}
+
+// rangeStats looks the window statistics of a job up at a Unix time, like rangeValue
+func rangeStats(stats map[MetricType]map[int64]UsageStats, jobName, namespace string, t int64) UsageStats {
+	if value, ok := stats[MetricType{Job: jobName, Namespace: namespace}][t]; ok {
+		return value
+	}
+	return stats[MetricType{Job: jobName}][t]
+}
+
+// listBackfillJobs lists every collected job of the cluster along with the versions of its spec,
+// falling back to its current spec when versions cannot be listed, and its allocations
+func listBackfillJobs(ctx context.Context, cluster *NomadCluster) []backfillJob {
+	var jobs []backfillJob
+
+	log.SetReportCaller(true)
+
+	for _, region := range getRegions(ctx, cluster) {
+		regionCluster := cluster.withRegion(region)
+		for _, namespace := range getNamespaces(ctx, regionCluster) {
+			namespaceCluster := regionCluster.withNamespace(namespace)
+			descs, err := getJobs(ctx, namespaceCluster)
+			if err != nil {
+				log.Error(fmt.Sprintf("Error in listing jobs in region %s, namespace %s: %v", region, namespace, err))
+				continue
+			}
+
+			for _, desc := range descs {
+				if !isCollected(desc) {
+					continue
+				}
+
+				job := backfillJob{desc, namespaceCluster, desc.JobSummary.Namespace, nil, nil}
+				if job.Namespace == "" {
+					job.Namespace = namespace
+				}
+
+				job.Versions, err = getJobVersions(ctx, namespaceCluster, desc.ID)
+				if err != nil {
+					log.Warning(fmt.Sprintf("Error in listing versions of %s, falling back to its current spec: %v", desc.ID, err))
+					jobSpec, err := getJobSpec(ctx, namespaceCluster, desc.ID)
+					if err != nil {
+						log.Error(err)
+						continue
+					}
+					job.Versions = []JobVersion{{JobSpec: jobSpec}}
+				}
+
+				job.Allocs, err = getAllocs(ctx, namespaceCluster, desc.ID)
+				if err != nil {
+					log.Error(err)
+				}
+
+				jobs = append(jobs, job)
+			}
+		}
+	}
+
+	return jobs
+}
+
+// backfillAt reconstructs the jobs with used resources at t like reachJob would have in a cycle of length step,
+// rolling periodic and dispatched children up into their parent job like reachNamespace. Jobs without samples at t
+// were not running and are left out. Jobs that are no longer registered are reconstructed from their series alone.
+// Requested resources that cannot be reconstructed, because the job is no longer registered or Nomad no longer keeps
+// the allocations it counts, are marked missing.
+func backfillAt(ctx context.Context, cluster *NomadCluster, jobs []backfillJob, usage rangeUsage, t time.Time, step time.Duration) []JobData {
+	var jobData []JobData
+
+	parents := make(map[string]int)
+	add := func(jobStruct JobData, parentID string) {
+		if parentID != "" {
+			jobStruct.JobID = parentID
+			jobStruct.Name = parentID
+			key := jobStruct.Region + "/" + jobStruct.Namespace + "/" + parentID
+			if j, ok := parents[key]; ok {
+				mergeJobData(&jobData[j], jobStruct)
+				return
+			}
+			parents[key] = len(jobData)
+		}
+		jobData = append(jobData, jobStruct)
+	}
+
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	listed := make(map[MetricType]bool)
+	for _, job := range jobs {
+		name, namespace := job.Desc.Name, job.Namespace
+		listed[MetricType{Job: name, Namespace: namespace}] = true
+		listed[MetricType{Job: name}] = true
+		jobStruct, ok := usedAt(usage, name, namespace, t)
+		if !ok {
+			continue
+		}
+
+		jobSpec := specAt(job.Versions, t)
+		allocs := allocsAt(job.Allocs, t)
+		requests := specRequests(ctx, job.Cluster, jobSpec, getTaskGroupCounts(job.Desc.Type, jobSpec, allocs), allocs)
+		jobStruct.RequestsSource = fromNomad
+		// The job ran at t, so no allocation alive at t means Nomad no longer keeps the ones it counts
+		if job.Desc.Type != "service" && len(allocs) == 0 {
+			jobStruct.RequestsSource = fromMissing
+		}
+
+		if isBatch(job.Desc.Type) {
+			var overlapping []string
+			jobStruct.RCPUSeconds, jobStruct.RMemoryMBSeconds, overlapping = lifetimeRequests(jobSpec, job.Allocs, t, step)
+			// Metrics servers keep no history of usage by allocation to integrate resource-seconds from
+			jobStruct.SecondsSource = fromNone
+			if len(overlapping) > 0 || jobStruct.RequestsSource == fromMissing {
+				jobStruct.SecondsSource = fromMissing
+			}
+		}
+
+		jobStruct.JobID = job.Desc.ID
+		jobStruct.Name = name
+		jobStruct.RCPU = requests.CPU
+		jobStruct.RMemoryMB = requests.MemoryMB
+		jobStruct.RdiskMB = requests.DiskMB
+		jobStruct.RIOPS = requests.IOPS
+		jobStruct.Namespace = namespace
+		jobStruct.DataCenters = strings.Join(job.Desc.Datacenters, ",")
+		jobStruct.CurrentTime = currentTime
+		jobStruct.Region = job.Cluster.Region
+		jobStruct.Cluster = job.Cluster.Name
+		jobStruct.Type = job.Desc.Type
+		jobStruct.RMBits = requests.MBits
+		jobStruct.RReservedPorts = requests.ReservedPorts
+		jobStruct.RDynamicPorts = requests.DynamicPorts
+		jobStruct.RMemoryMaxMB = requests.MemoryMaxMB
+		jobStruct.RCores = requests.Cores
+		jobStruct.RCoresMHz = requests.CoresMHz
+		jobStruct.WasteCPU = math.Max(0, requests.CPU+requests.CoresMHz-jobStruct.UTicks)
+		jobStruct.WasteMemoryMB = wasteMemory(requests.MemoryMB, jobStruct.URSS, nil)
+
+		add(jobStruct, job.Desc.ParentID)
+	}
+
+	for _, key := range unlistedAt(usage, listed, t) {
+		jobStruct, _ := usedAt(usage, key.Job, key.Namespace, t)
+		jobStruct.JobID = key.Job
+		jobStruct.Name = key.Job
+		jobStruct.Namespace = key.Namespace
+		jobStruct.CurrentTime = currentTime
+		jobStruct.Region = cluster.Region
+		jobStruct.Cluster = cluster.Name
+		jobStruct.RequestsSource = fromMissing
+
+		add(jobStruct, parentOf(key.Job))
+	}
+
+	return jobData
+}
+
+// usedAt returns the used resources of a job at t, or false when none of its series has a sample at t
+func usedAt(usage rangeUsage, jobName, namespace string, t time.Time) (JobData, bool) {
+	rss, rssOK := rangeValue(usage.RSS, jobName, namespace, t.Unix())
+	cache, cacheOK := rangeValue(usage.Cache, jobName, namespace, t.Unix())
+	ticks, ticksOK := rangeValue(usage.Ticks, jobName, namespace, t.Unix())
+	if !rssOK && !cacheOK && !ticksOK {
+		return JobData{}, false
+	}
+	ticksStats := rangeStats(usage.TicksStats, jobName, namespace, t.Unix())
+	rssStats := rangeStats(usage.RSSStats, jobName, namespace, t.Unix())
+
+	source := func(ok bool) string {
+		if ok {
+			return fromMetrics
+		}
+		return fromMissing
+	}
+
+	return JobData{
+		UTicks:      ticks,
+		URSS:        rss / 1.049e6,
+		UCache:      cache / 1.049e6,
+		UTicksAvg:   ticksStats.Avg,
+		UTicksMax:   ticksStats.Max,
+		UTicksP50:   ticksStats.P50,
+		UTicksP95:   ticksStats.P95,
+		UTicksP99:   ticksStats.P99,
+		URSSAvg:     rssStats.Avg / 1.049e6,
+		URSSMax:     rssStats.Max / 1.049e6,
+		URSSP50:     rssStats.P50 / 1.049e6,
+		URSSP95:     rssStats.P95 / 1.049e6,
+		URSSP99:     rssStats.P99 / 1.049e6,
+		RSSSource:   source(rssOK),
+		CacheSource: source(cacheOK),
+		TicksSource: source(ticksOK),
+	}, true
+}
+
+// unlistedAt returns the series with a sample at t of the jobs that are not listed, sorted by namespace and job
+func unlistedAt(usage rangeUsage, listed map[MetricType]bool, t time.Time) []MetricType {
+	var keys []MetricType
+
+	seen := make(map[MetricType]bool)
+	for _, metric := range []map[MetricType]map[int64]float64{usage.RSS, usage.Cache, usage.Ticks} {
+		for key, values := range metric {
+			if _, ok := values[t.Unix()]; !ok || listed[key] || seen[key] {
+				continue
+			}
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		return keys[i].Job < keys[j].Job
+	})
+
+	return keys
+}
+
+// getRangeUsage reads the used resources of every job at every step from begin to end
+func getRangeUsage(ctx context.Context, source RangeSource, begin, end time.Time, step time.Duration) (rangeUsage, error) {
+	var usage rangeUsage
+	var err error
+
+	usage.RSS, err = source.JobRangeUsage(ctx, rssMetric, begin, end, step)
+	if err != nil {
+		return usage, err
+	}
+	usage.Cache, err = source.JobRangeUsage(ctx, cacheMetric, begin, end, step)
+	if err != nil {
+		return usage, err
+	}
+	usage.Ticks, err = source.JobRangeUsage(ctx, ticksMetric, begin, end, step)
+	if err != nil {
+		return usage, err
+	}
+	usage.TicksStats, err = source.WindowRangeUsage(ctx, ticksMetric, begin, end, step, step)
+	if err != nil {
+		return usage, err
+	}
+	usage.RSSStats, err = source.WindowRangeUsage(ctx, rssMetric, begin, end, step, step)
+	if err != nil {
+		return usage, err
+	}
+
+	return usage, nil
+}
+
+// backfill stores the jobs of a cluster at every step from begin to end as if a cycle had run then, reading used
+// resources from the history of the cluster's metrics server. Steps that already have rows are skipped.
+// Returns the number of steps written and skipped.
+func backfill(ctx context.Context, cluster *NomadCluster, begin, end time.Time, step time.Duration) (int, int, error) {
+	var written, skipped int
+
+	log.SetReportCaller(true)
+
+	source, ok := cluster.metrics().(RangeSource)
+	if !ok {
+		return 0, 0, fmt.Errorf("Cluster %s reads used resources from Nomad alone, which keeps no history to backfill from", cluster.Name)
+	}
+
+	existing, err := getInsertTimesDB(db, cluster.Name, begin.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	jobs := listBackfillJobs(ctx, cluster)
+	log.Info(fmt.Sprintf("Backfilling %d jobs of %s from %s to %s every %s", len(jobs), cluster.Name,
+		begin.Format("2006-01-02 15:04:05"), end.Format("2006-01-02 15:04:05"), step))
+
+	for chunkBegin := begin; !chunkBegin.After(end); {
+		chunkEnd := chunkBegin.Add(step * (maxRangeSteps - 1))
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+
+		var pending []time.Time
+		for t := chunkBegin; !t.After(chunkEnd); t = t.Add(step) {
+			if _, ok := existing[t.Format("2006-01-02 15:04:05")]; ok {
+				skipped++
+				continue
+			}
+			pending = append(pending, t)
+		}
+
+		if len(pending) > 0 {
+			usage, err := getRangeUsage(ctx, source, pending[0], pending[len(pending)-1], step)
+			if err != nil {
+				return written, skipped, err
+			}
+			for _, t := range pending {
+				insertTime := t.Format("2006-01-02 15:04:05")
+				for _, v := range backfillAt(ctx, cluster, jobs, usage, t, step) {
+					err = insertJobDB(insert, v, insertTime)
+					if err != nil {
+						return written, skipped, err
+					}
+				}
+				written++
+			}
+		}
+
+		chunkBegin = chunkEnd.Add(step)
+	}
+
+	return written, skipped, nil
+}
+
+// parseBackfillTime parses an RFC 3339 time, or a local date and time like insertTime, or a local date
+func parseBackfillTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		t, err = time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, fmt.Errorf("Invalid time %q, must be RFC 3339, YYYY-MM-DD HH:MM:SS or YYYY-MM-DD", value)
+}
+
+// backfillRange returns the steps to backfill from and to, aligned to multiples of step like scheduled cycles
+func backfillRange(from, to string, step time.Duration) (time.Time, time.Time, error) {
+	if step < time.Minute {
+		return time.Time{}, time.Time{}, fmt.Errorf("--step must be at least 1m")
+	}
+	if from == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("--from is required")
+	}
+	begin, err := parseBackfillTime(from)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	end := time.Now()
+	if to != "" {
+		end, err = parseBackfillTime(to)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	if aligned := begin.Truncate(step); aligned.Before(begin) {
+		begin = aligned.Add(step)
+	}
+	end = end.Truncate(step)
+	if end.Before(begin) {
+		return time.Time{}, time.Time{}, fmt.Errorf("No multiple of %s between %s and %s", step, from, to)
+	}
+
+	return begin, end, nil
+}
+
+// backfillCommand runs nurd backfill with args, returning the exit status of nurd
+func backfillCommand(args []string) int {
+	log.SetReportCaller(true)
+	log.SetLevel(log.TraceLevel)
+
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	name := flags.String("cluster", "", "name of the configured Nomad cluster to backfill")
+	from := flags.String("from", "", "time to backfill from, RFC 3339, YYYY-MM-DD HH:MM:SS or YYYY-MM-DD")
+	to := flags.String("to", "", "time to backfill to, defaults to now")
+	step := flags.Duration("step", 15*time.Minute, "interval between backfilled cycles")
+	flags.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "timeout of each request to Nomad or the metrics server")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	if *name == "" {
+		log.Error("--cluster is required")
+		return 2
+	}
+	begin, end, err := backfillRange(*from, *to, *step)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+
+	err = loadConfig("/etc/nurd/config.json")
+	if err != nil {
+		log.Error(fmt.Sprintf("Error in loading /etc/nurd/config.json: %v", err))
+		return 1
+	}
+	clusters, err := CollectScope{Cluster: *name}.clusters()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	err = connectDB()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	written, skipped, err := backfill(context.Background(), clusters[0], begin, end, *step)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error in backfilling %s after %d steps: %v", *name, written, err))
+		return 1
+	}
+	log.Info(fmt.Sprintf("Backfilled %d steps of %s, skipped %d steps that already had data", written, *name, skipped))
+
+	return 0
+}
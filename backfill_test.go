@@ -0,0 +1,341 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func backfillSpec(count, cpu, memoryMB float64) JobSpec {
+	return JobSpec{[]TaskGroup{{"TaskGroup1", count, []Task{{"web", Resource{CPU: cpu, MemoryMB: memoryMB}}}, Disk{100}, nil}}}
+}
+
+func TestSpecAt(t *testing.T) {
+	begin := time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC)
+	versions := []JobVersion{
+		{backfillSpec(1, 100, 256), 0, begin.UnixNano()},
+		{backfillSpec(2, 100, 256), 1, begin.Add(time.Hour).UnixNano()},
+	}
+
+	assert.Equal(t, JobSpec{}, specAt(nil, begin))
+	assert.Equal(t, versions[0].JobSpec, specAt(versions, begin.Add(-time.Hour)))
+	assert.Equal(t, versions[0].JobSpec, specAt(versions, begin))
+	assert.Equal(t, versions[0].JobSpec, specAt(versions, begin.Add(59*time.Minute)))
+	assert.Equal(t, versions[1].JobSpec, specAt(versions, begin.Add(2*time.Hour)))
+}
+
+func TestCountsAt(t *testing.T) {
+	begin := time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC)
+	allocs := []Alloc{
+		{ID: "alloc1", TaskGroup: "TaskGroup1", ClientStatus: "running", CreateTime: begin.UnixNano()},
+		{ID: "alloc2", TaskGroup: "TaskGroup1", ClientStatus: "complete", CreateTime: begin.UnixNano(), ModifyTime: begin.Add(time.Hour).UnixNano()},
+		{ID: "alloc3", TaskGroup: "TaskGroup2", ClientStatus: "running", CreateTime: begin.Add(time.Hour).UnixNano()},
+	}
+
+	assert.Equal(t, map[string]float64{"TaskGroup1": 3}, countsAt("service", backfillSpec(3, 100, 256), allocs, begin))
+	assert.Equal(t, map[string]float64{}, countsAt("batch", JobSpec{}, allocs, begin.Add(-time.Minute)))
+	assert.Equal(t, map[string]float64{"TaskGroup1": 2}, countsAt("batch", JobSpec{}, allocs, begin))
+	assert.Equal(t, map[string]float64{"TaskGroup1": 1, "TaskGroup2": 1}, countsAt("system", JobSpec{}, allocs, begin.Add(time.Hour)))
+}
+
+func TestSpecRequests(t *testing.T) {
+	jobSpec := JobSpec{[]TaskGroup{{
+		"TaskGroup1",
+		2,
+		[]Task{
+			{"web", Resource{CPU: 100, Cores: 1, MemoryMB: 256, MemoryMaxMB: 512, IOPS: 10, Networks: []Network{{10, []Port{{"http", 80}}, nil}}}},
+			{"sidecar", Resource{CPU: 50, MemoryMB: 64}},
+		},
+		Disk{300},
+		[]Network{{5, nil, []Port{{"admin", 0}, {"metrics", 0}}}},
+	}}}
+
+	// Without allocations no node is looked up to convert reserved cores to MHz
+	expected := Requests{300, 640, 600, 20, 30, 2, 4, 1152, 2, 0}
+	assert.Equal(t, expected, specRequests(context.Background(), nil, jobSpec, map[string]float64{"TaskGroup1": 2}, nil))
+	assert.Equal(t, Requests{}, specRequests(context.Background(), nil, jobSpec, map[string]float64{}, nil))
+}
+
+func TestParentOf(t *testing.T) {
+	assert.Equal(t, "job2", parentOf("job2/periodic-1594142400"))
+	assert.Equal(t, "job2", parentOf("job2/dispatch-1594142400-3f4a1b2c"))
+	assert.Equal(t, "", parentOf("job2"))
+}
+
+func TestBackfillRange(t *testing.T) {
+	begin, end, err := backfillRange("2020-07-07T17:20:00Z", "2020-07-07T18:10:00Z", 15*time.Minute)
+	assert.Empty(t, err)
+	assert.Equal(t, time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC), begin.UTC())
+	assert.Equal(t, time.Date(2020, 7, 7, 18, 0, 0, 0, time.UTC), end.UTC())
+
+	begin, end, err = backfillRange("2020-07-07", "2020-07-07 01:00:00", time.Hour)
+	assert.Empty(t, err)
+	assert.Equal(t, "2020-07-07 00:00:00", begin.Format("2006-01-02 15:04:05"))
+	assert.Equal(t, "2020-07-07 01:00:00", end.Format("2006-01-02 15:04:05"))
+
+	_, _, err = backfillRange("", "", 15*time.Minute)
+	assert.EqualError(t, err, "--from is required")
+	_, _, err = backfillRange("2020-07-07", "", 30*time.Second)
+	assert.EqualError(t, err, "--step must be at least 1m")
+	_, _, err = backfillRange("July 7th", "", 15*time.Minute)
+	assert.EqualError(t, err, `Invalid time "July 7th", must be RFC 3339, YYYY-MM-DD HH:MM:SS or YYYY-MM-DD`)
+	_, _, err = backfillRange("2020-07-07T17:20:00Z", "2020-07-07T17:25:00Z", 15*time.Minute)
+	assert.NotNil(t, err)
+}
+
+func TestBackfillAt(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/backfill_node1",
+		httpmock.NewStringResponder(200, `{"ID": "backfill_node1", "Attributes": {"cpu.frequency": "2500"}}`),
+	)
+
+	at := time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC)
+	cluster := &NomadCluster{Name: "cluster1", Address: "clusterAddress", Namespace: "default"}
+	coresSpec := JobSpec{[]TaskGroup{{"TaskGroup1", 2, []Task{{"web", Resource{CPU: 100, Cores: 1, MemoryMB: 256}}}, Disk{100}, nil}}}
+	jobs := []backfillJob{
+		{JobDesc{ID: "job1", Name: "job1", Datacenters: []string{"dc1", "dc2"}, Type: "service"}, cluster, "default", []JobVersion{{JobSpec: coresSpec}},
+			[]Alloc{
+				{ID: "alloc3", NodeID: "backfill_node1", TaskGroup: "TaskGroup1", ClientStatus: "running", CreateTime: at.Add(-time.Hour).UnixNano()},
+				{ID: "alloc4", NodeID: "backfill_node1", TaskGroup: "TaskGroup1", ClientStatus: "complete", CreateTime: at.Add(-time.Hour).UnixNano(), ModifyTime: at.Add(time.Hour).UnixNano()},
+			}},
+		{JobDesc{ID: "job2/periodic-1", ParentID: "job2", Name: "job2/periodic-1", Type: "batch"}, cluster, "default", []JobVersion{{JobSpec: backfillSpec(1, 50, 64)}},
+			[]Alloc{{ID: "alloc1", TaskGroup: "TaskGroup1", ClientStatus: "running", CreateTime: at.Add(-time.Minute).UnixNano()}}},
+		{JobDesc{ID: "job2/periodic-2", ParentID: "job2", Name: "job2/periodic-2", Type: "batch"}, cluster, "default", []JobVersion{{JobSpec: backfillSpec(1, 50, 64)}},
+			[]Alloc{{ID: "alloc2", TaskGroup: "TaskGroup1", ClientStatus: "running", CreateTime: at.Add(-time.Minute).UnixNano()}}},
+		{JobDesc{ID: "job3", Name: "job3", Type: "service"}, cluster, "default", []JobVersion{{JobSpec: backfillSpec(1, 100, 256)}}, nil},
+		// The allocations of job4 were garbage collected since
+		{JobDesc{ID: "job4", Name: "job4", Type: "batch"}, cluster, "default", []JobVersion{{JobSpec: backfillSpec(1, 50, 64)}}, nil},
+	}
+	usage := rangeUsage{
+		RSS: map[MetricType]map[int64]float64{
+			{Job: "job1", Namespace: "default"}:            {at.Unix(): 100 * 1.049e6},
+			{Job: "job2/periodic-1"}:                       {at.Unix(): 10 * 1.049e6},
+			{Job: "job2/periodic-2"}:                       {at.Unix(): 20 * 1.049e6},
+			{Job: "job4", Namespace: "default"}:            {at.Unix(): 5 * 1.049e6},
+			{Job: "job5/periodic-1", Namespace: "default"}: {at.Unix(): 10 * 1.049e6},
+			{Job: "job5/periodic-2", Namespace: "default"}: {at.Unix(): 20 * 1.049e6},
+		},
+		Cache: map[MetricType]map[int64]float64{},
+		Ticks: map[MetricType]map[int64]float64{
+			{Job: "job1", Namespace: "default"}: {at.Unix(): 150},
+			{Job: "job3", Namespace: "default"}: {at.Add(time.Minute).Unix(): 150},
+			{Job: "gone", Namespace: "default"}: {at.Unix(): 40},
+		},
+		TicksStats: map[MetricType]map[int64]UsageStats{
+			{Job: "job1", Namespace: "default"}: {at.Unix(): {100, 200, 90, 180, 195}},
+		},
+		RSSStats: map[MetricType]map[int64]UsageStats{},
+	}
+
+	actual := backfillAt(context.Background(), cluster, jobs, usage, at, 15*time.Minute)
+	assert.Equal(t, 5, len(actual))
+	for i := range actual {
+		assert.NotEmpty(t, actual[i].CurrentTime)
+		actual[i].CurrentTime = ""
+	}
+
+	expected := []JobData{
+		{
+			JobID:          "job1",
+			Name:           "job1",
+			UTicks:         150,
+			RCPU:           200,
+			URSS:           100,
+			RMemoryMB:      512,
+			RdiskMB:        200,
+			Namespace:      "default",
+			DataCenters:    "dc1,dc2",
+			Cluster:        "cluster1",
+			Type:           "service",
+			RMemoryMaxMB:   512,
+			RCores:         2,
+			RCoresMHz:      5000,
+			WasteCPU:       5050,
+			WasteMemoryMB:  412,
+			UTicksAvg:      100,
+			UTicksMax:      200,
+			UTicksP50:      90,
+			UTicksP95:      180,
+			UTicksP99:      195,
+			RSSSource:      fromMetrics,
+			CacheSource:    fromMissing,
+			TicksSource:    fromMetrics,
+			RequestsSource: fromNomad,
+		},
+		{
+			JobID:            "job2",
+			Name:             "job2",
+			RCPU:             100,
+			URSS:             30,
+			RMemoryMB:        128,
+			RdiskMB:          200,
+			Namespace:        "default",
+			Cluster:          "cluster1",
+			Type:             "batch",
+			RCPUSeconds:      6000,
+			RMemoryMBSeconds: 7680,
+			RMemoryMaxMB:     128,
+			WasteCPU:         100,
+			WasteMemoryMB:    98,
+			RSSSource:        fromMetrics,
+			CacheSource:      fromMissing,
+			TicksSource:      fromMissing,
+			SecondsSource:    fromMissing,
+			RequestsSource:   fromNomad,
+		},
+		{
+			JobID:          "job4",
+			Name:           "job4",
+			URSS:           5,
+			Namespace:      "default",
+			Cluster:        "cluster1",
+			Type:           "batch",
+			RSSSource:      fromMetrics,
+			CacheSource:    fromMissing,
+			TicksSource:    fromMissing,
+			SecondsSource:  fromMissing,
+			RequestsSource: fromMissing,
+		},
+		// Jobs no longer registered are backfilled from their series alone
+		{
+			JobID:          "gone",
+			Name:           "gone",
+			UTicks:         40,
+			Namespace:      "default",
+			Cluster:        "cluster1",
+			RSSSource:      fromMissing,
+			CacheSource:    fromMissing,
+			TicksSource:    fromMetrics,
+			RequestsSource: fromMissing,
+		},
+		{
+			JobID:          "job5",
+			Name:           "job5",
+			URSS:           30,
+			Namespace:      "default",
+			Cluster:        "cluster1",
+			RSSSource:      fromMetrics,
+			CacheSource:    fromMissing,
+			TicksSource:    fromMissing,
+			RequestsSource: fromMissing,
+		},
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestBackfill(t *testing.T) {
+	begin := time.Date(2020, 7, 7, 17, 30, 0, 0, time.Local)
+	end := begin.Add(30 * time.Minute)
+
+	nomad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+		switch r.URL.Path {
+		case "/v1/namespaces":
+			body = []Namespace{{"default"}}
+		case "/v1/jobs":
+			body = []JobDesc{
+				{ID: "job1", Name: "job1", Type: "service"},
+				{ID: "job2", Name: "job2", Type: "batch", Periodic: true},
+				{ID: "job2/periodic-1", ParentID: "job2", Name: "job2/periodic-1", Type: "batch"},
+			}
+		case "/v1/job/job1/versions":
+			body = JobVersions{[]JobVersion{
+				{backfillSpec(2, 100, 256), 1, begin.Add(20 * time.Minute).UnixNano()},
+				{backfillSpec(1, 100, 256), 0, begin.Add(-time.Hour).UnixNano()},
+			}}
+		case "/v1/job/job1/allocations":
+			body = []Alloc{}
+		case "/v1/job/job2/periodic-1":
+			body = backfillSpec(1, 50, 64)
+		case "/v1/job/job2/periodic-1/allocations":
+			body = []Alloc{{ID: "alloc1", TaskGroup: "TaskGroup1", ClientStatus: "complete", CreateTime: begin.Add(-time.Minute).UnixNano(), ModifyTime: begin.Add(20 * time.Minute).UnixNano()}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer nomad.Close()
+
+	var ranges []string
+	metrics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		ranges = append(ranges, query.Get("start")+"-"+query.Get("end")+"/"+query.Get("step"))
+		var values [][]interface{}
+		for t := begin; !t.After(end); t = t.Add(15 * time.Minute) {
+			values = append(values, []interface{}{t.Unix(), "1049000"})
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"job1","namespace":"default"},"values":%s}]}}`, toJSON(values))
+	}))
+	defer metrics.Close()
+
+	cluster := &NomadCluster{Name: "cluster1", Address: strings.TrimPrefix(nomad.URL, "http://"), Scheme: "http", Client: nomadClient, Metrics: newVictoriaMetrics(strings.TrimPrefix(metrics.URL, "http://"))}
+
+	_, _, err := backfill(context.Background(), &NomadCluster{Name: "cluster2", Metrics: NomadOnly{}}, begin, end, 15*time.Minute)
+	assert.EqualError(t, err, "Cluster cluster2 reads used resources from Nomad alone, which keeps no history to backfill from")
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := mock.ExpectPrepare("INSERT INTO resources")
+	stmt, err := mockDB.Prepare("INSERT INTO resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, insert = mockDB, stmt
+	defer func() {
+		mockDB.Close()
+		db, insert = nil, nil
+	}()
+
+	mock.ExpectQuery("SELECT DISTINCT insertTime FROM resources").
+		WithArgs("cluster1", "2020-07-07 17:30:00", "2020-07-07 18:00:00").
+		WillReturnRows(sqlmock.NewRows([]string{"insertTime"}).AddRow(time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC)))
+	// job1 at 17:30 and 18:00, the child of job2 has no series
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(2, 1))
+
+	written, skipped, err := backfill(context.Background(), cluster, begin, end, 15*time.Minute)
+	assert.Empty(t, err)
+	assert.Equal(t, 2, written)
+	assert.Equal(t, 1, skipped)
+	assert.Empty(t, mock.ExpectationsWereMet())
+
+	// 3 used metrics and 5 statistics of 2 metrics, each over the steps left
+	assert.Equal(t, 13, len(ranges))
+	assert.Equal(t, fmt.Sprintf("%d-%d/900s", begin.Unix(), end.Unix()), ranges[0])
+}
+
+func toJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var (
+	// breakerThreshold is the number of consecutive failures that opens a breaker, breakers never open when 0
+	breakerThreshold int
+	// breakerCooldown is how long an open breaker rejects requests before letting a single probe through
+	breakerCooldown = 30 * time.Second
+
+	breakers     = make(map[string]*CircuitBreaker)
+	breakersLock sync.Mutex
+)
+
+// CircuitBreaker stops requests to an upstream after consecutive failures until its cooldown passes
+type CircuitBreaker struct {
+	lock     sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// BreakerStatus is the state of an upstream's circuit breaker as reported by the API
+type BreakerStatus struct {
+	Upstream            string
+	State               string
+	ConsecutiveFailures int
+	OpenedAt            string
+}
+
+// getBreaker returns the circuit breaker of upstream, creating a closed one on first use
+func getBreaker(upstream string) *CircuitBreaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	breaker, ok := breakers[upstream]
+	if !ok {
+		breaker = &CircuitBreaker{state: breakerClosed}
+		breakers[upstream] = breaker
+	}
+
+	return breaker
+}
+
+// getBreakerStatuses lists the state of every upstream's circuit breaker sorted by upstream
+func getBreakerStatuses() []BreakerStatus {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	statuses := []BreakerStatus{}
+	for upstream, breaker := range breakers {
+		statuses = append(statuses, breaker.status(upstream))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Upstream < statuses[j].Upstream })
+
+	return statuses
+}
+
+// allow reports whether a request may be sent to the upstream.
+// Once the cooldown of an open breaker passes, a single probe is let through.
+func (b *CircuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < breakerCooldown {
+			return fmt.Errorf("Circuit breaker open since %s", b.openedAt.Format("2006-01-02 15:04:05"))
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+	case breakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("Circuit breaker half-open, waiting for probe")
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+func (b *CircuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (breakerThreshold > 0 && b.failures >= breakerThreshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon lets another probe through a half-open breaker without recording a result
+func (b *CircuitBreaker) abandon() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+}
+
+// isOpen reports whether requests to the upstream are currently rejected
+func (b *CircuitBreaker) isOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state == breakerOpen && time.Since(b.openedAt) < breakerCooldown
+}
+
+func (b *CircuitBreaker) status(upstream string) BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status := BreakerStatus{upstream, b.state, b.failures, ""}
+	if !b.openedAt.IsZero() {
+		status.OpenedAt = b.openedAt.Format("2006-01-02 15:04:05")
+	}
+
+	return status
+}
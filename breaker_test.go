@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	threshold, cooldown := breakerThreshold, breakerCooldown
+	breakerThreshold, breakerCooldown = 2, time.Hour
+	defer func() { breakerThreshold, breakerCooldown = threshold, cooldown }()
+
+	breaker := &CircuitBreaker{state: breakerClosed}
+	assert.Nil(t, breaker.allow())
+	breaker.failure()
+	assert.Nil(t, breaker.allow())
+	assert.False(t, breaker.isOpen())
+	breaker.failure()
+	assert.True(t, breaker.isOpen())
+	assert.Error(t, breaker.allow())
+
+	// A single probe is let through once the cooldown passes
+	breakerCooldown = 0
+	assert.Nil(t, breaker.allow())
+	assert.Equal(t, breakerHalfOpen, breaker.status("upstream").State)
+	assert.Error(t, breaker.allow())
+	breaker.failure()
+	assert.Equal(t, breakerOpen, breaker.status("upstream").State)
+
+	assert.Nil(t, breaker.allow())
+	breaker.success()
+	status := breaker.status("upstream")
+	assert.Equal(t, "upstream", status.Upstream)
+	assert.Equal(t, breakerClosed, status.State)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+	assert.NotEmpty(t, status.OpenedAt)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	breaker := &CircuitBreaker{state: breakerClosed}
+	for i := 0; i < 10; i++ {
+		breaker.failure()
+	}
+	assert.Nil(t, breaker.allow())
+	assert.Equal(t, 10, breaker.status("upstream").ConsecutiveFailures)
+}
+
+func TestGetBreakerStatuses(t *testing.T) {
+	saved := breakers
+	breakers = make(map[string]*CircuitBreaker)
+	defer func() { breakers = saved }()
+
+	assert.Equal(t, []BreakerStatus{}, getBreakerStatuses())
+
+	getBreaker("nomad/cluster1").failure()
+	getBreaker("metrics/metricsAddress")
+	assert.Equal(t, []BreakerStatus{
+		{"metrics/metricsAddress", breakerClosed, 0, ""},
+		{"nomad/cluster1", breakerClosed, 1, ""},
+	}, getBreakerStatuses())
+	assert.Same(t, getBreaker("nomad/cluster1"), getBreaker("nomad/cluster1"))
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var (
+	// requestTimeout bounds every single request to Nomad or the metrics server
+	requestTimeout = 30 * time.Second
+
+	// nomadClient and metricsClient are shared by every collection so connections are reused across jobs and cycles.
+	// Both use http.DefaultTransport, which tuneTransport configures once at startup.
+	nomadClient   = &http.Client{}
+	metricsClient = &http.Client{}
+
+	// retryAttempts is the number of attempts of each GET request, retries are disabled when 1 or less
+	retryAttempts int
+	// retryBaseDelay is the delay before the first retry, doubling with every further retry up to retryMaxDelay
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// tuneTransport sizes the connection pool for many concurrent requests against few hosts
+// and bounds the time spent establishing connections and waiting for response headers
+func tuneTransport(transport *http.Transport) {
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 32
+	transport.IdleConnTimeout = 90 * time.Second
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.ResponseHeaderTimeout = requestTimeout
+}
+
+// cancelOnClose releases a request's context once its response body has been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// doRequest sends request to upstream through its circuit breaker.
+// GET requests failing with a transport error, 429 or 5xx are retried with jittered exponential backoff.
+// Each attempt has a deadline of requestTimeout, or earlier if ctx ends first.
+// The deadline covers reading the response body, and is released when the body is closed.
+func doRequest(ctx context.Context, client *http.Client, upstream string, request *http.Request) (*http.Response, error) {
+	breaker := getBreaker(upstream)
+	if err := breaker.allow(); err != nil {
+		return nil, fmt.Errorf("Skipping request to %s: %v", upstream, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		response, err := doAttempt(ctx, client, request)
+		// The end of a cycle says nothing about the upstream's health
+		if ctx.Err() != nil {
+			breaker.abandon()
+			if err == nil {
+				response.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		if !isRetryable(response, err) {
+			breaker.success()
+			return response, nil
+		}
+		if request.Method != "GET" || attempt >= retryAttempts {
+			breaker.failure()
+			return response, err
+		}
+		if err == nil {
+			response.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+			breaker.abandon()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func doAttempt(ctx context.Context, client *http.Client, request *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	response.Body = cancelOnClose{response.Body, cancel}
+
+	return response, nil
+}
+
+func isRetryable(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+}
+
+// backoff returns the delay before retrying after the given attempt, jittered between half and all of
+// retryBaseDelay doubled for every previous retry, up to retryMaxDelay
+func backoff(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// metricsGet issues a GET request against the metrics server
+func metricsGet(ctx context.Context, api string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", api, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return doRequest(ctx, metricsClient, "metrics/"+request.URL.Host, request)
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Query().Get("query")))
+	}))
+	defer server.Close()
+
+	response, err := metricsGet(context.Background(), server.URL+"/api/v1/query?query=up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "up", string(body))
+}
+
+func TestMetricsGetTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	timeout := requestTimeout
+	requestTimeout = 50 * time.Millisecond
+	defer func() { requestTimeout = timeout }()
+
+	begin := time.Now()
+	_, err := metricsGet(context.Background(), server.URL+"/api/v1/query?query=up")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(begin) < 5*time.Second)
+}
+
+func TestNomadGetCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cluster := &NomadCluster{Address: server.Listener.Addr().String()}
+	_, err := cluster.get(ctx, "/v1/jobs")
+	assert.NotNil(t, err)
+}
+
+func TestMetricsGetRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	attempts, baseDelay := retryAttempts, retryBaseDelay
+	retryAttempts, retryBaseDelay = 3, time.Millisecond
+	defer func() { retryAttempts, retryBaseDelay = attempts, baseDelay }()
+
+	response, err := metricsGet(context.Background(), server.URL+"/api/v1/query?query=up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, breakerClosed, getBreaker("metrics/"+server.Listener.Addr().String()).status("").State)
+}
+
+func TestNomadGetBreaker(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	attempts, baseDelay, threshold := retryAttempts, retryBaseDelay, breakerThreshold
+	retryAttempts, retryBaseDelay, breakerThreshold = 2, time.Millisecond, 2
+	defer func() { retryAttempts, retryBaseDelay, breakerThreshold = attempts, baseDelay, threshold }()
+
+	saved := breakers
+	breakers = make(map[string]*CircuitBreaker)
+	defer func() { breakers = saved }()
+
+	cluster := &NomadCluster{Name: "breakerCluster", Address: server.Listener.Addr().String()}
+	for i := 0; i < 3; i++ {
+		_, err := cluster.get(context.Background(), "/v1/jobs")
+		assert.Error(t, err)
+	}
+	// The breaker opens after two failed requests of two attempts each and rejects the third request
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	assert.True(t, getBreaker("nomad/breakerCluster").isOpen())
+
+	// Clusters without a name are keyed by their address
+	assert.Equal(t, "nomad/clusterAddress", (&NomadCluster{Address: "clusterAddress"}).upstream())
+}
+
+func TestBackoff(t *testing.T) {
+	baseDelay, maxDelay := retryBaseDelay, retryMaxDelay
+	retryBaseDelay, retryMaxDelay = 100*time.Millisecond, 300*time.Millisecond
+	defer func() { retryBaseDelay, retryMaxDelay = baseDelay, maxDelay }()
+
+	for i := 0; i < 20; i++ {
+		delay := backoff(1)
+		assert.True(t, delay >= 50*time.Millisecond && delay <= 100*time.Millisecond)
+		delay = backoff(2)
+		assert.True(t, delay >= 100*time.Millisecond && delay <= 200*time.Millisecond)
+		delay = backoff(5)
+		assert.True(t, delay >= 150*time.Millisecond && delay <= 300*time.Millisecond)
+	}
+}
+
+func TestTuneTransport(t *testing.T) {
+	transport := &http.Transport{}
+	tuneTransport(transport)
+	assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, requestTimeout, transport.ResponseHeaderTimeout)
+}
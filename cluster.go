@@ -18,10 +18,15 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -40,6 +45,98 @@ type JobData struct {
 	Namespace   string
 	DataCenters string
 	CurrentTime string
+	Region      string
+	Cluster     string
+	Type        string
+
+	// Resource-seconds within the collection window, only recorded for batch-style jobs
+	RCPUSeconds      float64
+	RMemoryMBSeconds float64
+	UTicksSeconds    float64
+	URSSSeconds      float64
+
+	// Requested network bandwidth and ports across task and group networks
+	RMBits         float64
+	RReservedPorts float64
+	RDynamicPorts  float64
+
+	// Hard memory limit including memory_max oversubscription, and reserved cores with their MHz
+	// on the nodes the allocations were placed on
+	RMemoryMaxMB float64
+	RCores       float64
+	RCoresMHz    float64
+
+	// Requested resources left unused, counting reserved cores as requested CPU and
+	// treating usage above the soft memory limit as oversubscription
+	WasteCPU      float64
+	WasteMemoryMB float64
+
+	// Used resources over the collection window rather than sampled at collection time
+	UTicksAvg float64
+	UTicksMax float64
+	UTicksP50 float64
+	UTicksP95 float64
+	UTicksP99 float64
+	URSSAvg   float64
+	URSSMax   float64
+	URSSP50   float64
+	URSSP95   float64
+	URSSP99   float64
+
+	// Where each used metric was read from and how many running allocations were measured, see UsageProvenance
+	RSSSource      string
+	CacheSource    string
+	TicksSource    string
+	MeasuredAllocs float64
+	TotalAllocs    float64
+	// Where UTicksSeconds and URSSSeconds were read from, empty for jobs that are not batch-style
+	SecondsSource string
+	// Where the requested resources were read from, nomad or missing when the spec or the allocations counted
+	// could not be read
+	RequestsSource string
+
+	Tasks   []TaskData
+	Allocs  []AllocData
+	Devices []DeviceData
+}
+
+// TaskData holds the requested and used resources of a single task across all allocations of a job
+type TaskData struct {
+	TaskGroup string
+	Task      string
+	Count     float64
+	RCPU      float64
+	RMemoryMB float64
+	UTicks    float64
+	URSS      float64
+	UCache    float64
+}
+
+// AllocData holds the placement and the requested and used resources of a single allocation
+type AllocData struct {
+	AllocID      string
+	NodeID       string
+	NodeName     string
+	TaskGroup    string
+	ClientStatus string
+	RCPU         float64
+	RMemoryMB    float64
+	UTicks       float64
+	URSS         float64
+	UCache       float64
+}
+
+// DeviceData holds the number of devices of a type requested by all allocations of a job.
+// Requests of the same device with different constraints are recorded separately.
+type DeviceData struct {
+	Name        string
+	Constraints string
+	Count       float64
+}
+
+type taskKey struct {
+	TaskGroup string
+	Task      string
 }
 
 type RawAlloc struct {
@@ -53,16 +150,26 @@ type DataMap struct {
 }
 
 type MetVal struct {
-	Metric MetricType
+	Metric map[string]string
 	Value  []interface{}
 }
 
+// MetricType holds the labels a metrics query groups by, labels not grouped by are left empty
 type MetricType struct {
-	Alloc_id string
+	Job        string
+	Namespace  string
+	Alloc_id   string
+	Task_group string
+	Task       string
 }
 
 type NomadAlloc struct {
 	ResourceUsage MemCPU
+	Tasks         map[string]NomadTask
+}
+
+type NomadTask struct {
+	ResourceUsage MemCPU
 }
 
 type MemCPU struct {
@@ -93,9 +200,11 @@ type TaskGroup struct {
 	Count         float64
 	Tasks         []Task
 	EphemeralDisk Disk
+	Networks      []Network
 }
 
 type Task struct {
+	Name      string
 	Resources Resource
 }
 
@@ -104,18 +213,49 @@ type Disk struct {
 }
 
 type Resource struct {
-	CPU      float64
-	MemoryMB float64
-	DiskMB   float64
-	IOPS     float64
+	CPU         float64
+	Cores       float64
+	MemoryMB    float64
+	MemoryMaxMB float64
+	DiskMB      float64
+	IOPS        float64
+	Networks    []Network
+	Devices     []Device
 }
 
-type JobDesc struct {
-	ID          string
+type Device struct {
 	Name        string
-	Datacenters []string
-	Type        string
-	JobSummary  JobSum
+	Count       float64
+	Constraints []Constraint
+}
+
+type Constraint struct {
+	LTarget string
+	RTarget string
+	Operand string
+}
+
+type Network struct {
+	MBits         float64
+	ReservedPorts []Port
+	DynamicPorts  []Port
+}
+
+type Port struct {
+	Label string
+	Value float64
+}
+
+type JobDesc struct {
+	ID               string
+	ParentID         string
+	Name             string
+	Datacenters      []string
+	Type             string
+	Periodic         bool
+	ParameterizedJob bool
+	JobSummary       JobSum
+	JobModifyIndex   uint64
 }
 
 type JobSum struct {
@@ -123,218 +263,455 @@ type JobSum struct {
 }
 
 type Alloc struct {
-	ID        string
-	TaskGroup string
+	ID           string
+	NodeID       string
+	NodeName     string
+	TaskGroup    string
+	ClientStatus string
+	CreateTime   int64
+	ModifyTime   int64
+	TaskStates   map[string]TaskState
 }
 
-func getVMAllocs(metricsAddress, query string) map[string]struct{} {
-	m := make(map[string]struct{})
+type TaskState struct {
+	State      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
 
-	log.SetReportCaller(true)
+type Namespace struct {
+	Name string
+}
+
+// NomadCluster is a configured Nomad cluster along with the client used to reach it.
+// A non-empty Namespace or Region is sent with every request, see withNamespace and withRegion.
+type NomadCluster struct {
+	Name              string
+	Address           string
+	Scheme            string
+	Token             string
+	Client            *http.Client
+	Namespace         string
+	Region            string
+	IncludeNamespaces []string
+	ExcludeNamespaces []string
+	DiscoverRegions   bool
+	Workers           int
+	StatsWorkers      int
+	EventStream       bool
+	Metrics           MetricsSource
+}
+
+// metrics returns the source of the cluster's used resources, by default the configured VictoriaMetrics server
+// or Nomad alone when there is none
+func (n *NomadCluster) metrics() MetricsSource {
+	if n.Metrics == nil {
+		if metricsAddress == "" {
+			return NomadOnly{}
+		}
+		return newVictoriaMetrics(metricsAddress)
+	}
+	return n.Metrics
+}
+
+// nomadOnly tells whether the cluster's used resources are read from Nomad alone, which leaves nothing to fall back to
+func (n *NomadCluster) nomadOnly() bool {
+	_, ok := n.metrics().(NomadOnly)
+	return ok
+}
+
+// withNamespace returns a copy of the cluster whose requests are scoped to namespace
+func (n *NomadCluster) withNamespace(namespace string) *NomadCluster {
+	scoped := *n
+	scoped.Namespace = namespace
+	return &scoped
+}
 
-	api := "http://" + metricsAddress + "/api/v1/query?query=" + query
-	response, err := http.Get(api)
+// upstream names the cluster's circuit breaker, shared by all of its regions and namespaces
+func (n *NomadCluster) upstream() string {
+	if n.Name != "" {
+		return "nomad/" + n.Name
+	}
+	return "nomad/" + n.Address
+}
+
+// withRegion returns a copy of the cluster whose requests are forwarded to region
+func (n *NomadCluster) withRegion(region string) *NomadCluster {
+	scoped := *n
+	scoped.Region = region
+	return &scoped
+}
+
+// get issues a GET request against the cluster's HTTP API, attaching the ACL token if one is configured.
+// The request is abandoned when ctx ends or after requestTimeout.
+func (n *NomadCluster) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := n.newRequest(path)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		return nil
+		return nil, err
 	}
-	defer response.Body.Close()
 
-	var allocs RawAlloc
-	err = json.NewDecoder(response.Body).Decode(&allocs)
+	response, err := doRequest(ctx, n.client(), n.upstream(), request)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return nil
+		reportUpstreamError(ctx, err)
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("Unexpected status %d from %s%s", response.StatusCode, n.Address, path)
+		reportUpstreamError(ctx, err)
+		return nil, err
 	}
 
-	var empty struct{}
-	for _, val := range allocs.Data.Result {
-		m[val.Metric.Alloc_id] = empty
+	return response, nil
+}
+
+// stream opens a long-lived GET request against the cluster's HTTP API, which is only abandoned when ctx ends
+func (n *NomadCluster) stream(ctx context.Context, path string) (*http.Response, error) {
+	request, err := n.newRequest(path)
+	if err != nil {
+		return nil, err
 	}
 
-	return m
+	response, err := n.client().Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("Unexpected status %d from %s%s", response.StatusCode, n.Address, path)
+	}
+
+	return response, nil
 }
 
-func getNomadAllocs(clusterAddress, jobID string) map[string]struct{} {
-	m := make(map[string]struct{})
+func (n *NomadCluster) client() *http.Client {
+	if n.Client == nil {
+		return nomadClient
+	}
+	return n.Client
+}
 
-	log.SetReportCaller(true)
+// newRequest builds a GET request of path scoped to the cluster's namespace and region, carrying its ACL token
+func (n *NomadCluster) newRequest(path string) (*http.Request, error) {
+	scheme := n.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
 
-	api := "http://" + clusterAddress + "/v1/job/" + jobID + "/allocations"
-	response, err := http.Get(api)
+	api, err := url.Parse(scheme + "://" + n.Address + path)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		return nil
+		return nil, err
+	}
+	if n.Namespace != "" || n.Region != "" {
+		query := api.Query()
+		if n.Namespace != "" {
+			query.Set("namespace", n.Namespace)
+		}
+		if n.Region != "" {
+			query.Set("region", n.Region)
+		}
+		api.RawQuery = query.Encode()
 	}
-	defer response.Body.Close()
 
-	var allocs []Alloc
-	err = json.NewDecoder(response.Body).Decode(&allocs)
+	request, err := http.NewRequest("GET", api.String(), nil)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return nil
+		return nil, err
 	}
-
-	var empty struct{}
-	for _, alloc := range allocs {
-		m[alloc.ID] = empty
+	if n.Token != "" {
+		request.Header.Set("X-Nomad-Token", n.Token)
 	}
 
-	return m
+	return request, nil
 }
 
-func getRSS(clusterAddress, metricsAddress, jobID, jobName string, remainders map[string][]string) float64 {
-	var rss float64
+// getNamespaces lists the cluster's namespaces after applying the configured include/exclude lists.
+// Clusters that cannot list namespaces fall back to the include list, or to the default namespace.
+func getNamespaces(ctx context.Context, cluster *NomadCluster) []string {
+	var namespaces []string
 
 	log.SetReportCaller(true)
 
-	api := "http://" + metricsAddress + "/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22" + jobName + "%22%7D)%20by%20(job)"
-	response, err := http.Get(api)
+	response, err := cluster.get(ctx, "/v1/namespaces")
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		nomadAllocs := getNomadAllocs(clusterAddress, jobID)
-		for allocID := range nomadAllocs {
-			remainders[allocID] = append(remainders[allocID], "rss")
+		log.Warning(fmt.Sprintf("Error in listing namespaces, falling back to configured namespaces: %v", err))
+	} else {
+		defer response.Body.Close()
+
+		var list []Namespace
+		err = json.NewDecoder(response.Body).Decode(&list)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
+		}
+		for _, namespace := range list {
+			namespaces = append(namespaces, namespace.Name)
 		}
-		return rss
 	}
-	defer response.Body.Close()
 
-	var VMStats RawAlloc
-	err = json.NewDecoder(response.Body).Decode(&VMStats)
-	if err != nil {
-		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return rss
+	if len(namespaces) == 0 {
+		if len(cluster.IncludeNamespaces) != 0 {
+			namespaces = cluster.IncludeNamespaces
+		} else {
+			namespaces = []string{"default"}
+		}
 	}
 
-	if len(VMStats.Data.Result) != 0 {
-		num, err := strconv.ParseFloat(VMStats.Data.Result[0].Value[1].(string), 64)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error in parsing float: %v", err))
-			return rss
-		}
-		rss += num / 1.049e6
+	include := make(map[string]struct{})
+	for _, namespace := range cluster.IncludeNamespaces {
+		include[namespace] = struct{}{}
+	}
+	exclude := make(map[string]struct{})
+	for _, namespace := range cluster.ExcludeNamespaces {
+		exclude[namespace] = struct{}{}
 	}
 
-	nomadAllocs := getNomadAllocs(clusterAddress, jobID)
-	VMAllocs := getVMAllocs(metricsAddress, "nomad_client_allocs_memory_rss_value")
-	for allocID := range nomadAllocs {
-		if _, ok := VMAllocs[allocID]; !ok {
-			remainders[allocID] = append(remainders[allocID], "rss")
+	filtered := []string{}
+	for _, namespace := range namespaces {
+		if _, ok := include[namespace]; len(include) != 0 && !ok {
+			continue
+		}
+		if _, ok := exclude[namespace]; ok {
+			continue
 		}
+		filtered = append(filtered, namespace)
 	}
 
-	return rss
+	return filtered
 }
 
-func getCache(clusterAddress, metricsAddress, jobID, jobName string, remainders map[string][]string) float64 {
-	var cache float64
+// getRegions lists the federated regions reachable through the cluster when region discovery is enabled,
+// otherwise the region of the configured servers. An empty region means requests are served by the region of the
+// configured servers, which could not be told.
+func getRegions(ctx context.Context, cluster *NomadCluster) []string {
+	if !cluster.DiscoverRegions {
+		return []string{getAgentRegion(ctx, cluster)}
+	}
 
 	log.SetReportCaller(true)
 
-	api := "http://" + metricsAddress + "/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22" + jobName + "%22%7D)%20by%20(job)"
-	response, err := http.Get(api)
+	response, err := cluster.get(ctx, "/v1/regions")
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		nomadAllocs := getNomadAllocs(clusterAddress, jobID)
-		for allocID := range nomadAllocs {
-			remainders[allocID] = append(remainders[allocID], "cache")
-		}
-		return cache
+		log.Error(fmt.Sprintf("Error in listing regions: %v", err))
+		return []string{""}
 	}
 	defer response.Body.Close()
 
-	var VMStats RawAlloc
-	err = json.NewDecoder(response.Body).Decode(&VMStats)
-	if err != nil {
+	var regions []string
+	err = json.NewDecoder(response.Body).Decode(&regions)
+	if err != nil || len(regions) == 0 {
 		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return cache
+		return []string{""}
 	}
 
-	if len(VMStats.Data.Result) != 0 {
-		num, err := strconv.ParseFloat(VMStats.Data.Result[0].Value[1].(string), 64)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error in parsing float: %v", err))
-			return cache
-		}
-		cache += num / 1.049e6
+	return regions
+}
+
+// agentRegions caches the region of the agent behind each cluster address, which only changes with its config
+var agentRegions sync.Map
+
+// getAgentRegion returns the region of the Nomad agent the cluster's requests are sent to, empty when unknown
+func getAgentRegion(ctx context.Context, cluster *NomadCluster) string {
+	if cluster.Region != "" {
+		return cluster.Region
+	}
+	key := cluster.Scheme + "://" + cluster.Address
+	if region, ok := agentRegions.Load(key); ok {
+		return region.(string)
 	}
 
-	nomadAllocs := getNomadAllocs(clusterAddress, jobID)
-	VMAllocs := getVMAllocs(metricsAddress, "nomad_client_allocs_memory_cache_value")
-	for allocID := range nomadAllocs {
-		if _, ok := VMAllocs[allocID]; !ok {
-			remainders[allocID] = append(remainders[allocID], "cache")
+	log.SetReportCaller(true)
+
+	response, err := cluster.get(ctx, "/v1/agent/self")
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in reading the region of %s: %v", cluster.Address, err))
+		return ""
+	}
+	defer response.Body.Close()
+
+	var agent struct {
+		Config struct {
+			Region string
 		}
 	}
+	err = json.NewDecoder(response.Body).Decode(&agent)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Error in decoding JSON: %v", err))
+		return ""
+	}
+	if agent.Config.Region != "" {
+		agentRegions.Store(key, agent.Config.Region)
+	}
 
-	return cache
+	return agent.Config.Region
 }
 
-func getTicks(clusterAddress, metricsAddress, jobID, jobName string, remainders map[string][]string) float64 {
-	var ticks float64
-
-	log.SetReportCaller(true)
+// getJobs lists the jobs of the cluster's namespace, from the cluster's event stream when it is subscribed to
+func getJobs(ctx context.Context, cluster *NomadCluster) ([]JobDesc, error) {
+	if model := getJobModel(cluster); model != nil {
+		jobs := model.listJobs(cluster.Namespace)
+		specCache.observe(cluster, jobs)
+		return jobs, nil
+	} else if cluster.EventStream {
+		log.Warning(fmt.Sprintf("Event stream of %s is not synced, listing its jobs from Nomad", modelKey(cluster)))
+	}
 
-	api := "http://" + metricsAddress + "/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22" + jobName + "%22%7D)%20by%20(job)"
-	response, err := http.Get(api)
+	response, err := cluster.get(ctx, "/v1/jobs")
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		nomadAllocs := getNomadAllocs(clusterAddress, jobID)
-		for allocID := range nomadAllocs {
-			remainders[allocID] = append(remainders[allocID], "ticks")
-		}
-		return ticks
+		return nil, fmt.Errorf("Error in getting API response: %v", err)
 	}
 	defer response.Body.Close()
 
-	var VMStats RawAlloc
-	err = json.NewDecoder(response.Body).Decode(&VMStats)
+	var jobs []JobDesc
+	err = json.NewDecoder(response.Body).Decode(&jobs)
+	if err != nil {
+		return nil, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+	specCache.observe(cluster, jobs)
+
+	return jobs, nil
+}
+
+// getMetricsAllocs lists the allocations the cluster's metrics source has data of metric for
+func getMetricsAllocs(ctx context.Context, job MetricsJob, metric string) map[string]struct{} {
+	m := make(map[string]struct{})
+
+	log.SetReportCaller(true)
+
+	allocUsage, err := job.Cluster.metrics().AllocUsage(ctx, metric, job)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return ticks
+		log.Error(err)
+		return nil
 	}
 
-	if len(VMStats.Data.Result) != 0 {
-		num, err := strconv.ParseFloat(VMStats.Data.Result[0].Value[1].(string), 64)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error in parsing float: %v", err))
-			return ticks
+	var empty struct{}
+	for allocID := range allocUsage {
+		m[allocID] = empty
+	}
+
+	return m
+}
+
+// allocIDs returns the set of IDs of allocs, nil when they could not be listed
+func allocIDs(allocs []Alloc) map[string]struct{} {
+	if allocs == nil {
+		return nil
+	}
+
+	m := make(map[string]struct{})
+	var empty struct{}
+	for _, alloc := range allocs {
+		m[alloc.ID] = empty
+	}
+
+	return m
+}
+
+func getRSS(ctx context.Context, cluster *NomadCluster, jobID, jobName string, nomadAllocs map[string]struct{}, remainders map[string][]string) float64 {
+	return getUsed(ctx, cluster, rssMetric, "rss", jobID, jobName, nomadAllocs, remainders) / 1.049e6
+}
+
+func getCache(ctx context.Context, cluster *NomadCluster, jobID, jobName string, nomadAllocs map[string]struct{}, remainders map[string][]string) float64 {
+	return getUsed(ctx, cluster, cacheMetric, "cache", jobID, jobName, nomadAllocs, remainders) / 1.049e6
+}
+
+func getTicks(ctx context.Context, cluster *NomadCluster, jobID, jobName string, nomadAllocs map[string]struct{}, remainders map[string][]string) float64 {
+	return getUsed(ctx, cluster, ticksMetric, "ticks", jobID, jobName, nomadAllocs, remainders)
+}
+
+// getUsed returns metric summed over a job's allocations from the cluster's metrics source.
+// Allocations of nomadAllocs the source has no data for are added to remainders under name, to be read from Nomad,
+// as is every allocation when the metrics server cannot be queried or answers badly.
+func getUsed(ctx context.Context, cluster *NomadCluster, metric, name, jobID, jobName string, nomadAllocs map[string]struct{}, remainders map[string][]string) float64 {
+	log.SetReportCaller(true)
+
+	job := MetricsJob{cluster, jobID, jobName, cluster.Namespace}
+	used, err := cluster.metrics().JobUsage(ctx, metric, job)
+	if err != nil {
+		// Whether the metrics server is down or answered badly, none of the allocations were measured
+		log.Error(err)
+		for allocID := range nomadAllocs {
+			remainders[allocID] = append(remainders[allocID], name)
 		}
-		ticks += num
+		return 0
+	}
+	if cluster.nomadOnly() {
+		return used
 	}
 
-	nomadAllocs := getNomadAllocs(clusterAddress, jobID)
-	VMAllocs := getVMAllocs(metricsAddress, "nomad_client_allocs_cpu_total_ticks_value")
+	metricsAllocs := getMetricsAllocs(ctx, job, metric)
 	for allocID := range nomadAllocs {
-		if _, ok := VMAllocs[allocID]; !ok {
-			remainders[allocID] = append(remainders[allocID], "ticks")
+		if _, ok := metricsAllocs[allocID]; !ok {
+			remainders[allocID] = append(remainders[allocID], name)
 		}
 	}
 
-	return ticks
+	return used
 }
 
-func getRemainderNomad(clusterAddress string, remainders map[string][]string) (float64, float64, float64) {
+// getAllocStats returns the stats of an allocation, read once per cycle when ctx carries a cache
+// and shared by every fallback to Nomad within the cycle
+func getAllocStats(ctx context.Context, cluster *NomadCluster, allocID string) (NomadAlloc, error) {
+	stats, err := cached(ctx, "stats/"+cluster.upstream()+"/"+allocID, func() (interface{}, error) {
+		return readAllocStats(ctx, cluster, allocID)
+	})
+	if err != nil {
+		return NomadAlloc{}, err
+	}
+
+	return stats.(NomadAlloc), nil
+}
+
+func readAllocStats(ctx context.Context, cluster *NomadCluster, allocID string) (NomadAlloc, error) {
+	var nomadAlloc NomadAlloc
+
+	response, err := cluster.get(ctx, "/v1/client/allocation/" + allocID + "/stats")
+	if err != nil {
+		err = fmt.Errorf("Error in getting API response: %v", err)
+		reportUnreachable(ctx, cluster, allocID, err)
+		return nomadAlloc, err
+	}
+	defer response.Body.Close()
+
+	err = json.NewDecoder(response.Body).Decode(&nomadAlloc)
+	if err != nil {
+		err = fmt.Errorf("Error in decoding JSON: %v", err)
+		reportUnreachable(ctx, cluster, allocID, err)
+		return nomadAlloc, err
+	}
+
+	return nomadAlloc, nil
+}
+
+// nomadStatsDown reports whether every fallback to the allocation stats of Nomad should be skipped,
+// because the circuit breaker of the cluster's Nomad servers is open
+func nomadStatsDown(cluster *NomadCluster) bool {
+	log.SetReportCaller(true)
+
+	if getBreaker(cluster.upstream()).isOpen() {
+		log.Warning(fmt.Sprintf("Skipping allocation stats, circuit breaker of %s is open", cluster.upstream()))
+		return true
+	}
+	return false
+}
+
+// getRemainderNomad reads the metrics left in remainders from the stats of each allocation,
+// also returning the allocations whose stats were read
+func getRemainderNomad(ctx context.Context, cluster *NomadCluster, remainders map[string][]string) (float64, float64, float64, map[string]struct{}) {
 	var rss, cache, ticks float64
+	read := make(map[string]struct{})
 
 	log.SetReportCaller(true)
 
 	for allocID, slice := range remainders {
-		api := "http://" + clusterAddress + "/v1/client/allocation/" + allocID + "/stats"
-		response, err := http.Get(api)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-			continue
+		// Stop falling back to the stats of every allocation once Nomad is clearly down
+		if nomadStatsDown(cluster) {
+			break
 		}
-		defer response.Body.Close()
-
-		var nomadAlloc NomadAlloc
-		err = json.NewDecoder(response.Body).Decode(&nomadAlloc)
+		nomadAlloc, err := getAllocStats(ctx, cluster, allocID)
 		if err != nil {
-			log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
+			log.Error(err)
 			continue
 		}
+		read[allocID] = struct{}{}
 
 		for _, val := range slice {
 			if nomadAlloc.ResourceUsage != (MemCPU{}) {
@@ -353,78 +730,114 @@ func getRemainderNomad(clusterAddress string, remainders map[string][]string) (f
 		}
 	}
 
-	return rss, cache, ticks
+	return rss, cache, ticks, read
 }
 
-func aggUsed(clusterAddress, metricsAddress, jobID, jobName string) (float64, float64, float64) {
+// aggUsed returns the used RSS, ticks and cache of a job along with where each was read from,
+// given its allocations or nil when they could not be listed
+func aggUsed(ctx context.Context, cluster *NomadCluster, jobID, jobName string, allocs []Alloc) (float64, float64, float64, UsageProvenance) {
 	remainders := make(map[string][]string)
 
-	rss := getRSS(clusterAddress, metricsAddress, jobID, jobName, remainders)
-	cache := getCache(clusterAddress, metricsAddress, jobID, jobName, remainders)
-	ticks := getTicks(clusterAddress, metricsAddress, jobID, jobName, remainders)
+	nomadAllocs := allocIDs(allocs)
+	rss := getRSS(ctx, cluster, jobID, jobName, nomadAllocs, remainders)
+	cache := getCache(ctx, cluster, jobID, jobName, nomadAllocs, remainders)
+	ticks := getTicks(ctx, cluster, jobID, jobName, nomadAllocs, remainders)
 
-	rssRemainder, cacheRemainder, ticksRemainder := getRemainderNomad(clusterAddress, remainders)
+	rssRemainder, cacheRemainder, ticksRemainder, read := getRemainderNomad(ctx, cluster, remainders)
 	rss += rssRemainder
 	cache += cacheRemainder
 	ticks += ticksRemainder
 
-	return rss, ticks, cache
+	return rss, ticks, cache, getUsageProvenance(ctx, cluster, jobID, jobName, allocs, remainders, read)
 }
 
-func aggRequested(clusterAddress, jobID, jobType string) (float64, float64, float64, float64) {
-	var cpu, memoryMB, diskMB, iops, count float64
-
-	log.SetLevel(log.TraceLevel)
-	log.SetReportCaller(true)
+// getJobSpec returns the spec of a job, from specCache unless the job changed since it was read
+func getJobSpec(ctx context.Context, cluster *NomadCluster, jobID string) (JobSpec, error) {
+	key := specKey(cluster, jobID)
+	jobSpec, ok := specCache.get(key)
+	if ok {
+		return jobSpec, nil
+	}
 
-	api := "http://" + clusterAddress + "/v1/job/" + jobID
-	response, err := http.Get(api)
+	response, err := cluster.get(ctx, "/v1/job/" + jobID)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		return cpu, memoryMB, diskMB, iops
+		return jobSpec, fmt.Errorf("Error in getting API response: %v", err)
 	}
 	defer response.Body.Close()
 
-	var jobSpec JobSpec
 	err = json.NewDecoder(response.Body).Decode(&jobSpec)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return cpu, memoryMB, diskMB, iops
+		return jobSpec, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+	index, _ := strconv.ParseUint(response.Header.Get("X-Nomad-Index"), 10, 64)
+	specCache.put(key, jobSpec, index)
+
+	return jobSpec, nil
+}
+
+// getAllocs lists the allocations of a job, from the cluster's event stream when it is subscribed to.
+// Listings are read once per cycle when ctx carries a cache and shared by every reader of the job within the cycle.
+func getAllocs(ctx context.Context, cluster *NomadCluster, jobID string) ([]Alloc, error) {
+	if model := getJobModel(cluster); model != nil {
+		return model.listAllocs(cluster.Namespace, jobID), nil
+	}
+
+	key := "allocs/" + cluster.upstream() + "/" + cluster.Region + "/" + cluster.Namespace + "/" + jobID
+	allocs, err := cached(ctx, key, func() (interface{}, error) {
+		return readAllocs(ctx, cluster, jobID)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if jobSpec.TaskGroups == nil {
-		return cpu, memoryMB, diskMB, iops
+	return allocs.([]Alloc), nil
+}
+
+func readAllocs(ctx context.Context, cluster *NomadCluster, jobID string) ([]Alloc, error) {
+	response, err := cluster.get(ctx, "/v1/job/" + jobID + "/allocations")
+	if err != nil {
+		return nil, fmt.Errorf("Error in getting API response: %v", err)
 	}
+	defer response.Body.Close()
 
+	var allocs []Alloc
+	err = json.NewDecoder(response.Body).Decode(&allocs)
+	if err != nil {
+		return nil, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+
+	return allocs, nil
+}
+
+// getTaskGroupCounts returns the number of allocations requesting resources for each task group.
+// Service jobs use the group count while all other job types count their allocations.
+func getTaskGroupCounts(jobType string, jobSpec JobSpec, allocs []Alloc) map[string]float64 {
 	mapTaskGroupCount := make(map[string]float64)
-	if jobType == "system" {
-		api = "http://" + clusterAddress + "/v1/job/" + jobID + "/allocations"
-		response, err := http.Get(api)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-			return cpu, memoryMB, diskMB, iops
-		}
-		defer response.Body.Close()
 
-		var allocs []Alloc
-		err = json.NewDecoder(response.Body).Decode(&allocs)
-		if err != nil {
-			log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-			return cpu, memoryMB, diskMB, iops
+	switch jobType {
+	case "service":
+		for _, taskGroup := range jobSpec.TaskGroups {
+			mapTaskGroupCount[taskGroup.Name] = taskGroup.Count
 		}
-
+	case "system", "batch", "sysbatch":
 		for _, alloc := range allocs {
+			// Batch-style jobs only request resources while their allocations are running
+			if jobType != "system" && isTerminal(alloc.ClientStatus) {
+				continue
+			}
 			mapTaskGroupCount[alloc.TaskGroup] += 1
 		}
 	}
 
+	return mapTaskGroupCount
+}
+
+// aggRequested returns the CPU, memory, disk and IOPS requested by all allocations of a job
+func aggRequested(jobSpec JobSpec, mapTaskGroupCount map[string]float64) (float64, float64, float64, float64) {
+	var cpu, memoryMB, diskMB, iops, count float64
+
 	for _, taskGroup := range jobSpec.TaskGroups {
-		switch jobType {
-		case "service":
-			count = taskGroup.Count
-		case "system":
-			count = mapTaskGroupCount[taskGroup.Name]
-		}
+		count = mapTaskGroupCount[taskGroup.Name]
 
 		for _, task := range taskGroup.Tasks {
 			resources := task.Resources
@@ -438,64 +851,684 @@ func aggRequested(clusterAddress, jobID, jobType string) (float64, float64, floa
 	return cpu, memoryMB, diskMB, iops
 }
 
-func reachCluster(clusterAddress, metricsAddress string, c chan<- []JobData) {
-	var jobData []JobData
-	var rss, ticks, cache, CPUTotal, memoryMBTotal, diskMBTotal, IOPSTotal float64
+// aggNetworks returns the network bandwidth in MBits and the number of reserved and dynamic ports
+// requested by all allocations of a job, across both group and task level networks
+func aggNetworks(jobSpec JobSpec, mapTaskGroupCount map[string]float64) (float64, float64, float64) {
+	var mbits, reservedPorts, dynamicPorts, count float64
+
+	for _, taskGroup := range jobSpec.TaskGroups {
+		count = mapTaskGroupCount[taskGroup.Name]
+
+		networks := taskGroup.Networks
+		for _, task := range taskGroup.Tasks {
+			networks = append(networks, task.Resources.Networks...)
+		}
+		for _, network := range networks {
+			mbits += count * network.MBits
+			reservedPorts += count * float64(len(network.ReservedPorts))
+			dynamicPorts += count * float64(len(network.DynamicPorts))
+		}
+	}
+
+	return mbits, reservedPorts, dynamicPorts
+}
+
+// aggLimits returns the hard memory limit and the reserved cores requested by all allocations of a job.
+// Tasks without memory_max are limited to their memory. Cores are converted to MHz using the CPU
+// frequency of the node each allocation was placed on, so only placed allocations contribute MHz.
+func aggLimits(ctx context.Context, cluster *NomadCluster, jobSpec JobSpec, mapTaskGroupCount map[string]float64, allocs []Alloc) (float64, float64, float64) {
+	var memoryMaxMB, cores, coresMHz float64
 
 	log.SetLevel(log.TraceLevel)
 	log.SetReportCaller(true)
 
-	api := "http://" + clusterAddress + "/v1/jobs"
-	response, err := http.Get(api)
-	if err != nil {
-		log.Error(fmt.Sprintf("Error in getting API response: %v", err))
-		wg.Done()
-		return
+	mapTaskGroupCores := make(map[string]float64)
+	for _, taskGroup := range jobSpec.TaskGroups {
+		count := mapTaskGroupCount[taskGroup.Name]
+
+		for _, task := range taskGroup.Tasks {
+			resources := task.Resources
+			if resources.MemoryMaxMB > resources.MemoryMB {
+				memoryMaxMB += count * resources.MemoryMaxMB
+			} else {
+				memoryMaxMB += count * resources.MemoryMB
+			}
+			cores += count * resources.Cores
+			mapTaskGroupCores[taskGroup.Name] += resources.Cores
+		}
 	}
-	defer response.Body.Close()
 
-	var jobs []JobDesc
-	err = json.NewDecoder(response.Body).Decode(&jobs)
+	if cores == 0 {
+		return memoryMaxMB, cores, coresMHz
+	}
+
+	mapNodeCoreMHz := make(map[string]float64)
+	for _, alloc := range allocs {
+		if isTerminal(alloc.ClientStatus) || mapTaskGroupCores[alloc.TaskGroup] == 0 || alloc.NodeID == "" {
+			continue
+		}
+		coreMHz, ok := mapNodeCoreMHz[alloc.NodeID]
+		if !ok {
+			var err error
+			coreMHz, err = getNodeCoreMHz(ctx, cluster, alloc.NodeID)
+			if err != nil {
+				log.Error(err)
+			}
+			mapNodeCoreMHz[alloc.NodeID] = coreMHz
+		}
+		coresMHz += mapTaskGroupCores[alloc.TaskGroup] * coreMHz
+	}
+
+	return memoryMaxMB, cores, coresMHz
+}
+
+// getDeviceRequests sums the devices requested by the tasks of a job spec, weighted by task group counts
+func getDeviceRequests(jobSpec JobSpec, mapTaskGroupCount map[string]float64) []DeviceData {
+	var devices []DeviceData
+
+	for _, taskGroup := range jobSpec.TaskGroups {
+		count := mapTaskGroupCount[taskGroup.Name]
+		if count == 0 {
+			continue
+		}
+
+		for _, task := range taskGroup.Tasks {
+			for _, device := range task.Resources.Devices {
+				var constraints []string
+				for _, constraint := range device.Constraints {
+					constraints = append(constraints, strings.TrimSpace(constraint.LTarget+" "+constraint.Operand+" "+constraint.RTarget))
+				}
+				deviceCount := device.Count
+				// Nomad defaults device requests without a count to a single instance
+				if deviceCount == 0 {
+					deviceCount = 1
+				}
+
+				devices = mergeDevices(devices, DeviceData{
+					device.Name,
+					strings.Join(constraints, ", "),
+					count * deviceCount,
+				})
+			}
+		}
+	}
+
+	return devices
+}
+
+// mergeDevices adds device to devices, summing the count of a matching name and constraints
+func mergeDevices(devices []DeviceData, device DeviceData) []DeviceData {
+	for i := range devices {
+		if devices[i].Name == device.Name && devices[i].Constraints == device.Constraints {
+			devices[i].Count += device.Count
+			return devices
+		}
+	}
+	return append(devices, device)
+}
+
+// aggTasks breaks the requested and used resources of a job down by task group and task.
+// Usage comes from the cluster's metrics source, falling back to Nomad allocation stats when it cannot be queried.
+func aggTasks(ctx context.Context, cluster *NomadCluster, jobID, jobName string, jobSpec JobSpec, mapTaskGroupCount map[string]float64, allocs []Alloc) []TaskData {
+	var tasks []TaskData
+
+	log.SetReportCaller(true)
+
+	index := make(map[taskKey]int)
+	for _, taskGroup := range jobSpec.TaskGroups {
+		count := mapTaskGroupCount[taskGroup.Name]
+		for _, task := range taskGroup.Tasks {
+			index[taskKey{taskGroup.Name, task.Name}] = len(tasks)
+			tasks = append(tasks, TaskData{
+				TaskGroup: taskGroup.Name,
+				Task:      task.Name,
+				Count:     count,
+				RCPU:      count * task.Resources.CPU,
+				RMemoryMB: count * task.Resources.MemoryMB,
+			})
+		}
+	}
+
+	job := MetricsJob{cluster, jobID, jobName, cluster.Namespace}
+	rss, errRSS := cluster.metrics().TaskUsage(ctx, rssMetric, job)
+	cache, errCache := cluster.metrics().TaskUsage(ctx, cacheMetric, job)
+	ticks, errTicks := cluster.metrics().TaskUsage(ctx, ticksMetric, job)
+	if errRSS == nil && errCache == nil && errTicks == nil {
+		for key, i := range index {
+			tasks[i].URSS = rss[key] / 1.049e6
+			tasks[i].UCache = cache[key] / 1.049e6
+			tasks[i].UTicks = ticks[key]
+		}
+		return tasks
+	}
+	if nomadStatsDown(cluster) {
+		return tasks
+	}
+
+	for _, alloc := range allocs {
+		if isTerminal(alloc.ClientStatus) {
+			continue
+		}
+		nomadAlloc, err := getAllocStats(ctx, cluster, alloc.ID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for name, task := range nomadAlloc.Tasks {
+			i, ok := index[taskKey{alloc.TaskGroup, name}]
+			if !ok {
+				continue
+			}
+			tasks[i].URSS += task.ResourceUsage.MemoryStats.RSS / 1.049e6
+			tasks[i].UCache += task.ResourceUsage.MemoryStats.Cache / 1.049e6
+			tasks[i].UTicks += task.ResourceUsage.CpuStats.TotalTicks
+		}
+	}
+
+	return tasks
+}
+
+// aggAllocs returns the placement and the requested and used resources of each non-terminal allocation of a job.
+// Usage comes from the cluster's metrics source, falling back to Nomad allocation stats for allocations it has no data for.
+func aggAllocs(ctx context.Context, cluster *NomadCluster, jobID, jobName string, jobSpec JobSpec, allocs []Alloc) []AllocData {
+	var allocData []AllocData
+
+	log.SetReportCaller(true)
+
+	requested := make(map[string]Resource)
+	for _, taskGroup := range jobSpec.TaskGroups {
+		var resources Resource
+		for _, task := range taskGroup.Tasks {
+			resources.CPU += task.Resources.CPU
+			resources.MemoryMB += task.Resources.MemoryMB
+		}
+		requested[taskGroup.Name] = resources
+	}
+
+	job := MetricsJob{cluster, jobID, jobName, cluster.Namespace}
+	rss, errRSS := cluster.metrics().AllocUsage(ctx, rssMetric, job)
+	cache, errCache := cluster.metrics().AllocUsage(ctx, cacheMetric, job)
+	ticks, errTicks := cluster.metrics().AllocUsage(ctx, ticksMetric, job)
+	metricsOK := errRSS == nil && errCache == nil && errTicks == nil
+	fallback := !cluster.nomadOnly() && !nomadStatsDown(cluster)
+
+	for _, alloc := range allocs {
+		if isTerminal(alloc.ClientStatus) {
+			continue
+		}
+
+		data := AllocData{
+			AllocID:      alloc.ID,
+			NodeID:       alloc.NodeID,
+			NodeName:     alloc.NodeName,
+			TaskGroup:    alloc.TaskGroup,
+			ClientStatus: alloc.ClientStatus,
+			RCPU:         requested[alloc.TaskGroup].CPU,
+			RMemoryMB:    requested[alloc.TaskGroup].MemoryMB,
+		}
+
+		if _, ok := rss[alloc.ID]; metricsOK && ok {
+			data.URSS = rss[alloc.ID] / 1.049e6
+			data.UCache = cache[alloc.ID] / 1.049e6
+			data.UTicks = ticks[alloc.ID]
+		} else if alloc.ClientStatus == "running" && fallback {
+			nomadAlloc, err := getAllocStats(ctx, cluster, alloc.ID)
+			if err != nil {
+				log.Error(err)
+			} else {
+				data.URSS = nomadAlloc.ResourceUsage.MemoryStats.RSS / 1.049e6
+				data.UCache = nomadAlloc.ResourceUsage.MemoryStats.Cache / 1.049e6
+				data.UTicks = nomadAlloc.ResourceUsage.CpuStats.TotalTicks
+			}
+		}
+
+		allocData = append(allocData, data)
+	}
+
+	return allocData
+}
+
+// aggWindowUsage returns the statistics of a job's usage over the collection window divided by unit,
+// or zero when the cluster's metrics source cannot be queried
+func aggWindowUsage(ctx context.Context, cluster *NomadCluster, metric, jobID, jobName, namespace string, unit float64) UsageStats {
+	log.SetReportCaller(true)
+
+	job := MetricsJob{cluster, jobID, jobName, namespace}
+	stats, err := cluster.metrics().WindowUsage(ctx, metric, job, collectionWindow)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error in decoding JSON: %v", err))
-		return
+		log.Error(err)
+		return UsageStats{}
 	}
 
+	return UsageStats{stats.Avg / unit, stats.Max / unit, stats.P50 / unit, stats.P95 / unit, stats.P99 / unit}
+}
+
+func isTerminal(clientStatus string) bool {
+	return clientStatus == "complete" || clientStatus == "failed" || clientStatus == "lost"
+}
+
+func isBatch(jobType string) bool {
+	return jobType == "batch" || jobType == "sysbatch"
+}
+
+// isCollected tells whether the resources of a job are collected, periodic and parameterized parents
+// never run allocations themselves
+func isCollected(job JobDesc) bool {
+	if job.Type != "system" && job.Type != "service" && !isBatch(job.Type) {
+		return false
+	}
+	return job.ParentID != "" || !(job.Periodic || job.ParameterizedJob)
+}
+
+// countCollected returns the number of jobs stored for jobs, periodic and dispatched children being rolled up
+// into a single job under their parent ID
+func countCollected(jobs []JobDesc) int {
+	parents := make(map[string]struct{})
+	count := 0
+
 	for _, job := range jobs {
-		log.Trace(job.ID)
+		if !isCollected(job) {
+			continue
+		}
+		if job.ParentID != "" {
+			if _, ok := parents[job.ParentID]; ok {
+				continue
+			}
+			parents[job.ParentID] = struct{}{}
+		}
+		count++
+	}
+
+	return count
+}
+
+// overlap returns the number of seconds [begin, end) shares with [windowBegin, windowEnd)
+func overlap(begin, end, windowBegin, windowEnd time.Time) float64 {
+	if begin.Before(windowBegin) {
+		begin = windowBegin
+	}
+	if end.After(windowEnd) {
+		end = windowEnd
+	}
+	if !end.After(begin) {
+		return 0
+	}
+	return end.Sub(begin).Seconds()
+}
+
+// aggLifetime returns the requested CPU and memory resource-seconds and the used CPU and RSS resource-seconds
+// of a batch-style job's allocations within the collection window ending at windowEnd, along with where the used
+// resource-seconds were read from. Task run times come from task states, falling back to the allocation's create
+// and modify times. Usage is integrated by allocation over the window by the cluster's metrics source, which counts
+// allocations that have since stopped. Sources keeping no history leave the used resource-seconds missing.
+func aggLifetime(ctx context.Context, cluster *NomadCluster, jobID, jobName string, jobSpec JobSpec, allocs []Alloc, windowEnd time.Time, window time.Duration) (float64, float64, float64, float64, string) {
+	var ticksSeconds, rssSeconds float64
+	var measured int
+
+	log.SetReportCaller(true)
+
+	cpuSeconds, memoryMBSeconds, overlapping := lifetimeRequests(jobSpec, allocs, windowEnd, window)
+
+	job := MetricsJob{cluster, jobID, jobName, cluster.Namespace}
+	allocTicks, err := cluster.metrics().AllocSeconds(ctx, ticksMetric, job, window)
+	if err != nil {
+		log.Error(err)
+	}
+	allocRSS, err := cluster.metrics().AllocSeconds(ctx, rssMetric, job, window)
+	if err != nil {
+		log.Error(err)
+	}
+
+	for _, allocID := range overlapping {
+		ticks, ticksOK := allocTicks[allocID]
+		rss, rssOK := allocRSS[allocID]
+		if ticksOK && rssOK {
+			measured++
+		}
+		ticksSeconds += ticks
+		rssSeconds += rss / 1.049e6
+	}
+
+	return cpuSeconds, memoryMBSeconds, ticksSeconds, rssSeconds, sourceOf(fromMetrics, measured, 0, len(overlapping))
+}
+
+// lifetimeRequests returns the CPU and memory seconds requested by every task that ran within the window ending at
+// windowEnd, using task states and falling back to allocation create/modify times, along with the IDs of the
+// allocations that overlap the window
+func lifetimeRequests(jobSpec JobSpec, allocs []Alloc, windowEnd time.Time, window time.Duration) (float64, float64, []string) {
+	var cpuSeconds, memoryMBSeconds float64
+	var overlapping []string
+
+	taskGroups := make(map[string][]Task)
+	for _, taskGroup := range jobSpec.TaskGroups {
+		taskGroups[taskGroup.Name] = taskGroup.Tasks
+	}
+
+	windowBegin := windowEnd.Add(-window)
+	for _, alloc := range allocs {
+		allocBegin := time.Unix(0, alloc.CreateTime)
+		allocEnd := windowEnd
+		if isTerminal(alloc.ClientStatus) {
+			allocEnd = time.Unix(0, alloc.ModifyTime)
+		}
+		if overlap(allocBegin, allocEnd, windowBegin, windowEnd) == 0 {
+			continue
+		}
+		overlapping = append(overlapping, alloc.ID)
+
+		for _, task := range taskGroups[alloc.TaskGroup] {
+			taskBegin, taskEnd := allocBegin, allocEnd
+			if state, ok := alloc.TaskStates[task.Name]; ok {
+				if state.StartedAt.IsZero() {
+					continue
+				}
+				taskBegin = state.StartedAt
+				if !state.FinishedAt.IsZero() {
+					taskEnd = state.FinishedAt
+				}
+			}
+
+			seconds := overlap(taskBegin, taskEnd, windowBegin, windowEnd)
+			cpuSeconds += task.Resources.CPU * seconds
+			memoryMBSeconds += task.Resources.MemoryMB * seconds
+		}
+	}
+
+	return cpuSeconds, memoryMBSeconds, overlapping
+}
+
+// wasteMemory returns the soft memory limit of a job left unused by its RSS.
+// Nomad places allocations by their soft limit and lets tasks use memory above it up to memory_max when the node has
+// some free. Such oversubscribed memory, measured task by task, is never counted as negative waste nor does it offset
+// the waste of other tasks. Without a task breakdown of usage the job's RSS is compared to its soft limit as a whole.
+func wasteMemory(memoryMB, rss float64, tasks []TaskData) float64 {
+	var oversubscribed float64
+
+	for _, task := range tasks {
+		oversubscribed += math.Max(0, task.URSS-task.RMemoryMB)
+	}
+
+	return math.Max(0, memoryMB-rss+oversubscribed)
+}
+
+// mergeJobData adds the resources of other into jobData
+func mergeJobData(jobData *JobData, other JobData) {
+	jobData.UTicks += other.UTicks
+	jobData.RCPU += other.RCPU
+	jobData.URSS += other.URSS
+	jobData.UCache += other.UCache
+	jobData.RMemoryMB += other.RMemoryMB
+	jobData.RdiskMB += other.RdiskMB
+	jobData.RIOPS += other.RIOPS
+	jobData.RCPUSeconds += other.RCPUSeconds
+	jobData.RMemoryMBSeconds += other.RMemoryMBSeconds
+	jobData.UTicksSeconds += other.UTicksSeconds
+	jobData.URSSSeconds += other.URSSSeconds
+	jobData.RMBits += other.RMBits
+	jobData.RReservedPorts += other.RReservedPorts
+	jobData.RDynamicPorts += other.RDynamicPorts
+	jobData.RMemoryMaxMB += other.RMemoryMaxMB
+	jobData.RCores += other.RCores
+	jobData.RCoresMHz += other.RCoresMHz
+	jobData.WasteCPU += other.WasteCPU
+	jobData.WasteMemoryMB += other.WasteMemoryMB
+	jobData.UTicksAvg += other.UTicksAvg
+	jobData.UTicksMax += other.UTicksMax
+	jobData.UTicksP50 += other.UTicksP50
+	jobData.UTicksP95 += other.UTicksP95
+	jobData.UTicksP99 += other.UTicksP99
+	jobData.URSSAvg += other.URSSAvg
+	jobData.URSSMax += other.URSSMax
+	jobData.URSSP50 += other.URSSP50
+	jobData.URSSP95 += other.URSSP95
+	jobData.URSSP99 += other.URSSP99
+	jobData.RSSSource = mergeSource(jobData.RSSSource, other.RSSSource)
+	jobData.CacheSource = mergeSource(jobData.CacheSource, other.CacheSource)
+	jobData.TicksSource = mergeSource(jobData.TicksSource, other.TicksSource)
+	jobData.SecondsSource = mergeSource(jobData.SecondsSource, other.SecondsSource)
+	jobData.RequestsSource = mergeSource(jobData.RequestsSource, other.RequestsSource)
+	jobData.MeasuredAllocs += other.MeasuredAllocs
+	jobData.TotalAllocs += other.TotalAllocs
+
+	for _, task := range other.Tasks {
+		merged := false
+		for i := range jobData.Tasks {
+			if jobData.Tasks[i].TaskGroup == task.TaskGroup && jobData.Tasks[i].Task == task.Task {
+				jobData.Tasks[i].Count += task.Count
+				jobData.Tasks[i].RCPU += task.RCPU
+				jobData.Tasks[i].RMemoryMB += task.RMemoryMB
+				jobData.Tasks[i].UTicks += task.UTicks
+				jobData.Tasks[i].URSS += task.URSS
+				jobData.Tasks[i].UCache += task.UCache
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			jobData.Tasks = append(jobData.Tasks, task)
+		}
+	}
+	jobData.Allocs = append(jobData.Allocs, other.Allocs...)
+	for _, device := range other.Devices {
+		jobData.Devices = mergeDevices(jobData.Devices, device)
+	}
+}
+
+// ClusterJobs holds the jobs collected from a cluster in one cycle.
+// TimedOut is set when the cycle ended before every job of the cluster was collected.
+type ClusterJobs struct {
+	Cluster  string
+	Jobs     []JobData
+	TimedOut bool
+}
+
+// reachCluster collects every job of the cluster until ctx ends, always reporting what was collected to c
+func reachCluster(ctx context.Context, cluster *NomadCluster, c chan<- ClusterJobs) {
+	var jobData []JobData
+
+	defer wg.Done()
+
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+
+	for _, region := range getRegions(ctx, cluster) {
+		regionCluster := cluster.withRegion(region)
+		for _, namespace := range getNamespaces(ctx, regionCluster) {
+			if ctx.Err() != nil {
+				break
+			}
+			namespaceCluster := regionCluster.withNamespace(namespace)
+			jobs, err := getJobs(ctx, namespaceCluster)
+			if err != nil {
+				log.Error(fmt.Sprintf("Error in listing jobs in region %s, namespace %s: %v", region, namespace, err))
+				continue
+			}
+			jobs = scopedJobs(ctx, jobs)
+			reportJobsSeen(ctx, countCollected(jobs))
+			jobData = append(jobData, reachNamespace(ctx, namespaceCluster, jobs)...)
+		}
+	}
+
+	c <- ClusterJobs{cluster.Name, jobData, ctx.Err() != nil}
+}
+
+// reachNamespace collects every supported job of a namespace using the cluster's worker pool.
+// Jobs are returned in listing order regardless of the order their workers finish in.
+func reachNamespace(ctx context.Context, cluster *NomadCluster, jobs []JobDesc) []JobData {
+	var jobData []JobData
+
+	workers := cluster.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-		if job.Type != "system" && job.Type != "service" {
+	results := make([]*JobData, len(jobs))
+	indexes := make(chan int)
+	var workerWG sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		workerWG.Add(1)
+		go func() {
+			defer workerWG.Done()
+			for i := range indexes {
+				// Jobs left when the cycle ends are drained without being collected
+				if ctx.Err() != nil {
+					continue
+				}
+				results[i] = reachJob(ctx, cluster, jobs[i])
+			}
+		}()
+	}
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
+	workerWG.Wait()
+
+	// Periodic and dispatched children are rolled up into their parent job
+	parents := make(map[string]int)
+
+	for i, job := range jobs {
+		jobStruct := results[i]
+		if jobStruct == nil {
 			continue
 		}
-		rss, ticks, cache = aggUsed(clusterAddress, metricsAddress, job.ID, job.Name)
-		CPUTotal, memoryMBTotal, diskMBTotal, IOPSTotal = aggRequested(clusterAddress, job.ID, job.Type)
 
-		var dataCenters string
-		for i, val := range job.Datacenters {
-			dataCenters += val
-			if i != len(job.Datacenters)-1 {
-				dataCenters += ","
+		if job.ParentID != "" {
+			if j, ok := parents[job.ParentID]; ok {
+				mergeJobData(&jobData[j], *jobStruct)
+				continue
 			}
+			parents[job.ParentID] = len(jobData)
 		}
+		jobData = append(jobData, *jobStruct)
+	}
+
+	return jobData
+}
+
+// reachJob collects the requested and used resources of a single job, or returns nil for jobs that are not collected.
+// Children of periodic and parameterized jobs are reported under their parent's ID.
+// Jobs still waiting for a slot when ctx ends are not collected.
+func reachJob(ctx context.Context, cluster *NomadCluster, job JobDesc) *JobData {
+	var CPUSeconds, memoryMBSeconds, ticksSeconds, rssSeconds float64
+	var secondsSource string
+	requestsSource := fromNomad
+
+	log.Trace(job.ID)
 
-		currentTime := time.Now().Format("2006-01-02 15:04:05")
-		jobStruct := JobData{
-			job.ID,
-			job.Name,
-			ticks,
-			CPUTotal,
-			rss,
-			cache,
-			memoryMBTotal,
-			diskMBTotal,
-			IOPSTotal,
-			job.JobSummary.Namespace,
-			dataCenters,
-			currentTime,
+	if !isCollected(job) {
+		return nil
+	}
+
+	// Bound the number of jobs collected at once across all clusters
+	if slots := jobSlots; slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return nil
 		}
-		jobData = append(jobData, jobStruct)
 	}
 
-	c <- jobData
-	wg.Done()
+	// The spec and allocations of a job are read once and shared by every aggregation below
+	jobSpec, err := getJobSpec(ctx, cluster, job.ID)
+	if err != nil {
+		log.Error(err)
+		requestsSource = fromMissing
+	}
+	jobAllocs, err := getAllocs(ctx, cluster, job.ID)
+	if err != nil {
+		log.Error(err)
+		// Only jobs other than services count their task groups from their allocations
+		if job.Type != "service" {
+			requestsSource = fromMissing
+		}
+	}
+	mapTaskGroupCount := getTaskGroupCounts(job.Type, jobSpec, jobAllocs)
+
+	rss, ticks, cache, provenance := aggUsed(ctx, cluster, job.ID, job.Name, jobAllocs)
+	CPUTotal, memoryMBTotal, diskMBTotal, IOPSTotal := aggRequested(jobSpec, mapTaskGroupCount)
+	mbits, reservedPorts, dynamicPorts := aggNetworks(jobSpec, mapTaskGroupCount)
+	memoryMaxMB, cores, coresMHz := aggLimits(ctx, cluster, jobSpec, mapTaskGroupCount, jobAllocs)
+
+	if isBatch(job.Type) {
+		CPUSeconds, memoryMBSeconds, ticksSeconds, rssSeconds, secondsSource = aggLifetime(ctx, cluster, job.ID, job.Name, jobSpec, jobAllocs, scheduledTime(ctx), collectionWindow)
+	}
+	tasks := aggTasks(ctx, cluster, job.ID, job.Name, jobSpec, mapTaskGroupCount, jobAllocs)
+	allocs := aggAllocs(ctx, cluster, job.ID, job.Name, jobSpec, jobAllocs)
+	devices := getDeviceRequests(jobSpec, mapTaskGroupCount)
+
+	var dataCenters string
+	for i, val := range job.Datacenters {
+		dataCenters += val
+		if i != len(job.Datacenters)-1 {
+			dataCenters += ","
+		}
+	}
+
+	namespace := job.JobSummary.Namespace
+	if namespace == "" {
+		namespace = cluster.Namespace
+	}
+
+	ticksStats := aggWindowUsage(ctx, cluster, ticksMetric, job.ID, job.Name, namespace, 1)
+	rssStats := aggWindowUsage(ctx, cluster, rssMetric, job.ID, job.Name, namespace, 1.049e6)
+
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	jobStruct := JobData{
+		job.ID,
+		job.Name,
+		ticks,
+		CPUTotal,
+		rss,
+		cache,
+		memoryMBTotal,
+		diskMBTotal,
+		IOPSTotal,
+		namespace,
+		dataCenters,
+		currentTime,
+		cluster.Region,
+		cluster.Name,
+		job.Type,
+		CPUSeconds,
+		memoryMBSeconds,
+		ticksSeconds,
+		rssSeconds,
+		mbits,
+		reservedPorts,
+		dynamicPorts,
+		memoryMaxMB,
+		cores,
+		coresMHz,
+		math.Max(0, CPUTotal+coresMHz-ticks),
+		wasteMemory(memoryMBTotal, rss, tasks),
+		ticksStats.Avg,
+		ticksStats.Max,
+		ticksStats.P50,
+		ticksStats.P95,
+		ticksStats.P99,
+		rssStats.Avg,
+		rssStats.Max,
+		rssStats.P50,
+		rssStats.P95,
+		rssStats.P99,
+		provenance.RSSSource,
+		provenance.CacheSource,
+		provenance.TicksSource,
+		provenance.MeasuredAllocs,
+		provenance.TotalAllocs,
+		secondsSource,
+		requestsSource,
+		tasks,
+		allocs,
+		devices,
+	}
+
+	if job.ParentID != "" {
+		jobStruct.JobID = job.ParentID
+		jobStruct.Name = job.ParentID
+	}
+
+	return &jobStruct
 }
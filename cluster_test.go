@@ -18,20 +18,166 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jarcoal/httpmock"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestGetVMAllocs(t *testing.T) {
+func TestNomadClusterTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Nomad-Token") != "secretToken" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Permission denied"))
+			return
+		}
+		w.Write([]byte(`[{"ID": "alloc_id1"}, {"ID": "alloc_id2"}]`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "nurd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caCert, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := strings.Split(serverURL.Host, ":")
+
+	cluster, err := newNomadCluster(Server{
+		URL:    host[0],
+		Port:   host[1],
+		Token:  "secretToken",
+		CACert: caCert,
+	}, "")
+	assert.Empty(t, err)
+	assert.Equal(t, "https", cluster.Scheme)
+	expectedNomadAllocs := map[string]struct{}{
+		"alloc_id1": {},
+		"alloc_id2": {},
+	}
+	actualNomadAllocs := listAllocIDs(cluster, "job1")
+	assert.Equal(t, expectedNomadAllocs, actualNomadAllocs)
+
+	// Missing token is rejected by the server
+	cluster, err = newNomadCluster(Server{
+		URL:    host[0],
+		Port:   host[1],
+		CACert: caCert,
+	}, "")
+	assert.Empty(t, err)
+	actualNomadAllocs = listAllocIDs(cluster, "job1")
+	assert.Nil(t, actualNomadAllocs)
+
+	// Server certificate is not trusted without the CA
+	cluster, err = newNomadCluster(Server{
+		URL:           host[0],
+		Port:          host[1],
+		Token:         "secretToken",
+		TLSServerName: "example.com",
+	}, "")
+	assert.Empty(t, err)
+	actualNomadAllocs = listAllocIDs(cluster, "job1")
+	assert.Nil(t, actualNomadAllocs)
+}
+
+func TestGetNamespaces(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	// Namespaces unavailable
+	cluster := &NomadCluster{Address: "clusterAddress"}
+	assert.Equal(t, []string{"default"}, getNamespaces(context.Background(), cluster))
+
+	cluster = &NomadCluster{Address: "clusterAddress", IncludeNamespaces: []string{"ns1", "ns2"}}
+	assert.Equal(t, []string{"ns1", "ns2"}, getNamespaces(context.Background(), cluster))
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/namespaces",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"Name": "default"
+				},
+				{
+					"Name": "ns1"
+				},
+				{
+					"Name": "ns2"
+				}
+			]`,
+		),
+	)
+	cluster = &NomadCluster{Address: "clusterAddress"}
+	assert.Equal(t, []string{"default", "ns1", "ns2"}, getNamespaces(context.Background(), cluster))
+
+	cluster = &NomadCluster{Address: "clusterAddress", IncludeNamespaces: []string{"ns1", "ns3"}}
+	assert.Equal(t, []string{"ns1"}, getNamespaces(context.Background(), cluster))
+
+	cluster = &NomadCluster{Address: "clusterAddress", ExcludeNamespaces: []string{"default"}}
+	assert.Equal(t, []string{"ns1", "ns2"}, getNamespaces(context.Background(), cluster))
+
+	cluster = &NomadCluster{Address: "clusterAddress", IncludeNamespaces: []string{"ns1", "ns2"}, ExcludeNamespaces: []string{"ns2"}}
+	assert.Equal(t, []string{"ns1"}, getNamespaces(context.Background(), cluster))
+}
+
+func TestGetRegions(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/regions",
+		httpmock.NewStringResponder(200, `["global", "eu"]`),
+	)
+
+	httpmock.RegisterResponder("GET", "http://agentAddress/v1/agent/self",
+		httpmock.NewStringResponder(200, `{"Config": {"Region": "us-east"}}`),
+	)
+
+	// Region discovery disabled, the region of the configured servers is read once
+	agentRegions.Delete("http://agentAddress")
+	cluster := &NomadCluster{Address: "clusterAddress"}
+	assert.Equal(t, []string{""}, getRegions(context.Background(), cluster))
+	cluster = &NomadCluster{Scheme: "http", Address: "agentAddress"}
+	assert.Equal(t, []string{"us-east"}, getRegions(context.Background(), cluster))
+	assert.Equal(t, []string{"us-east"}, getRegions(context.Background(), cluster))
+	assert.Equal(t, 1, httpmock.GetCallCountInfo()["GET http://agentAddress/v1/agent/self"])
+	cluster = &NomadCluster{Address: "agentAddress", Region: "eu"}
+	assert.Equal(t, []string{"eu"}, getRegions(context.Background(), cluster))
+
+	cluster = &NomadCluster{Address: "clusterAddress", DiscoverRegions: true}
+	assert.Equal(t, []string{"global", "eu"}, getRegions(context.Background(), cluster))
+
+	cluster = &NomadCluster{Address: "badAddress", DiscoverRegions: true}
+	assert.Equal(t, []string{""}, getRegions(context.Background(), cluster))
+}
+
+func TestGetMetricsAllocs(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder("GET", "http://goodAddress/api/v1/query?query=query1",
+	httpmock.RegisterResponder("GET", metricsQueryURL("goodAddress", victoriaMetricsDialect.allocQuery("query1")),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -44,12 +190,12 @@ func TestGetVMAllocs(t *testing.T) {
 			}`,
 		),
 	)
-	expectedVMAllocs := map[string]struct{}{}
-	actualVMAllocs := getVMAllocs("goodAddress", "query1")
-	assert.Empty(t, actualVMAllocs)
-	assert.Equal(t, expectedVMAllocs, actualVMAllocs)
+	expectedMetricsAllocs := map[string]struct{}{}
+	actualMetricsAllocs := getMetricsAllocs(context.Background(), MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics("goodAddress")}}, "query1")
+	assert.Empty(t, actualMetricsAllocs)
+	assert.Equal(t, expectedMetricsAllocs, actualMetricsAllocs)
 
-	httpmock.RegisterResponder("GET", "http://goodAddress/api/v1/query?query=query2",
+	httpmock.RegisterResponder("GET", metricsQueryURL("goodAddress", victoriaMetricsDialect.allocQuery("query2")),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -71,38 +217,38 @@ func TestGetVMAllocs(t *testing.T) {
 			}`,
 		),
 	)
-	expectedVMAllocs = map[string]struct{}{
+	expectedMetricsAllocs = map[string]struct{}{
 		"alloc_id1": {},
 		"alloc_id2": {},
 	}
-	actualVMAllocs = getVMAllocs("goodAddress", "query2")
-	assert.NotNil(t, actualVMAllocs)
-	assert.Equal(t, expectedVMAllocs, actualVMAllocs)
+	actualMetricsAllocs = getMetricsAllocs(context.Background(), MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics("goodAddress")}}, "query2")
+	assert.NotNil(t, actualMetricsAllocs)
+	assert.Equal(t, expectedMetricsAllocs, actualMetricsAllocs)
 
-	httpmock.RegisterResponder("GET", "http://goodAddress/api/v1/query?query=query3",
+	httpmock.RegisterResponder("GET", metricsQueryURL("goodAddress", victoriaMetricsDialect.allocQuery("query3")),
 		httpmock.NewStringResponder(200, `
 			{
 				invalid JSON
 			}`,
 		),
 	)
-	expectedVMAllocs = nil
-	actualVMAllocs = getVMAllocs("goodAddress", "query3")
-	assert.Empty(t, actualVMAllocs)
-	assert.Equal(t, expectedVMAllocs, actualVMAllocs)
+	expectedMetricsAllocs = nil
+	actualMetricsAllocs = getMetricsAllocs(context.Background(), MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics("goodAddress")}}, "query3")
+	assert.Empty(t, actualMetricsAllocs)
+	assert.Equal(t, expectedMetricsAllocs, actualMetricsAllocs)
 
-	expectedVMAllocs = nil
-	actualVMAllocs = getVMAllocs("goodAddress", "badQuery")
-	assert.Empty(t, actualVMAllocs)
-	assert.Equal(t, expectedVMAllocs, actualVMAllocs)
+	expectedMetricsAllocs = nil
+	actualMetricsAllocs = getMetricsAllocs(context.Background(), MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics("goodAddress")}}, "badQuery")
+	assert.Empty(t, actualMetricsAllocs)
+	assert.Equal(t, expectedMetricsAllocs, actualMetricsAllocs)
 
-	expectedVMAllocs = nil
-	actualVMAllocs = getVMAllocs("badAddress", "query2")
-	assert.Empty(t, actualVMAllocs)
-	assert.Equal(t, expectedVMAllocs, actualVMAllocs)
+	expectedMetricsAllocs = nil
+	actualMetricsAllocs = getMetricsAllocs(context.Background(), MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics("badAddress")}}, "query2")
+	assert.Empty(t, actualMetricsAllocs)
+	assert.Equal(t, expectedMetricsAllocs, actualMetricsAllocs)
 }
 
-func TestGetNomadAllocs(t *testing.T) {
+func TestListAllocIDs(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
@@ -113,7 +259,7 @@ func TestGetNomadAllocs(t *testing.T) {
 		),
 	)
 	expectedNomadAllocs := map[string]struct{}{}
-	actualNomadAllocs := getNomadAllocs("goodAddress", "job1")
+	actualNomadAllocs := listAllocIDs(&NomadCluster{Address: "goodAddress"}, "job1")
 	assert.Empty(t, actualNomadAllocs)
 	assert.Equal(t, expectedNomadAllocs, actualNomadAllocs)
 
@@ -133,7 +279,7 @@ func TestGetNomadAllocs(t *testing.T) {
 		"ID1": {},
 		"ID2": {},
 	}
-	actualNomadAllocs = getNomadAllocs("goodAddress", "job2")
+	actualNomadAllocs = listAllocIDs(&NomadCluster{Address: "goodAddress"}, "job2")
 	assert.NotNil(t, actualNomadAllocs)
 	assert.Equal(t, expectedNomadAllocs, actualNomadAllocs)
 
@@ -145,17 +291,17 @@ func TestGetNomadAllocs(t *testing.T) {
 		),
 	)
 	expectedNomadAllocs = nil
-	actualNomadAllocs = getNomadAllocs("goodAddress", "job3")
+	actualNomadAllocs = listAllocIDs(&NomadCluster{Address: "goodAddress"}, "job3")
 	assert.Empty(t, actualNomadAllocs)
 	assert.Equal(t, expectedNomadAllocs, actualNomadAllocs)
 
 	expectedNomadAllocs = nil
-	actualNomadAllocs = getNomadAllocs("goodAddress", "badJobID")
+	actualNomadAllocs = listAllocIDs(&NomadCluster{Address: "goodAddress"}, "badJobID")
 	assert.Empty(t, actualNomadAllocs)
 	assert.Equal(t, expectedNomadAllocs, actualNomadAllocs)
 
 	expectedNomadAllocs = nil
-	actualNomadAllocs = getNomadAllocs("badAddress", "job2")
+	actualNomadAllocs = listAllocIDs(&NomadCluster{Address: "badAddress"}, "job2")
 	assert.Empty(t, actualNomadAllocs)
 	assert.Equal(t, expectedNomadAllocs, actualNomadAllocs)
 }
@@ -164,7 +310,7 @@ func TestGetRSS(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -203,7 +349,7 @@ func TestGetRSS(t *testing.T) {
 			]`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=nomad_client_allocs_memory_rss_value",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -231,7 +377,7 @@ func TestGetRSS(t *testing.T) {
 		"alloc_id4": {"rss"},
 	}
 	actualRemainders := map[string][]string{}
-	actualRSS := getRSS("clusterAddress", "metricsAddress", "jobID", "jobName", actualRemainders)
+	actualRSS := getRSS(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualRSS)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.NotNil(t, actualRemainders)
@@ -240,7 +386,7 @@ func TestGetRSS(t *testing.T) {
 	expectedRSS = 13459456 / 1.049e6
 	expectedRemainders = map[string][]string{}
 	actualRemainders = map[string][]string{}
-	actualRSS = getRSS("badAddress", "metricsAddress", "jobID", "jobName", actualRemainders)
+	actualRSS = getRSS(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualRSS)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.NotNil(t, actualRemainders)
@@ -254,7 +400,7 @@ func TestGetRSS(t *testing.T) {
 		"alloc_id4": {"rss"},
 	}
 	actualRemainders = map[string][]string{}
-	actualRSS = getRSS("clusterAddress", "badAddress", "jobID", "jobName", actualRemainders)
+	actualRSS = getRSS(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualRSS)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.NotNil(t, actualRemainders)
@@ -263,13 +409,13 @@ func TestGetRSS(t *testing.T) {
 	expectedRSS = 0.0
 	expectedRemainders = map[string][]string{}
 	actualRemainders = map[string][]string{}
-	actualRSS = getRSS("badAddress", "badAddress", "jobID", "jobName", actualRemainders)
+	actualRSS = getRSS(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualRSS)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.NotNil(t, actualRemainders)
 	assert.Equal(t, expectedRemainders, actualRemainders)
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress2/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress2", victoriaMetricsDialect.jobQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				invalid JSON
@@ -277,15 +423,20 @@ func TestGetRSS(t *testing.T) {
 		),
 	)
 	expectedRSS = 0.0
-	expectedRemainders = map[string][]string{}
+	expectedRemainders = map[string][]string{
+		"alloc_id1": {"rss"},
+		"alloc_id2": {"rss"},
+		"alloc_id3": {"rss"},
+		"alloc_id4": {"rss"},
+	}
 	actualRemainders = map[string][]string{}
-	actualRSS = getRSS("clusterAddress", "metricsAddress2", "jobID", "jobName", actualRemainders)
+	actualRSS = getRSS(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress2")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress2")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualRSS)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.NotNil(t, actualRemainders)
 	assert.Equal(t, expectedRemainders, actualRemainders)
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress3/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress3", victoriaMetricsDialect.jobQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -307,9 +458,14 @@ func TestGetRSS(t *testing.T) {
 		),
 	)
 	expectedRSS = 0.0
-	expectedRemainders = map[string][]string{}
+	expectedRemainders = map[string][]string{
+		"alloc_id1": {"rss"},
+		"alloc_id2": {"rss"},
+		"alloc_id3": {"rss"},
+		"alloc_id4": {"rss"},
+	}
 	actualRemainders = map[string][]string{}
-	actualRSS = getRSS("clusterAddress", "metricsAddress3", "jobID", "jobName", actualRemainders)
+	actualRSS = getRSS(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress3")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress3")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualRSS)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.NotNil(t, actualRemainders)
@@ -320,7 +476,7 @@ func TestGetCache(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -359,7 +515,7 @@ func TestGetCache(t *testing.T) {
 			]`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=nomad_client_allocs_memory_cache_value",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -387,7 +543,7 @@ func TestGetCache(t *testing.T) {
 		"alloc_id4": {"cache"},
 	}
 	actualRemainders := map[string][]string{}
-	actualCache := getCache("clusterAddress", "metricsAddress", "jobID", "jobName", actualRemainders)
+	actualCache := getCache(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualCache)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.NotNil(t, actualRemainders)
@@ -396,7 +552,7 @@ func TestGetCache(t *testing.T) {
 	expectedCache = 13459456 / 1.049e6
 	expectedRemainders = map[string][]string{}
 	actualRemainders = map[string][]string{}
-	actualCache = getCache("badAddress", "metricsAddress", "jobID", "jobName", actualRemainders)
+	actualCache = getCache(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualCache)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.NotNil(t, actualRemainders)
@@ -410,7 +566,7 @@ func TestGetCache(t *testing.T) {
 		"alloc_id4": {"cache"},
 	}
 	actualRemainders = map[string][]string{}
-	actualCache = getCache("clusterAddress", "badAddress", "jobID", "jobName", actualRemainders)
+	actualCache = getCache(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualCache)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.NotNil(t, actualRemainders)
@@ -419,13 +575,13 @@ func TestGetCache(t *testing.T) {
 	expectedCache = 0.0
 	expectedRemainders = map[string][]string{}
 	actualRemainders = map[string][]string{}
-	actualCache = getCache("badAddress", "badAddress", "jobID", "jobName", actualRemainders)
+	actualCache = getCache(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualCache)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.NotNil(t, actualRemainders)
 	assert.Equal(t, expectedRemainders, actualRemainders)
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress2/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress2", victoriaMetricsDialect.jobQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				invalid JSON
@@ -433,15 +589,20 @@ func TestGetCache(t *testing.T) {
 		),
 	)
 	expectedCache = 0.0
-	expectedRemainders = map[string][]string{}
+	expectedRemainders = map[string][]string{
+		"alloc_id1": {"cache"},
+		"alloc_id2": {"cache"},
+		"alloc_id3": {"cache"},
+		"alloc_id4": {"cache"},
+	}
 	actualRemainders = map[string][]string{}
-	actualCache = getCache("clusterAddress", "metricsAddress2", "jobID", "jobName", actualRemainders)
+	actualCache = getCache(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress2")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress2")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualCache)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.NotNil(t, actualRemainders)
 	assert.Equal(t, expectedRemainders, actualRemainders)
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress3/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress3", victoriaMetricsDialect.jobQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -463,9 +624,14 @@ func TestGetCache(t *testing.T) {
 		),
 	)
 	expectedCache = 0.0
-	expectedRemainders = map[string][]string{}
+	expectedRemainders = map[string][]string{
+		"alloc_id1": {"cache"},
+		"alloc_id2": {"cache"},
+		"alloc_id3": {"cache"},
+		"alloc_id4": {"cache"},
+	}
 	actualRemainders = map[string][]string{}
-	actualCache = getCache("clusterAddress", "metricsAddress3", "jobID", "jobName", actualRemainders)
+	actualCache = getCache(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress3")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress3")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualCache)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.NotNil(t, actualRemainders)
@@ -476,7 +642,7 @@ func TestGetTicks(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -515,7 +681,7 @@ func TestGetTicks(t *testing.T) {
 			]`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=nomad_client_allocs_cpu_total_ticks_value",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -543,7 +709,7 @@ func TestGetTicks(t *testing.T) {
 		"alloc_id4": {"ticks"},
 	}
 	actualRemainders := map[string][]string{}
-	actualTicks := getTicks("clusterAddress", "metricsAddress", "jobID", "jobName", actualRemainders)
+	actualTicks := getTicks(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.NotNil(t, actualRemainders)
@@ -552,7 +718,7 @@ func TestGetTicks(t *testing.T) {
 	expectedTicks = 13459456.0
 	expectedRemainders = map[string][]string{}
 	actualRemainders = map[string][]string{}
-	actualTicks = getTicks("badAddress", "metricsAddress", "jobID", "jobName", actualRemainders)
+	actualTicks = getTicks(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.NotNil(t, actualRemainders)
@@ -566,7 +732,7 @@ func TestGetTicks(t *testing.T) {
 		"alloc_id4": {"ticks"},
 	}
 	actualRemainders = map[string][]string{}
-	actualTicks = getTicks("clusterAddress", "badAddress", "jobID", "jobName", actualRemainders)
+	actualTicks = getTicks(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.NotNil(t, actualRemainders)
@@ -575,13 +741,13 @@ func TestGetTicks(t *testing.T) {
 	expectedTicks = 0.0
 	expectedRemainders = map[string][]string{}
 	actualRemainders = map[string][]string{}
-	actualTicks = getTicks("badAddress", "badAddress", "jobID", "jobName", actualRemainders)
+	actualTicks = getTicks(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("badAddress")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.NotNil(t, actualRemainders)
 	assert.Equal(t, expectedRemainders, actualRemainders)
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress2/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress2", victoriaMetricsDialect.jobQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				Invalid JSON
@@ -589,15 +755,20 @@ func TestGetTicks(t *testing.T) {
 		),
 	)
 	expectedTicks = 0.0
-	expectedRemainders = map[string][]string{}
+	expectedRemainders = map[string][]string{
+		"alloc_id1": {"ticks"},
+		"alloc_id2": {"ticks"},
+		"alloc_id3": {"ticks"},
+		"alloc_id4": {"ticks"},
+	}
 	actualRemainders = map[string][]string{}
-	actualTicks = getTicks("clusterAddress", "metricsAddress2", "jobID", "jobName", actualRemainders)
+	actualTicks = getTicks(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress2")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress2")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.NotNil(t, actualRemainders)
 	assert.Equal(t, expectedRemainders, actualRemainders)
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress3/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress3", victoriaMetricsDialect.jobQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -619,9 +790,14 @@ func TestGetTicks(t *testing.T) {
 		),
 	)
 	expectedTicks = 0.0
-	expectedRemainders = map[string][]string{}
+	expectedRemainders = map[string][]string{
+		"alloc_id1": {"ticks"},
+		"alloc_id2": {"ticks"},
+		"alloc_id3": {"ticks"},
+		"alloc_id4": {"ticks"},
+	}
 	actualRemainders = map[string][]string{}
-	actualTicks = getTicks("clusterAddress", "metricsAddress3", "jobID", "jobName", actualRemainders)
+	actualTicks = getTicks(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress3")}, "jobID", "jobName", listAllocIDs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress3")}, "jobID"), actualRemainders)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.NotNil(t, actualRemainders)
@@ -679,7 +855,7 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS := 6451200/1.049e6 + 552821/1.049e6
 	expectedCache := 654321/1.049e6 + 789246/1.049e6
 	expectedTicks := 2394.4724337708644 + 1125.6842315
-	actualRSS, actualCache, actualTicks := getRemainderNomad("clusterAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ := getRemainderNomad(context.Background(), &NomadCluster{Address: "clusterAddress"}, remainders)
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualCache)
 	assert.NotNil(t, actualTicks)
@@ -694,7 +870,7 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS = 552821 / 1.049e6
 	expectedCache = 654321 / 1.049e6
 	expectedTicks = 2394.4724337708644
-	actualRSS, actualCache, actualTicks = getRemainderNomad("clusterAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), &NomadCluster{Address: "clusterAddress"}, remainders)
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualCache)
 	assert.NotNil(t, actualTicks)
@@ -715,7 +891,7 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS = 0.0
 	expectedCache = 0.0
 	expectedTicks = 0.0
-	actualRSS, actualCache, actualTicks = getRemainderNomad("clusterAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), &NomadCluster{Address: "clusterAddress"}, remainders)
 	assert.Empty(t, actualRSS)
 	assert.Empty(t, actualCache)
 	assert.Empty(t, actualTicks)
@@ -730,7 +906,7 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS = 0.0
 	expectedCache = 0.0
 	expectedTicks = 0.0
-	actualRSS, actualCache, actualTicks = getRemainderNomad("badAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), &NomadCluster{Address: "badAddress"}, remainders)
 	assert.Empty(t, actualRSS)
 	assert.Empty(t, actualCache)
 	assert.Empty(t, actualTicks)
@@ -745,7 +921,7 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS = 6451200 / 1.049e6
 	expectedCache = 654321 / 1.049e6
 	expectedTicks = 2394.4724337708644
-	actualRSS, actualCache, actualTicks = getRemainderNomad("clusterAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), &NomadCluster{Address: "clusterAddress"}, remainders)
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualCache)
 	assert.NotNil(t, actualTicks)
@@ -760,7 +936,7 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS = 6451200 / 1.049e6
 	expectedCache = 654321 / 1.049e6
 	expectedTicks = 2394.4724337708644
-	actualRSS, actualCache, actualTicks = getRemainderNomad("clusterAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), &NomadCluster{Address: "clusterAddress"}, remainders)
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualCache)
 	assert.NotNil(t, actualTicks)
@@ -775,20 +951,31 @@ func TestGetRemainderNomad(t *testing.T) {
 	expectedRSS = 6451200 / 1.049e6
 	expectedCache = 654321 / 1.049e6
 	expectedTicks = 2394.4724337708644
-	actualRSS, actualCache, actualTicks = getRemainderNomad("clusterAddress", remainders)
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), &NomadCluster{Address: "clusterAddress"}, remainders)
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualCache)
 	assert.NotNil(t, actualTicks)
 	assert.Equal(t, expectedRSS, actualRSS)
 	assert.Equal(t, expectedCache, actualCache)
 	assert.Equal(t, expectedTicks, actualTicks)
+
+	// Allocation stats are not requested while the cluster's breaker is open
+	threshold := breakerThreshold
+	breakerThreshold = 1
+	defer func() { breakerThreshold = threshold }()
+	openCluster := &NomadCluster{Name: "openCluster", Address: "clusterAddress"}
+	getBreaker(openCluster.upstream()).failure()
+	httpmock.ZeroCallCounters()
+	actualRSS, actualCache, actualTicks, _ = getRemainderNomad(context.Background(), openCluster, map[string][]string{"alloc_id1": {"rss"}})
+	assert.Equal(t, 0.0, actualRSS+actualCache+actualTicks)
+	assert.Equal(t, 0, httpmock.GetTotalCallCount())
 }
 
 func TestAggUsed(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -809,7 +996,7 @@ func TestAggUsed(t *testing.T) {
 			}`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -830,7 +1017,7 @@ func TestAggUsed(t *testing.T) {
 			}`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -854,7 +1041,7 @@ func TestAggUsed(t *testing.T) {
 	expectedRSS := 13459456 / 1.049e6
 	expectedTicks := 23459456.0
 	expectedCache := 33459456 / 1.049e6
-	actualRSS, actualTicks, actualCache := aggUsed("clusterAddress", "metricsAddress", "jobID", "jobName")
+	actualRSS, actualTicks, actualCache, _ := aggUsed(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"))
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualTicks)
 	assert.NotNil(t, actualCache)
@@ -918,7 +1105,7 @@ func TestAggUsed(t *testing.T) {
 	expectedRSS = (13459456 + 6451200 + 552821) / 1.049e6
 	expectedTicks = 23459456.0 + 2394.4724337708644 + 1125.6842315
 	expectedCache = (33459456 + 654321 + 789246) / 1.049e6
-	actualRSS, actualTicks, actualCache = aggUsed("clusterAddress", "metricsAddress", "jobID", "jobName")
+	actualRSS, actualTicks, actualCache, _ = aggUsed(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"))
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualTicks)
 	assert.NotNil(t, actualCache)
@@ -926,8 +1113,8 @@ func TestAggUsed(t *testing.T) {
 	assert.Equal(t, expectedTicks, actualTicks)
 	assert.Equal(t, expectedCache, actualCache)
 
-	// VMAllocs
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=nomad_client_allocs_memory_rss_value",
+	// Metrics allocs
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -949,7 +1136,7 @@ func TestAggUsed(t *testing.T) {
 			}`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=nomad_client_allocs_cpu_total_ticks_value",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -971,7 +1158,7 @@ func TestAggUsed(t *testing.T) {
 			}`,
 		),
 	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=nomad_client_allocs_memory_cache_value",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status":"successTest",
@@ -996,7 +1183,7 @@ func TestAggUsed(t *testing.T) {
 	expectedRSS = 13459456 / 1.049e6
 	expectedTicks = 23459456.0
 	expectedCache = 33459456 / 1.049e6
-	actualRSS, actualTicks, actualCache = aggUsed("clusterAddress", "metricsAddress", "jobID", "jobName")
+	actualRSS, actualTicks, actualCache, _ = aggUsed(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", listAllocs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"))
 	assert.NotNil(t, actualRSS)
 	assert.NotNil(t, actualTicks)
 	assert.NotNil(t, actualCache)
@@ -1076,7 +1263,7 @@ func TestAggRequested(t *testing.T) {
 	expectedMemory := 1792.0
 	expectedDisk := 3500.0
 	expectedIOPS := 160.0
-	actualCPU, actualMemory, actualDisk, actualIOPS := aggRequested("clusterAddress", "jobID", "system")
+	actualCPU, actualMemory, actualDisk, actualIOPS := aggRequested(jobInputs(&NomadCluster{Address: "clusterAddress"}, "jobID", "system"))
 	assert.NotNil(t, actualCPU)
 	assert.NotNil(t, actualMemory)
 	assert.NotNil(t, actualDisk)
@@ -1132,7 +1319,7 @@ func TestAggRequested(t *testing.T) {
 	expectedMemory = 2048.0
 	expectedDisk = 4000.0
 	expectedIOPS = 140.0
-	actualCPU, actualMemory, actualDisk, actualIOPS = aggRequested("clusterAddress", "jobID2", "service")
+	actualCPU, actualMemory, actualDisk, actualIOPS = aggRequested(jobInputs(&NomadCluster{Address: "clusterAddress"}, "jobID2", "service"))
 	assert.NotNil(t, actualCPU)
 	assert.NotNil(t, actualMemory)
 	assert.NotNil(t, actualDisk)
@@ -1146,7 +1333,7 @@ func TestAggRequested(t *testing.T) {
 	expectedMemory = 0.0
 	expectedDisk = 0.0
 	expectedIOPS = 0.0
-	actualCPU, actualMemory, actualDisk, actualIOPS = aggRequested("clusterAddress", "jobID", "none")
+	actualCPU, actualMemory, actualDisk, actualIOPS = aggRequested(jobInputs(&NomadCluster{Address: "clusterAddress"}, "jobID", "none"))
 	assert.NotNil(t, actualCPU)
 	assert.NotNil(t, actualMemory)
 	assert.NotNil(t, actualDisk)
@@ -1160,7 +1347,7 @@ func TestAggRequested(t *testing.T) {
 	expectedMemory = 0.0
 	expectedDisk = 0.0
 	expectedIOPS = 0.0
-	actualCPU, actualMemory, actualDisk, actualIOPS = aggRequested("badAddress", "jobID", "system")
+	actualCPU, actualMemory, actualDisk, actualIOPS = aggRequested(jobInputs(&NomadCluster{Address: "badAddress"}, "jobID", "system"))
 	assert.NotNil(t, actualCPU)
 	assert.NotNil(t, actualMemory)
 	assert.NotNil(t, actualDisk)
@@ -1217,8 +1404,7 @@ func TestReachCluster(t *testing.T) {
 	)
 
 	// VictoriaMetrics
-	// jobName1
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName1%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(rssMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -1227,53 +1413,32 @@ func TestReachCluster(t *testing.T) {
 					"result": [
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName1",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
 								"13459456"
 							]
-						}
-					]
-				}
-			}`,
-		),
-	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName1%22%7D)%20by%20(job)",
-		httpmock.NewStringResponder(200, `
-			{
-				"status": "success",
-				"data": {
-					"resultType": "vector",
-					"result": [
+						},
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName2",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
-								"33459456"
+								"23459456"
 							]
-						}
-					]
-				}
-			}`,
-		),
-	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName1%22%7D)%20by%20(job)",
-		httpmock.NewStringResponder(200, `
-			{
-				"status": "success",
-				"data": {
-					"resultType": "vector",
-					"result": [
+						},
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName3",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
-								"23459456.0"
+								"12459456"
 							]
 						}
 					]
@@ -1281,8 +1446,7 @@ func TestReachCluster(t *testing.T) {
 			}`,
 		),
 	)
-	// jobName2
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName2%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(cacheMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -1291,53 +1455,32 @@ func TestReachCluster(t *testing.T) {
 					"result": [
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName1",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
-								"23459456"
+								"33459456"
 							]
-						}
-					]
-				}
-			}`,
-		),
-	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName2%22%7D)%20by%20(job)",
-		httpmock.NewStringResponder(200, `
-			{
-				"status": "success",
-				"data": {
-					"resultType": "vector",
-					"result": [
+						},
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName2",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
 								"54459456"
 							]
-						}
-					]
-				}
-			}`,
-		),
-	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName2%22%7D)%20by%20(job)",
-		httpmock.NewStringResponder(200, `
-			{
-				"status": "success",
-				"data": {
-					"resultType": "vector",
-					"result": [
+						},
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName3",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
-								"63459456.0"
+								"56459456"
 							]
 						}
 					]
@@ -1345,8 +1488,7 @@ func TestReachCluster(t *testing.T) {
 			}`,
 		),
 	)
-	// jobName3
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_rss_value%7Bjob%3D%22jobName3%22%7D)%20by%20(job)",
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.jobQuery(ticksMetric)),
 		httpmock.NewStringResponder(200, `
 			{
 				"status": "success",
@@ -1355,49 +1497,28 @@ func TestReachCluster(t *testing.T) {
 					"result": [
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName1",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
-								"12459456"
+								"23459456.0"
 							]
-						}
-					]
-				}
-			}`,
-		),
-	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_memory_cache_value%7Bjob%3D%22jobName3%22%7D)%20by%20(job)",
-		httpmock.NewStringResponder(200, `
-			{
-				"status": "success",
-				"data": {
-					"resultType": "vector",
-					"result": [
+						},
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName2",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
-								"56459456"
+								"63459456.0"
 							]
-						}
-					]
-				}
-			}`,
-		),
-	)
-	httpmock.RegisterResponder("GET", "http://metricsAddress/api/v1/query?query=sum(nomad_client_allocs_cpu_total_ticks_value%7Bjob%3D%22jobName3%22%7D)%20by%20(job)",
-		httpmock.NewStringResponder(200, `
-			{
-				"status": "success",
-				"data": {
-					"resultType": "vector",
-					"result": [
+						},
 						{
 							"metric": {
-								"job": "jobName"
+								"job": "jobName3",
+								"namespace": "default"
 							},
 							"value": [
 								1597365496,
@@ -1557,8 +1678,8 @@ func TestReachCluster(t *testing.T) {
 	)
 	
 	wg.Add(1)
-	c := make(chan []JobData, 1)
-	reachCluster("clusterAddress", "metricsAddress", c)
+	c := make(chan ClusterJobs, 1)
+	reachCluster(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, c)
 	wg.Wait()
 	close(c)
 
@@ -1575,6 +1696,41 @@ func TestReachCluster(t *testing.T) {
 		"default",
 		"DC1",
 		"",
+		"",
+		"",
+		"service",
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		"missing",
+		"missing",
+		"missing",
+		0,
+		0,
+		"",
+		"nomad",
+		nil,
+		nil,
+		nil,
 	}
 	expectedJob2 := JobData{
 		"jobID2",
@@ -1589,8 +1745,43 @@ func TestReachCluster(t *testing.T) {
 		"default",
 		"DC2",
 		"",
+		"",
+		"",
+		"system",
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
+		"none",
+		"none",
+		"none",
+		0,
+		0,
+		"",
+		"nomad",
+		nil,
+		nil,
+		nil,
 	}
-	actualJobs := <-c
+	actualJobs := (<-c).Jobs
 	assert.Equal(t, expectedJob1.JobID, actualJobs[0].JobID)
 	assert.Equal(t, expectedJob1.Name, actualJobs[0].Name)
 	assert.Equal(t, expectedJob1.UTicks, actualJobs[0].UTicks)
@@ -1602,6 +1793,11 @@ func TestReachCluster(t *testing.T) {
 	assert.Equal(t, expectedJob1.RIOPS, actualJobs[0].RIOPS)
 	assert.Equal(t, expectedJob1.Namespace, actualJobs[0].Namespace)
 	assert.Equal(t, expectedJob1.DataCenters, actualJobs[0].DataCenters)
+	assert.Equal(t, 0.0, actualJobs[0].WasteCPU)
+	assert.Equal(t, expectedJob1.RMemoryMB-expectedJob1.URSS, actualJobs[0].WasteMemoryMB)
+	assert.Equal(t, expectedJob1.RSSSource, actualJobs[0].RSSSource)
+	assert.Equal(t, expectedJob1.TotalAllocs, actualJobs[0].TotalAllocs)
+	assert.Equal(t, expectedJob1.RequestsSource, actualJobs[0].RequestsSource)
 
 	assert.Equal(t, expectedJob2.JobID, actualJobs[1].JobID)
 	assert.Equal(t, expectedJob2.Name, actualJobs[1].Name)
@@ -1614,4 +1810,1182 @@ func TestReachCluster(t *testing.T) {
 	assert.Equal(t, expectedJob2.RIOPS, actualJobs[1].RIOPS)
 	assert.Equal(t, expectedJob2.Namespace, actualJobs[1].Namespace)
 	assert.Equal(t, expectedJob2.DataCenters, actualJobs[1].DataCenters)
-}
\ No newline at end of file
+	assert.Equal(t, expectedJob2.CacheSource, actualJobs[1].CacheSource)
+	assert.Equal(t, expectedJob2.MeasuredAllocs, actualJobs[1].MeasuredAllocs)
+	assert.Equal(t, expectedJob2.RequestsSource, actualJobs[1].RequestsSource)
+}
+
+func TestReachClusterNamespaces(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/namespaces",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"Name": "default"
+				},
+				{
+					"Name": "ns1"
+				}
+			]`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/jobs?namespace=default",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "jobID1",
+					"Name": "jobName1",
+					"Datacenters": [
+						"DC1"
+					],
+					"Type": "service",
+					"JobSummary": {
+						"Namespace": "default"
+					}
+				}
+			]`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/jobs?namespace=ns1",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "jobID1",
+					"Name": "jobName1",
+					"Datacenters": [
+						"DC1"
+					],
+					"Type": "service",
+					"JobSummary": {
+						"Namespace": "ns1"
+					}
+				}
+			]`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID1?namespace=default",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID1",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 1,
+						"Tasks": [
+							{
+								"Resources": {
+									"CPU": 100,
+									"MemoryMB": 128
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID1?namespace=ns1",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID1",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 2,
+						"Tasks": [
+							{
+								"Resources": {
+									"CPU": 300,
+									"MemoryMB": 256
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+
+	wg.Add(1)
+	c := make(chan ClusterJobs, 1)
+	reachCluster(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, c)
+	wg.Wait()
+	close(c)
+
+	actualJobs := (<-c).Jobs
+	assert.Equal(t, 2, len(actualJobs))
+	assert.Equal(t, "jobID1", actualJobs[0].JobID)
+	assert.Equal(t, "default", actualJobs[0].Namespace)
+	assert.Equal(t, 100.0, actualJobs[0].RCPU)
+	assert.Equal(t, 128.0, actualJobs[0].RMemoryMB)
+	assert.Equal(t, "jobID1", actualJobs[1].JobID)
+	assert.Equal(t, "ns1", actualJobs[1].Namespace)
+	assert.Equal(t, 600.0, actualJobs[1].RCPU)
+	assert.Equal(t, 512.0, actualJobs[1].RMemoryMB)
+
+	// Excluded namespaces are never listed
+	wg.Add(1)
+	c = make(chan ClusterJobs, 1)
+	reachCluster(context.Background(), &NomadCluster{Address: "clusterAddress", ExcludeNamespaces: []string{"default"}, Metrics: newVictoriaMetrics("metricsAddress")}, c)
+	wg.Wait()
+	close(c)
+
+	actualJobs = (<-c).Jobs
+	assert.Equal(t, 1, len(actualJobs))
+	assert.Equal(t, "ns1", actualJobs[0].Namespace)
+}
+
+func TestReachClusterRegions(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/regions",
+		httpmock.NewStringResponder(200, `["global", "eu"]`),
+	)
+	for _, region := range []string{"global", "eu"} {
+		httpmock.RegisterResponder("GET", "http://clusterAddress/v1/jobs?namespace=default&region="+region,
+			httpmock.NewStringResponder(200, `
+				[
+					{
+						"ID": "jobID-`+region+`",
+						"Name": "jobName",
+						"Datacenters": [
+							"DC1"
+						],
+						"Type": "service",
+						"JobSummary": {
+							"Namespace": "default"
+						}
+					}
+				]`,
+			),
+		)
+	}
+
+	wg.Add(1)
+	c := make(chan ClusterJobs, 1)
+	reachCluster(context.Background(), &NomadCluster{Address: "clusterAddress", DiscoverRegions: true, Metrics: newVictoriaMetrics("metricsAddress")}, c)
+	wg.Wait()
+	close(c)
+
+	actualJobs := (<-c).Jobs
+	assert.Equal(t, 2, len(actualJobs))
+	assert.Equal(t, "jobID-global", actualJobs[0].JobID)
+	assert.Equal(t, "global", actualJobs[0].Region)
+	assert.Equal(t, "jobID-eu", actualJobs[1].JobID)
+	assert.Equal(t, "eu", actualJobs[1].Region)
+}
+
+func TestCountCollected(t *testing.T) {
+	jobs := []JobDesc{
+		{ID: "service1", Type: "service"},
+		{ID: "periodic1", Type: "batch", Periodic: true},
+		{ID: "periodic1/periodic-1594143300", ParentID: "periodic1", Type: "batch"},
+		{ID: "periodic1/periodic-1594143600", ParentID: "periodic1", Type: "batch"},
+		{ID: "dispatch1/dispatch-1594143300-3d6f9f43", ParentID: "dispatch1", Type: "sysbatch"},
+		{ID: "unknown1", Type: "unknown"},
+	}
+
+	assert.Equal(t, 3, countCollected(jobs))
+	assert.Equal(t, 0, countCollected(nil))
+}
+
+func TestOverlap(t *testing.T) {
+	windowBegin := time.Date(2020, 1, 1, 11, 45, 0, 0, time.UTC)
+	windowEnd := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 900.0, overlap(windowBegin.Add(-time.Hour), windowEnd.Add(time.Hour), windowBegin, windowEnd))
+	assert.Equal(t, 300.0, overlap(windowBegin.Add(-time.Hour), windowBegin.Add(5*time.Minute), windowBegin, windowEnd))
+	assert.Equal(t, 60.0, overlap(windowEnd.Add(-time.Minute), windowEnd.Add(time.Hour), windowBegin, windowEnd))
+	assert.Equal(t, 0.0, overlap(windowBegin.Add(-time.Hour), windowBegin.Add(-time.Minute), windowBegin, windowEnd))
+	assert.Equal(t, 0.0, overlap(windowEnd, windowBegin, windowBegin, windowEnd))
+}
+
+func TestAggLifetime(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	windowEnd := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/batchJob",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "batchJob",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 1,
+						"Tasks": [
+							{
+								"Name": "task1",
+								"Resources": {
+									"CPU": 100,
+									"MemoryMB": 200
+								}
+							},
+							{
+								"Name": "task2",
+								"Resources": {
+									"CPU": 50,
+									"MemoryMB": 100
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/batchJob/allocations",
+		httpmock.NewStringResponder(200, fmt.Sprintf(`
+			[
+				{
+					"ID": "alloc_id1",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "complete",
+					"CreateTime": %d,
+					"ModifyTime": %d,
+					"TaskStates": {
+						"task1": {
+							"State": "dead",
+							"StartedAt": "2020-01-01T11:50:00Z",
+							"FinishedAt": "2020-01-01T11:55:00Z"
+						},
+						"task2": {
+							"State": "pending",
+							"StartedAt": "0001-01-01T00:00:00Z",
+							"FinishedAt": "0001-01-01T00:00:00Z"
+						}
+					}
+				},
+				{
+					"ID": "alloc_id2",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running",
+					"CreateTime": %d,
+					"ModifyTime": %d
+				},
+				{
+					"ID": "alloc_id3",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "complete",
+					"CreateTime": %d,
+					"ModifyTime": %d
+				}
+			]`,
+			at(11, 40).UnixNano(), at(11, 55).UnixNano(),
+			at(11, 55).UnixNano(), at(11, 55).UnixNano(),
+			at(10, 0).UnixNano(), at(11, 0).UnixNano(),
+		)),
+	)
+	allocSeconds := func(value1, value2 string) httpmock.Responder {
+		return httpmock.NewStringResponder(200, fmt.Sprintf(`
+			{
+				"status":"success",
+				"data":{
+					"resultType":"vector",
+					"result":[
+						{
+							"metric":{
+								"alloc_id":"alloc_id1"
+							},
+							"value":[1577880000, "%s"]
+						},
+						{
+							"metric":{
+								"alloc_id":"alloc_id2"
+							},
+							"value":[1577880000, "%s"]
+						},
+						{
+							"metric":{
+								"alloc_id":"otherAlloc"
+							},
+							"value":[1577880000, "1000"]
+						}
+					]
+				}
+			}`, value1, value2),
+		)
+	}
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocSecondsQuery(ticksMetric, 15*time.Minute)),
+		allocSeconds("50", "500"))
+	httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocSecondsQuery(rssMetric, 15*time.Minute)),
+		allocSeconds("52450000", "524500000"))
+	httpmock.RegisterResponder("GET", metricsQueryURL("downAddress", victoriaMetricsDialect.allocSecondsQuery(ticksMetric, 15*time.Minute)),
+		httpmock.NewStringResponder(500, ""))
+	httpmock.RegisterResponder("GET", metricsQueryURL("downAddress", victoriaMetricsDialect.allocSecondsQuery(rssMetric, 15*time.Minute)),
+		httpmock.NewStringResponder(500, ""))
+
+	// Samples are taken every minute, alloc_id3 stopped before the window began
+	cluster := &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}
+	actualCPU, actualMemory, actualTicks, actualRSS, actualSource := aggLifetime(context.Background(), cluster, "batchJob", "batchJob", jobSpecOf(cluster, "batchJob"), listAllocs(cluster, "batchJob"), windowEnd, 15*time.Minute)
+	assert.Equal(t, 100*300.0+150*300.0, actualCPU)
+	assert.Equal(t, 200*300.0+300*300.0, actualMemory)
+	assert.Equal(t, 550*60.0, actualTicks)
+	assert.InDelta(t, 550*60.0, actualRSS, 1e-6)
+	assert.Equal(t, fromMetrics, actualSource)
+
+	// Nomad keeps no history and an unreachable metrics server has none to give, used resource-seconds are missing
+	for _, cluster := range []*NomadCluster{
+		{Address: "clusterAddress"},
+		{Address: "clusterAddress", Metrics: newVictoriaMetrics("downAddress")},
+	} {
+		actualCPU, actualMemory, actualTicks, actualRSS, actualSource = aggLifetime(context.Background(), cluster, "batchJob", "batchJob", jobSpecOf(cluster, "batchJob"), listAllocs(cluster, "batchJob"), windowEnd, 15*time.Minute)
+		assert.Equal(t, 100*300.0+150*300.0, actualCPU)
+		assert.Equal(t, 200*300.0+300*300.0, actualMemory)
+		assert.Empty(t, actualTicks)
+		assert.Empty(t, actualRSS)
+		assert.Equal(t, fromMissing, actualSource)
+	}
+
+	actualCPU, actualMemory, actualTicks, actualRSS, actualSource = aggLifetime(context.Background(), cluster, "badJob", "badJob", jobSpecOf(cluster, "badJob"), listAllocs(cluster, "badJob"), windowEnd, 15*time.Minute)
+	assert.Empty(t, actualCPU)
+	assert.Empty(t, actualMemory)
+	assert.Empty(t, actualTicks)
+	assert.Empty(t, actualRSS)
+	assert.Equal(t, fromNone, actualSource)
+}
+
+func TestReachClusterBatch(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/jobs",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "etl",
+					"Name": "etl",
+					"Type": "batch",
+					"Periodic": true,
+					"JobSummary": {
+						"Namespace": "default"
+					}
+				},
+				{
+					"ID": "etl/periodic-1",
+					"ParentID": "etl",
+					"Name": "etl/periodic-1",
+					"Type": "batch",
+					"JobSummary": {
+						"Namespace": "default"
+					}
+				},
+				{
+					"ID": "etl/periodic-2",
+					"ParentID": "etl",
+					"Name": "etl/periodic-2",
+					"Type": "batch",
+					"JobSummary": {
+						"Namespace": "default"
+					}
+				}
+			]`,
+		),
+	)
+	// The cycle was scheduled a little before it ran, allocations started a minute before it was scheduled
+	scheduled := time.Now().Add(-30 * time.Second)
+	createTime := scheduled.Add(-time.Minute).UnixNano()
+	for _, jobID := range []string{"etl/periodic-1", "etl/periodic-2"} {
+		httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/"+jobID,
+			httpmock.NewStringResponder(200, `
+				{
+					"TaskGroups": [
+						{
+							"Name": "TaskGroup1",
+							"Count": 1,
+							"Tasks": [
+								{
+									"Name": "task1",
+									"Resources": {
+										"CPU": 100,
+										"MemoryMB": 200
+									}
+								}
+							]
+						}
+					]
+				}`,
+			),
+		)
+		httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/"+jobID+"/allocations",
+			httpmock.NewStringResponder(200, fmt.Sprintf(`
+				[
+					{
+						"ID": "alloc-%s",
+						"TaskGroup": "TaskGroup1",
+						"ClientStatus": "running",
+						"CreateTime": %d
+					},
+					{
+						"ID": "alloc-%s-done",
+						"TaskGroup": "TaskGroup1",
+						"ClientStatus": "complete",
+						"CreateTime": %d,
+						"ModifyTime": %d
+					}
+				]`, jobID, createTime, jobID, createTime, createTime),
+			),
+		)
+	}
+
+	wg.Add(1)
+	c := make(chan ClusterJobs, 1)
+	reachCluster(withScheduled(context.Background(), scheduled), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, c)
+	wg.Wait()
+	close(c)
+
+	actualJobs := (<-c).Jobs
+	assert.Equal(t, 1, len(actualJobs))
+	assert.Equal(t, "etl", actualJobs[0].JobID)
+	assert.Equal(t, "etl", actualJobs[0].Name)
+	assert.Equal(t, "batch", actualJobs[0].Type)
+	assert.Equal(t, 200.0, actualJobs[0].RCPU)
+	assert.Equal(t, 400.0, actualJobs[0].RMemoryMB)
+	assert.InDelta(t, 2*100*60.0, actualJobs[0].RCPUSeconds, 1e-6)
+	assert.InDelta(t, 2*200*60.0, actualJobs[0].RMemoryMBSeconds, 1e-6)
+}
+
+func TestAggTasks(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 2,
+						"Tasks": [
+							{
+								"Name": "web",
+								"Resources": {
+									"CPU": 500,
+									"MemoryMB": 1024
+								}
+							},
+							{
+								"Name": "sidecar",
+								"Resources": {
+									"CPU": 100,
+									"MemoryMB": 64
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+	for metric, values := range map[string][2]string{
+		rssMetric:   {"104900000", "10490000"},
+		cacheMetric: {"10490000", "0"},
+		ticksMetric: {"250.5", "20"},
+	} {
+		httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.taskQuery(metric)),
+			httpmock.NewStringResponder(200, `
+				{
+					"status": "success",
+					"data": {
+						"resultType": "vector",
+						"result": [
+							{
+								"metric": {
+									"job": "jobName",
+									"task_group": "TaskGroup1",
+									"task": "web"
+								},
+								"value": [
+									1597365496,
+									"`+values[0]+`"
+								]
+							},
+							{
+								"metric": {
+									"job": "jobName",
+									"task_group": "TaskGroup1",
+									"task": "sidecar"
+								},
+								"value": [
+									1597365496,
+									"`+values[1]+`"
+								]
+							},
+							{
+								"metric": {
+									"job": "otherJob",
+									"task_group": "TaskGroup1",
+									"task": "web"
+								},
+								"value": [
+									1597365496,
+									"999"
+								]
+							}
+						]
+					}
+				}`,
+			),
+		)
+	}
+
+	expectedTasks := []TaskData{
+		{"TaskGroup1", "web", 2, 1000, 2048, 250.5, 100, 10},
+		{"TaskGroup1", "sidecar", 2, 200, 128, 20, 10, 0},
+	}
+	tasksCluster := &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}
+	jobSpec, mapTaskGroupCount := jobInputs(tasksCluster, "jobID", "service")
+	actualTasks := aggTasks(context.Background(), tasksCluster, "jobID", "jobName", jobSpec, mapTaskGroupCount, listAllocs(tasksCluster, "jobID"))
+	assert.Equal(t, expectedTasks, actualTasks)
+
+	// Fall back to Nomad allocation stats
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID/allocations",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "alloc_id1",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id2",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "complete"
+				}
+			]`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/client/allocation/alloc_id1/stats",
+		httpmock.NewStringResponder(200, `
+			{
+				"Tasks": {
+					"web": {
+						"ResourceUsage": {
+							"MemoryStats": {
+								"RSS": 104900000,
+								"Cache": 0
+							},
+							"CpuStats": {
+								"TotalTicks": 300
+							}
+						}
+					}
+				}
+			}`,
+		),
+	)
+	expectedTasks = []TaskData{
+		{"TaskGroup1", "web", 2, 1000, 2048, 300, 100, 0},
+		{"TaskGroup1", "sidecar", 2, 200, 128, 0, 0, 0},
+	}
+	tasksCluster = &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("badAddress")}
+	jobSpec, mapTaskGroupCount = jobInputs(tasksCluster, "jobID", "service")
+	actualTasks = aggTasks(context.Background(), tasksCluster, "jobID", "jobName", jobSpec, mapTaskGroupCount, listAllocs(tasksCluster, "jobID"))
+	assert.Equal(t, expectedTasks, actualTasks)
+
+	tasksCluster = &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}
+	jobSpec, mapTaskGroupCount = jobInputs(tasksCluster, "jobID", "service")
+	actualTasks = aggTasks(context.Background(), tasksCluster, "jobID", "jobName", jobSpec, mapTaskGroupCount, listAllocs(tasksCluster, "jobID"))
+	assert.Empty(t, actualTasks)
+}
+
+func TestAggAllocs(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 2,
+						"Tasks": [
+							{
+								"Name": "web",
+								"Resources": {
+									"CPU": 500,
+									"MemoryMB": 1024
+								}
+							},
+							{
+								"Name": "sidecar",
+								"Resources": {
+									"CPU": 100,
+									"MemoryMB": 64
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID/allocations",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "alloc_id1",
+					"NodeID": "node_id1",
+					"NodeName": "node1",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id2",
+					"NodeID": "node_id2",
+					"NodeName": "node2",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id3",
+					"NodeID": "node_id2",
+					"NodeName": "node2",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "failed"
+				}
+			]`,
+		),
+	)
+	for metric, value := range map[string]string{
+		rssMetric:   "104900000",
+		cacheMetric: "10490000",
+		ticksMetric: "250.5",
+	} {
+		httpmock.RegisterResponder("GET", metricsQueryURL("metricsAddress", victoriaMetricsDialect.allocQuery(metric)),
+			httpmock.NewStringResponder(200, `
+				{
+					"status": "success",
+					"data": {
+						"resultType": "vector",
+						"result": [
+							{
+								"metric": {
+									"alloc_id": "alloc_id1"
+								},
+								"value": [
+									1597365496,
+									"`+value+`"
+								]
+							}
+						]
+					}
+				}`,
+			),
+		)
+	}
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/client/allocation/alloc_id2/stats",
+		httpmock.NewStringResponder(200, `
+			{
+				"ResourceUsage": {
+					"MemoryStats": {
+						"RSS": 20980000,
+						"Cache": 0
+					},
+					"CpuStats": {
+						"TotalTicks": 42
+					}
+				}
+			}`,
+		),
+	)
+
+	expectedAllocs := []AllocData{
+		{"alloc_id1", "node_id1", "node1", "TaskGroup1", "running", 600, 1088, 250.5, 100, 10},
+		{"alloc_id2", "node_id2", "node2", "TaskGroup1", "running", 600, 1088, 42, 20, 0},
+	}
+	actualAllocs := aggAllocs(context.Background(), &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", jobSpecOf(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), listAllocs(&NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"))
+	assert.Equal(t, expectedAllocs, actualAllocs)
+
+	actualAllocs = aggAllocs(context.Background(), &NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID", "jobName", jobSpecOf(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"), listAllocs(&NomadCluster{Address: "badAddress", Metrics: newVictoriaMetrics("metricsAddress")}, "jobID"))
+	assert.Empty(t, actualAllocs)
+}
+
+func TestAllocStatsFallback(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://statsAddress/v1/job/jobID",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 2,
+						"Tasks": [
+							{
+								"Name": "web",
+								"Resources": {
+									"CPU": 500,
+									"MemoryMB": 1024
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://statsAddress/v1/job/jobID/allocations",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "alloc_id1",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id2",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				}
+			]`,
+		),
+	)
+	for _, allocID := range []string{"alloc_id1", "alloc_id2"} {
+		httpmock.RegisterResponder("GET", "http://statsAddress/v1/client/allocation/"+allocID+"/stats",
+			httpmock.NewStringResponder(200, `
+				{
+					"ResourceUsage": {
+						"MemoryStats": {
+							"RSS": 104900000,
+							"Cache": 0
+						},
+						"CpuStats": {
+							"TotalTicks": 100
+						}
+					},
+					"Tasks": {
+						"web": {
+							"ResourceUsage": {
+								"MemoryStats": {
+									"RSS": 104900000,
+									"Cache": 0
+								},
+								"CpuStats": {
+									"TotalTicks": 100
+								}
+							}
+						}
+					}
+				}`,
+			),
+		)
+	}
+
+	saved := breakers
+	breakers = make(map[string]*CircuitBreaker)
+	defer func() { breakers = saved }()
+
+	// With the metrics server down every consumer falls back to the same stats, read once per allocation
+	cluster := &NomadCluster{Name: "statsCluster", Address: "statsAddress", Metrics: newVictoriaMetrics("badMetricsAddress")}
+	jobSpec, mapTaskGroupCount := jobInputs(cluster, "jobID", "service")
+	allocs := listAllocs(cluster, "jobID")
+	httpmock.ZeroCallCounters()
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+	rss, ticks, _, _ := aggUsed(ctx, cluster, "jobID", "jobName", allocs)
+	tasks := aggTasks(ctx, cluster, "jobID", "jobName", jobSpec, mapTaskGroupCount, allocs)
+	allocData := aggAllocs(ctx, cluster, "jobID", "jobName", jobSpec, allocs)
+	assert.Equal(t, 200.0, rss)
+	assert.Equal(t, 200.0, ticks)
+	assert.Equal(t, 200.0, tasks[0].URSS)
+	assert.Equal(t, 100.0, allocData[1].UTicks)
+	calls := httpmock.GetCallCountInfo()
+	assert.Equal(t, 1, calls["GET http://statsAddress/v1/client/allocation/alloc_id1/stats"])
+	assert.Equal(t, 1, calls["GET http://statsAddress/v1/client/allocation/alloc_id2/stats"])
+
+	// No fallback reads allocation stats while the breaker of the cluster's Nomad servers is open
+	threshold := breakerThreshold
+	breakerThreshold = 1
+	defer func() { breakerThreshold = threshold }()
+	getBreaker(cluster.upstream()).failure()
+	httpmock.ZeroCallCounters()
+	ctx = withMetricsCache(context.Background(), newMetricsCache())
+	rss, _, _, _ = aggUsed(ctx, cluster, "jobID", "jobName", allocs)
+	tasks = aggTasks(ctx, cluster, "jobID", "jobName", jobSpec, mapTaskGroupCount, allocs)
+	allocData = aggAllocs(ctx, cluster, "jobID", "jobName", jobSpec, allocs)
+	assert.Equal(t, 0.0, rss)
+	assert.Equal(t, 0.0, tasks[0].URSS)
+	assert.Equal(t, 0.0, allocData[0].URSS)
+	calls = httpmock.GetCallCountInfo()
+	assert.Equal(t, 0, calls["GET http://statsAddress/v1/client/allocation/alloc_id1/stats"])
+	assert.Equal(t, 0, calls["GET http://statsAddress/v1/client/allocation/alloc_id2/stats"])
+}
+
+func TestAggNetworks(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 3,
+						"Networks": [
+							{
+								"MBits": 10,
+								"ReservedPorts": [
+									{
+										"Label": "http",
+										"Value": 8080
+									}
+								],
+								"DynamicPorts": [
+									{
+										"Label": "rpc"
+									},
+									{
+										"Label": "metrics"
+									}
+								]
+							}
+						],
+						"Tasks": [
+							{
+								"Name": "web",
+								"Resources": {
+									"CPU": 500,
+									"MemoryMB": 1024,
+									"Networks": [
+										{
+											"MBits": 100,
+											"DynamicPorts": [
+												{
+													"Label": "admin"
+												}
+											]
+										}
+									]
+								}
+							}
+						]
+					},
+					{
+						"Name": "TaskGroup2",
+						"Count": 1,
+						"Tasks": [
+							{
+								"Name": "worker",
+								"Resources": {
+									"CPU": 100,
+									"MemoryMB": 64
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+
+	mbits, reservedPorts, dynamicPorts := aggNetworks(jobInputs(&NomadCluster{Address: "clusterAddress"}, "jobID", "service"))
+	assert.Equal(t, 330.0, mbits)
+	assert.Equal(t, 3.0, reservedPorts)
+	assert.Equal(t, 9.0, dynamicPorts)
+
+	mbits, reservedPorts, dynamicPorts = aggNetworks(jobInputs(&NomadCluster{Address: "badAddress"}, "jobID", "service"))
+	assert.Equal(t, 0.0, mbits)
+	assert.Equal(t, 0.0, reservedPorts)
+	assert.Equal(t, 0.0, dynamicPorts)
+}
+
+func TestGetDeviceRequests(t *testing.T) {
+	data, err := ioutil.ReadFile("devices_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jobSpec JobSpec
+	err = json.Unmarshal(data, &jobSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedDevices := []DeviceData{
+		{"nvidia/gpu", "${device.attr.memory} >= 11 GiB", 6},
+		{"xilinx/fpga", "", 2},
+		{"nvidia/gpu", "", 1},
+	}
+	actualDevices := getDeviceRequests(jobSpec, map[string]float64{"trainer": 2, "inference": 1})
+	assert.Equal(t, expectedDevices, actualDevices)
+
+	assert.Empty(t, getDeviceRequests(jobSpec, map[string]float64{}))
+	assert.Empty(t, getDeviceRequests(JobSpec{}, nil))
+}
+
+func TestAggDevices(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	data, err := ioutil.ReadFile("devices_test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/ml-training",
+		httpmock.NewBytesResponder(200, data),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/ml-training/allocations",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "alloc_id1",
+					"TaskGroup": "trainer",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id2",
+					"TaskGroup": "trainer",
+					"ClientStatus": "complete"
+				}
+			]`,
+		),
+	)
+
+	expectedDevices := []DeviceData{
+		{"nvidia/gpu", "${device.attr.memory} >= 11 GiB", 3},
+		{"xilinx/fpga", "", 1},
+	}
+	actualDevices := getDeviceRequests(jobInputs(&NomadCluster{Address: "clusterAddress"}, "ml-training", "batch"))
+	assert.Equal(t, expectedDevices, actualDevices)
+
+	assert.Empty(t, getDeviceRequests(jobInputs(&NomadCluster{Address: "badAddress"}, "ml-training", "batch")))
+}
+
+func TestAggLimits(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "jobID",
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 2,
+						"Tasks": [
+							{
+								"Name": "web",
+								"Resources": {
+									"Cores": 2,
+									"MemoryMB": 1024,
+									"MemoryMaxMB": 2048
+								}
+							},
+							{
+								"Name": "sidecar",
+								"Resources": {
+									"CPU": 100,
+									"MemoryMB": 64
+								}
+							}
+						]
+					}
+				]
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/jobID/allocations",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "alloc_id1",
+					"NodeID": "node_id1",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id2",
+					"NodeID": "node_id2",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "running"
+				},
+				{
+					"ID": "alloc_id3",
+					"NodeID": "node_id1",
+					"TaskGroup": "TaskGroup1",
+					"ClientStatus": "complete"
+				}
+			]`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id1",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "node_id1",
+				"Attributes": {
+					"cpu.frequency": "2500"
+				}
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id2",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "node_id2",
+				"NodeResources": {
+					"Cpu": {
+						"CpuShares": 24000,
+						"TotalCpuCores": 8
+					}
+				}
+			}`,
+		),
+	)
+
+	limitsCluster := &NomadCluster{Address: "clusterAddress"}
+	jobSpec, mapTaskGroupCount := jobInputs(limitsCluster, "jobID", "service")
+	memoryMaxMB, cores, coresMHz := aggLimits(context.Background(), limitsCluster, jobSpec, mapTaskGroupCount, listAllocs(limitsCluster, "jobID"))
+	assert.Equal(t, 4224.0, memoryMaxMB)
+	assert.Equal(t, 4.0, cores)
+	assert.Equal(t, 11000.0, coresMHz)
+
+	limitsCluster = &NomadCluster{Address: "badAddress"}
+	jobSpec, mapTaskGroupCount = jobInputs(limitsCluster, "jobID", "service")
+	memoryMaxMB, cores, coresMHz = aggLimits(context.Background(), limitsCluster, jobSpec, mapTaskGroupCount, listAllocs(limitsCluster, "jobID"))
+	assert.Equal(t, 0.0, memoryMaxMB)
+	assert.Equal(t, 0.0, cores)
+	assert.Equal(t, 0.0, coresMHz)
+}
+
+func TestWasteMemory(t *testing.T) {
+	// web is oversubscribed up to its memory_max, which leaves the memory sidecar does not use wasted
+	tasks := []TaskData{
+		{TaskGroup: "TaskGroup1", Task: "web", Count: 1, RMemoryMB: 256, URSS: 512},
+		{TaskGroup: "TaskGroup1", Task: "sidecar", Count: 1, RMemoryMB: 512, URSS: 100},
+	}
+	assert.Equal(t, 412.0, wasteMemory(768, 612, tasks))
+	assert.Equal(t, 0.0, wasteMemory(256, 512, tasks[:1]))
+
+	// Without a task breakdown the job is compared as a whole
+	assert.Equal(t, 156.0, wasteMemory(768, 612, nil))
+	assert.Equal(t, 0.0, wasteMemory(256, 512, nil))
+}
+
+func TestReachNamespaceWorkers(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	var inFlight, maxInFlight int32
+	var jobs []JobDesc
+	for i := 1; i <= 8; i++ {
+		jobID := fmt.Sprintf("jobID%d", i)
+		jobs = append(jobs, JobDesc{ID: jobID, Name: jobID, Type: "service"})
+
+		spec := fmt.Sprintf(`
+			{
+				"TaskGroups": [
+					{
+						"Name": "TaskGroup1",
+						"Count": 1,
+						"Tasks": [
+							{
+								"Name": "task1",
+								"Resources": {
+									"CPU": %d,
+									"MemoryMB": 100
+								}
+							}
+						]
+					}
+				]
+			}`, i*100)
+		httpmock.RegisterResponder("GET", "http://clusterAddress/v1/job/"+jobID,
+			func(req *http.Request) (*http.Response, error) {
+				current := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					peak := atomic.LoadInt32(&maxInFlight)
+					if current <= peak || atomic.CompareAndSwapInt32(&maxInFlight, peak, current) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				return httpmock.NewStringResponse(200, spec), nil
+			},
+		)
+	}
+	jobs = append(jobs, JobDesc{ID: "jobID9", Name: "jobID9", Type: "unsupported"})
+
+	slots := jobSlots
+	jobSlots = make(chan struct{}, 2)
+	defer func() { jobSlots = slots }()
+
+	actualJobs := reachNamespace(context.Background(), &NomadCluster{Address: "clusterAddress", Workers: 4, Metrics: newVictoriaMetrics("metricsAddress")}, jobs)
+	assert.Equal(t, 8, len(actualJobs))
+	for i, job := range actualJobs {
+		assert.Equal(t, fmt.Sprintf("jobID%d", i+1), job.JobID)
+		assert.Equal(t, float64((i+1)*100), job.RCPU)
+	}
+	assert.True(t, atomic.LoadInt32(&maxInFlight) <= 2)
+	assert.True(t, atomic.LoadInt32(&maxInFlight) >= 1)
+}
+func TestReachClusterTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	wg.Add(1)
+	c := make(chan ClusterJobs, 1)
+	reachCluster(ctx, &NomadCluster{Name: "cluster1", Address: strings.TrimPrefix(server.URL, "http://"), Metrics: newVictoriaMetrics("metricsAddress")}, c)
+	wg.Wait()
+
+	actual := <-c
+	assert.Equal(t, "cluster1", actual.Cluster)
+	assert.Empty(t, actual.Jobs)
+	assert.True(t, actual.TimedOut)
+}
+
+func TestReachJobCancelled(t *testing.T) {
+	slots := jobSlots
+	jobSlots = make(chan struct{}, 1)
+	jobSlots <- struct{}{}
+	defer func() { jobSlots = slots }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	actual := reachJob(ctx, &NomadCluster{Address: "clusterAddress", Metrics: newVictoriaMetrics("metricsAddress")}, JobDesc{ID: "jobID", Name: "jobID", Type: "service"})
+	assert.Nil(t, actual)
+}
+
+// listAllocs lists the allocations of a job like reachJob, nil when they cannot be listed
+func listAllocs(cluster *NomadCluster, jobID string) []Alloc {
+	allocs, err := getAllocs(context.Background(), cluster, jobID)
+	if err != nil {
+		return nil
+	}
+	return allocs
+}
+
+func listAllocIDs(cluster *NomadCluster, jobID string) map[string]struct{} {
+	return allocIDs(listAllocs(cluster, jobID))
+}
+
+func jobSpecOf(cluster *NomadCluster, jobID string) JobSpec {
+	jobSpec, _ := getJobSpec(context.Background(), cluster, jobID)
+	return jobSpec
+}
+
+// jobInputs reads the spec and task group counts of a job like reachJob
+func jobInputs(cluster *NomadCluster, jobID, jobType string) (JobSpec, map[string]float64) {
+	jobSpec := jobSpecOf(cluster, jobID)
+	return jobSpec, getTaskGroupCounts(jobType, jobSpec, listAllocs(cluster, jobID))
+}
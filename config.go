@@ -18,28 +18,94 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type ConfigFile struct {
 	VictoriaMetrics Server
 	Nomad           []Server
+	MaxWorkers      int
+	Retry           RetryConfig
+	CircuitBreaker  BreakerConfig
+	Schedule        ScheduleConfig
+}
+
+// ScheduleConfig sets when aggregation cycles start. Cron is a five field cron expression evaluated in local time,
+// without which cycles start at every multiple of --aggregate-frequency. Overrun is skip (default) or queue.
+type ScheduleConfig struct {
+	Cron    string
+	Overrun string
+}
+
+// RetryConfig configures the retries of failed GET requests, durations use time.ParseDuration syntax
+type RetryConfig struct {
+	Attempts  int
+	BaseDelay string
+	MaxDelay  string
+}
+
+// BreakerConfig configures the circuit breaker of every upstream, a negative FailureThreshold disables breakers
+type BreakerConfig struct {
+	FailureThreshold int
+	Cooldown         string
 }
 
 type Server struct {
-	URL  string
-	Port string
+	Name              string
+	URL               string
+	Port              string
+	Token             string
+	CACert            string
+	ClientCert        string
+	ClientKey         string
+	TLSServerName     string
+	Namespaces        []string
+	ExcludeNamespaces []string
+	DiscoverRegions   bool
+	Workers           int
+	StatsWorkers      int
+	EventStream       bool
+	Metrics           MetricsConfig
+}
+
+// MetricsConfig chooses where the used resources of a Nomad cluster are read from, one of victoriametrics (default),
+// prometheus or nomad to read the allocation stats of Nomad clients alone.
+// URL and Port default to those of the VictoriaMetrics server, without which clusters default to nomad.
+// Labels select the series of the cluster on a metrics server shared with other clusters, e.g. {"cluster": "east"}.
+type MetricsConfig struct {
+	Source string
+	URL    string
+	Port   string
+	Labels map[string]string
 }
 
 var (
-	nomadAddresses []string
+	nomadClusters  []*NomadCluster
 	metricsAddress string
+
+	// jobSlots bounds the number of jobs collected at once across all clusters, nil when unbounded
+	jobSlots chan struct{}
+
+	// cycleSchedule tells when aggregation cycles start and overrunPolicy what happens when one overruns the next,
+	// both replaced on reload under scheduleLock
+	cycleSchedule Schedule = everySchedule{15 * time.Minute}
+	overrunPolicy          = overrunSkip
+	scheduleLock  sync.Mutex
 )
 
+// loadConfig reads the config file at path and applies it once every section and server is valid,
+// so that a bad config leaves the running one alone
 func loadConfig(path string) error {
-	nomadAddresses = []string{}
-
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
@@ -50,11 +116,315 @@ func loadConfig(path string) error {
 		return err
 	}
 
-	metricsAddress = config.VictoriaMetrics.URL + ":" + config.VictoriaMetrics.Port
+	address := ""
+	if config.VictoriaMetrics.URL != "" {
+		address = config.VictoriaMetrics.URL + ":" + config.VictoriaMetrics.Port
+	}
 
+	retry, err := parseRetryConfig(config.Retry, config.CircuitBreaker)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := parseScheduleConfig(config.Schedule)
+	if err != nil {
+		return err
+	}
+
+	clusters := []*NomadCluster{}
 	for _, server := range config.Nomad {
-		nomadAddresses = append(nomadAddresses, server.URL+":"+server.Port)
+		cluster, err := newNomadCluster(server, address)
+		if err != nil {
+			return fmt.Errorf("Error in configuring Nomad cluster %s:%s: %v", server.URL, server.Port, err)
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	var slots chan struct{}
+	if config.MaxWorkers > 0 {
+		slots = make(chan struct{}, config.MaxWorkers)
+	}
+
+	metricsAddress = address
+	jobSlots = slots
+	retry.apply()
+	schedule.apply()
+	nomadClusters = clusters
+	for _, cluster := range nomadClusters {
+		if _, ok := cluster.Metrics.(NomadOnly); ok {
+			log.Info(fmt.Sprintf("Reading used resources of %s from Nomad alone", cluster.Name))
+		}
 	}
+	warnSharedMetrics(nomadClusters)
 
 	return nil
 }
+
+// warnSharedMetrics warns about clusters reading the same series from a metrics server, whose jobs of the same name
+// and namespace would be summed together
+func warnSharedMetrics(clusters []*NomadCluster) {
+	log.SetReportCaller(true)
+
+	readers := make(map[string]string)
+	for _, cluster := range clusters {
+		var source promQLSource
+		switch metrics := cluster.Metrics.(type) {
+		case VictoriaMetrics:
+			source = metrics.promQLSource
+		case Prometheus:
+			source = metrics.promQLSource
+		default:
+			continue
+		}
+
+		series := source.Address + source.Dialect.Selector
+		if other, ok := readers[series]; ok {
+			log.Warning(fmt.Sprintf("Clusters %s and %s read the same series from %s, set Metrics.Labels to tell their jobs apart", other, cluster.Name, source.Address))
+			continue
+		}
+		readers[series] = cluster.Name
+	}
+}
+
+// retrySettings is a validated retry policy and breaker thresholds, applied once the whole config is valid
+type retrySettings struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	threshold int
+	cooldown  time.Duration
+}
+
+// parseRetryConfig validates the retry policy and breaker thresholds of every upstream, defaulting to 3 attempts
+// backing off from 100ms up to 2s, and breakers opening for 30s after 5 consecutive failures
+func parseRetryConfig(retry RetryConfig, breaker BreakerConfig) (retrySettings, error) {
+	var settings retrySettings
+
+	baseDelay, err := parseDuration(retry.BaseDelay, 100*time.Millisecond)
+	if err != nil {
+		return settings, fmt.Errorf("Error in parsing Retry.BaseDelay: %v", err)
+	}
+	maxDelay, err := parseDuration(retry.MaxDelay, 2*time.Second)
+	if err != nil {
+		return settings, fmt.Errorf("Error in parsing Retry.MaxDelay: %v", err)
+	}
+	cooldown, err := parseDuration(breaker.Cooldown, 30*time.Second)
+	if err != nil {
+		return settings, fmt.Errorf("Error in parsing CircuitBreaker.Cooldown: %v", err)
+	}
+
+	settings.attempts = retry.Attempts
+	if settings.attempts == 0 {
+		settings.attempts = 3
+	}
+	settings.baseDelay = baseDelay
+	settings.maxDelay = maxDelay
+
+	settings.threshold = breaker.FailureThreshold
+	if settings.threshold == 0 {
+		settings.threshold = 5
+	} else if settings.threshold < 0 {
+		settings.threshold = 0
+	}
+	settings.cooldown = cooldown
+
+	return settings, nil
+}
+
+// apply sets the retry policy and breaker thresholds of every upstream
+func (s retrySettings) apply() {
+	retryAttempts = s.attempts
+	retryBaseDelay = s.baseDelay
+	retryMaxDelay = s.maxDelay
+	breakerThreshold = s.threshold
+	breakerCooldown = s.cooldown
+}
+
+// scheduleSettings is a validated schedule and overrun policy, applied once the whole config is valid
+type scheduleSettings struct {
+	schedule Schedule
+	overrun  string
+}
+
+// parseScheduleConfig validates when aggregation cycles start, defaulting to every multiple of the collection window
+// and skipping the cycles an aggregation cycle overruns
+func parseScheduleConfig(config ScheduleConfig) (scheduleSettings, error) {
+	var settings scheduleSettings
+
+	var schedule Schedule = everySchedule{collectionWindow}
+	if config.Cron != "" {
+		cron, err := parseCron(config.Cron)
+		if err != nil {
+			return settings, err
+		}
+		if cron.next(time.Now()).IsZero() {
+			return settings, fmt.Errorf("Cron expression %q never matches", config.Cron)
+		}
+		schedule = cron
+	}
+
+	overrun := config.Overrun
+	switch overrun {
+	case "":
+		overrun = overrunSkip
+	case overrunSkip, overrunQueue:
+	default:
+		return settings, fmt.Errorf("Unknown overrun policy %s, must be one of skip or queue", overrun)
+	}
+
+	return scheduleSettings{schedule, overrun}, nil
+}
+
+// apply sets when aggregation cycles start and what happens when one overruns the next
+func (s scheduleSettings) apply() {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	cycleSchedule = s.schedule
+	overrunPolicy = s.overrun
+}
+
+// currentSchedule returns a snapshot of the schedule and overrun policy of aggregation cycles
+func currentSchedule() scheduleSettings {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	return scheduleSettings{cycleSchedule, overrunPolicy}
+}
+
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// newMetricsSource returns the source configured by config, reading from the VictoriaMetrics server at
+// metricsAddress unless config sets its own URL
+func newMetricsSource(config MetricsConfig, metricsAddress string) (MetricsSource, error) {
+	address := metricsAddress
+	if config.URL != "" {
+		address = config.URL + ":" + config.Port
+	}
+
+	switch config.Source {
+	case "":
+		if address == "" {
+			return NomadOnly{}, nil
+		}
+		source := newVictoriaMetrics(address)
+		source.Dialect = source.Dialect.withLabels(config.Labels)
+		return source, nil
+	case "victoriametrics", "prometheus":
+		if address == "" {
+			return nil, fmt.Errorf("Metrics source %s requires a URL", config.Source)
+		}
+		if config.Source == "prometheus" {
+			source := newPrometheus(address)
+			source.Dialect = source.Dialect.withLabels(config.Labels)
+			return source, nil
+		}
+		source := newVictoriaMetrics(address)
+		source.Dialect = source.Dialect.withLabels(config.Labels)
+		return source, nil
+	case "nomad":
+		return NomadOnly{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown metrics source %s, must be one of victoriametrics, prometheus or nomad", config.Source)
+}
+
+// newNomadCluster builds the HTTP client used for every request to a Nomad cluster.
+// Clusters without a configured Name are named after their address, and read their used resources from the
+// VictoriaMetrics server at metricsAddress unless their Metrics say otherwise.
+// TLS is enabled by an https:// URL or when any of CACert, ClientCert, ClientKey or TLSServerName is set,
+// verifying the server against the system CA pool unless CACert is set.
+func newNomadCluster(server Server, metricsAddress string) (*NomadCluster, error) {
+	scheme := ""
+	host := server.URL
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme, host = host[:i], host[i+3:]
+	}
+	tlsSet := server.CACert != "" || server.ClientCert != "" || server.ClientKey != "" || server.TLSServerName != ""
+	switch scheme {
+	case "":
+		scheme = "http"
+		if tlsSet {
+			scheme = "https"
+		}
+	case "https":
+	case "http":
+		if tlsSet {
+			return nil, fmt.Errorf("TLS is configured but URL %s is not https://", server.URL)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown scheme %s in URL %s, must be http or https", scheme, server.URL)
+	}
+	if server.ClientKey != "" && server.ClientCert == "" {
+		return nil, fmt.Errorf("ClientKey %s is set without ClientCert", server.ClientKey)
+	}
+	if server.ClientCert != "" && server.ClientKey == "" {
+		return nil, fmt.Errorf("ClientCert %s is set without ClientKey", server.ClientCert)
+	}
+
+	cluster := &NomadCluster{
+		Name:    server.Name,
+		Address: host + ":" + server.Port,
+		Scheme:  "http",
+		Token:   server.Token,
+		Client:  nomadClient,
+
+		IncludeNamespaces: server.Namespaces,
+		ExcludeNamespaces: server.ExcludeNamespaces,
+		DiscoverRegions:   server.DiscoverRegions,
+		Workers:           server.Workers,
+		StatsWorkers:      server.StatsWorkers,
+		EventStream:       server.EventStream,
+	}
+
+	if cluster.Name == "" {
+		cluster.Name = cluster.Address
+	}
+
+	metrics, err := newMetricsSource(server.Metrics, metricsAddress)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Metrics = metrics
+
+	if scheme == "http" {
+		return cluster, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: server.TLSServerName,
+	}
+
+	if server.CACert != "" {
+		pem, err := ioutil.ReadFile(server.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error in reading CA cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificates found in %s", server.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if server.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(server.ClientCert, server.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error in loading client cert/key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	cluster.Scheme = "https"
+	cluster.Client = &http.Client{Transport: transport}
+
+	return cluster, nil
+}
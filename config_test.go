@@ -18,25 +18,232 @@ limitations under the License.
 package main
 
 import (
+	"io/ioutil"
+	"net/http"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestLoadConfig(t *testing.T) {
+	clusters := nomadClusters
+	defer func() {
+		retryAttempts, retryBaseDelay, retryMaxDelay = 0, 100*time.Millisecond, 2*time.Second
+		breakerThreshold, breakerCooldown = 0, 30*time.Second
+		metricsAddress, jobSlots = "", nil
+		cycleSchedule, overrunPolicy = everySchedule{15 * time.Minute}, overrunSkip
+		nomadClusters = clusters
+	}()
+	nomadClusters = nil
+
 	err := loadConfig("NOPATH")
 	assert.Error(t, err)
-	assert.Empty(t, nomadAddresses)
+	assert.Empty(t, nomadClusters)
 	assert.Empty(t, metricsAddress)
 
 	err = loadConfig("config_test.json")
 	assert.Empty(t, err)
-	assert.IsType(t, []string{}, nomadAddresses)
-	assert.Equal(t, 2, len(nomadAddresses))
-	assert.IsType(t, "", nomadAddresses[0])
-	assert.Equal(t, "NomadURL0:NomadPort0", nomadAddresses[0])
-	assert.IsType(t, "", nomadAddresses[1])
-	assert.Equal(t, "NomadURL1:NomadPort1", nomadAddresses[1])
+	assert.IsType(t, []*NomadCluster{}, nomadClusters)
+	assert.Equal(t, 2, len(nomadClusters))
+	assert.Equal(t, "NomadURL0:NomadPort0", nomadClusters[0].Address)
+	assert.Equal(t, "NomadURL0:NomadPort0", nomadClusters[0].Name)
+	assert.Equal(t, "http", nomadClusters[0].Scheme)
+	assert.Equal(t, "", nomadClusters[0].Token)
+	assert.Equal(t, "NomadURL1:NomadPort1", nomadClusters[1].Address)
+	assert.Equal(t, "nomad1", nomadClusters[1].Name)
+	assert.Equal(t, "https", nomadClusters[1].Scheme)
+	assert.Equal(t, "NomadToken1", nomadClusters[1].Token)
+	assert.Empty(t, nomadClusters[0].IncludeNamespaces)
+	assert.Equal(t, []string{"default", "batch"}, nomadClusters[1].IncludeNamespaces)
+	assert.Equal(t, []string{"batch"}, nomadClusters[1].ExcludeNamespaces)
+	assert.False(t, nomadClusters[0].DiscoverRegions)
+	assert.True(t, nomadClusters[1].DiscoverRegions)
+	assert.Equal(t, 0, nomadClusters[0].Workers)
+	assert.Equal(t, 8, nomadClusters[1].Workers)
+	assert.Equal(t, 0, nomadClusters[0].StatsWorkers)
+	assert.Equal(t, 16, nomadClusters[1].StatsWorkers)
+	assert.Equal(t, newVictoriaMetrics("VMURL:VMPort"), nomadClusters[0].Metrics)
+	assert.Equal(t, newPrometheus("PromURL:9090"), nomadClusters[1].Metrics)
+	assert.Equal(t, 16, cap(jobSlots))
 	assert.IsType(t, "", metricsAddress)
 	assert.Equal(t, "VMURL:VMPort", metricsAddress)
-}
\ No newline at end of file
+	assert.Equal(t, 4, retryAttempts)
+	assert.Equal(t, 50*time.Millisecond, retryBaseDelay)
+	assert.Equal(t, 2*time.Second, retryMaxDelay)
+	assert.Equal(t, 10, breakerThreshold)
+	assert.Equal(t, 30*time.Second, breakerCooldown)
+	assert.IsType(t, cronSchedule{}, cycleSchedule)
+	assert.Equal(t, overrunQueue, overrunPolicy)
+
+	// A config with a bad server leaves the running one alone
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte(`{"VictoriaMetrics": {"URL": "OtherURL", "Port": "8428"}, "MaxWorkers": 2, "Retry": {"Attempts": 1}, "Schedule": {"Overrun": "skip"},
+		"Nomad": [{"URL": "NomadURL2", "Port": "4646"}, {"URL": "ftp://NomadURL3", "Port": "4646"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	err = loadConfig(file.Name())
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(nomadClusters))
+	assert.Equal(t, "nomad1", nomadClusters[1].Name)
+	assert.Equal(t, "VMURL:VMPort", metricsAddress)
+	assert.Equal(t, 16, cap(jobSlots))
+	assert.Equal(t, 4, retryAttempts)
+	assert.Equal(t, overrunQueue, overrunPolicy)
+}
+
+func TestParseScheduleConfig(t *testing.T) {
+	defer func() {
+		cycleSchedule, overrunPolicy = everySchedule{15 * time.Minute}, overrunSkip
+	}()
+
+	window := collectionWindow
+	collectionWindow = 5 * time.Minute
+	defer func() { collectionWindow = window }()
+
+	schedule, err := parseScheduleConfig(ScheduleConfig{})
+	assert.Empty(t, err)
+	schedule.apply()
+	assert.Equal(t, everySchedule{5 * time.Minute}, cycleSchedule)
+	assert.Equal(t, overrunSkip, overrunPolicy)
+
+	schedule, err = parseScheduleConfig(ScheduleConfig{Cron: "0 * * * *", Overrun: "queue"})
+	assert.Empty(t, err)
+	schedule.apply()
+	assert.Equal(t, time.Date(2020, 7, 7, 18, 0, 0, 0, time.UTC), cycleSchedule.next(time.Date(2020, 7, 7, 17, 34, 53, 0, time.UTC)))
+	assert.Equal(t, overrunQueue, overrunPolicy)
+
+	// An invalid config leaves the applied one alone
+	_, err = parseScheduleConfig(ScheduleConfig{Cron: "0 0 30 2 *"})
+	assert.Error(t, err)
+	_, err = parseScheduleConfig(ScheduleConfig{Cron: "hourly"})
+	assert.Error(t, err)
+	_, err = parseScheduleConfig(ScheduleConfig{Overrun: "wait"})
+	assert.Error(t, err)
+	assert.IsType(t, cronSchedule{}, cycleSchedule)
+	assert.Equal(t, overrunQueue, overrunPolicy)
+}
+
+func TestParseRetryConfig(t *testing.T) {
+	defer func() {
+		retryAttempts, retryBaseDelay, retryMaxDelay = 0, 100*time.Millisecond, 2*time.Second
+		breakerThreshold, breakerCooldown = 0, 30*time.Second
+	}()
+
+	retry, err := parseRetryConfig(RetryConfig{}, BreakerConfig{})
+	assert.Empty(t, err)
+	retry.apply()
+	assert.Equal(t, 3, retryAttempts)
+	assert.Equal(t, 100*time.Millisecond, retryBaseDelay)
+	assert.Equal(t, 5, breakerThreshold)
+
+	retry, err = parseRetryConfig(RetryConfig{Attempts: 1}, BreakerConfig{FailureThreshold: -1, Cooldown: "1m"})
+	assert.Empty(t, err)
+	retry.apply()
+	assert.Equal(t, 1, retryAttempts)
+	assert.Equal(t, 0, breakerThreshold)
+	assert.Equal(t, time.Minute, breakerCooldown)
+
+	// An invalid config leaves the applied one alone
+	_, err = parseRetryConfig(RetryConfig{MaxDelay: "soon"}, BreakerConfig{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, retryAttempts)
+	assert.Equal(t, time.Minute, breakerCooldown)
+}
+
+func TestNewMetricsSource(t *testing.T) {
+	address := "VMURL:VMPort"
+
+	source, err := newMetricsSource(MetricsConfig{}, address)
+	assert.Empty(t, err)
+	assert.Equal(t, newVictoriaMetrics("VMURL:VMPort"), source)
+
+	source, err = newMetricsSource(MetricsConfig{Source: "victoriametrics", URL: "OtherURL", Port: "8428"}, address)
+	assert.Empty(t, err)
+	assert.Equal(t, newVictoriaMetrics("OtherURL:8428"), source)
+
+	source, err = newMetricsSource(MetricsConfig{Source: "prometheus", URL: "PromURL", Port: "9090"}, address)
+	assert.Empty(t, err)
+	assert.Equal(t, newPrometheus("PromURL:9090"), source)
+
+	source, err = newMetricsSource(MetricsConfig{Source: "prometheus", URL: "PromURL", Port: "9090", Labels: map[string]string{"cluster": "east"}}, address)
+	assert.Empty(t, err)
+	assert.Equal(t, "sum by (exported_job, namespace) (nomad_client_allocs_memory_rss{cluster=\"east\"})", source.(Prometheus).Dialect.jobQuery(rssMetric))
+
+	source, err = newMetricsSource(MetricsConfig{Source: "nomad"}, address)
+	assert.Empty(t, err)
+	assert.Equal(t, NomadOnly{}, source)
+
+	address = ""
+	source, err = newMetricsSource(MetricsConfig{}, address)
+	assert.Empty(t, err)
+	assert.Equal(t, NomadOnly{}, source)
+
+	source, err = newMetricsSource(MetricsConfig{Source: "prometheus"}, address)
+	assert.Error(t, err)
+	assert.Nil(t, source)
+
+	source, err = newMetricsSource(MetricsConfig{Source: "graphite"}, address)
+	assert.Error(t, err)
+	assert.Nil(t, source)
+}
+
+func TestNewNomadCluster(t *testing.T) {
+	cluster, err := newNomadCluster(Server{URL: "NomadURL", Port: "4646", Token: "token"}, "")
+	assert.Empty(t, err)
+	assert.Equal(t, "NomadURL:4646", cluster.Address)
+	assert.Equal(t, "http", cluster.Scheme)
+	assert.Equal(t, "token", cluster.Token)
+	assert.NotNil(t, cluster.Client)
+	assert.NotNil(t, cluster.Metrics)
+
+	cluster, err = newNomadCluster(Server{URL: "NomadURL", Port: "4646", CACert: "NOPATH"}, "")
+	assert.Error(t, err)
+	assert.Nil(t, cluster)
+
+	cluster, err = newNomadCluster(Server{URL: "NomadURL", Port: "4646", CACert: "config_test.json"}, "")
+	assert.Error(t, err)
+	assert.Nil(t, cluster)
+
+	cluster, err = newNomadCluster(Server{URL: "NomadURL", Port: "4646", ClientCert: "NOPATH", ClientKey: "NOPATH"}, "")
+	assert.Error(t, err)
+	assert.Nil(t, cluster)
+
+	// An https:// URL alone verifies the server against the system CA pool
+	cluster, err = newNomadCluster(Server{URL: "https://NomadURL", Port: "4646"}, "")
+	assert.Empty(t, err)
+	assert.Equal(t, "NomadURL:4646", cluster.Address)
+	assert.Equal(t, "NomadURL:4646", cluster.Name)
+	assert.Equal(t, "https", cluster.Scheme)
+	transport := cluster.Client.Transport.(*http.Transport)
+	assert.Nil(t, transport.TLSClientConfig.RootCAs)
+	assert.Empty(t, transport.TLSClientConfig.Certificates)
+
+	cluster, err = newNomadCluster(Server{URL: "http://NomadURL", Port: "4646"}, "")
+	assert.Empty(t, err)
+	assert.Equal(t, "NomadURL:4646", cluster.Address)
+	assert.Equal(t, "http", cluster.Scheme)
+
+	cluster, err = newNomadCluster(Server{URL: "NomadURL", Port: "4646", ClientKey: "cli-key.pem"}, "")
+	assert.EqualError(t, err, "ClientKey cli-key.pem is set without ClientCert")
+	assert.Nil(t, cluster)
+
+	cluster, err = newNomadCluster(Server{URL: "NomadURL", Port: "4646", ClientCert: "cli.pem"}, "")
+	assert.EqualError(t, err, "ClientCert cli.pem is set without ClientKey")
+	assert.Nil(t, cluster)
+
+	cluster, err = newNomadCluster(Server{URL: "http://NomadURL", Port: "4646", TLSServerName: "server.global.nomad"}, "")
+	assert.EqualError(t, err, "TLS is configured but URL http://NomadURL is not https://")
+	assert.Nil(t, cluster)
+
+	cluster, err = newNomadCluster(Server{URL: "ftp://NomadURL", Port: "4646"}, "")
+	assert.Error(t, err)
+	assert.Nil(t, cluster)
+}
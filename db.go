@@ -21,6 +21,8 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	_ "github.com/denisenkom/go-mssqldb"
 )
@@ -39,6 +41,188 @@ type JobDataDB struct {
 	DataCenters string
 	CurrentTime string
 	InsertTime  string
+	Region      string
+	Cluster     string
+	Type        string
+
+	RCPUSeconds      float64
+	RMemoryMBSeconds float64
+	UTicksSeconds    float64
+	URSSSeconds      float64
+
+	RMBits         float64
+	RReservedPorts float64
+	RDynamicPorts  float64
+
+	RMemoryMaxMB  float64
+	RCores        float64
+	RCoresMHz     float64
+	WasteCPU      float64
+	WasteMemoryMB float64
+
+	UTicksAvg float64
+	UTicksMax float64
+	UTicksP50 float64
+	UTicksP95 float64
+	UTicksP99 float64
+	URSSAvg   float64
+	URSSMax   float64
+	URSSP50   float64
+	URSSP95   float64
+	URSSP99   float64
+
+	// Where each used metric was read from, one of metrics, nomad, mixed, missing or none,
+	// and the fraction of running allocations measured
+	RSSSource      string
+	CacheSource    string
+	TicksSource    string
+	MeasuredAllocs float64
+	TotalAllocs    float64
+	Completeness   float64
+	// Where UTicksSeconds and URSSSeconds were read from, empty for jobs that are not batch-style
+	SecondsSource string
+	// Where the requested resources were read from, nomad or missing
+	RequestsSource string
+}
+
+// GroupDataDB holds the requested and used resources of a task group along with its tasks
+type GroupDataDB struct {
+	Cluster   string
+	TaskGroup string
+	Count     float64
+	RCPU      float64
+	RMemoryMB float64
+	UTicks    float64
+	URSS      float64
+	UCache    float64
+	Tasks     []TaskData
+}
+
+// AllocDataDB is a recorded allocation along with the job it belongs to
+type AllocDataDB struct {
+	JobID        string
+	Namespace    string
+	Region       string
+	Cluster      string
+	AllocID      string
+	NodeID       string
+	NodeName     string
+	TaskGroup    string
+	ClientStatus string
+	RCPU         float64
+	RMemoryMB    float64
+	UTicks       float64
+	URSS         float64
+	UCache       float64
+	InsertTime   string
+}
+
+// CapacityDataDB is the recorded capacity of a cluster in a collection cycle
+type CapacityDataDB struct {
+	Cluster           string
+	Nodes             int
+	ReadyNodes        int
+	CPU               float64
+	MemoryMB          float64
+	DiskMB            float64
+	ReservedCPU       float64
+	ReservedMemoryMB  float64
+	ReservedDiskMB    float64
+	AllocatedCPU      float64
+	AllocatedMemoryMB float64
+	AllocatedDiskMB   float64
+	UsedCPU           float64
+	UsedMemoryMB      float64
+	InsertTime        string
+}
+
+// DeviceUsageDB is the number of devices of a type requested by all jobs of a namespace in a cluster
+type DeviceUsageDB struct {
+	Cluster   string
+	Namespace string
+	Device    string
+	Count     float64
+}
+
+// AllocFilter restricts allocation queries to rows matching its non-empty fields.
+// Without Begin and End only the latest collection cycle is returned.
+type AllocFilter struct {
+	JobID   string
+	NodeID  string
+	AllocID string
+	Begin   string
+	End     string
+}
+
+// Filter restricts API queries to rows matching its non-empty fields
+type Filter struct {
+	Region  string
+	Cluster string
+}
+
+// addedColumns lists columns added to resources after its initial schema, in order.
+// Existing tables are migrated by appending any missing column.
+var addedColumns = [][2]string{
+	{"region", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"jobType", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"rCPUSeconds", "REAL NOT NULL DEFAULT 0"},
+	{"rMemoryMBSeconds", "REAL NOT NULL DEFAULT 0"},
+	{"uTicksSeconds", "REAL NOT NULL DEFAULT 0"},
+	{"uRSSSeconds", "REAL NOT NULL DEFAULT 0"},
+	{"rMBits", "REAL NOT NULL DEFAULT 0"},
+	{"rReservedPorts", "REAL NOT NULL DEFAULT 0"},
+	{"rDynamicPorts", "REAL NOT NULL DEFAULT 0"},
+	{"rMemoryMaxMB", "REAL NOT NULL DEFAULT 0"},
+	{"rCores", "REAL NOT NULL DEFAULT 0"},
+	{"rCoresMHz", "REAL NOT NULL DEFAULT 0"},
+	{"wasteCPU", "REAL NOT NULL DEFAULT 0"},
+	{"wasteMemoryMB", "REAL NOT NULL DEFAULT 0"},
+	{"cluster", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"uTicksAvg", "REAL NOT NULL DEFAULT 0"},
+	{"uTicksMax", "REAL NOT NULL DEFAULT 0"},
+	{"uTicksP50", "REAL NOT NULL DEFAULT 0"},
+	{"uTicksP95", "REAL NOT NULL DEFAULT 0"},
+	{"uTicksP99", "REAL NOT NULL DEFAULT 0"},
+	{"uRSSAvg", "REAL NOT NULL DEFAULT 0"},
+	{"uRSSMax", "REAL NOT NULL DEFAULT 0"},
+	{"uRSSP50", "REAL NOT NULL DEFAULT 0"},
+	{"uRSSP95", "REAL NOT NULL DEFAULT 0"},
+	{"uRSSP99", "REAL NOT NULL DEFAULT 0"},
+	{"rssSource", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"cacheSource", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"ticksSource", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"measuredAllocs", "REAL NOT NULL DEFAULT 0"},
+	{"totalAllocs", "REAL NOT NULL DEFAULT 0"},
+	{"secondsSource", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"requestsSource", "VARCHAR(255) NOT NULL DEFAULT ''"},
+}
+
+// conditions returns the SQL conditions and arguments matching the filter
+func (f Filter) conditions() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.Region != "" {
+		conditions = append(conditions, "region = ?")
+		args = append(args, f.Region)
+	}
+	if f.Cluster != "" {
+		conditions = append(conditions, "cluster = ?")
+		args = append(args, f.Cluster)
+	}
+
+	return conditions, args
+}
+
+// usageColumns maps each statistic selectable in the job API to the columns reported as used CPU ticks and RSS.
+// The sample taken at collection time is reported by default.
+var usageColumns = map[string][2]string{
+	"":    {"uTicks", "uRSS"},
+	"avg": {"uTicksAvg", "uRSSAvg"},
+	"max": {"uTicksMax", "uRSSMax"},
+	"p50": {"uTicksP50", "uRSSP50"},
+	"p95": {"uTicksP95", "uRSSP95"},
+	"p99": {"uTicksP99", "uRSSP99"},
 }
 
 func initDB() (*sql.DB, *sql.Stmt, error) {
@@ -62,12 +246,197 @@ func initDB() (*sql.DB, *sql.Stmt, error) {
 		namespace VARCHAR(255),
 		dataCenters VARCHAR(255),
 		date DATETIME,
-		insertTime DATETIME);`)
+		insertTime DATETIME,
+		region VARCHAR(255) NOT NULL DEFAULT '',
+		jobType VARCHAR(255) NOT NULL DEFAULT '',
+		rCPUSeconds REAL NOT NULL DEFAULT 0,
+		rMemoryMBSeconds REAL NOT NULL DEFAULT 0,
+		uTicksSeconds REAL NOT NULL DEFAULT 0,
+		uRSSSeconds REAL NOT NULL DEFAULT 0,
+		rMBits REAL NOT NULL DEFAULT 0,
+		rReservedPorts REAL NOT NULL DEFAULT 0,
+		rDynamicPorts REAL NOT NULL DEFAULT 0,
+		rMemoryMaxMB REAL NOT NULL DEFAULT 0,
+		rCores REAL NOT NULL DEFAULT 0,
+		rCoresMHz REAL NOT NULL DEFAULT 0,
+		wasteCPU REAL NOT NULL DEFAULT 0,
+		wasteMemoryMB REAL NOT NULL DEFAULT 0,
+		cluster VARCHAR(255) NOT NULL DEFAULT '',
+		uTicksAvg REAL NOT NULL DEFAULT 0,
+		uTicksMax REAL NOT NULL DEFAULT 0,
+		uTicksP50 REAL NOT NULL DEFAULT 0,
+		uTicksP95 REAL NOT NULL DEFAULT 0,
+		uTicksP99 REAL NOT NULL DEFAULT 0,
+		uRSSAvg REAL NOT NULL DEFAULT 0,
+		uRSSMax REAL NOT NULL DEFAULT 0,
+		uRSSP50 REAL NOT NULL DEFAULT 0,
+		uRSSP95 REAL NOT NULL DEFAULT 0,
+		uRSSP99 REAL NOT NULL DEFAULT 0,
+		rssSource VARCHAR(255) NOT NULL DEFAULT '',
+		cacheSource VARCHAR(255) NOT NULL DEFAULT '',
+		ticksSource VARCHAR(255) NOT NULL DEFAULT '',
+		measuredAllocs REAL NOT NULL DEFAULT 0,
+		totalAllocs REAL NOT NULL DEFAULT 0,
+		secondsSource VARCHAR(255) NOT NULL DEFAULT '',
+		requestsSource VARCHAR(255) NOT NULL DEFAULT '');`)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error in creating DB table: %v", err)
 	}
 	createTable.Exec()
 
+	for _, column := range addedColumns {
+		_, err = db.Exec(fmt.Sprintf("IF COL_LENGTH('resources', '%s') IS NULL ALTER TABLE resources ADD %s %s;", column[0], column[0], column[1]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in adding column %s: %v", column[0], err)
+		}
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='task_resources' and xtype='U')
+		CREATE TABLE task_resources
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		JobID VARCHAR(255),
+		namespace VARCHAR(255),
+		region VARCHAR(255),
+		taskGroup VARCHAR(255),
+		task VARCHAR(255),
+		count REAL,
+		rCPU REAL,
+		rMemoryMB REAL,
+		uTicks REAL,
+		uRSS REAL,
+		uCache REAL,
+		insertTime DATETIME,
+		cluster VARCHAR(255) NOT NULL DEFAULT '');`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating task_resources table: %v", err)
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='allocations' and xtype='U')
+		CREATE TABLE allocations
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		JobID VARCHAR(255),
+		namespace VARCHAR(255),
+		region VARCHAR(255),
+		allocID VARCHAR(255),
+		nodeID VARCHAR(255),
+		nodeName VARCHAR(255),
+		taskGroup VARCHAR(255),
+		clientStatus VARCHAR(255),
+		rCPU REAL,
+		rMemoryMB REAL,
+		uTicks REAL,
+		uRSS REAL,
+		uCache REAL,
+		insertTime DATETIME,
+		cluster VARCHAR(255) NOT NULL DEFAULT '');`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating allocations table: %v", err)
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='devices' and xtype='U')
+		CREATE TABLE devices
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		JobID VARCHAR(255),
+		namespace VARCHAR(255),
+		region VARCHAR(255),
+		device VARCHAR(255),
+		constraints VARCHAR(1024),
+		count REAL,
+		insertTime DATETIME,
+		cluster VARCHAR(255) NOT NULL DEFAULT '');`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating devices table: %v", err)
+	}
+
+	// Tables created before clusters were named are migrated like resources
+	for _, table := range []string{"task_resources", "allocations", "devices"} {
+		_, err = db.Exec(fmt.Sprintf("IF COL_LENGTH('%s', 'cluster') IS NULL ALTER TABLE %s ADD cluster VARCHAR(255) NOT NULL DEFAULT '';", table, table))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in adding column cluster to %s: %v", table, err)
+		}
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='nodes' and xtype='U')
+		CREATE TABLE nodes
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		nodeID VARCHAR(255),
+		name VARCHAR(255),
+		cluster VARCHAR(255),
+		region VARCHAR(255),
+		dataCenter VARCHAR(255),
+		nodeClass VARCHAR(255),
+		status VARCHAR(255),
+		eligibility VARCHAR(255),
+		drain BIT,
+		cpu REAL,
+		memoryMB REAL,
+		diskMB REAL,
+		reservedCPU REAL,
+		reservedMemoryMB REAL,
+		reservedDiskMB REAL,
+		insertTime DATETIME);`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating nodes table: %v", err)
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='capacity' and xtype='U')
+		CREATE TABLE capacity
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		cluster VARCHAR(255),
+		nodes INTEGER,
+		readyNodes INTEGER,
+		cpu REAL,
+		memoryMB REAL,
+		diskMB REAL,
+		reservedCPU REAL,
+		reservedMemoryMB REAL,
+		reservedDiskMB REAL,
+		allocatedCPU REAL,
+		allocatedMemoryMB REAL,
+		allocatedDiskMB REAL,
+		usedCPU REAL,
+		usedMemoryMB REAL,
+		insertTime DATETIME);`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating capacity table: %v", err)
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='collection_runs' and xtype='U')
+		CREATE TABLE collection_runs
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		beginTime DATETIME,
+		endTime DATETIME,
+		durationSeconds REAL,
+		status VARCHAR(255),
+		insertTime DATETIME,
+		scoped BIT NOT NULL DEFAULT 0);`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating collection_runs table: %v", err)
+	}
+
+	// The latest rows are read from the insertTime of the last run over every cluster and job
+	for _, column := range [][2]string{{"insertTime", "DATETIME"}, {"scoped", "BIT NOT NULL DEFAULT 0"}} {
+		_, err = db.Exec(fmt.Sprintf("IF COL_LENGTH('collection_runs', '%s') IS NULL ALTER TABLE collection_runs ADD %s %s;", column[0], column[0], column[1]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in adding column %s to collection_runs: %v", column[0], err)
+		}
+	}
+
+	_, err = db.Exec(`if not exists (select * from sysobjects where name='collection_run_clusters' and xtype='U')
+		CREATE TABLE collection_run_clusters
+		(id INTEGER IDENTITY(1,1) PRIMARY KEY,
+		runID INTEGER,
+		cluster VARCHAR(255),
+		status VARCHAR(255),
+		jobsSeen INTEGER,
+		jobsStored INTEGER,
+		errors INTEGER,
+		firstError VARCHAR(MAX),
+		timedOut BIT);`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in creating collection_run_clusters table: %v", err)
+	}
+
 	insert, err := db.Prepare(`INSERT INTO resources (JobID,
 		name,
 		uTicks,
@@ -80,7 +449,39 @@ func initDB() (*sql.DB, *sql.Stmt, error) {
 		namespace,
 		dataCenters,
 		date,
-		insertTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		insertTime,
+		region,
+		jobType,
+		rCPUSeconds,
+		rMemoryMBSeconds,
+		uTicksSeconds,
+		uRSSSeconds,
+		rMBits,
+		rReservedPorts,
+		rDynamicPorts,
+		rMemoryMaxMB,
+		rCores,
+		rCoresMHz,
+		wasteCPU,
+		wasteMemoryMB,
+		cluster,
+		uTicksAvg,
+		uTicksMax,
+		uTicksP50,
+		uTicksP95,
+		uTicksP99,
+		uRSSAvg,
+		uRSSMax,
+		uRSSP50,
+		uRSSP95,
+		uRSSP99,
+		rssSource,
+		cacheSource,
+		ticksSource,
+		measuredAllocs,
+		totalAllocs,
+		secondsSource,
+		requestsSource) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error in preparing DB insert: %v", err)
 	}
@@ -88,23 +489,34 @@ func initDB() (*sql.DB, *sql.Stmt, error) {
 	return db, insert, nil
 }
 
-func getAllRowsDB(db *sql.DB) ([]JobDataDB, error) {
+func getAllRowsDB(db *sql.DB, filter Filter) ([]JobDataDB, error) {
 	if db == nil {
 		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
 	}
 
 	all := make([]JobDataDB, 0)
 
-	rows, err := db.Query("SELECT * FROM resources")
+	query := "SELECT * FROM resources"
+	conditions, args := filter.conditions()
+	if len(conditions) != 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("Error in querying DB: %v", err)
 	}
 
-	var JobID, name, namespace, dataCenters, currentTime, insertTime string
+	var JobID, name, namespace, dataCenters, currentTime, insertTime, region, cluster, jobType string
 	var uTicks, rCPU, uRSS, uCache, rMemoryMB, rdiskMB, rIOPS float64
+	var rCPUSeconds, rMemoryMBSeconds, uTicksSeconds, uRSSSeconds float64
+	var rMBits, rReservedPorts, rDynamicPorts float64
+	var rMemoryMaxMB, rCores, rCoresMHz, wasteCPU, wasteMemoryMB float64
+	var uTicksAvg, uTicksMax, uTicksP50, uTicksP95, uTicksP99, uRSSAvg, uRSSMax, uRSSP50, uRSSP95, uRSSP99 float64
+	var rssSource, cacheSource, ticksSource, secondsSource, requestsSource string
+	var measuredAllocs, totalAllocs float64
 	var id int
 	for rows.Next() {
-		rows.Scan(&id, &JobID, &name, &uTicks, &rCPU, &uRSS, &uCache, &rMemoryMB, &rdiskMB, &rIOPS, &namespace, &dataCenters, &currentTime, &insertTime)
+		rows.Scan(&id, &JobID, &name, &uTicks, &rCPU, &uRSS, &uCache, &rMemoryMB, &rdiskMB, &rIOPS, &namespace, &dataCenters, &currentTime, &insertTime, &region, &jobType, &rCPUSeconds, &rMemoryMBSeconds, &uTicksSeconds, &uRSSSeconds, &rMBits, &rReservedPorts, &rDynamicPorts, &rMemoryMaxMB, &rCores, &rCoresMHz, &wasteCPU, &wasteMemoryMB, &cluster, &uTicksAvg, &uTicksMax, &uTicksP50, &uTicksP95, &uTicksP99, &uRSSAvg, &uRSSMax, &uRSSP50, &uRSSP95, &uRSSP99, &rssSource, &cacheSource, &ticksSource, &measuredAllocs, &totalAllocs, &secondsSource, &requestsSource)
 		all = append(all, JobDataDB{
 			JobID,
 			name,
@@ -119,6 +531,39 @@ func getAllRowsDB(db *sql.DB) ([]JobDataDB, error) {
 			dataCenters,
 			currentTime,
 			insertTime,
+			region,
+			cluster,
+			jobType,
+			rCPUSeconds,
+			rMemoryMBSeconds,
+			uTicksSeconds,
+			uRSSSeconds,
+			rMBits,
+			rReservedPorts,
+			rDynamicPorts,
+			rMemoryMaxMB,
+			rCores,
+			rCoresMHz,
+			wasteCPU,
+			wasteMemoryMB,
+			uTicksAvg,
+			uTicksMax,
+			uTicksP50,
+			uTicksP95,
+			uTicksP99,
+			uRSSAvg,
+			uRSSMax,
+			uRSSP50,
+			uRSSP95,
+			uRSSP99,
+			rssSource,
+			cacheSource,
+			ticksSource,
+			measuredAllocs,
+			totalAllocs,
+			completeness(measuredAllocs, totalAllocs),
+			secondsSource,
+			requestsSource,
 		},
 		)
 	}
@@ -126,27 +571,59 @@ func getAllRowsDB(db *sql.DB) ([]JobDataDB, error) {
 	return all, nil
 }
 
-func getLatestJobDB(db *sql.DB, jobID string) ([]JobDataDB, error) {
+// sumSource returns the SQL aggregating the provenance in column over summed rows like mergeSource:
+// rows with nothing to measure are ignored and rows measured from different sources, or not at all, are mixed
+func sumSource(column string) string {
+	measured := `NULLIF(NULLIF(` + column + `, '` + fromNone + `'), '')`
+	return `CASE WHEN COUNT(DISTINCT ` + measured + `) > 1 THEN '` + fromMixed + `' ELSE COALESCE(MAX(` + measured + `), MAX(` + column + `)) END`
+}
+
+// latestCondition returns the SQL condition keeping the rows of table recorded by the last full cycle, unless a
+// later run scoped to a cluster or job recorded the same job again. Scoped runs only store the jobs within their scope,
+// so the jobs outside of it are still read from the last full cycle, while jobs gone since are not read at all.
+// Without any full cycle recorded in collection_runs, the latest rows of every job are read.
+func latestCondition(table string) string {
+	return `insertTime = (SELECT MAX(latest.insertTime) FROM ` + table + ` latest WHERE latest.JobID = ` + table + `.JobID AND latest.cluster = ` + table + `.cluster) ` +
+		`AND insertTime >= (SELECT COALESCE(MAX(runs.insertTime), '1900-01-01') FROM collection_runs runs WHERE runs.scoped = 0)`
+}
+
+func getLatestJobDB(db *sql.DB, jobID string, stat string, filter Filter) ([]JobDataDB, error) {
 	if db == nil {
 		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
 	}
 
 	all := make([]JobDataDB, 0)
 
+	columns, ok := usageColumns[stat]
+	if !ok {
+		return nil, fmt.Errorf("Unknown statistic: %s", stat)
+	}
+
 	jobID = "'" + jobID + "'"
-	rows, err := db.Query(`SELECT JobID, name, SUM(uTicks), SUM(rCPU), SUM(uRSS), SUM(uCache), SUM(rMemoryMB), SUM(rdiskMB), namespace, dataCenters, insertTime 
+	conditions, args := filter.conditions()
+	var filterSQL string
+	for _, condition := range conditions {
+		filterSQL += " AND " + condition
+	}
+	rows, err := db.Query(`SELECT JobID, name, SUM(`+columns[0]+`), SUM(rCPU), SUM(`+columns[1]+`), SUM(uCache), SUM(rMemoryMB), SUM(rdiskMB), namespace, dataCenters, insertTime, region, cluster, jobType, SUM(rCPUSeconds), SUM(rMemoryMBSeconds), SUM(uTicksSeconds), SUM(uRSSSeconds), SUM(rMBits), SUM(rReservedPorts), SUM(rDynamicPorts), SUM(rMemoryMaxMB), SUM(rCores), SUM(rCoresMHz), SUM(wasteCPU), SUM(wasteMemoryMB), SUM(uTicksAvg), SUM(uTicksMax), SUM(uTicksP50), SUM(uTicksP95), SUM(uTicksP99), SUM(uRSSAvg), SUM(uRSSMax), SUM(uRSSP50), SUM(uRSSP95), SUM(uRSSP99), `+sumSource("rssSource")+`, `+sumSource("cacheSource")+`, `+sumSource("ticksSource")+`, SUM(measuredAllocs), SUM(totalAllocs), `+sumSource("secondsSource")+`, `+sumSource("requestsSource")+` 
 						   FROM resources 
-						   WHERE insertTime IN (SELECT MAX(insertTime) FROM resources) AND JobID = ` + jobID + ` 
-						   GROUP BY JobID, name, namespace, dataCenters, insertTime`)
+						   WHERE `+latestCondition("resources")+` AND JobID = `+jobID+filterSQL+` 
+						   GROUP BY JobID, name, namespace, dataCenters, insertTime, region, cluster, jobType`, args...)
 	if err != nil {
 		return nil, fmt.Errorf("Error in querying DB: %v", err)
 	}
 
-	var JobID, name, namespace, dataCenters, currentTime, insertTime string
+	var JobID, name, namespace, dataCenters, currentTime, insertTime, region, cluster, jobType string
 	var uTicks, rCPU, uRSS, uCache, rMemoryMB, rdiskMB, rIOPS float64
+	var rCPUSeconds, rMemoryMBSeconds, uTicksSeconds, uRSSSeconds float64
+	var rMBits, rReservedPorts, rDynamicPorts float64
+	var rMemoryMaxMB, rCores, rCoresMHz, wasteCPU, wasteMemoryMB float64
+	var uTicksAvg, uTicksMax, uTicksP50, uTicksP95, uTicksP99, uRSSAvg, uRSSMax, uRSSP50, uRSSP95, uRSSP99 float64
+	var rssSource, cacheSource, ticksSource, secondsSource, requestsSource string
+	var measuredAllocs, totalAllocs float64
 
 	for rows.Next() {
-		rows.Scan(&JobID, &name, &uTicks, &rCPU, &uRSS, &uCache, &rMemoryMB, &rdiskMB, &namespace, &dataCenters, &insertTime)
+		rows.Scan(&JobID, &name, &uTicks, &rCPU, &uRSS, &uCache, &rMemoryMB, &rdiskMB, &namespace, &dataCenters, &insertTime, &region, &cluster, &jobType, &rCPUSeconds, &rMemoryMBSeconds, &uTicksSeconds, &uRSSSeconds, &rMBits, &rReservedPorts, &rDynamicPorts, &rMemoryMaxMB, &rCores, &rCoresMHz, &wasteCPU, &wasteMemoryMB, &uTicksAvg, &uTicksMax, &uTicksP50, &uTicksP95, &uTicksP99, &uRSSAvg, &uRSSMax, &uRSSP50, &uRSSP95, &uRSSP99, &rssSource, &cacheSource, &ticksSource, &measuredAllocs, &totalAllocs, &secondsSource, &requestsSource)
 		all = append(all, JobDataDB{
 			JobID,
 			name,
@@ -160,36 +637,85 @@ func getLatestJobDB(db *sql.DB, jobID string) ([]JobDataDB, error) {
 			namespace,
 			dataCenters,
 			currentTime,
-			insertTime})
+			insertTime,
+			region,
+			cluster,
+			jobType,
+			rCPUSeconds,
+			rMemoryMBSeconds,
+			uTicksSeconds,
+			uRSSSeconds,
+			rMBits,
+			rReservedPorts,
+			rDynamicPorts,
+			rMemoryMaxMB,
+			rCores,
+			rCoresMHz,
+			wasteCPU,
+			wasteMemoryMB,
+			uTicksAvg,
+			uTicksMax,
+			uTicksP50,
+			uTicksP95,
+			uTicksP99,
+			uRSSAvg,
+			uRSSMax,
+			uRSSP50,
+			uRSSP95,
+			uRSSP99,
+			rssSource,
+			cacheSource,
+			ticksSource,
+			measuredAllocs,
+			totalAllocs,
+			completeness(measuredAllocs, totalAllocs),
+			secondsSource,
+			requestsSource})
 	}
 
 	return all, nil
 }
 
-func getTimeSliceDB(db *sql.DB, jobID, begin, end string) ([]JobDataDB, error) {
+func getTimeSliceDB(db *sql.DB, jobID, begin, end string, stat string, filter Filter) ([]JobDataDB, error) {
 	if db == nil {
 		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
 	}
 
 	all := make([]JobDataDB, 0)
 
+	columns, ok := usageColumns[stat]
+	if !ok {
+		return nil, fmt.Errorf("Unknown statistic: %s", stat)
+	}
+
 	jobID = "'" + jobID + "'"
 	begin = "'" + begin + "'"
 	end = "'" + end + "'"
-	rows, err := db.Query(`SELECT JobID, name, SUM(uTicks), SUM(rCPU), SUM(uRSS), SUM(uCache), SUM(rMemoryMB), SUM(rdiskMB), namespace, dataCenters, insertTime 
+	conditions, args := filter.conditions()
+	var filterSQL string
+	for _, condition := range conditions {
+		filterSQL += " AND " + condition
+	}
+	rows, err := db.Query(`SELECT JobID, name, SUM(`+columns[0]+`), SUM(rCPU), SUM(`+columns[1]+`), SUM(uCache), SUM(rMemoryMB), SUM(rdiskMB), namespace, dataCenters, insertTime, region, cluster, jobType, SUM(rCPUSeconds), SUM(rMemoryMBSeconds), SUM(uTicksSeconds), SUM(uRSSSeconds), SUM(rMBits), SUM(rReservedPorts), SUM(rDynamicPorts), SUM(rMemoryMaxMB), SUM(rCores), SUM(rCoresMHz), SUM(wasteCPU), SUM(wasteMemoryMB), SUM(uTicksAvg), SUM(uTicksMax), SUM(uTicksP50), SUM(uTicksP95), SUM(uTicksP99), SUM(uRSSAvg), SUM(uRSSMax), SUM(uRSSP50), SUM(uRSSP95), SUM(uRSSP99), `+sumSource("rssSource")+`, `+sumSource("cacheSource")+`, `+sumSource("ticksSource")+`, SUM(measuredAllocs), SUM(totalAllocs), `+sumSource("secondsSource")+`, `+sumSource("requestsSource")+` 
 						   FROM resources 
-						   WHERE JobID = ` + jobID + ` AND insertTime BETWEEN ` + begin + ` AND ` + end + ` 
-						   GROUP BY JobID, name, namespace, dataCenters, insertTime
-						   ORDER BY insertTime DESC`)
+						   WHERE JobID = `+jobID+` AND insertTime BETWEEN `+begin+` AND `+end+filterSQL+` 
+						   GROUP BY JobID, name, namespace, dataCenters, insertTime, region, cluster, jobType
+						   ORDER BY insertTime DESC`, args...)
 	if err != nil {
 		return nil, fmt.Errorf("Error in querying DB: %v", err)
 	}
 
-	var JobID, name, namespace, dataCenters, currentTime, insertTime string
+	var JobID, name, namespace, dataCenters, currentTime, insertTime, region, cluster, jobType string
 	var uTicks, rCPU, uRSS, uCache, rMemoryMB, rdiskMB, rIOPS float64
+	var rCPUSeconds, rMemoryMBSeconds, uTicksSeconds, uRSSSeconds float64
+	var rMBits, rReservedPorts, rDynamicPorts float64
+	var rMemoryMaxMB, rCores, rCoresMHz, wasteCPU, wasteMemoryMB float64
+	var uTicksAvg, uTicksMax, uTicksP50, uTicksP95, uTicksP99, uRSSAvg, uRSSMax, uRSSP50, uRSSP95, uRSSP99 float64
+	var rssSource, cacheSource, ticksSource, secondsSource, requestsSource string
+	var measuredAllocs, totalAllocs float64
 
 	for rows.Next() {
-		rows.Scan(&JobID, &name, &uTicks, &rCPU, &uRSS, &uCache, &rMemoryMB, &rdiskMB, &namespace, &dataCenters, &insertTime)
+		rows.Scan(&JobID, &name, &uTicks, &rCPU, &uRSS, &uCache, &rMemoryMB, &rdiskMB, &namespace, &dataCenters, &insertTime, &region, &cluster, &jobType, &rCPUSeconds, &rMemoryMBSeconds, &uTicksSeconds, &uRSSSeconds, &rMBits, &rReservedPorts, &rDynamicPorts, &rMemoryMaxMB, &rCores, &rCoresMHz, &wasteCPU, &wasteMemoryMB, &uTicksAvg, &uTicksMax, &uTicksP50, &uTicksP95, &uTicksP99, &uRSSAvg, &uRSSMax, &uRSSP50, &uRSSP95, &uRSSP99, &rssSource, &cacheSource, &ticksSource, &measuredAllocs, &totalAllocs, &secondsSource, &requestsSource)
 		all = append(all,
 			JobDataDB{
 				JobID,
@@ -205,9 +731,643 @@ func getTimeSliceDB(db *sql.DB, jobID, begin, end string) ([]JobDataDB, error) {
 				dataCenters,
 				currentTime,
 				insertTime,
+				region,
+				cluster,
+				jobType,
+				rCPUSeconds,
+				rMemoryMBSeconds,
+				uTicksSeconds,
+				uRSSSeconds,
+				rMBits,
+				rReservedPorts,
+				rDynamicPorts,
+				rMemoryMaxMB,
+				rCores,
+				rCoresMHz,
+				wasteCPU,
+				wasteMemoryMB,
+				uTicksAvg,
+				uTicksMax,
+				uTicksP50,
+				uTicksP95,
+				uTicksP99,
+				uRSSAvg,
+				uRSSMax,
+				uRSSP50,
+				uRSSP95,
+				uRSSP99,
+				rssSource,
+				cacheSource,
+				ticksSource,
+				measuredAllocs,
+				totalAllocs,
+				completeness(measuredAllocs, totalAllocs),
+				secondsSource,
+				requestsSource,
 			},
 		)
 	}
 
 	return all, nil
 }
+
+// insertJobDB stores a job collected at insertTime with the resources insert prepared by initDB
+func insertJobDB(insert *sql.Stmt, jobData JobData, insertTime string) error {
+	if insert == nil {
+		return fmt.Errorf("Parameter insert *sql.Stmt is nil")
+	}
+
+	_, err := insert.Exec(jobData.JobID,
+		jobData.Name,
+		jobData.UTicks,
+		jobData.RCPU,
+		jobData.URSS,
+		jobData.UCache,
+		jobData.RMemoryMB,
+		jobData.RdiskMB,
+		jobData.RIOPS,
+		jobData.Namespace,
+		jobData.DataCenters,
+		jobData.CurrentTime,
+		insertTime,
+		jobData.Region,
+		jobData.Type,
+		jobData.RCPUSeconds,
+		jobData.RMemoryMBSeconds,
+		jobData.UTicksSeconds,
+		jobData.URSSSeconds,
+		jobData.RMBits,
+		jobData.RReservedPorts,
+		jobData.RDynamicPorts,
+		jobData.RMemoryMaxMB,
+		jobData.RCores,
+		jobData.RCoresMHz,
+		jobData.WasteCPU,
+		jobData.WasteMemoryMB,
+		jobData.Cluster,
+		jobData.UTicksAvg,
+		jobData.UTicksMax,
+		jobData.UTicksP50,
+		jobData.UTicksP95,
+		jobData.UTicksP99,
+		jobData.URSSAvg,
+		jobData.URSSMax,
+		jobData.URSSP50,
+		jobData.URSSP95,
+		jobData.URSSP99,
+		jobData.RSSSource,
+		jobData.CacheSource,
+		jobData.TicksSource,
+		jobData.MeasuredAllocs,
+		jobData.TotalAllocs,
+		jobData.SecondsSource,
+		jobData.RequestsSource)
+	if err != nil {
+		return fmt.Errorf("Error in inserting %s: %v", jobData.JobID, err)
+	}
+
+	return nil
+}
+
+// insertTasksDB stores the task level breakdown of a job collected at insertTime
+func insertTasksDB(db *sql.DB, jobData JobData, insertTime string) error {
+	if db == nil {
+		return fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	for _, task := range jobData.Tasks {
+		_, err := db.Exec(`INSERT INTO task_resources (JobID,
+			namespace,
+			region,
+			taskGroup,
+			task,
+			count,
+			rCPU,
+			rMemoryMB,
+			uTicks,
+			uRSS,
+			uCache,
+			insertTime,
+			cluster) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			jobData.JobID,
+			jobData.Namespace,
+			jobData.Region,
+			task.TaskGroup,
+			task.Task,
+			task.Count,
+			task.RCPU,
+			task.RMemoryMB,
+			task.UTicks,
+			task.URSS,
+			task.UCache,
+			insertTime,
+			jobData.Cluster)
+		if err != nil {
+			return fmt.Errorf("Error in inserting task %s/%s: %v", task.TaskGroup, task.Task, err)
+		}
+	}
+
+	return nil
+}
+
+// getJobGroupsDB returns the latest recorded task group and task breakdown of a job
+func getJobGroupsDB(db *sql.DB, jobID string, filter Filter) ([]GroupDataDB, error) {
+	if db == nil {
+		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	groups := make([]GroupDataDB, 0)
+
+	conditions, args := filter.conditions()
+	var filterSQL string
+	for _, condition := range conditions {
+		filterSQL += " AND " + condition
+	}
+	rows, err := db.Query(`SELECT cluster, taskGroup, task, SUM(count), SUM(rCPU), SUM(rMemoryMB), SUM(uTicks), SUM(uRSS), SUM(uCache) 
+						   FROM task_resources 
+						   WHERE `+latestCondition("task_resources")+` AND JobID = ?`+filterSQL+` 
+						   GROUP BY cluster, taskGroup, task 
+						   ORDER BY cluster, taskGroup, task`, append([]interface{}{jobID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("Error in querying DB: %v", err)
+	}
+	defer rows.Close()
+
+	var cluster string
+	var task TaskData
+	for rows.Next() {
+		err = rows.Scan(&cluster, &task.TaskGroup, &task.Task, &task.Count, &task.RCPU, &task.RMemoryMB, &task.UTicks, &task.URSS, &task.UCache)
+		if err != nil {
+			return nil, fmt.Errorf("Error in scanning row: %v", err)
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].TaskGroup != task.TaskGroup || groups[len(groups)-1].Cluster != cluster {
+			groups = append(groups, GroupDataDB{
+				Cluster:   cluster,
+				TaskGroup: task.TaskGroup,
+				Count:     task.Count,
+			})
+		}
+		group := &groups[len(groups)-1]
+		group.RCPU += task.RCPU
+		group.RMemoryMB += task.RMemoryMB
+		group.UTicks += task.UTicks
+		group.URSS += task.URSS
+		group.UCache += task.UCache
+		group.Tasks = append(group.Tasks, task)
+	}
+
+	return groups, nil
+}
+
+// insertAllocsDB stores the allocations of a job collected at insertTime
+func insertAllocsDB(db *sql.DB, jobData JobData, insertTime string) error {
+	if db == nil {
+		return fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	for _, alloc := range jobData.Allocs {
+		_, err := db.Exec(`INSERT INTO allocations (JobID,
+			namespace,
+			region,
+			allocID,
+			nodeID,
+			nodeName,
+			taskGroup,
+			clientStatus,
+			rCPU,
+			rMemoryMB,
+			uTicks,
+			uRSS,
+			uCache,
+			insertTime,
+			cluster) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			jobData.JobID,
+			jobData.Namespace,
+			jobData.Region,
+			alloc.AllocID,
+			alloc.NodeID,
+			alloc.NodeName,
+			alloc.TaskGroup,
+			alloc.ClientStatus,
+			alloc.RCPU,
+			alloc.RMemoryMB,
+			alloc.UTicks,
+			alloc.URSS,
+			alloc.UCache,
+			insertTime,
+			jobData.Cluster)
+		if err != nil {
+			return fmt.Errorf("Error in inserting allocation %s: %v", alloc.AllocID, err)
+		}
+	}
+
+	return nil
+}
+
+// getAllocationsDB returns the recorded allocations matching allocFilter and filter
+func getAllocationsDB(db *sql.DB, allocFilter AllocFilter, filter Filter) ([]AllocDataDB, error) {
+	if db == nil {
+		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	all := make([]AllocDataDB, 0)
+
+	var conditions []string
+	var args []interface{}
+	if allocFilter.Begin != "" && allocFilter.End != "" {
+		conditions = append(conditions, "insertTime BETWEEN ? AND ?")
+		args = append(args, allocFilter.Begin, allocFilter.End)
+	} else {
+		conditions = append(conditions, latestCondition("allocations"))
+	}
+	if allocFilter.JobID != "" {
+		conditions = append(conditions, "JobID = ?")
+		args = append(args, allocFilter.JobID)
+	}
+	if allocFilter.NodeID != "" {
+		conditions = append(conditions, "nodeID = ?")
+		args = append(args, allocFilter.NodeID)
+	}
+	if allocFilter.AllocID != "" {
+		conditions = append(conditions, "allocID = ?")
+		args = append(args, allocFilter.AllocID)
+	}
+	filterConditions, filterArgs := filter.conditions()
+	conditions = append(conditions, filterConditions...)
+	args = append(args, filterArgs...)
+
+	rows, err := db.Query(`SELECT JobID, namespace, region, cluster, allocID, nodeID, nodeName, taskGroup, clientStatus, rCPU, rMemoryMB, uTicks, uRSS, uCache, insertTime 
+						   FROM allocations 
+						   WHERE `+strings.Join(conditions, " AND ")+` 
+						   ORDER BY insertTime DESC, cluster, JobID, allocID`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error in querying DB: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alloc AllocDataDB
+		err = rows.Scan(&alloc.JobID, &alloc.Namespace, &alloc.Region, &alloc.Cluster, &alloc.AllocID, &alloc.NodeID, &alloc.NodeName, &alloc.TaskGroup, &alloc.ClientStatus,
+			&alloc.RCPU, &alloc.RMemoryMB, &alloc.UTicks, &alloc.URSS, &alloc.UCache, &alloc.InsertTime)
+		if err != nil {
+			return nil, fmt.Errorf("Error in scanning row: %v", err)
+		}
+		all = append(all, alloc)
+	}
+
+	return all, nil
+}
+
+// insertDevicesDB stores the devices requested by a job collected at insertTime
+func insertDevicesDB(db *sql.DB, jobData JobData, insertTime string) error {
+	if db == nil {
+		return fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	for _, device := range jobData.Devices {
+		_, err := db.Exec(`INSERT INTO devices (JobID,
+			namespace,
+			region,
+			device,
+			constraints,
+			count,
+			insertTime,
+			cluster) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			jobData.JobID,
+			jobData.Namespace,
+			jobData.Region,
+			device.Name,
+			device.Constraints,
+			device.Count,
+			insertTime,
+			jobData.Cluster)
+		if err != nil {
+			return fmt.Errorf("Error in inserting device %s: %v", device.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getDevicesDB returns the latest recorded device requests summed by cluster, namespace and device.
+// A non-empty namespace only returns the devices requested in that namespace.
+func getDevicesDB(db *sql.DB, namespace string, filter Filter) ([]DeviceUsageDB, error) {
+	if db == nil {
+		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	all := make([]DeviceUsageDB, 0)
+
+	conditions, args := filter.conditions()
+	if namespace != "" {
+		conditions = append([]string{"namespace = ?"}, conditions...)
+		args = append([]interface{}{namespace}, args...)
+	}
+	var filterSQL string
+	for _, condition := range conditions {
+		filterSQL += " AND " + condition
+	}
+	rows, err := db.Query(`SELECT cluster, namespace, device, SUM(count) 
+						   FROM devices 
+						   WHERE `+latestCondition("devices")+filterSQL+` 
+						   GROUP BY cluster, namespace, device 
+						   ORDER BY cluster, namespace, device`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error in querying DB: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var device DeviceUsageDB
+		err = rows.Scan(&device.Cluster, &device.Namespace, &device.Device, &device.Count)
+		if err != nil {
+			return nil, fmt.Errorf("Error in scanning row: %v", err)
+		}
+		all = append(all, device)
+	}
+
+	return all, nil
+}
+
+// insertNodesDB stores the node inventory collected at insertTime
+func insertNodesDB(db *sql.DB, nodes []NodeData, insertTime string) error {
+	if db == nil {
+		return fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	for _, node := range nodes {
+		_, err := db.Exec(`INSERT INTO nodes (nodeID,
+			name,
+			cluster,
+			region,
+			dataCenter,
+			nodeClass,
+			status,
+			eligibility,
+			drain,
+			cpu,
+			memoryMB,
+			diskMB,
+			reservedCPU,
+			reservedMemoryMB,
+			reservedDiskMB,
+			insertTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			node.NodeID,
+			node.Name,
+			node.Cluster,
+			node.Region,
+			node.Datacenter,
+			node.NodeClass,
+			node.Status,
+			node.SchedulingEligibility,
+			node.Drain,
+			node.CPU,
+			node.MemoryMB,
+			node.DiskMB,
+			node.ReservedCPU,
+			node.ReservedMemoryMB,
+			node.ReservedDiskMB,
+			insertTime)
+		if err != nil {
+			return fmt.Errorf("Error in inserting node %s: %v", node.NodeID, err)
+		}
+	}
+
+	return nil
+}
+
+// insertCapacityDB stores the capacity of a cluster collected at insertTime
+func insertCapacityDB(db *sql.DB, capacity CapacityData, insertTime string) error {
+	if db == nil {
+		return fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	_, err := db.Exec(`INSERT INTO capacity (cluster,
+		nodes,
+		readyNodes,
+		cpu,
+		memoryMB,
+		diskMB,
+		reservedCPU,
+		reservedMemoryMB,
+		reservedDiskMB,
+		allocatedCPU,
+		allocatedMemoryMB,
+		allocatedDiskMB,
+		usedCPU,
+		usedMemoryMB,
+		insertTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		capacity.Cluster,
+		capacity.Nodes,
+		capacity.ReadyNodes,
+		capacity.CPU,
+		capacity.MemoryMB,
+		capacity.DiskMB,
+		capacity.ReservedCPU,
+		capacity.ReservedMemoryMB,
+		capacity.ReservedDiskMB,
+		capacity.AllocatedCPU,
+		capacity.AllocatedMemoryMB,
+		capacity.AllocatedDiskMB,
+		capacity.UsedCPU,
+		capacity.UsedMemoryMB,
+		insertTime)
+	if err != nil {
+		return fmt.Errorf("Error in inserting capacity of %s: %v", capacity.Cluster, err)
+	}
+
+	return nil
+}
+
+// getCapacityDB returns the latest recorded capacity of a cluster, or sql.ErrNoRows if none was recorded
+func getCapacityDB(db *sql.DB, cluster string) (CapacityDataDB, error) {
+	var capacity CapacityDataDB
+
+	if db == nil {
+		return capacity, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	err := db.QueryRow(`SELECT TOP 1 cluster, nodes, readyNodes, cpu, memoryMB, diskMB, reservedCPU, reservedMemoryMB, reservedDiskMB, allocatedCPU, allocatedMemoryMB, allocatedDiskMB, usedCPU, usedMemoryMB, insertTime 
+						FROM capacity 
+						WHERE cluster = ? 
+						ORDER BY insertTime DESC`, cluster).Scan(&capacity.Cluster, &capacity.Nodes, &capacity.ReadyNodes,
+		&capacity.CPU, &capacity.MemoryMB, &capacity.DiskMB,
+		&capacity.ReservedCPU, &capacity.ReservedMemoryMB, &capacity.ReservedDiskMB,
+		&capacity.AllocatedCPU, &capacity.AllocatedMemoryMB, &capacity.AllocatedDiskMB,
+		&capacity.UsedCPU, &capacity.UsedMemoryMB, &capacity.InsertTime)
+	if err == sql.ErrNoRows {
+		return capacity, err
+	}
+	if err != nil {
+		return capacity, fmt.Errorf("Error in querying DB: %v", err)
+	}
+
+	return capacity, nil
+}
+
+// insertRunDB stores a collection run along with the outcome of each of its clusters, returning the ID of the run.
+// insertTime is the time the rows of the run were stored at and scoped tells runs restricted to a cluster or job.
+func insertRunDB(db *sql.DB, run CollectionRun, insertTime string, scoped bool) (int, error) {
+	var id int
+
+	if db == nil {
+		return id, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	err := db.QueryRow(`INSERT INTO collection_runs (beginTime,
+		endTime,
+		durationSeconds,
+		status,
+		insertTime,
+		scoped) OUTPUT INSERTED.id VALUES (?, ?, ?, ?, ?, ?)`,
+		run.Begin,
+		run.End,
+		run.DurationSeconds,
+		run.Status,
+		insertTime,
+		scoped).Scan(&id)
+	if err != nil {
+		return id, fmt.Errorf("Error in inserting collection run: %v", err)
+	}
+
+	for _, cluster := range run.Clusters {
+		_, err = db.Exec(`INSERT INTO collection_run_clusters (runID,
+			cluster,
+			status,
+			jobsSeen,
+			jobsStored,
+			errors,
+			firstError,
+			timedOut) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			id,
+			cluster.Cluster,
+			cluster.Status,
+			cluster.JobsSeen,
+			cluster.JobsStored,
+			cluster.Errors,
+			cluster.FirstError,
+			cluster.TimedOut)
+		if err != nil {
+			return id, fmt.Errorf("Error in inserting collection run of %s: %v", cluster.Cluster, err)
+		}
+	}
+
+	return id, nil
+}
+
+// getRunsDB returns the latest limit collection runs, most recent first, along with the outcome of their clusters
+func getRunsDB(db *sql.DB, limit int) ([]CollectionRun, error) {
+	if db == nil {
+		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	runs := make([]CollectionRun, 0)
+
+	rows, err := db.Query(`SELECT TOP (?) id, beginTime, endTime, durationSeconds, status 
+						   FROM collection_runs 
+						   ORDER BY id DESC`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Error in querying DB: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var run CollectionRun
+		rows.Scan(&run.ID, &run.Begin, &run.End, &run.DurationSeconds, &run.Status)
+		run.Clusters = make([]ClusterRun, 0)
+		runs = append(runs, run)
+	}
+	if len(runs) == 0 {
+		return runs, nil
+	}
+
+	clusters, err := getRunClustersDB(db, runs[len(runs)-1].ID, runs[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		runs[i].Clusters = append(runs[i].Clusters, clusters[runs[i].ID]...)
+	}
+
+	return runs, nil
+}
+
+// getRunDB returns a collection run along with the outcome of its clusters, or sql.ErrNoRows if there is none
+func getRunDB(db *sql.DB, id int) (CollectionRun, error) {
+	var run CollectionRun
+
+	if db == nil {
+		return run, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	err := db.QueryRow(`SELECT id, beginTime, endTime, durationSeconds, status 
+						FROM collection_runs 
+						WHERE id = ?`, id).Scan(&run.ID, &run.Begin, &run.End, &run.DurationSeconds, &run.Status)
+	if err == sql.ErrNoRows {
+		return run, err
+	}
+	if err != nil {
+		return run, fmt.Errorf("Error in querying DB: %v", err)
+	}
+
+	clusters, err := getRunClustersDB(db, id, id)
+	if err != nil {
+		return run, err
+	}
+	run.Clusters = append(make([]ClusterRun, 0), clusters[id]...)
+
+	return run, nil
+}
+
+// getRunClustersDB returns the outcome of each cluster of the collection runs with IDs from first to last, by run ID
+func getRunClustersDB(db *sql.DB, first, last int) (map[int][]ClusterRun, error) {
+	clusters := make(map[int][]ClusterRun)
+
+	rows, err := db.Query(`SELECT runID, cluster, status, jobsSeen, jobsStored, errors, firstError, timedOut 
+						   FROM collection_run_clusters 
+						   WHERE runID BETWEEN ? AND ? 
+						   ORDER BY runID, cluster`, first, last)
+	if err != nil {
+		return nil, fmt.Errorf("Error in querying DB: %v", err)
+	}
+	defer rows.Close()
+
+	var runID int
+	for rows.Next() {
+		var cluster ClusterRun
+		rows.Scan(&runID, &cluster.Cluster, &cluster.Status, &cluster.JobsSeen, &cluster.JobsStored, &cluster.Errors, &cluster.FirstError, &cluster.TimedOut)
+		clusters[runID] = append(clusters[runID], cluster)
+	}
+
+	return clusters, nil
+}
+
+// getInsertTimesDB returns the times between begin and end at which jobs of a cluster were stored,
+// formatted like the insertTime of collectCycle
+func getInsertTimesDB(db *sql.DB, cluster, begin, end string) (map[string]struct{}, error) {
+	if db == nil {
+		return nil, fmt.Errorf("Parameter db *sql.DB is nil")
+	}
+
+	insertTimes := make(map[string]struct{})
+
+	rows, err := db.Query(`SELECT DISTINCT insertTime 
+						   FROM resources 
+						   WHERE cluster = ? AND insertTime BETWEEN ? AND ?`, cluster, begin, end)
+	if err != nil {
+		return nil, fmt.Errorf("Error in querying DB: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var insertTime time.Time
+		err = rows.Scan(&insertTime)
+		if err != nil {
+			return nil, fmt.Errorf("Error in scanning DB: %v", err)
+		}
+		insertTimes[insertTime.Format("2006-01-02 15:04:05")] = struct{}{}
+	}
+
+	return insertTimes, nil
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"os"
 	"testing"
 	"time"
@@ -34,7 +35,7 @@ func populateDB(t *testing.T, insert *sql.Stmt) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = insert.Exec("JobID1", "JobName1", 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, "Namespace1", "DC1", time1, time1)
+	_, err = insert.Exec("JobID1", "JobName1", 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, "Namespace1", "DC1", time1, time1, "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -44,15 +45,15 @@ func populateDB(t *testing.T, insert *sql.Stmt) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = insert.Exec("JobID1", "JobName1", 3.0, 3.0, 3.0, 3.0, 3.0, 3.0, 3.0, "Namespace1", "DC1", time2, time2)
+	_, err = insert.Exec("JobID1", "JobName1", 3.0, 3.0, 3.0, 3.0, 3.0, 3.0, 3.0, "Namespace1", "DC1", time2, time2, "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = insert.Exec("JobID1", "JobName1", 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, "Namespace1", "DC1", time2, time2)
+	_, err = insert.Exec("JobID1", "JobName1", 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, "Namespace1", "DC1", time2, time2, "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = insert.Exec("JobID2", "JobName2", 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, "Namespace2", "DC2", time2, time2)
+	_, err = insert.Exec("JobID2", "JobName2", 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, "Namespace2", "DC2", time2, time2, "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,28 +103,28 @@ func TestGetAllRowsDBMock(t *testing.T) {
 	assert.Empty(t, err)
 	defer db.Close()
 
-	all, err := getAllRowsDB(nil)
+	all, err := getAllRowsDB(nil, Filter{})
 	assert.NotNil(t, err)
 	assert.Empty(t, all)
 
-	all, err = getAllRowsDB(db)
+	all, err = getAllRowsDB(db, Filter{})
 	assert.NotNil(t, err)
 	assert.Empty(t, all)
 
 	// Test on an empty DB
 	query := `SELECT \* FROM resources`
-	rows := sqlmock.NewRows([]string{"id", "JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "rIOPS", "namespace", "dataCenters", "date", "insertTime"})
+	rows := sqlmock.NewRows([]string{"id", "JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "rIOPS", "namespace", "dataCenters", "date", "insertTime", "region", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "cluster", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"})
 	mock.ExpectQuery(query).WillReturnRows(rows)
-	all, err = getAllRowsDB(db)
+	all, err = getAllRowsDB(db, Filter{})
 	assert.Empty(t, err)
 	assert.Empty(t, all)
 
 	// Test after inserting rows into DB
-	rows = sqlmock.NewRows([]string{"id", "JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "rIOPS", "namespace", "dataCenters", "date", "insertTime"}).
-		AddRow(1, "JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "0000-00-01", "0000-00-01").
-		AddRow(2, "JobID2", "name2", 222.2, 222.2, 222.2, 222.2, 222.2, 222.2, 222.2, "namespace2", "dataCenter2", "0000-00-02", "0000-00-02")
+	rows = sqlmock.NewRows([]string{"id", "JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "rIOPS", "namespace", "dataCenters", "date", "insertTime", "region", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "cluster", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow(1, "JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "0000-00-01", "0000-00-01", "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "").
+		AddRow(2, "JobID2", "name2", 222.2, 222.2, 222.2, 222.2, 222.2, 222.2, 222.2, "namespace2", "dataCenter2", "0000-00-02", "0000-00-02", "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "")
 	mock.ExpectQuery(query).WillReturnRows(rows)
-	all, err = getAllRowsDB(db)
+	all, err = getAllRowsDB(db, Filter{})
 	assert.Empty(t, err)
 	assert.NotEmpty(t, all)
 
@@ -142,6 +143,39 @@ func TestGetAllRowsDBMock(t *testing.T) {
 			"dataCenter1",
 			"0000-00-01",
 			"0000-00-01",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 		{
 			"JobID2",
@@ -157,11 +191,110 @@ func TestGetAllRowsDBMock(t *testing.T) {
 			"dataCenter2",
 			"0000-00-02",
 			"0000-00-02",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 	}
 	assert.Equal(t, expected, all)
 }
 
+func TestGetAllRowsDBFilterMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	query := `SELECT \* FROM resources WHERE region \= \? AND cluster \= \?`
+	rows := sqlmock.NewRows([]string{"id", "JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "rIOPS", "namespace", "dataCenters", "date", "insertTime", "region", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "cluster", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow(1, "JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "0000-00-01", "0000-00-01", "eu", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "cluster1", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "")
+	mock.ExpectQuery(query).WithArgs("eu", "cluster1").WillReturnRows(rows)
+	all, err := getAllRowsDB(db, Filter{Region: "eu", Cluster: "cluster1"})
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, "eu", all[0].Region)
+	assert.Equal(t, "cluster1", all[0].Cluster)
+
+	query = `AND JobID \= 'JobID1' AND region \= \? AND cluster \= \?`
+	rows = sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow("JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "0001-01-04T00:00:00Z", "eu", "cluster1", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "")
+	mock.ExpectQuery(query).WithArgs("eu", "cluster1").WillReturnRows(rows)
+	all, err = getLatestJobDB(db, "JobID1", "", Filter{Region: "eu", Cluster: "cluster1"})
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, "eu", all[0].Region)
+	assert.Equal(t, "cluster1", all[0].Cluster)
+
+	query = `BETWEEN '2020\-07\-07 17\:34\:53' AND '2020\-07\-18 17\:42\:19' AND region \= \? AND cluster \= \?`
+	rows = sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow("JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "2020-07-07T17:35:00Z", "eu", "cluster1", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "")
+	mock.ExpectQuery(query).WithArgs("eu", "cluster1").WillReturnRows(rows)
+	all, err = getTimeSliceDB(db, "JobID1", "2020-07-07 17:34:53", "2020-07-18 17:42:19", "", Filter{Region: "eu", Cluster: "cluster1"})
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, "eu", all[0].Region)
+	assert.Equal(t, "cluster1", all[0].Cluster)
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetLatestJobDBStatMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	all, err := getLatestJobDB(db, "JobID1", "p90", Filter{})
+	assert.NotNil(t, err)
+	assert.Empty(t, all)
+
+	query := `SELECT JobID, name, SUM\(uTicksP95\), SUM\(rCPU\), SUM\(uRSSP95\), SUM\(uCache\)`
+	rows := sqlmock.NewRows([]string{"JobID", "name", "uTicksP95", "rCPU", "uRSSP95", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow("JobID1", "name1", 950.0, 1000.0, 95.0, 0.0, 128.0, 0.0, "namespace1", "dataCenter1", "0001-01-04T00:00:00Z", "", "cluster1", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 500.0, 1000.0, 400.0, 950.0, 990.0, 50.0, 100.0, 40.0, 95.0, 99.0, "", "", "", 0.0, 0.0, "", "")
+	mock.ExpectQuery(query).WillReturnRows(rows)
+	all, err = getLatestJobDB(db, "JobID1", "p95", Filter{})
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(all))
+	assert.Equal(t, 950.0, all[0].Ticks)
+	assert.Equal(t, 95.0, all[0].RSS)
+	assert.Equal(t, 500.0, all[0].UTicksAvg)
+	assert.Equal(t, 99.0, all[0].URSSP99)
+
+	all, err = getTimeSliceDB(db, "JobID1", "2020-07-07 17:34:53", "2020-07-18 17:42:19", "p90", Filter{})
+	assert.NotNil(t, err)
+	assert.Empty(t, all)
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
 func TestGetAllRowsDBLive(t *testing.T) {
 	var db *sql.DB
 	var insert *sql.Stmt
@@ -172,7 +305,7 @@ func TestGetAllRowsDBLive(t *testing.T) {
 
 	populateDB(t, insert)
 
-	all, err := getAllRowsDB(db)
+	all, err := getAllRowsDB(db, Filter{})
 	assert.Nil(t, err)
 	assert.NotNil(t, all)
 
@@ -191,6 +324,39 @@ func TestGetAllRowsDBLive(t *testing.T) {
 			"DC1",
 			"2000-01-01T00:00:00Z",
 			"2000-01-01T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 		{
 			"JobID1",
@@ -206,6 +372,39 @@ func TestGetAllRowsDBLive(t *testing.T) {
 			"DC1",
 			"2000-01-02T00:00:00Z",
 			"2000-01-02T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 		{
 			"JobID1",
@@ -221,6 +420,39 @@ func TestGetAllRowsDBLive(t *testing.T) {
 			"DC1",
 			"2000-01-02T00:00:00Z",
 			"2000-01-02T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 		{
 			"JobID2",
@@ -236,6 +468,39 @@ func TestGetAllRowsDBLive(t *testing.T) {
 			"DC2",
 			"2000-01-02T00:00:00Z",
 			"2000-01-02T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 	}
 	assert.Equal(t, expected, all)
@@ -246,11 +511,11 @@ func TestGetLatestJobDBMock(t *testing.T) {
 	assert.Empty(t, err)
 	defer db.Close()
 
-	all, err := getLatestJobDB(nil, "")
+	all, err := getLatestJobDB(nil, "", "", Filter{})
 	assert.NotNil(t, err)
 	assert.Empty(t, all)
 
-	all, err = getLatestJobDB(db, "")
+	all, err = getLatestJobDB(db, "", "", Filter{})
 	assert.NotNil(t, err)
 	assert.Empty(t, all)
 
@@ -267,29 +532,63 @@ func TestGetLatestJobDBMock(t *testing.T) {
 			SUM\(rdiskMB\), 
 			namespace, 
 			dataCenters, 
-			insertTime 
+			insertTime, 
+			region, 
+			cluster, 
+			jobType, 
+			SUM\(rCPUSeconds\), 
+			SUM\(rMemoryMBSeconds\), 
+			SUM\(uTicksSeconds\), 
+			SUM\(uRSSSeconds\), 
+			SUM\(rMBits\), 
+			SUM\(rReservedPorts\), 
+			SUM\(rDynamicPorts\), 
+			SUM\(rMemoryMaxMB\), 
+			SUM\(rCores\), 
+			SUM\(rCoresMHz\), 
+			SUM\(wasteCPU\), 
+			SUM\(wasteMemoryMB\), 
+			SUM\(uTicksAvg\), 
+			SUM\(uTicksMax\), 
+			SUM\(uTicksP50\), 
+			SUM\(uTicksP95\), 
+			SUM\(uTicksP99\), 
+			SUM\(uRSSAvg\), 
+			SUM\(uRSSMax\), 
+			SUM\(uRSSP50\), 
+			SUM\(uRSSP95\), 
+			SUM\(uRSSP99\), 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(rssSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(rssSource, 'none'\), ''\)\), MAX\(rssSource\)\) END, 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(cacheSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(cacheSource, 'none'\), ''\)\), MAX\(cacheSource\)\) END, 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(ticksSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(ticksSource, 'none'\), ''\)\), MAX\(ticksSource\)\) END, 
+			SUM\(measuredAllocs\), 
+			SUM\(totalAllocs\), 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(secondsSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(secondsSource, 'none'\), ''\)\), MAX\(secondsSource\)\) END, CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(requestsSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(requestsSource, 'none'\), ''\)\), MAX\(requestsSource\)\) END 
 		FROM 
 			resources 
 		WHERE 
-			insertTime IN \(SELECT MAX\(insertTime\) FROM resources\) 
+			insertTime \= \(SELECT MAX\(latest\.insertTime\) FROM resources latest WHERE latest\.JobID \= resources\.JobID AND latest\.cluster \= resources\.cluster\) AND insertTime >\= \(SELECT COALESCE\(MAX\(runs\.insertTime\), '1900-01-01'\) FROM collection_runs runs WHERE runs\.scoped \= 0\) 
 			AND JobID \= 'JobID1' 
 		GROUP BY 
 			JobID, 
 			name, 
 			namespace, 
 			dataCenters, 
-			insertTime`
-	rows := sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime"})
+			insertTime, 
+			region, 
+			cluster, 
+			jobType`
+	rows := sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"})
 	mock.ExpectQuery(query).WillReturnRows(rows)
-	all, err = getLatestJobDB(db, "JobID1")
+	all, err = getLatestJobDB(db, "JobID1", "", Filter{})
 	assert.Empty(t, err)
 	assert.Empty(t, all)
 
 	// Test after inserting rows into DB
-	rows = sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime"}).
-		AddRow("JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "0001-01-04T00:00:00Z")
+	rows = sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow("JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "0001-01-04T00:00:00Z", "", "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "")
 	mock.ExpectQuery(query).WillReturnRows(rows)
-	all, err = getLatestJobDB(db, "JobID1")
+	all, err = getLatestJobDB(db, "JobID1", "", Filter{})
 	assert.Empty(t, err)
 	assert.NotEmpty(t, all)
 
@@ -308,6 +607,39 @@ func TestGetLatestJobDBMock(t *testing.T) {
 			"dataCenter1",
 			"",
 			"0001-01-04T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 	}
 	assert.Equal(t, expected, all)
@@ -320,7 +652,7 @@ func TestGetLatestJobDBLive(t *testing.T) {
 	os.Setenv("CONNECTION_STRING", "Server=localhost;Database=master;User Id=sa;Password=yourStrong(!)Password;")
 	db, _, err = initDB()
 
-	all, err := getLatestJobDB(db, "JobID1")
+	all, err := getLatestJobDB(db, "JobID1", "", Filter{})
 	assert.Nil(t, err)
 	assert.NotNil(t, all)
 	expected := []JobDataDB{
@@ -338,26 +670,59 @@ func TestGetLatestJobDBLive(t *testing.T) {
 			"DC1",
 			"",
 			"2000-01-02T00:00:00Z",
-		},
-	}
-	assert.Equal(t, expected, all)
-}
-
-func TestGetTimeSliceDBMock(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	assert.Empty(t, err)
-	defer db.Close()
-
-	all, err := getTimeSliceDB(nil, "", "2020-07-07 17:34:53", "2020-07-18 17:42:19")
-	assert.NotNil(t, err)
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
+		},
+	}
+	assert.Equal(t, expected, all)
+}
+
+func TestGetTimeSliceDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	all, err := getTimeSliceDB(nil, "", "2020-07-07 17:34:53", "2020-07-18 17:42:19", "", Filter{})
+	assert.NotNil(t, err)
 	assert.Empty(t, all)
 
-	all, err = getTimeSliceDB(db, "", "2020-07-07 17:34:53", "2020-07-18 17:42:19")
+	all, err = getTimeSliceDB(db, "", "2020-07-07 17:34:53", "2020-07-18 17:42:19", "", Filter{})
 	assert.NotNil(t, err)
 	assert.Empty(t, all)
 
 	// Test on an empty DB
-	rows := sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime"})
+	rows := sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"})
 	query := `
 		SELECT 
 			JobID, 
@@ -370,7 +735,38 @@ func TestGetTimeSliceDBMock(t *testing.T) {
 			SUM\(rdiskMB\), 
 			namespace, 
 			dataCenters, 
-			insertTime 
+			insertTime, 
+			region, 
+			cluster, 
+			jobType, 
+			SUM\(rCPUSeconds\), 
+			SUM\(rMemoryMBSeconds\), 
+			SUM\(uTicksSeconds\), 
+			SUM\(uRSSSeconds\), 
+			SUM\(rMBits\), 
+			SUM\(rReservedPorts\), 
+			SUM\(rDynamicPorts\), 
+			SUM\(rMemoryMaxMB\), 
+			SUM\(rCores\), 
+			SUM\(rCoresMHz\), 
+			SUM\(wasteCPU\), 
+			SUM\(wasteMemoryMB\), 
+			SUM\(uTicksAvg\), 
+			SUM\(uTicksMax\), 
+			SUM\(uTicksP50\), 
+			SUM\(uTicksP95\), 
+			SUM\(uTicksP99\), 
+			SUM\(uRSSAvg\), 
+			SUM\(uRSSMax\), 
+			SUM\(uRSSP50\), 
+			SUM\(uRSSP95\), 
+			SUM\(uRSSP99\), 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(rssSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(rssSource, 'none'\), ''\)\), MAX\(rssSource\)\) END, 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(cacheSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(cacheSource, 'none'\), ''\)\), MAX\(cacheSource\)\) END, 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(ticksSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(ticksSource, 'none'\), ''\)\), MAX\(ticksSource\)\) END, 
+			SUM\(measuredAllocs\), 
+			SUM\(totalAllocs\), 
+			CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(secondsSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(secondsSource, 'none'\), ''\)\), MAX\(secondsSource\)\) END, CASE WHEN COUNT\(DISTINCT NULLIF\(NULLIF\(requestsSource, 'none'\), ''\)\) > 1 THEN 'mixed' ELSE COALESCE\(MAX\(NULLIF\(NULLIF\(requestsSource, 'none'\), ''\)\), MAX\(requestsSource\)\) END 
 		FROM 
 			resources 
 		WHERE 
@@ -381,19 +777,22 @@ func TestGetTimeSliceDBMock(t *testing.T) {
 			name, 
 			namespace, 
 			dataCenters, 
-			insertTime 
+			insertTime, 
+			region, 
+			cluster, 
+			jobType 
 		ORDER BY 
 			insertTime DESC`
 	mock.ExpectQuery(query).WillReturnRows(rows)
-	all, err = getTimeSliceDB(db, "JobID1", "2020-07-07 17:34:53", "2020-07-18 17:42:19")
+	all, err = getTimeSliceDB(db, "JobID1", "2020-07-07 17:34:53", "2020-07-18 17:42:19", "", Filter{})
 	assert.Empty(t, err)
 	assert.Empty(t, all)
 
 	// Test after inserting rows into DB
-	rows = sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime"}).
-		AddRow("JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "2020-07-07T17:35:00Z")
+	rows = sqlmock.NewRows([]string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}).
+		AddRow("JobID1", "name1", 111.1, 111.1, 111.1, 111.1, 111.1, 111.1, "namespace1", "dataCenter1", "2020-07-07T17:35:00Z", "", "", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "", "", "", 0.0, 0.0, "", "")
 	mock.ExpectQuery(query).WillReturnRows(rows)
-	all, err = getTimeSliceDB(db, "JobID1", "2020-07-07 17:34:53", "2020-07-18 17:42:19")
+	all, err = getTimeSliceDB(db, "JobID1", "2020-07-07 17:34:53", "2020-07-18 17:42:19", "", Filter{})
 	assert.Empty(t, err)
 	assert.NotEmpty(t, all)
 
@@ -412,6 +811,39 @@ func TestGetTimeSliceDBMock(t *testing.T) {
 			"dataCenter1",
 			"",
 			"2020-07-07T17:35:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 	}
 	assert.Equal(t, expected, all)
@@ -424,7 +856,7 @@ func TestGetTimeSliceDBLive(t *testing.T) {
 	os.Setenv("CONNECTION_STRING", "Server=localhost;Database=master;User Id=sa;Password=yourStrong(!)Password;")
 	db, _, err = initDB()
 
-	all, err := getTimeSliceDB(db, "JobID1", "2000-01-01 00:00:01", "2000-01-02 00:00:01")
+	all, err := getTimeSliceDB(db, "JobID1", "2000-01-01 00:00:01", "2000-01-02 00:00:01", "", Filter{})
 	assert.Nil(t, err)
 	assert.NotNil(t, all)
 
@@ -443,11 +875,44 @@ func TestGetTimeSliceDBLive(t *testing.T) {
 			"DC1",
 			"",
 			"2000-01-02T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 	}
 	assert.Equal(t, expected, all)
 
-	all, err = getTimeSliceDB(db, "JobID1", "2000-01-01 00:00:00", "2000-01-01 12:00:01")
+	all, err = getTimeSliceDB(db, "JobID1", "2000-01-01 00:00:00", "2000-01-01 12:00:01", "", Filter{})
 	assert.Nil(t, err)
 	assert.NotNil(t, all)
 
@@ -466,16 +931,480 @@ func TestGetTimeSliceDBLive(t *testing.T) {
 			"DC1",
 			"",
 			"2000-01-01T00:00:00Z",
+			"",
+			"",
+			"service",
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			0,
+			"",
+			"",
+			"",
+			0,
+			0,
+			1,
+			"",
+			"",
 		},
 	}
 	assert.NotNil(t, all)
 	assert.Equal(t, expected, all)
 
-	all, err = getTimeSliceDB(db, "JobID1", "2000-04-04 00:00:00", "2000-05-05 12:00:01")
+	all, err = getTimeSliceDB(db, "JobID1", "2000-04-04 00:00:00", "2000-05-05 12:00:01", "", Filter{})
 	assert.Nil(t, err)
 	assert.NotNil(t, all)
 
 	expected = []JobDataDB{}
 	assert.NotNil(t, all)
 	assert.Equal(t, expected, all)
-}
\ No newline at end of file
+}
+
+func TestInsertTasksDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	err = insertTasksDB(nil, JobData{}, "2020-07-07 17:35:00")
+	assert.NotNil(t, err)
+
+	jobData := JobData{
+		JobID:     "JobID1",
+		Namespace: "default",
+		Region:    "global",
+		Cluster:   "cluster1",
+		Tasks: []TaskData{
+			{"TaskGroup1", "web", 2, 1000, 2048, 250.5, 100, 10},
+			{"TaskGroup1", "sidecar", 2, 200, 128, 20, 10, 0},
+		},
+	}
+	query := `INSERT INTO task_resources`
+	mock.ExpectExec(query).
+		WithArgs("JobID1", "default", "global", "TaskGroup1", "web", 2.0, 1000.0, 2048.0, 250.5, 100.0, 10.0, "2020-07-07 17:35:00", "cluster1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(query).
+		WithArgs("JobID1", "default", "global", "TaskGroup1", "sidecar", 2.0, 200.0, 128.0, 20.0, 10.0, 0.0, "2020-07-07 17:35:00", "cluster1").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	err = insertTasksDB(db, jobData, "2020-07-07 17:35:00")
+	assert.Empty(t, err)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetJobGroupsDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	groups, err := getJobGroupsDB(nil, "JobID1", Filter{})
+	assert.NotNil(t, err)
+	assert.Empty(t, groups)
+
+	query := `
+		SELECT 
+			cluster, 
+			taskGroup, 
+			task, 
+			SUM\(count\), 
+			SUM\(rCPU\), 
+			SUM\(rMemoryMB\), 
+			SUM\(uTicks\), 
+			SUM\(uRSS\), 
+			SUM\(uCache\) 
+		FROM 
+			task_resources 
+		WHERE 
+			insertTime \= \(SELECT MAX\(latest\.insertTime\) FROM task_resources latest WHERE latest\.JobID \= task_resources\.JobID AND latest\.cluster \= task_resources\.cluster\) AND insertTime >\= \(SELECT COALESCE\(MAX\(runs\.insertTime\), '1900-01-01'\) FROM collection_runs runs WHERE runs\.scoped \= 0\) 
+			AND JobID \= \? 
+		GROUP BY 
+			cluster, 
+			taskGroup, 
+			task 
+		ORDER BY 
+			cluster, 
+			taskGroup, 
+			task`
+	columns := []string{"cluster", "taskGroup", "task", "count", "rCPU", "rMemoryMB", "uTicks", "uRSS", "uCache"}
+	mock.ExpectQuery(query).WithArgs("JobID1").WillReturnRows(sqlmock.NewRows(columns))
+	groups, err = getJobGroupsDB(db, "JobID1", Filter{})
+	assert.Empty(t, err)
+	assert.Empty(t, groups)
+
+	rows := sqlmock.NewRows(columns).
+		AddRow("cluster1", "TaskGroup1", "sidecar", 2.0, 200.0, 128.0, 20.0, 10.0, 0.0).
+		AddRow("cluster1", "TaskGroup1", "web", 2.0, 1000.0, 2048.0, 250.5, 100.0, 10.0).
+		AddRow("cluster1", "TaskGroup2", "worker", 1.0, 100.0, 256.0, 50.0, 64.0, 1.0)
+	mock.ExpectQuery(`AND JobID \= \? AND region \= \?`).WithArgs("JobID1", "global").WillReturnRows(rows)
+	groups, err = getJobGroupsDB(db, "JobID1", Filter{Region: "global"})
+	assert.Empty(t, err)
+
+	expected := []GroupDataDB{
+		{
+			Cluster:   "cluster1",
+			TaskGroup: "TaskGroup1",
+			Count:     2,
+			RCPU:      1200,
+			RMemoryMB: 2176,
+			UTicks:    270.5,
+			URSS:      110,
+			UCache:    10,
+			Tasks: []TaskData{
+				{"TaskGroup1", "sidecar", 2, 200, 128, 20, 10, 0},
+				{"TaskGroup1", "web", 2, 1000, 2048, 250.5, 100, 10},
+			},
+		},
+		{
+			Cluster:   "cluster1",
+			TaskGroup: "TaskGroup2",
+			Count:     1,
+			RCPU:      100,
+			RMemoryMB: 256,
+			UTicks:    50,
+			URSS:      64,
+			UCache:    1,
+			Tasks: []TaskData{
+				{"TaskGroup2", "worker", 1, 100, 256, 50, 64, 1},
+			},
+		},
+	}
+	assert.Equal(t, expected, groups)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertAllocsDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	err = insertAllocsDB(nil, JobData{}, "2020-07-07 17:35:00")
+	assert.NotNil(t, err)
+
+	jobData := JobData{
+		JobID:     "JobID1",
+		Namespace: "default",
+		Region:    "global",
+		Cluster:   "cluster1",
+		Allocs: []AllocData{
+			{"alloc_id1", "node_id1", "node1", "TaskGroup1", "running", 600, 1088, 250.5, 100, 10},
+		},
+	}
+	mock.ExpectExec(`INSERT INTO allocations`).
+		WithArgs("JobID1", "default", "global", "alloc_id1", "node_id1", "node1", "TaskGroup1", "running", 600.0, 1088.0, 250.5, 100.0, 10.0, "2020-07-07 17:35:00", "cluster1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = insertAllocsDB(db, jobData, "2020-07-07 17:35:00")
+	assert.Empty(t, err)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetAllocationsDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	all, err := getAllocationsDB(nil, AllocFilter{}, Filter{})
+	assert.NotNil(t, err)
+	assert.Empty(t, all)
+
+	columns := []string{"JobID", "namespace", "region", "cluster", "allocID", "nodeID", "nodeName", "taskGroup", "clientStatus", "rCPU", "rMemoryMB", "uTicks", "uRSS", "uCache", "insertTime"}
+
+	// Latest cycle
+	query := `
+		SELECT 
+			JobID, 
+			namespace, 
+			region, 
+			cluster, 
+			allocID, 
+			nodeID, 
+			nodeName, 
+			taskGroup, 
+			clientStatus, 
+			rCPU, 
+			rMemoryMB, 
+			uTicks, 
+			uRSS, 
+			uCache, 
+			insertTime 
+		FROM 
+			allocations 
+		WHERE 
+			insertTime \= \(SELECT MAX\(latest\.insertTime\) FROM allocations latest WHERE latest\.JobID \= allocations\.JobID AND latest\.cluster \= allocations\.cluster\) AND insertTime >\= \(SELECT COALESCE\(MAX\(runs\.insertTime\), '1900-01-01'\) FROM collection_runs runs WHERE runs\.scoped \= 0\) 
+			AND nodeID \= \? 
+		ORDER BY 
+			insertTime DESC, 
+			cluster, 
+			JobID, 
+			allocID`
+	rows := sqlmock.NewRows(columns).
+		AddRow("JobID1", "default", "global", "cluster1", "alloc_id1", "node_id1", "node1", "TaskGroup1", "running", 600.0, 1088.0, 250.5, 100.0, 10.0, "2020-07-07T17:35:00Z")
+	mock.ExpectQuery(query).WithArgs("node_id1").WillReturnRows(rows)
+	all, err = getAllocationsDB(db, AllocFilter{NodeID: "node_id1"}, Filter{})
+	assert.Empty(t, err)
+
+	expected := []AllocDataDB{
+		{"JobID1", "default", "global", "cluster1", "alloc_id1", "node_id1", "node1", "TaskGroup1", "running", 600, 1088, 250.5, 100, 10, "2020-07-07T17:35:00Z"},
+	}
+	assert.Equal(t, expected, all)
+
+	// Allocation history
+	query = `WHERE insertTime BETWEEN \? AND \? AND JobID \= \? AND allocID \= \? AND region \= \?`
+	mock.ExpectQuery(query).
+		WithArgs("2020-07-07 00:00:00", "2020-07-08 00:00:00", "JobID1", "alloc_id1", "global").
+		WillReturnRows(sqlmock.NewRows(columns))
+	all, err = getAllocationsDB(db, AllocFilter{JobID: "JobID1", AllocID: "alloc_id1", Begin: "2020-07-07 00:00:00", End: "2020-07-08 00:00:00"}, Filter{Region: "global"})
+	assert.Empty(t, err)
+	assert.Empty(t, all)
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertNodesDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	err = insertNodesDB(nil, nil, "2020-07-07 17:35:00")
+	assert.NotNil(t, err)
+
+	nodes := []NodeData{
+		{"node_id1", "node1", "cluster1", "global", "DC1", "web", "ready", "eligible", false, 8000, 16384, 100000, 500, 1024, 5000},
+	}
+	mock.ExpectExec(`INSERT INTO nodes`).
+		WithArgs("node_id1", "node1", "cluster1", "global", "DC1", "web", "ready", "eligible", false, 8000.0, 16384.0, 100000.0, 500.0, 1024.0, 5000.0, "2020-07-07 17:35:00").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = insertNodesDB(db, nodes, "2020-07-07 17:35:00")
+	assert.Empty(t, err)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertCapacityDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	err = insertCapacityDB(nil, CapacityData{}, "2020-07-07 17:35:00")
+	assert.NotNil(t, err)
+
+	capacity := CapacityData{"cluster1", 3, 2, 12000, 24576, 150000, 500, 1024, 5000, 1500, 2304, 450, 270.5, 110}
+	mock.ExpectExec(`INSERT INTO capacity`).
+		WithArgs("cluster1", 3, 2, 12000.0, 24576.0, 150000.0, 500.0, 1024.0, 5000.0, 1500.0, 2304.0, 450.0, 270.5, 110.0, "2020-07-07 17:35:00").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = insertCapacityDB(db, capacity, "2020-07-07 17:35:00")
+	assert.Empty(t, err)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetCapacityDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	_, err = getCapacityDB(nil, "cluster1")
+	assert.NotNil(t, err)
+
+	columns := []string{"cluster", "nodes", "readyNodes", "cpu", "memoryMB", "diskMB", "reservedCPU", "reservedMemoryMB", "reservedDiskMB", "allocatedCPU", "allocatedMemoryMB", "allocatedDiskMB", "usedCPU", "usedMemoryMB", "insertTime"}
+	query := `SELECT TOP 1 (.+) FROM capacity WHERE cluster \= \? ORDER BY insertTime DESC`
+	rows := sqlmock.NewRows(columns).
+		AddRow("cluster1", 3, 2, 12000.0, 24576.0, 150000.0, 500.0, 1024.0, 5000.0, 1500.0, 2304.0, 450.0, 270.5, 110.0, "2020-07-07T17:35:00Z")
+	mock.ExpectQuery(query).WithArgs("cluster1").WillReturnRows(rows)
+	capacity, err := getCapacityDB(db, "cluster1")
+	assert.Empty(t, err)
+	assert.Equal(t, CapacityDataDB{"cluster1", 3, 2, 12000, 24576, 150000, 500, 1024, 5000, 1500, 2304, 450, 270.5, 110, "2020-07-07T17:35:00Z"}, capacity)
+
+	mock.ExpectQuery(query).WithArgs("cluster2").WillReturnRows(sqlmock.NewRows(columns))
+	_, err = getCapacityDB(db, "cluster2")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertDevicesDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	err = insertDevicesDB(nil, JobData{}, "2020-07-07 17:35:00")
+	assert.NotNil(t, err)
+
+	jobData := JobData{
+		JobID:     "JobID1",
+		Namespace: "ml",
+		Region:    "global",
+		Cluster:   "cluster1",
+		Devices: []DeviceData{
+			{"nvidia/gpu", "${device.attr.memory} >= 11 GiB", 6},
+		},
+	}
+	mock.ExpectExec(`INSERT INTO devices`).
+		WithArgs("JobID1", "ml", "global", "nvidia/gpu", "${device.attr.memory} >= 11 GiB", 6.0, "2020-07-07 17:35:00", "cluster1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = insertDevicesDB(db, jobData, "2020-07-07 17:35:00")
+	assert.Empty(t, err)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDevicesDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	all, err := getDevicesDB(nil, "", Filter{})
+	assert.NotNil(t, err)
+	assert.Empty(t, all)
+
+	query := `
+		SELECT 
+			cluster, 
+			namespace, 
+			device, 
+			SUM\(count\) 
+		FROM 
+			devices 
+		WHERE 
+			insertTime \= \(SELECT MAX\(latest\.insertTime\) FROM devices latest WHERE latest\.JobID \= devices\.JobID AND latest\.cluster \= devices\.cluster\) AND insertTime >\= \(SELECT COALESCE\(MAX\(runs\.insertTime\), '1900-01-01'\) FROM collection_runs runs WHERE runs\.scoped \= 0\) 
+		GROUP BY 
+			cluster, 
+			namespace, 
+			device 
+		ORDER BY 
+			cluster, 
+			namespace, 
+			device`
+	rows := sqlmock.NewRows([]string{"cluster", "namespace", "device", "count"}).
+		AddRow("cluster1", "default", "nvidia/gpu", 1.0).
+		AddRow("cluster1", "ml", "nvidia/gpu", 6.0)
+	mock.ExpectQuery(query).WillReturnRows(rows)
+	all, err = getDevicesDB(db, "", Filter{})
+	assert.Empty(t, err)
+	assert.Equal(t, []DeviceUsageDB{{"cluster1", "default", "nvidia/gpu", 1}, {"cluster1", "ml", "nvidia/gpu", 6}}, all)
+
+	query = `WHERE insertTime \= \(SELECT MAX\(latest\.insertTime\) FROM devices latest WHERE latest\.JobID \= devices\.JobID AND latest\.cluster \= devices\.cluster\) AND insertTime >\= \(SELECT COALESCE\(MAX\(runs\.insertTime\), '1900-01-01'\) FROM collection_runs runs WHERE runs\.scoped \= 0\) AND namespace \= \? AND region \= \?`
+	mock.ExpectQuery(query).WithArgs("ml", "global").
+		WillReturnRows(sqlmock.NewRows([]string{"cluster", "namespace", "device", "count"}).AddRow("cluster1", "ml", "nvidia/gpu", 6.0))
+	all, err = getDevicesDB(db, "ml", Filter{Region: "global"})
+	assert.Empty(t, err)
+	assert.Equal(t, []DeviceUsageDB{{"cluster1", "ml", "nvidia/gpu", 6}}, all)
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+func TestInsertRunDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	_, err = insertRunDB(nil, CollectionRun{}, "", false)
+	assert.NotNil(t, err)
+
+	run := CollectionRun{0, "2020-07-07 17:35:00", "2020-07-07 17:36:30", 90, "partial", []ClusterRun{
+		{"cluster1", "succeeded", 12, 10, 0, "", false},
+		{"cluster2", "failed", 0, 0, 3, "Unexpected status 403 from nomad2:4646/v1/jobs", false},
+	}}
+	mock.ExpectQuery(`INSERT INTO collection_runs (.+) OUTPUT INSERTED.id`).
+		WithArgs("2020-07-07 17:35:00", "2020-07-07 17:36:30", 90.0, "partial", "2020-07-07 17:35:00", false).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec(`INSERT INTO collection_run_clusters`).
+		WithArgs(7, "cluster1", "succeeded", 12, 10, 0, "", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO collection_run_clusters`).
+		WithArgs(7, "cluster2", "failed", 0, 0, 3, "Unexpected status 403 from nomad2:4646/v1/jobs", false).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	id, err := insertRunDB(db, run, "2020-07-07 17:35:00", false)
+	assert.Empty(t, err)
+	assert.Equal(t, 7, id)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetRunsDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	_, err = getRunsDB(nil, 20)
+	assert.NotNil(t, err)
+	_, err = getRunDB(nil, 7)
+	assert.NotNil(t, err)
+
+	runColumns := []string{"id", "beginTime", "endTime", "durationSeconds", "status"}
+	clusterColumns := []string{"runID", "cluster", "status", "jobsSeen", "jobsStored", "errors", "firstError", "timedOut"}
+
+	// Test on an empty DB
+	mock.ExpectQuery(`SELECT TOP \(\?\) (.+) FROM collection_runs ORDER BY id DESC`).WithArgs(20).WillReturnRows(sqlmock.NewRows(runColumns))
+	runs, err := getRunsDB(db, 20)
+	assert.Empty(t, err)
+	assert.Equal(t, []CollectionRun{}, runs)
+
+	mock.ExpectQuery(`SELECT TOP \(\?\) (.+) FROM collection_runs ORDER BY id DESC`).WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(runColumns).
+			AddRow(7, "2020-07-07T17:50:00Z", "2020-07-07T17:51:00Z", 60.0, "succeeded").
+			AddRow(6, "2020-07-07T17:35:00Z", "2020-07-07T17:36:30Z", 90.0, "failed"))
+	mock.ExpectQuery(`FROM collection_run_clusters WHERE runID BETWEEN \? AND \? ORDER BY runID, cluster`).WithArgs(6, 7).
+		WillReturnRows(sqlmock.NewRows(clusterColumns).
+			AddRow(6, "cluster1", "failed", 0, 0, 3, "Unexpected status 403 from nomad1:4646/v1/jobs", false).
+			AddRow(7, "cluster1", "succeeded", 12, 10, 0, "", false))
+	runs, err = getRunsDB(db, 2)
+	assert.Empty(t, err)
+	expected := []CollectionRun{
+		{7, "2020-07-07T17:50:00Z", "2020-07-07T17:51:00Z", 60, "succeeded", []ClusterRun{
+			{"cluster1", "succeeded", 12, 10, 0, "", false},
+		}},
+		{6, "2020-07-07T17:35:00Z", "2020-07-07T17:36:30Z", 90, "failed", []ClusterRun{
+			{"cluster1", "failed", 0, 0, 3, "Unexpected status 403 from nomad1:4646/v1/jobs", false},
+		}},
+	}
+	assert.Equal(t, expected, runs)
+
+	mock.ExpectQuery(`FROM collection_runs WHERE id \= \?`).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(runColumns).AddRow(7, "2020-07-07T17:50:00Z", "2020-07-07T17:51:00Z", 60.0, "succeeded"))
+	mock.ExpectQuery(`FROM collection_run_clusters WHERE runID BETWEEN \? AND \?`).WithArgs(7, 7).
+		WillReturnRows(sqlmock.NewRows(clusterColumns).AddRow(7, "cluster1", "succeeded", 12, 10, 0, "", false))
+	run, err := getRunDB(db, 7)
+	assert.Empty(t, err)
+	assert.Equal(t, expected[0], run)
+
+	mock.ExpectQuery(`FROM collection_runs WHERE id \= \?`).WithArgs(8).WillReturnRows(sqlmock.NewRows(runColumns))
+	_, err = getRunDB(db, 8)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestGetInsertTimesDBMock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Empty(t, err)
+	defer db.Close()
+
+	_, err = getInsertTimesDB(nil, "cluster1", "2020-07-07 17:30:00", "2020-07-07 18:00:00")
+	assert.NotNil(t, err)
+
+	mock.ExpectQuery(`SELECT DISTINCT insertTime FROM resources WHERE cluster = \? AND insertTime BETWEEN \? AND \?`).
+		WithArgs("cluster1", "2020-07-07 17:30:00", "2020-07-07 18:00:00").
+		WillReturnRows(sqlmock.NewRows([]string{"insertTime"}).
+			AddRow(time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC)).
+			AddRow(time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC)))
+	insertTimes, err := getInsertTimesDB(db, "cluster1", "2020-07-07 17:30:00", "2020-07-07 18:00:00")
+	assert.Empty(t, err)
+	assert.Equal(t, map[string]struct{}{"2020-07-07 17:30:00": {}, "2020-07-07 17:45:00": {}}, insertTimes)
+
+	mock.ExpectQuery("SELECT DISTINCT insertTime").WillReturnError(errors.New("connection reset"))
+	_, err = getInsertTimesDB(db, "cluster1", "2020-07-07 17:30:00", "2020-07-07 18:00:00")
+	assert.EqualError(t, err, "Error in querying DB: connection reset")
+
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,488 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventTopics are the topics of Nomad's event stream the job model subscribes to
+const eventTopics = "topic=Job:*&topic=Allocation:*&topic=Deployment:*&topic=Node:*"
+
+// maxLifecycleEvents bounds the number of lifecycle events kept in memory across all clusters
+const maxLifecycleEvents = 1000
+
+var (
+	// eventReconnectDelay is waited before resuming an event stream that failed or disconnected
+	eventReconnectDelay = 5 * time.Second
+
+	jobModels     = make(map[string]*JobModel)
+	jobModelsLock sync.RWMutex
+	stopEvents    context.CancelFunc
+
+	lifecycleEvents     []LifecycleEvent
+	lifecycleEventsLock sync.RWMutex
+)
+
+// LifecycleEvent is a job, allocation, deployment or node event received from a cluster's event stream
+type LifecycleEvent struct {
+	Cluster   string
+	Region    string
+	Topic     string
+	Type      string
+	Key       string
+	Namespace string
+	Index     uint64
+	Time      string
+}
+
+type EventFrame struct {
+	Index  uint64
+	Events []Event
+}
+
+type Event struct {
+	Topic     string
+	Type      string
+	Key       string
+	Namespace string
+	Index     uint64
+	Payload   EventPayload
+}
+
+type EventPayload struct {
+	Job        *EventJob
+	Allocation *EventAlloc
+}
+
+// EventJob holds the fields of a full job carried by job events that a job listing reports in JobDesc
+type EventJob struct {
+	ID               string
+	ParentID         string
+	Name             string
+	Namespace        string
+	Datacenters      []string
+	Type             string
+	Periodic         *struct{ Enabled bool }
+	ParameterizedJob *struct{}
+	JobModifyIndex   uint64
+}
+
+type EventAlloc struct {
+	Alloc
+	JobID     string
+	Namespace string
+}
+
+// JobModel tracks the jobs and allocations of a cluster region between cycles from its event stream.
+// Deregistered jobs and terminal allocations are kept for two collection windows so short-lived ones are collected.
+type JobModel struct {
+	lock   sync.RWMutex
+	synced bool
+	index  uint64
+	jobs   map[string]*modelJob
+	allocs map[string]*modelAlloc
+}
+
+type modelJob struct {
+	job            JobDesc
+	deregisteredAt time.Time
+}
+
+type modelAlloc struct {
+	alloc      Alloc
+	jobID      string
+	namespace  string
+	terminalAt time.Time
+}
+
+func newJobModel() *JobModel {
+	return &JobModel{jobs: make(map[string]*modelJob), allocs: make(map[string]*modelAlloc)}
+}
+
+// modelKey names the model of a cluster region
+func modelKey(cluster *NomadCluster) string {
+	return cluster.Name + "/" + cluster.Region
+}
+
+// getJobModel returns the model of the cluster's region once it is synced, or nil when jobs must be listed from Nomad
+func getJobModel(cluster *NomadCluster) *JobModel {
+	jobModelsLock.RLock()
+	model, ok := jobModels[modelKey(cluster)]
+	jobModelsLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	model.lock.RLock()
+	defer model.lock.RUnlock()
+	if !model.synced {
+		return nil
+	}
+
+	return model
+}
+
+// startEventStreams subscribes to the event stream of every region of the clusters with EventStream set,
+// stopping the subscriptions of the previous config
+func startEventStreams(clusters []*NomadCluster) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	jobModelsLock.Lock()
+	if stopEvents != nil {
+		stopEvents()
+	}
+	stopEvents = cancel
+	jobModels = make(map[string]*JobModel)
+	jobModelsLock.Unlock()
+
+	for _, cluster := range clusters {
+		if !cluster.EventStream {
+			continue
+		}
+		go subscribeCluster(ctx, cluster)
+	}
+}
+
+// subscribeCluster subscribes to the event stream of every region of cluster until ctx ends.
+// Models are looked up by region, so the regions are resolved again after eventReconnectDelay until they are known.
+func subscribeCluster(ctx context.Context, cluster *NomadCluster) {
+	log.SetReportCaller(true)
+
+	for ctx.Err() == nil {
+		regions := getRegions(ctx, cluster)
+		if !contains(regions, "") {
+			for _, region := range regions {
+				regionCluster := cluster.withRegion(region)
+				model := newJobModel()
+				if !addJobModel(ctx, regionCluster, model) {
+					return
+				}
+				go subscribeEvents(ctx, regionCluster, model)
+			}
+			return
+		}
+		log.Warning(fmt.Sprintf("Regions of %s are unknown, retrying its event stream in %v", cluster.Name, eventReconnectDelay))
+
+		select {
+		case <-time.After(eventReconnectDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// addJobModel registers the model of a cluster region, unless ctx was ended by a newer call to startEventStreams
+func addJobModel(ctx context.Context, cluster *NomadCluster, model *JobModel) bool {
+	jobModelsLock.Lock()
+	defer jobModelsLock.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	jobModels[modelKey(cluster)] = model
+	return true
+}
+
+// subscribeEvents keeps model in sync with the event stream of a cluster region until ctx ends.
+// The model is loaded from the job and allocation listings first, then every reconnection resumes from the last index,
+// loading the model again when events may have been missed in between.
+func subscribeEvents(ctx context.Context, cluster *NomadCluster, model *JobModel) {
+	log.SetReportCaller(true)
+
+	reload := true
+	for ctx.Err() == nil {
+		var err error
+		resumed := !reload
+		if reload {
+			err = model.load(ctx, cluster)
+		}
+		if err == nil {
+			reload = false
+			err = model.stream(ctx, cluster, resumed)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if _, ok := err.(eventGapError); ok {
+			log.Warning(fmt.Sprintf("Event stream of %s resumed past missed events, listing jobs and allocations again: %v", modelKey(cluster), err))
+			reload = true
+			continue
+		}
+		log.Warning(fmt.Sprintf("Event stream of %s disconnected, resuming from index %d: %v", modelKey(cluster), model.lastIndex(), err))
+
+		select {
+		case <-time.After(eventReconnectDelay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// eventGapError is returned when a resumed event stream starts past the index following the model's last index,
+// as Nomad only buffers a limited number of events
+type eventGapError struct {
+	from, to uint64
+}
+
+func (e eventGapError) Error() string {
+	return fmt.Sprintf("Events from index %d to %d may have been missed", e.from, e.to)
+}
+
+// load replaces the model with the jobs and allocations listed in every namespace of the cluster region
+func (m *JobModel) load(ctx context.Context, cluster *NomadCluster) error {
+	allNamespaces := cluster.withNamespace("*")
+
+	response, err := allNamespaces.get(ctx, "/v1/jobs")
+	if err != nil {
+		return fmt.Errorf("Error in getting API response: %v", err)
+	}
+	defer response.Body.Close()
+	var jobs []JobDesc
+	err = json.NewDecoder(response.Body).Decode(&jobs)
+	if err != nil {
+		return fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+	jobsIndex, _ := strconv.ParseUint(response.Header.Get("X-Nomad-Index"), 10, 64)
+
+	response, err = allNamespaces.get(ctx, "/v1/allocations")
+	if err != nil {
+		return fmt.Errorf("Error in getting API response: %v", err)
+	}
+	defer response.Body.Close()
+	var allocs []EventAlloc
+	err = json.NewDecoder(response.Body).Decode(&allocs)
+	if err != nil {
+		return fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+	allocsIndex, _ := strconv.ParseUint(response.Header.Get("X-Nomad-Index"), 10, 64)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.jobs = make(map[string]*modelJob)
+	m.allocs = make(map[string]*modelAlloc)
+	for _, job := range jobs {
+		m.jobs[namespaceOf(job.JobSummary.Namespace)+"/"+job.ID] = &modelJob{job: job}
+	}
+	for _, alloc := range allocs {
+		m.setAlloc(alloc)
+	}
+	// Events between the two listings are streamed again, applying them twice is harmless
+	m.index = jobsIndex
+	if allocsIndex < jobsIndex {
+		m.index = allocsIndex
+	}
+	m.synced = true
+
+	return nil
+}
+
+// stream applies the events of the cluster region from the model's last index until the stream ends.
+// A resumed stream whose first frame skips indexes returns an eventGapError without applying it. Raft indexes also
+// advance without events, so the model may be loaded again needlessly after a quiet period, which is harmless.
+func (m *JobModel) stream(ctx context.Context, cluster *NomadCluster, resumed bool) error {
+	from := m.lastIndex() + 1
+	path := "/v1/event/stream?" + eventTopics + "&index=" + strconv.FormatUint(from, 10)
+	response, err := cluster.withNamespace("*").stream(ctx, path)
+	if err != nil {
+		return fmt.Errorf("Error in getting API response: %v", err)
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var frame EventFrame
+		err = decoder.Decode(&frame)
+		if err != nil {
+			return fmt.Errorf("Error in decoding JSON: %v", err)
+		}
+		// Heartbeats carry no events
+		if frame.Index == 0 {
+			continue
+		}
+		if resumed && frame.Index > from {
+			return eventGapError{from, frame.Index - 1}
+		}
+		resumed = false
+		m.apply(cluster, frame)
+	}
+}
+
+// apply updates the model with the events of a frame and records them as lifecycle events
+func (m *JobModel) apply(cluster *NomadCluster, frame EventFrame) {
+	now := time.Now()
+
+	m.lock.Lock()
+	for _, event := range frame.Events {
+		switch {
+		case event.Topic == "Job" && event.Payload.Job != nil:
+			job := event.Payload.Job
+			key := namespaceOf(job.Namespace) + "/" + job.ID
+			if event.Type == "JobDeregistered" || event.Type == "JobBatchDeregistered" {
+				if j, ok := m.jobs[key]; ok && j.deregisteredAt.IsZero() {
+					j.deregisteredAt = now
+				}
+				continue
+			}
+			m.jobs[key] = &modelJob{job: JobDesc{
+				ID:               job.ID,
+				ParentID:         job.ParentID,
+				Name:             job.Name,
+				Datacenters:      job.Datacenters,
+				Type:             job.Type,
+				Periodic:         job.Periodic != nil && job.Periodic.Enabled,
+				ParameterizedJob: job.ParameterizedJob != nil,
+				JobSummary:       JobSum{job.Namespace},
+				JobModifyIndex:   job.JobModifyIndex,
+			}}
+		case event.Topic == "Allocation" && event.Payload.Allocation != nil:
+			m.setAlloc(*event.Payload.Allocation)
+		}
+	}
+	if frame.Index > m.index {
+		m.index = frame.Index
+	}
+	m.prune(now)
+	m.lock.Unlock()
+
+	recordEvents(cluster, frame.Events, now)
+}
+
+// setAlloc adds or updates an allocation, the model's lock must be held
+func (m *JobModel) setAlloc(alloc EventAlloc) {
+	previous, ok := m.allocs[alloc.ID]
+	updated := &modelAlloc{alloc.Alloc, alloc.JobID, namespaceOf(alloc.Namespace), time.Time{}}
+	if isTerminal(alloc.ClientStatus) {
+		updated.terminalAt = time.Now()
+		if ok && !previous.terminalAt.IsZero() {
+			updated.terminalAt = previous.terminalAt
+		}
+	}
+	m.allocs[alloc.ID] = updated
+}
+
+// prune drops the jobs deregistered and the allocations terminal for longer than two collection windows,
+// the model's lock must be held
+func (m *JobModel) prune(now time.Time) {
+	retention := 2 * collectionWindow
+	for key, job := range m.jobs {
+		if !job.deregisteredAt.IsZero() && now.Sub(job.deregisteredAt) > retention {
+			delete(m.jobs, key)
+		}
+	}
+	for id, alloc := range m.allocs {
+		if !alloc.terminalAt.IsZero() && now.Sub(alloc.terminalAt) > retention {
+			delete(m.allocs, id)
+		}
+	}
+}
+
+func (m *JobModel) lastIndex() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.index
+}
+
+// listJobs returns the jobs of a namespace sorted by ID, as listed by /v1/jobs
+func (m *JobModel) listJobs(namespace string) []JobDesc {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	jobs := []JobDesc{}
+	for _, job := range m.jobs {
+		if namespaceOf(job.job.JobSummary.Namespace) == namespaceOf(namespace) {
+			jobs = append(jobs, job.job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+
+	return jobs
+}
+
+// listAllocs returns the allocations of a job sorted by creation, as listed by /v1/job/:job_id/allocations
+func (m *JobModel) listAllocs(namespace, jobID string) []Alloc {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	allocs := []Alloc{}
+	for _, alloc := range m.allocs {
+		if alloc.jobID == jobID && alloc.namespace == namespaceOf(namespace) {
+			allocs = append(allocs, alloc.alloc)
+		}
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		if allocs[i].CreateTime != allocs[j].CreateTime {
+			return allocs[i].CreateTime < allocs[j].CreateTime
+		}
+		return allocs[i].ID < allocs[j].ID
+	})
+
+	return allocs
+}
+
+// namespaceOf treats objects of Nomad versions without namespaces as part of the default namespace
+func namespaceOf(namespace string) string {
+	if namespace == "" {
+		return "default"
+	}
+	return namespace
+}
+
+// recordEvents keeps the most recent lifecycle events of every cluster
+func recordEvents(cluster *NomadCluster, events []Event, now time.Time) {
+	lifecycleEventsLock.Lock()
+	defer lifecycleEventsLock.Unlock()
+
+	for _, event := range events {
+		log.Trace(fmt.Sprintf("%s %s %s %s", modelKey(cluster), event.Topic, event.Type, event.Key))
+		lifecycleEvents = append(lifecycleEvents, LifecycleEvent{
+			cluster.Name,
+			cluster.Region,
+			event.Topic,
+			event.Type,
+			event.Key,
+			event.Namespace,
+			event.Index,
+			now.Format("2006-01-02 15:04:05"),
+		})
+	}
+	if len(lifecycleEvents) > maxLifecycleEvents {
+		lifecycleEvents = append([]LifecycleEvent{}, lifecycleEvents[len(lifecycleEvents)-maxLifecycleEvents:]...)
+	}
+}
+
+// getLifecycleEvents returns the recorded lifecycle events, oldest first, of a cluster and topic when not empty
+func getLifecycleEvents(cluster, topic string) []LifecycleEvent {
+	lifecycleEventsLock.RLock()
+	defer lifecycleEventsLock.RUnlock()
+
+	events := []LifecycleEvent{}
+	for _, event := range lifecycleEvents {
+		if (cluster == "" || event.Cluster == cluster) && (topic == "" || event.Topic == topic) {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobModelApply(t *testing.T) {
+	defer func() { lifecycleEvents = nil }()
+	window := collectionWindow
+	collectionWindow = 15 * time.Minute
+	defer func() { collectionWindow = window }()
+
+	model := newJobModel()
+	cluster := &NomadCluster{Name: "cluster1"}
+
+	var frame EventFrame
+	err := json.Unmarshal([]byte(`
+		{
+			"Index": 20,
+			"Events": [
+				{"Topic": "Job", "Type": "JobRegistered", "Key": "job1", "Namespace": "default", "Index": 18,
+					"Payload": {"Job": {"ID": "job1", "Name": "job1", "Namespace": "default", "Type": "service", "Datacenters": ["dc1", "dc2"], "JobModifyIndex": 18}}},
+				{"Topic": "Job", "Type": "JobRegistered", "Key": "job2", "Namespace": "batch", "Index": 19,
+					"Payload": {"Job": {"ID": "job2", "Name": "job2", "Namespace": "batch", "Type": "batch", "Periodic": {"Enabled": true}}}},
+				{"Topic": "Allocation", "Type": "AllocationUpdated", "Key": "alloc1", "Namespace": "default", "Index": 20,
+					"Payload": {"Allocation": {"ID": "alloc1", "JobID": "job1", "Namespace": "default", "TaskGroup": "TaskGroup1", "ClientStatus": "running", "CreateTime": 2}}},
+				{"Topic": "Allocation", "Type": "AllocationUpdated", "Key": "alloc0", "Namespace": "default", "Index": 20,
+					"Payload": {"Allocation": {"ID": "alloc0", "JobID": "job1", "Namespace": "default", "TaskGroup": "TaskGroup1", "ClientStatus": "complete", "CreateTime": 1}}},
+				{"Topic": "Deployment", "Type": "DeploymentStatusUpdate", "Key": "deployment1", "Namespace": "default", "Index": 20,
+					"Payload": {"Deployment": {"ID": "deployment1"}}},
+				{"Topic": "Node", "Type": "NodeRegistration", "Key": "node1", "Index": 20,
+					"Payload": {"Node": {"ID": "node1"}}}
+			]
+		}`), &frame)
+	assert.Nil(t, err)
+	model.apply(cluster, frame)
+
+	assert.Equal(t, uint64(20), model.lastIndex())
+	assert.Equal(t, []JobDesc{{"job1", "", "job1", []string{"dc1", "dc2"}, "service", false, false, JobSum{"default"}, 18}}, model.listJobs("default"))
+	assert.Equal(t, []JobDesc{{"job2", "", "job2", nil, "batch", true, false, JobSum{"batch"}, 0}}, model.listJobs("batch"))
+	allocs := model.listAllocs("default", "job1")
+	assert.Equal(t, 2, len(allocs))
+	assert.Equal(t, "alloc0", allocs[0].ID)
+	assert.Equal(t, "running", allocs[1].ClientStatus)
+	assert.Empty(t, model.listAllocs("batch", "job1"))
+
+	events := getLifecycleEvents("cluster1", "")
+	assert.Equal(t, 6, len(events))
+	assert.Equal(t, LifecycleEvent{"cluster1", "", "Node", "NodeRegistration", "node1", "", 20, events[5].Time}, events[5])
+	assert.Equal(t, 1, len(getLifecycleEvents("", "Deployment")))
+	assert.Empty(t, getLifecycleEvents("cluster2", ""))
+
+	// Deregistered jobs and terminal allocations are kept for two collection windows
+	model.apply(cluster, EventFrame{21, []Event{
+		{"Job", "JobDeregistered", "job1", "default", 21, EventPayload{Job: &EventJob{ID: "job1", Namespace: "default"}}},
+		{"Allocation", "AllocationUpdated", "alloc1", "default", 21, EventPayload{Allocation: &EventAlloc{Alloc{ID: "alloc1", ClientStatus: "failed"}, "job1", "default"}}},
+	}})
+	assert.Equal(t, 1, len(model.listJobs("default")))
+	assert.Equal(t, 2, len(model.listAllocs("default", "job1")))
+
+	model.lock.Lock()
+	model.prune(time.Now().Add(31 * time.Minute))
+	model.lock.Unlock()
+	assert.Empty(t, model.listJobs("default"))
+	assert.Empty(t, model.listAllocs("default", "job1"))
+	assert.Equal(t, 1, len(model.listJobs("batch")))
+}
+
+func TestRecordEventsBounded(t *testing.T) {
+	defer func() { lifecycleEvents = nil }()
+
+	var events []Event
+	for i := 0; i < maxLifecycleEvents+10; i++ {
+		events = append(events, Event{Topic: "Node", Key: fmt.Sprintf("node%d", i), Index: uint64(i)})
+	}
+	recordEvents(&NomadCluster{Name: "cluster1"}, events, time.Now())
+
+	recorded := getLifecycleEvents("", "")
+	assert.Equal(t, maxLifecycleEvents, len(recorded))
+	assert.Equal(t, "node10", recorded[0].Key)
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	defer func() { lifecycleEvents = nil }()
+	delay := eventReconnectDelay
+	eventReconnectDelay = 10 * time.Millisecond
+	defer func() { eventReconnectDelay = delay }()
+
+	streamIndexes := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			w.Write([]byte(`{"Config": {"Region": "global"}}`))
+			return
+		}
+		assert.Equal(t, "*", r.URL.Query().Get("namespace"))
+		assert.Equal(t, "global", r.URL.Query().Get("region"))
+		switch r.URL.Path {
+		case "/v1/jobs":
+			w.Header().Set("X-Nomad-Index", "10")
+			w.Write([]byte(`[{"ID": "job1", "Name": "job1", "Type": "service", "JobSummary": {"Namespace": "default"}}]`))
+		case "/v1/allocations":
+			w.Header().Set("X-Nomad-Index", "12")
+			w.Write([]byte(`[{"ID": "alloc1", "JobID": "job1", "Namespace": "default", "ClientStatus": "running"}]`))
+		case "/v1/event/stream":
+			assert.Equal(t, []string{"Job:*", "Allocation:*", "Deployment:*", "Node:*"}, r.URL.Query()["topic"])
+			index := r.URL.Query().Get("index")
+			streamIndexes <- index
+			if index == "11" {
+				// Disconnect after a single frame and a heartbeat
+				w.Write([]byte(`{"Index": 15, "Events": [{"Topic": "Job", "Type": "JobRegistered", "Key": "job2", "Namespace": "default",
+					"Payload": {"Job": {"ID": "job2", "Name": "job2", "Namespace": "default", "Type": "batch"}}}]}` + "\n{}\n"))
+				return
+			}
+			w.Write([]byte(`{"Index": 16, "Events": [{"Topic": "Allocation", "Type": "AllocationUpdated", "Key": "alloc2", "Namespace": "default",
+				"Payload": {"Allocation": {"ID": "alloc2", "JobID": "job2", "Namespace": "default", "ClientStatus": "running"}}}]}` + "\n"))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cluster := &NomadCluster{Name: "cluster1", Address: strings.TrimPrefix(server.URL, "http://"), EventStream: true}
+	startEventStreams([]*NomadCluster{cluster, {Name: "cluster2", Address: "badAddress"}})
+	defer startEventStreams(nil)
+
+	assert.Equal(t, "11", <-streamIndexes)
+	assert.Equal(t, "16", <-streamIndexes)
+	// Without region discovery the model is kept for the region of the configured servers
+	namespaceCluster := cluster.withRegion("global").withNamespace("default")
+	for i := 0; i < 100 && (getJobModel(namespaceCluster) == nil || getJobModel(namespaceCluster).lastIndex() < 16); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, getJobModel(&NomadCluster{Name: "cluster2"}))
+
+	// The collector reads from the model instead of listing
+	jobs, err := getJobs(context.Background(), namespaceCluster)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(jobs))
+	assert.Equal(t, "job2", jobs[1].ID)
+	allocs, err := getAllocs(context.Background(), namespaceCluster, "job2")
+	assert.Nil(t, err)
+	assert.Equal(t, "alloc2", allocs[0].ID)
+	assert.Equal(t, 2, len(getLifecycleEvents("cluster1", "")))
+
+	startEventStreams(nil)
+	assert.Nil(t, getJobModel(namespaceCluster))
+}
+
+func TestSubscribeEventsGap(t *testing.T) {
+	defer func() { lifecycleEvents = nil }()
+	delay := eventReconnectDelay
+	eventReconnectDelay = 10 * time.Millisecond
+	defer func() { eventReconnectDelay = delay }()
+
+	var loads int32
+	streamIndexes := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			w.Write([]byte(`{"Config": {"Region": "global"}}`))
+		case "/v1/jobs":
+			// The second listing happens after the gap and includes the job registered meanwhile
+			if atomic.AddInt32(&loads, 1) == 1 {
+				w.Header().Set("X-Nomad-Index", "10")
+				w.Write([]byte(`[{"ID": "job1", "Name": "job1", "Type": "service", "JobSummary": {"Namespace": "default"}}]`))
+				return
+			}
+			w.Header().Set("X-Nomad-Index", "40")
+			w.Write([]byte(`[{"ID": "job1", "Name": "job1", "Type": "service", "JobSummary": {"Namespace": "default"}},
+				{"ID": "job3", "Name": "job3", "Type": "service", "JobSummary": {"Namespace": "default"}}]`))
+		case "/v1/allocations":
+			w.Header().Set("X-Nomad-Index", "40")
+			w.Write([]byte(`[]`))
+		case "/v1/event/stream":
+			index := r.URL.Query().Get("index")
+			streamIndexes <- index
+			switch index {
+			case "11":
+				w.Write([]byte(`{"Index": 15, "Events": [{"Topic": "Node", "Type": "NodeRegistration", "Key": "node1"}]}` + "\n"))
+				return
+			case "16":
+				// Events 16 to 29 were dropped from Nomad's buffer while disconnected
+				w.Write([]byte(`{"Index": 30, "Events": [{"Topic": "Job", "Type": "JobRegistered", "Key": "job2", "Namespace": "default",
+					"Payload": {"Job": {"ID": "job2", "Name": "job2", "Namespace": "default", "Type": "batch"}}}]}` + "\n"))
+				return
+			}
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cluster := &NomadCluster{Name: "gapCluster", Address: strings.TrimPrefix(server.URL, "http://"), EventStream: true}
+	startEventStreams([]*NomadCluster{cluster})
+	defer startEventStreams(nil)
+
+	assert.Equal(t, "11", <-streamIndexes)
+	assert.Equal(t, "16", <-streamIndexes)
+	assert.Equal(t, "41", <-streamIndexes)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&loads))
+
+	// The frame past the gap is not applied, the listing after it is
+	jobs, err := getJobs(context.Background(), cluster.withRegion("global").withNamespace("default"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(jobs))
+	for _, job := range jobs {
+		assert.NotEqual(t, "job2", job.ID)
+	}
+}
+
+func TestSubscribeClusterRetriesRegions(t *testing.T) {
+	defer func() { lifecycleEvents = nil }()
+	delay := eventReconnectDelay
+	eventReconnectDelay = 10 * time.Millisecond
+	defer func() { eventReconnectDelay = delay }()
+
+	var reads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/self":
+			// The region cannot be read until the third attempt
+			if atomic.AddInt32(&reads, 1) < 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"Config": {"Region": "retried"}}`))
+		case "/v1/jobs", "/v1/allocations":
+			w.Header().Set("X-Nomad-Index", "10")
+			w.Write([]byte(`[]`))
+		case "/v1/event/stream":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cluster := &NomadCluster{Name: "retryCluster", Address: strings.TrimPrefix(server.URL, "http://"), EventStream: true}
+	startEventStreams([]*NomadCluster{cluster})
+	defer startEventStreams(nil)
+
+	regionCluster := cluster.withRegion("retried")
+	for i := 0; i < 100 && getJobModel(regionCluster) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, getJobModel(regionCluster))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&reads))
+	assert.Nil(t, getJobModel(cluster.withRegion("")))
+}
@@ -18,6 +18,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
@@ -26,6 +27,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -37,10 +40,36 @@ type APIError struct {
 	Error string
 }
 
+// CycleStats describes the last completed aggregation cycle
+type CycleStats struct {
+	Begin           string
+	End             string
+	DurationSeconds float64
+	Clusters        int
+	Jobs            int
+	TimedOut        []string
+	// Allocations whose stats could not be read from Nomad
+	UnreachableAllocs []UnreachableAlloc
+	// Fraction of job specs read from specCache during the cycle
+	SpecCacheHitRatio float64
+}
+
 var (
 	wg     sync.WaitGroup
 	db     *sql.DB
 	insert *sql.Stmt
+
+	// collectionWindow is the period covered by each aggregation cycle
+	collectionWindow = 15 * time.Minute
+
+	// cycleTimeout bounds a whole aggregation cycle, defaults to the aggregation frequency when 0
+	cycleTimeout time.Duration
+
+	lastCycle     CycleStats
+	lastCycleLock sync.RWMutex
+
+	// initialized is closed once the config is loaded and the DB connected, on-demand cycles are refused until then
+	initialized = make(chan struct{})
 )
 
 func handleAPIError(w http.ResponseWriter, err string, status int) {
@@ -56,6 +85,15 @@ func handleAPIError(w http.ResponseWriter, err string, status int) {
 	}
 }
 
+// requestFilter reads the region and cluster query params shared by all endpoints
+func requestFilter(r *http.Request) Filter {
+	query := r.URL.Query()
+	return Filter{
+		Region:  query.Get("region"),
+		Cluster: query.Get("cluster"),
+	}
+}
+
 func homePage(w http.ResponseWriter, r *http.Request) {
 	log.SetLevel(log.TraceLevel)
 	log.SetReportCaller(true)
@@ -70,7 +108,7 @@ func returnAll(w http.ResponseWriter, r *http.Request) {
 	log.SetReportCaller(true)
 	log.Trace(r)
 
-	all, err := getAllRowsDB(db)
+	all, err := getAllRowsDB(db, requestFilter(r))
 	if err != nil {
 		handleAPIError(w, fmt.Sprintf("Error in getting all rows from DB: %v", err), http.StatusInternalServerError)
 		return
@@ -88,11 +126,15 @@ func returnJob(w http.ResponseWriter, r *http.Request) {
 	log.Trace(r)
 
 	jobID := mux.Vars(r)["id"]
+	filter := requestFilter(r)
 	begin, okBegin := r.URL.Query()["begin"]
 	end, okEnd := r.URL.Query()["end"]
+	stat := r.URL.Query().Get("stat")
 
-	if !okBegin && !okEnd {
-		all, err := getLatestJobDB(db, jobID)
+	if _, ok := usageColumns[stat]; !ok {
+		handleAPIError(w, fmt.Sprintf("Invalid query param 'stat': %s, must be one of avg, max, p50, p95, p99", stat), http.StatusBadRequest)
+	} else if !okBegin && !okEnd {
+		all, err := getLatestJobDB(db, jobID, stat, filter)
 		if err != nil {
 			handleAPIError(w, fmt.Sprintf("Error in getting latest job from DB: %v", err), http.StatusInternalServerError)
 			return
@@ -107,7 +149,7 @@ func returnJob(w http.ResponseWriter, r *http.Request) {
 	} else if okBegin && !okEnd {
 		handleAPIError(w, "Missing query param: 'end'", http.StatusBadRequest)
 	} else {
-		all, err := getTimeSliceDB(db, jobID, begin[0], end[0])
+		all, err := getTimeSliceDB(db, jobID, begin[0], end[0], stat, filter)
 		if err != nil {
 			handleAPIError(w, fmt.Sprintf("Error in getting latest job from DB: %v", err), http.StatusInternalServerError)
 			return
@@ -120,6 +162,216 @@ func returnJob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func returnJobGroups(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	jobID := mux.Vars(r)["id"]
+	filter := requestFilter(r)
+
+	groups, err := getJobGroupsDB(db, jobID, filter)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in getting job groups from DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(groups)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnAllocations(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	query := r.URL.Query()
+	allocFilter := AllocFilter{
+		JobID:   query.Get("job"),
+		NodeID:  query.Get("node"),
+		AllocID: query.Get("alloc"),
+		Begin:   query.Get("begin"),
+		End:     query.Get("end"),
+	}
+	filter := requestFilter(r)
+
+	if allocFilter.Begin == "" && allocFilter.End != "" {
+		handleAPIError(w, "Missing query param: 'begin'", http.StatusBadRequest)
+		return
+	} else if allocFilter.Begin != "" && allocFilter.End == "" {
+		handleAPIError(w, "Missing query param: 'end'", http.StatusBadRequest)
+		return
+	}
+
+	allocs, err := getAllocationsDB(db, allocFilter, filter)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in getting allocations from DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(allocs)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnDevices(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	query := r.URL.Query()
+	filter := requestFilter(r)
+
+	devices, err := getDevicesDB(db, query.Get("namespace"), filter)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in getting devices from DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(devices)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnCapacity(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	name := mux.Vars(r)["name"]
+
+	capacity, err := getCapacityDB(db, name)
+	if err == sql.ErrNoRows {
+		handleAPIError(w, fmt.Sprintf("No capacity recorded for cluster %s", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in getting capacity from DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(capacity)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnCycle(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	lastCycleLock.RLock()
+	cycle := lastCycle
+	lastCycleLock.RUnlock()
+
+	if cycle.Begin == "" {
+		handleAPIError(w, "No aggregation cycle has completed yet", http.StatusNotFound)
+		return
+	}
+	err := json.NewEncoder(w).Encode(cycle)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnBreakers(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	err := json.NewEncoder(w).Encode(getBreakerStatuses())
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnCache(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	err := json.NewEncoder(w).Encode(map[string]CacheStats{"JobSpecs": specCache.stats()})
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnEvents(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	query := r.URL.Query()
+	err := json.NewEncoder(w).Encode(getLifecycleEvents(query.Get("cluster"), query.Get("topic")))
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnRuns(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	limit := 20
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			handleAPIError(w, fmt.Sprintf("Invalid query param 'limit': %s, must be a positive integer", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := getRunsDB(db, limit)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in getting collection runs from DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(runs)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func returnRun(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	value := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Invalid collection run ID: %s", value), http.StatusBadRequest)
+		return
+	}
+
+	run, err := getRunDB(db, id)
+	if err == sql.ErrNoRows {
+		handleAPIError(w, fmt.Sprintf("No collection run %d", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in getting collection run from DB: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(run)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	log.SetLevel(log.TraceLevel)
 	log.SetReportCaller(true)
@@ -127,7 +379,47 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func collectData(freq *string) {
+func triggerCollect(w http.ResponseWriter, r *http.Request) {
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+	log.Trace(r)
+
+	select {
+	case <-initialized:
+	default:
+		handleAPIError(w, "NURD is still initializing", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	scope := CollectScope{query.Get("cluster"), query.Get("job")}
+	if _, err := scope.clusters(); err != nil {
+		handleAPIError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	select {
+	case cycleSlot <- struct{}{}:
+		defer func() { <-cycleSlot }()
+	default:
+		handleAPIError(w, "An aggregation cycle is already running", http.StatusConflict)
+		return
+	}
+
+	run, err := collectCycle(time.Now(), scope)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in collecting: %v", err), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(run)
+	if err != nil {
+		handleAPIError(w, fmt.Sprintf("Error in encoding JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// initCollection parses the aggregation frequency, loads the config and connects to the DB, exiting on failure
+func initCollection(freq *string) {
 	log.SetReportCaller(true)
 	log.SetLevel(log.TraceLevel)
 
@@ -139,13 +431,26 @@ func collectData(freq *string) {
 		log.Warning("--aggregate-frequency should be within (0m, 30m]. Defaulting to 15m.")
 		duration = 15 * time.Minute
 	}
+	collectionWindow = duration
+	if cycleTimeout <= 0 {
+		cycleTimeout = duration
+	}
 
 	err = loadConfig("/etc/nurd/config.json")
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Error in loading /etc/nurd/config.json: %v", err))
 	}
 
-	// Retry initializing DB 5 times before exiting
+	err = connectDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connectDB initializes the DB and the resources insert, retrying 5 times before giving up
+func connectDB() error {
+	var err error
+
 	retryLoad := 5
 	for i := 0; i < retryLoad; i++ {
 		db, insert, err = initDB()
@@ -153,50 +458,248 @@ func collectData(freq *string) {
 			log.Warning(fmt.Sprintf("DB initialization failed, retrying: %v", err))
 		} else {
 			log.Info("DB initialized successfully, break ...")
-			break
+			return nil
 		}
 
 		if i == retryLoad-1 {
-			log.Fatal(fmt.Sprintf("Error in initializing DB: %v", err))
+			break
 		}
 
 		time.Sleep(5 * time.Second)
 	}
 
+	return fmt.Errorf("Error in initializing DB: %v", err)
+}
+
+func collectData(freq *string) {
+	initCollection(freq)
+	close(initialized)
+	startEventStreams(nomadClusters)
+
+	runSchedule(func(scheduled time.Time) {
+		cycleSlot <- struct{}{}
+		collectCycle(scheduled, CollectScope{})
+		<-cycleSlot
+	})
+}
+
+// runSchedule calls collect at every start of the schedule, reading the schedule again after each cycle
+// so that reloads apply from the next start. Scheduled collection stops once the schedule has no start left,
+// while on-demand collection goes on.
+func runSchedule(collect func(scheduled time.Time)) {
+	settings := currentSchedule()
+	scheduled := settings.schedule.next(time.Now())
+	if scheduled.IsZero() {
+		log.Error("Aggregation schedule has no start left, no cycle is scheduled")
+		return
+	}
+	log.Info(fmt.Sprintf("First aggregation cycle scheduled at %s", scheduled.Format("2006-01-02 15:04:05")))
 	for {
-		log.Trace("BEGIN AGGREGATION")
-		c := make(chan []JobData, len(nomadAddresses))
+		time.Sleep(time.Until(scheduled))
+		collect(scheduled)
+
+		finished := time.Now()
+		settings = currentSchedule()
+		next, skipped := plan(settings.schedule, settings.overrun, scheduled, finished)
+		if next.IsZero() {
+			log.Error(fmt.Sprintf("Aggregation schedule has no start after the cycle of %s, no further cycle is scheduled", scheduled.Format("2006-01-02 15:04:05")))
+			return
+		}
+		if skipped > 0 || next.Before(finished) {
+			log.Warning(fmt.Sprintf("Aggregation cycle scheduled at %s overran the next start, skipping %d cycles and running the cycle of %s next (overrun policy %s)",
+				scheduled.Format("2006-01-02 15:04:05"), skipped, next.Format("2006-01-02 15:04:05"), settings.overrun))
+		}
+		scheduled = next
+	}
+}
+
+// collectCycle runs one aggregation cycle, storing everything it collects under the time it was scheduled at
+// so that cycles are recorded at regular intervals however long they take.
+// Cycles scoped to a job skip nodes and capacity. The caller must hold cycleSlot.
+func collectCycle(scheduled time.Time, scope CollectScope) (CollectionRun, error) {
+	clusters, err := scope.clusters()
+	if err != nil {
+		return CollectionRun{}, err
+	}
 
-		for _, address := range nomadAddresses {
+	log.Trace("BEGIN AGGREGATION")
+	begin := time.Now()
+	specStats := specCache.stats()
+	jobCount := 0
+	var timedOut []string
+	c := make(chan ClusterJobs, len(clusters))
+	nodeC := make(chan []NodeData, len(clusters))
+
+	// Every upstream request is abandoned once the cycle deadline passes, so the cycle always finishes
+	ctx, cancel := context.WithTimeout(context.Background(), cycleTimeout)
+	// Metrics queries are grouped across every job and sent once per cycle
+	ctx = withMetricsCache(ctx, newMetricsCache())
+	unreachable := newUnreachableAllocs()
+	ctx = withUnreachableAllocs(ctx, unreachable)
+	// Resource-seconds are accounted over the window ending at the insertTime of the cycle
+	ctx = withScheduled(ctx, scheduled)
+	if scope.Job != "" {
+		ctx = withJobScope(ctx, scope.Job)
+	}
+	recorders := make(map[string]*clusterRecorder)
+	for _, cluster := range clusters {
+		recorders[cluster.Name] = newClusterRecorder(cluster.Name)
+		clusterCtx := withClusterRecorder(ctx, recorders[cluster.Name])
+		wg.Add(1)
+		go reachCluster(clusterCtx, cluster, c)
+		if scope.Job == "" {
 			wg.Add(1)
-			go reachCluster(address, metricsAddress, c)
-		}
-
-		wg.Wait()
-		close(c)
-
-		insertTime := time.Now().Truncate(time.Minute).Format("2006-01-02 15:04:05")
-		for jobDataSlice := range c {
-			for _, v := range jobDataSlice {
-				insert.Exec(v.JobID,
-					v.Name,
-					v.UTicks,
-					v.RCPU,
-					v.URSS,
-					v.UCache,
-					v.RMemoryMB,
-					v.RdiskMB,
-					v.RIOPS,
-					v.Namespace,
-					v.DataCenters,
-					v.CurrentTime,
-					insertTime)
+			go reachNodes(clusterCtx, cluster, nodeC)
+		}
+	}
+
+	wg.Wait()
+	cancel()
+	close(c)
+	close(nodeC)
+
+	insertTime := scheduled.Format("2006-01-02 15:04:05")
+	clusterJobs := make(map[string][]JobData)
+	clusterNodes := make(map[string][]NodeData)
+	clusterTimedOut := make(map[string]bool)
+	for clusterJobData := range c {
+		if clusterJobData.TimedOut {
+			timedOut = append(timedOut, clusterJobData.Cluster)
+			clusterTimedOut[clusterJobData.Cluster] = true
+		}
+		// Failed writes count as errors of the cluster, a job whose row is not stored is not counted as stored
+		storeFailed := func(err error) {
+			log.Error(err)
+			if recorder, ok := recorders[clusterJobData.Cluster]; ok {
+				recorder.failed(err)
+			}
+		}
+		for _, v := range clusterJobData.Jobs {
+			clusterJobs[v.Cluster] = append(clusterJobs[v.Cluster], v)
+			jobCount++
+			err = insertJobDB(insert, v, insertTime)
+			if err != nil {
+				storeFailed(err)
+				continue
+			}
+			if recorder, ok := recorders[clusterJobData.Cluster]; ok {
+				recorder.stored()
+			}
+
+			err = insertTasksDB(db, v, insertTime)
+			if err != nil {
+				storeFailed(fmt.Errorf("Error in inserting tasks of %s: %v", v.JobID, err))
+			}
+			err = insertAllocsDB(db, v, insertTime)
+			if err != nil {
+				storeFailed(fmt.Errorf("Error in inserting allocations of %s: %v", v.JobID, err))
+			}
+			err = insertDevicesDB(db, v, insertTime)
+			if err != nil {
+				storeFailed(fmt.Errorf("Error in inserting devices of %s: %v", v.JobID, err))
+			}
+		}
+	}
+	for nodeDataSlice := range nodeC {
+		for _, node := range nodeDataSlice {
+			clusterNodes[node.Cluster] = append(clusterNodes[node.Cluster], node)
+		}
+		err = insertNodesDB(db, nodeDataSlice, insertTime)
+		if err != nil {
+			err = fmt.Errorf("Error in inserting nodes: %v", err)
+			log.Error(err)
+			if len(nodeDataSlice) > 0 {
+				if recorder, ok := recorders[nodeDataSlice[0].Cluster]; ok {
+					recorder.failed(err)
+				}
 			}
 		}
+	}
+	for _, cluster := range clusters {
+		if scope.Job != "" {
+			break
+		}
+		capacity := aggCapacity(cluster.Name, clusterNodes[cluster.Name], clusterJobs[cluster.Name])
+		err = insertCapacityDB(db, capacity, insertTime)
+		if err != nil {
+			err = fmt.Errorf("Error in inserting capacity of %s: %v", cluster.Name, err)
+			log.Error(err)
+			recorders[cluster.Name].failed(err)
+		}
+	}
+
+	unreachableAllocs := unreachable.list()
+	cycleSpecStats := specCache.stats()
+	specHitRatio := hitRatio(cycleSpecStats.Hits-specStats.Hits, cycleSpecStats.Misses-specStats.Misses)
+	end := time.Now()
+	// /v1/cycle describes the last cycle over every cluster and job
+	if scope == (CollectScope{}) {
+		lastCycleLock.Lock()
+		lastCycle = CycleStats{
+			begin.Format("2006-01-02 15:04:05"),
+			end.Format("2006-01-02 15:04:05"),
+			end.Sub(begin).Seconds(),
+			len(clusters),
+			jobCount,
+			timedOut,
+			unreachableAllocs,
+			specHitRatio,
+		}
+		lastCycleLock.Unlock()
+	}
+
+	run := CollectionRun{
+		Begin:           begin.Format("2006-01-02 15:04:05"),
+		End:             end.Format("2006-01-02 15:04:05"),
+		DurationSeconds: end.Sub(begin).Seconds(),
+	}
+	for _, cluster := range clusters {
+		run.Clusters = append(run.Clusters, recorders[cluster.Name].result(clusterTimedOut[cluster.Name]))
+	}
+	run.Status = runStatus(run.Clusters)
+	run.ID, err = insertRunDB(db, run, insertTime, scope != (CollectScope{}))
+	if err != nil {
+		log.Error(err)
+	} else if run.Status != runSucceeded {
+		log.Warning(fmt.Sprintf("Collection run %d %s, see /v1/runs/%d", run.ID, run.Status, run.ID))
+	}
+	if len(timedOut) > 0 {
+		log.Warning(fmt.Sprintf("Cycle deadline of %s passed before collection finished for clusters: %s", cycleTimeout, strings.Join(timedOut, ", ")))
+	}
+	if len(unreachableAllocs) > 0 {
+		log.Warning(fmt.Sprintf("Stats of %d allocations could not be read from Nomad, see /v1/cycle", len(unreachableAllocs)))
+	}
+	log.Info(fmt.Sprintf("Aggregated %d jobs from %d clusters in %s, %.0f%% of job specs cached", jobCount, len(clusters), end.Sub(begin), 100*specHitRatio))
+
+	log.Trace("END AGGREGATION")
+	return run, err
+}
+
+// collectOnce runs a single aggregation cycle for --once, returning the exit status of nurd
+func collectOnce(freq *string) int {
+	initCollection(freq)
 
-		log.Trace("END AGGREGATION")
-		time.Sleep(duration)
+	cycleSlot <- struct{}{}
+	run, err := collectCycle(time.Now(), CollectScope{})
+	<-cycleSlot
+	return exitStatus(run, err)
+}
+
+// exitStatus returns 1 when a run failed or could not be stored, 2 when it was partial and 0 when it succeeded,
+// so that callers can tell runs that collected nothing from runs that missed some of the data
+func exitStatus(run CollectionRun, err error) int {
+	if err != nil {
+		return 1
+	}
+	switch run.Status {
+	case runFailed:
+		log.Error(fmt.Sprintf("Collection run %d failed", run.ID))
+		return 1
+	case runPartial:
+		log.Warning(fmt.Sprintf("Collection run %d was partial, see /v1/runs/%d", run.ID, run.ID))
+		return 2
 	}
+	return 0
 }
 
 func reloadConfig(sigs chan os.Signal) {
@@ -208,14 +711,28 @@ func reloadConfig(sigs chan os.Signal) {
 			log.Info("Reloading /etc/nurd/config.json")
 			if err := loadConfig("/etc/nurd/config.json"); err != nil {
 				log.Warning(fmt.Sprintf("Error in reloading /etc/nurd/config.json: %v", err))
+			} else {
+				startEventStreams(nomadClusters)
 			}
 		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		tuneTransport(http.DefaultTransport.(*http.Transport))
+		os.Exit(backfillCommand(os.Args[2:]))
+	}
+
 	freq := flag.String("aggregate-frequency", "15m", "frequency of resource aggregation")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "timeout of each request to Nomad or the metrics server")
+	flag.DurationVar(&cycleTimeout, "cycle-timeout", 0, "timeout of each aggregation cycle, defaults to --aggregate-frequency")
+	once := flag.Bool("once", false, "run a single aggregation cycle and exit, non-zero when it fails")
 	flag.Parse()
+	tuneTransport(http.DefaultTransport.(*http.Transport))
+	if *once {
+		os.Exit(collectOnce(freq))
+	}
 	go collectData(freq)
 
 	sigs := make(chan os.Signal, 1)
@@ -226,6 +743,17 @@ func main() {
 	router.HandleFunc("/", homePage)
 	router.HandleFunc("/v1/jobs", returnAll)
 	router.HandleFunc("/v1/job/{id}", returnJob)
+	router.HandleFunc("/v1/job/{id}/groups", returnJobGroups)
+	router.HandleFunc("/v1/allocations", returnAllocations)
+	router.HandleFunc("/v1/devices", returnDevices)
+	router.HandleFunc("/v1/clusters/{name}/capacity", returnCapacity)
+	router.HandleFunc("/v1/cycle", returnCycle)
+	router.HandleFunc("/v1/breakers", returnBreakers)
+	router.HandleFunc("/v1/events", returnEvents)
+	router.HandleFunc("/v1/cache", returnCache)
+	router.HandleFunc("/v1/runs", returnRuns)
+	router.HandleFunc("/v1/runs/{id}", returnRun)
+	router.HandleFunc("/v1/collect", triggerCollect).Methods("POST")
 	router.HandleFunc("/v1/health", healthCheck)
 	log.Fatal(http.ListenAndServe(":8080", router))
 }
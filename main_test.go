@@ -19,11 +19,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -153,6 +158,215 @@ func TestReturnJobParams(t *testing.T) {
 	assert.Equal(t, expectedStr, actualStr)
 }
 
+func TestReturnJobInvalidStat(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/job/jobID?stat=p90", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnJob)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	expectedStr := APIError{
+		Error: "Invalid query param 'stat': p90, must be one of avg, max, p50, p95, p99",
+	}
+	var actualStr APIError
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+}
+
+func TestReturnJobGroupsNoDB(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/job/jobID/groups", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnJobGroups)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	expectedStr := APIError{
+		Error: "Error in getting job groups from DB: Parameter db *sql.DB is nil",
+	}
+	var actualStr APIError
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+}
+
+func TestReturnAllocations(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/allocations?node=node_id1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnAllocations)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	expectedStr := APIError{
+		Error: "Error in getting allocations from DB: Parameter db *sql.DB is nil",
+	}
+	var actualStr APIError
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+
+	req, err = http.NewRequest("GET", "/v1/allocations?alloc=alloc_id1&begin=2020-07-18%2017:42:19", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	expectedStr = APIError{
+		Error: "Missing query param: 'end'",
+	}
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+}
+
+func TestReturnDevicesNoDB(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/devices?namespace=ml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnDevices)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	expectedStr := APIError{
+		Error: "Error in getting devices from DB: Parameter db *sql.DB is nil",
+	}
+	var actualStr APIError
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+}
+
+func TestReturnCapacity(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/clusters/cluster1/capacity", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"name": "cluster1"})
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnCapacity)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	expectedStr := APIError{
+		Error: "Error in getting capacity from DB: Parameter db *sql.DB is nil",
+	}
+	var actualStr APIError
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = mockDB
+	defer func() {
+		mockDB.Close()
+		db = nil
+	}()
+	mock.ExpectQuery("FROM capacity").WithArgs("cluster1").WillReturnRows(sqlmock.NewRows([]string{"cluster"}))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	expectedStr = APIError{
+		Error: "No capacity recorded for cluster cluster1",
+	}
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expectedStr, actualStr)
+}
+
+func TestRequestFilter(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/jobs?region=eu&cluster=cluster1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Filter{Region: "eu", Cluster: "cluster1"}, requestFilter(req))
+
+	req, err = http.NewRequest("GET", "/v1/jobs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Filter{}, requestFilter(req))
+}
+
+func TestReturnCycle(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/cycle", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnCycle)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	lastCycle = CycleStats{"2020-07-07 17:35:00", "2020-07-07 17:36:30", 90, 2, 4000, []string{"cluster2"}, []UnreachableAlloc{{"cluster1", "allocID1", "Error in getting API response: timeout"}}, 0.75}
+	defer func() { lastCycle = CycleStats{} }()
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actualCycle CycleStats
+	err = json.NewDecoder(rr.Body).Decode(&actualCycle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lastCycle, actualCycle)
+}
+
+func TestReturnBreakers(t *testing.T) {
+	saved := breakers
+	breakers = make(map[string]*CircuitBreaker)
+	defer func() { breakers = saved }()
+	getBreaker("nomad/cluster1").failure()
+
+	req, err := http.NewRequest("GET", "/v1/breakers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnBreakers)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actualBreakers []BreakerStatus
+	err = json.NewDecoder(rr.Body).Decode(&actualBreakers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []BreakerStatus{{"nomad/cluster1", breakerClosed, 1, ""}}, actualBreakers)
+}
+
 func TestHealthCheck(t *testing.T) {
 	req, err := http.NewRequest("GET", "/v1/health", nil)
 	if err != nil {
@@ -162,4 +376,407 @@ func TestHealthCheck(t *testing.T) {
 	handler := http.HandlerFunc(healthCheck)
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusOK, rr.Code)
-}
\ No newline at end of file
+}
+func TestReturnEvents(t *testing.T) {
+	defer func() { lifecycleEvents = nil }()
+	recordEvents(&NomadCluster{Name: "cluster1"}, []Event{{Topic: "Job", Type: "JobRegistered", Key: "job1", Index: 5}}, time.Now())
+	recordEvents(&NomadCluster{Name: "cluster2"}, []Event{{Topic: "Node", Type: "NodeRegistration", Key: "node1", Index: 7}}, time.Now())
+
+	req, err := http.NewRequest("GET", "/v1/events?cluster=cluster1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnEvents)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actualEvents []LifecycleEvent
+	err = json.NewDecoder(rr.Body).Decode(&actualEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(actualEvents))
+	assert.Equal(t, "job1", actualEvents[0].Key)
+	assert.Equal(t, uint64(5), actualEvents[0].Index)
+}
+
+func TestReturnCache(t *testing.T) {
+	saved := specCache
+	specCache = newSpecCache()
+	defer func() { specCache = saved }()
+	specCache.put("nomad/cluster1//default/jobID", JobSpec{}, 10)
+	specCache.get("nomad/cluster1//default/jobID")
+
+	req, err := http.NewRequest("GET", "/v1/cache", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnCache)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actualStats map[string]CacheStats
+	err = json.NewDecoder(rr.Body).Decode(&actualStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]CacheStats{"JobSpecs": {0, 1, 0, 1}}, actualStats)
+}
+
+func TestReturnRuns(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/runs?limit=0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnRuns)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req, err = http.NewRequest("GET", "/v1/runs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = mockDB
+	defer func() {
+		mockDB.Close()
+		db = nil
+	}()
+	mock.ExpectQuery("FROM collection_runs").WithArgs(20).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "beginTime", "endTime", "durationSeconds", "status"}).
+			AddRow(7, "2020-07-07T17:50:00Z", "2020-07-07T17:51:00Z", 60.0, "failed"))
+	mock.ExpectQuery("FROM collection_run_clusters").WithArgs(7, 7).
+		WillReturnRows(sqlmock.NewRows([]string{"runID", "cluster", "status", "jobsSeen", "jobsStored", "errors", "firstError", "timedOut"}).
+			AddRow(7, "cluster1", "failed", 0, 0, 3, "Unexpected status 403 from nomad1:4646/v1/jobs", false))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actual []CollectionRun
+	err = json.NewDecoder(rr.Body).Decode(&actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []CollectionRun{{7, "2020-07-07T17:50:00Z", "2020-07-07T17:51:00Z", 60, "failed", []ClusterRun{
+		{"cluster1", "failed", 0, 0, 3, "Unexpected status 403 from nomad1:4646/v1/jobs", false},
+	}}}, actual)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestReturnRun(t *testing.T) {
+	req, err := http.NewRequest("GET", "/v1/runs/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": "latest"})
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(returnRun)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = mockDB
+	defer func() {
+		mockDB.Close()
+		db = nil
+	}()
+	mock.ExpectQuery("FROM collection_runs").WithArgs(8).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	req, err = http.NewRequest("GET", "/v1/runs/8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": "8"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	var actualStr APIError
+	err = json.NewDecoder(rr.Body).Decode(&actualStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, APIError{Error: "No collection run 8"}, actualStr)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestTriggerCollect(t *testing.T) {
+	clusters := nomadClusters
+	timeout := cycleTimeout
+	ready := initialized
+	defer func() {
+		nomadClusters = clusters
+		cycleTimeout = timeout
+		initialized = ready
+	}()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	nomadClusters = []*NomadCluster{{Name: "cluster1", Address: strings.TrimPrefix(server.URL, "http://"), Client: nomadClient, Scheme: "http", Metrics: NomadOnly{}}}
+	cycleTimeout = 5 * time.Second
+
+	handler := http.HandlerFunc(triggerCollect)
+
+	// Nothing is collected before the config is loaded and the DB connected
+	initialized = make(chan struct{})
+	req, err := http.NewRequest("POST", "/v1/collect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	close(initialized)
+
+	req, err = http.NewRequest("POST", "/v1/collect?cluster=cluster2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	cycleSlot <- struct{}{}
+	req, err = http.NewRequest("POST", "/v1/collect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	<-cycleSlot
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = mockDB
+	defer func() {
+		mockDB.Close()
+		db = nil
+	}()
+	mock.ExpectQuery(`INSERT INTO collection_runs (.+) OUTPUT INSERTED.id`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "succeeded", sqlmock.AnyArg(), true).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec(`INSERT INTO collection_run_clusters`).
+		WithArgs(3, "cluster1", "succeeded", 0, 0, 0, "", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Scoped to a job, nodes and capacity are left alone
+	req, err = http.NewRequest("POST", "/v1/collect?cluster=cluster1&job=job1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actual CollectionRun
+	err = json.NewDecoder(rr.Body).Decode(&actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, actual.ID)
+	assert.Equal(t, runSucceeded, actual.Status)
+	assert.Equal(t, []ClusterRun{{"cluster1", "succeeded", 0, 0, 0, "", false}}, actual.Clusters)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+// startsSchedule starts at each of its times, and never after the last
+type startsSchedule []time.Time
+
+func (s startsSchedule) next(t time.Time) time.Time {
+	for _, start := range s {
+		if start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+func TestRunSchedule(t *testing.T) {
+	defer func() {
+		scheduleSettings{everySchedule{15 * time.Minute}, overrunSkip}.apply()
+	}()
+
+	// Nothing is collected without a start
+	scheduleSettings{startsSchedule{}, overrunSkip}.apply()
+	var collected []time.Time
+	runSchedule(func(scheduled time.Time) { collected = append(collected, scheduled) })
+	assert.Empty(t, collected)
+
+	// Scheduled collection stops after the last start, a reload applies from the next start
+	now := time.Now()
+	starts := startsSchedule{now.Add(10 * time.Millisecond), now.Add(20 * time.Millisecond), now.Add(30 * time.Millisecond)}
+	scheduleSettings{starts, overrunQueue}.apply()
+	runSchedule(func(scheduled time.Time) {
+		collected = append(collected, scheduled)
+		if len(collected) == 2 {
+			scheduleSettings{starts[:2], overrunQueue}.apply()
+		}
+	})
+	assert.Equal(t, []time.Time(starts[:2]), collected)
+}
+
+func TestExitStatus(t *testing.T) {
+	assert.Equal(t, 0, exitStatus(CollectionRun{ID: 1, Status: runSucceeded}, nil))
+	assert.Equal(t, 2, exitStatus(CollectionRun{ID: 2, Status: runPartial}, nil))
+	assert.Equal(t, 1, exitStatus(CollectionRun{ID: 3, Status: runFailed}, nil))
+	assert.Equal(t, 1, exitStatus(CollectionRun{Status: runSucceeded}, errors.New("Parameter db *sql.DB is nil")))
+}
+
+func TestCollectCycleStoreErrors(t *testing.T) {
+	clusters := nomadClusters
+	timeout := cycleTimeout
+	cycle := lastCycle
+	defer func() {
+		nomadClusters = clusters
+		cycleTimeout = timeout
+		lastCycle = cycle
+	}()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/jobs":
+			w.Write([]byte(`[{"ID": "job1", "Name": "job1", "Type": "service"}, {"ID": "job2", "Name": "job2", "Type": "service"}]`))
+		case "/v1/job/job1", "/v1/job/job2":
+			w.Write([]byte(`{"ID": "` + strings.TrimPrefix(r.URL.Path, "/v1/job/") + `"}`))
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer server.Close()
+	nomadClusters = []*NomadCluster{{Name: "cluster1", Region: "global", Address: strings.TrimPrefix(server.URL, "http://"), Client: nomadClient, Scheme: "http", Metrics: NomadOnly{}}}
+	cycleTimeout = 5 * time.Second
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := mock.ExpectPrepare("INSERT INTO resources")
+	stmt, err := mockDB.Prepare("INSERT INTO resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, insert = mockDB, stmt
+	defer func() {
+		mockDB.Close()
+		db, insert = nil, nil
+	}()
+
+	// The row of job2 and the capacity of the cluster fail to be stored
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	prepare.ExpectExec().WillReturnError(errors.New("connection reset"))
+	mock.ExpectExec(`INSERT INTO capacity`).WillReturnError(errors.New("connection reset"))
+	mock.ExpectQuery(`INSERT INTO collection_runs (.+) OUTPUT INSERTED.id`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "partial", sqlmock.AnyArg(), false).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectExec(`INSERT INTO collection_run_clusters`).
+		WithArgs(4, "cluster1", "partial", 2, 1, 2, "Error in inserting job2: connection reset", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	cycleSlot <- struct{}{}
+	run, err := collectCycle(time.Now(), CollectScope{})
+	<-cycleSlot
+	assert.Empty(t, err)
+	assert.Equal(t, runPartial, run.Status)
+	assert.Equal(t, []ClusterRun{{"cluster1", "partial", 2, 1, 2, "Error in inserting job2: connection reset", false}}, run.Clusters)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
+
+func TestScopedCollectKeepsOtherJobs(t *testing.T) {
+	clusters := nomadClusters
+	timeout := cycleTimeout
+	ready := initialized
+	defer func() {
+		nomadClusters = clusters
+		cycleTimeout = timeout
+		initialized = ready
+	}()
+	initialized = make(chan struct{})
+	close(initialized)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/jobs":
+			w.Write([]byte(`[{"ID": "job1", "Name": "job1", "Type": "service"}, {"ID": "job2", "Name": "job2", "Type": "service"}]`))
+		case "/v1/job/job1":
+			w.Write([]byte(`{"ID": "job1"}`))
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer server.Close()
+	nomadClusters = []*NomadCluster{{Name: "cluster1", Region: "global", Address: strings.TrimPrefix(server.URL, "http://"), Client: nomadClient, Scheme: "http", Metrics: NomadOnly{}}}
+	cycleTimeout = 5 * time.Second
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := mock.ExpectPrepare("INSERT INTO resources")
+	stmt, err := mockDB.Prepare("INSERT INTO resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, insert = mockDB, stmt
+	defer func() {
+		mockDB.Close()
+		db, insert = nil, nil
+	}()
+
+	// Only job1 is collected and stored, at a later insertTime than job2 was by the last full cycle
+	prepare.ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`INSERT INTO collection_runs (.+) OUTPUT INSERTED.id`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "succeeded", sqlmock.AnyArg(), true).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectExec(`INSERT INTO collection_run_clusters`).
+		WithArgs(5, "cluster1", "succeeded", 1, 1, 0, "", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req, err := http.NewRequest("POST", "/v1/collect?job=job1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(triggerCollect).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// job2 is still read at the insertTime of the last full cycle
+	columns := []string{"JobID", "name", "uTicks", "rCPU", "uRSS", "uCache", "rMemoryMB", "rdiskMB", "namespace", "dataCenters", "insertTime", "region", "cluster", "jobType", "rCPUSeconds", "rMemoryMBSeconds", "uTicksSeconds", "uRSSSeconds", "rMBits", "rReservedPorts", "rDynamicPorts", "rMemoryMaxMB", "rCores", "rCoresMHz", "wasteCPU", "wasteMemoryMB", "uTicksAvg", "uTicksMax", "uTicksP50", "uTicksP95", "uTicksP99", "uRSSAvg", "uRSSMax", "uRSSP50", "uRSSP95", "uRSSP99", "rssSource", "cacheSource", "ticksSource", "measuredAllocs", "totalAllocs", "secondsSource", "requestsSource"}
+	mock.ExpectQuery(`WHERE insertTime \= \(SELECT MAX\(latest\.insertTime\) FROM resources latest WHERE latest\.JobID \= resources\.JobID AND latest\.cluster \= resources\.cluster\) AND insertTime >\= \(SELECT COALESCE\(MAX\(runs\.insertTime\), '1900-01-01'\) FROM collection_runs runs WHERE runs\.scoped \= 0\) AND JobID \= 'job2'`).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("job2", "job2", 100.0, 500.0, 64.0, 0.0, 256.0, 300.0, "default", "DC1", "2020-07-07 17:30:00", "global", "cluster1", "service", 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 400.0, 192.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, "nomad", "nomad", "nomad", 1.0, 1.0, "", ""))
+
+	req, err = http.NewRequest("GET", "/v1/job/job2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": "job2"})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(returnJob).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var actual []JobDataDB
+	err = json.NewDecoder(rr.Body).Decode(&actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(actual))
+	assert.Equal(t, "job2", actual[0].JobID)
+	assert.Equal(t, "2020-07-07 17:30:00", actual[0].InsertTime)
+	assert.Empty(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,480 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nomad client allocation metrics used resources are read from
+const (
+	rssMetric   = "nomad_client_allocs_memory_rss_value"
+	cacheMetric = "nomad_client_allocs_memory_cache_value"
+	ticksMetric = "nomad_client_allocs_cpu_total_ticks_value"
+)
+
+// windowStep is the resolution at which job usage is sampled over the collection window, windowStepSeconds in seconds
+const (
+	windowStep        = "1m"
+	windowStepSeconds = 60
+)
+
+// UsageStats summarizes the used resources of a job over the collection window
+type UsageStats struct {
+	Avg float64
+	Max float64
+	P50 float64
+	P95 float64
+	P99 float64
+}
+
+// windowFunctions compute each statistic of UsageStats, in order, over a range of samples
+var windowFunctions = []string{
+	"avg_over_time(",
+	"max_over_time(",
+	"quantile_over_time(0.5, ",
+	"quantile_over_time(0.95, ",
+	"quantile_over_time(0.99, ",
+}
+
+type metricsCacheKey struct{}
+
+// metricsRequestError is returned when the metrics server cannot be reached, as opposed to answering badly
+type metricsRequestError struct {
+	err error
+}
+
+func (e metricsRequestError) Error() string {
+	return fmt.Sprintf("Error in getting API response: %v", e.err)
+}
+
+// metricsCache holds the results of the grouped metrics queries of a cycle, shared by every job and cluster.
+// Each query is sent once, concurrent callers wait for the first one and failures are cached as well.
+type metricsCache struct {
+	lock    sync.Mutex
+	results map[string]*metricsResult
+}
+
+type metricsResult struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func newMetricsCache() *metricsCache {
+	return &metricsCache{results: make(map[string]*metricsResult)}
+}
+
+// withMetricsCache returns a copy of ctx whose metrics queries are answered from cache
+func withMetricsCache(ctx context.Context, cache *metricsCache) context.Context {
+	return context.WithValue(ctx, metricsCacheKey{}, cache)
+}
+
+// cached returns the result of fetch under key, from the cycle's cache when ctx carries one
+func cached(ctx context.Context, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	cache, ok := ctx.Value(metricsCacheKey{}).(*metricsCache)
+	if !ok {
+		return fetch()
+	}
+
+	cache.lock.Lock()
+	result, ok := cache.results[key]
+	if !ok {
+		result = &metricsResult{done: make(chan struct{})}
+		cache.results[key] = result
+	}
+	cache.lock.Unlock()
+
+	if !ok {
+		result.value, result.err = fetch()
+		close(result.done)
+	}
+
+	select {
+	case <-result.done:
+		return result.value, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// promDialect describes how a metrics server implementing the Prometheus query API names Nomad allocation series
+type promDialect struct {
+	Job       string
+	Namespace string
+	TaskGroup string
+	Task      string
+	AllocID   string
+	// Metrics renames rssMetric, cacheMetric and ticksMetric, other metrics are queried as named
+	Metrics map[string]string
+	// Selector restricts every query to the series of one cluster on a metrics server shared by several,
+	// empty to read every series
+	Selector string
+}
+
+var victoriaMetricsDialect = promDialect{"job", "namespace", "task_group", "task", "alloc_id", nil, ""}
+
+// Nomad exposes gauges to Prometheus without the _value suffix, and Prometheus renames the job label of
+// scraped series to exported_job as it clashes with the label of the scrape job
+var prometheusDialect = promDialect{"exported_job", "namespace", "task_group", "task", "alloc_id", map[string]string{
+	rssMetric:   "nomad_client_allocs_memory_rss",
+	cacheMetric: "nomad_client_allocs_memory_cache",
+	ticksMetric: "nomad_client_allocs_cpu_total_ticks",
+}, ""}
+
+func (d promDialect) metric(metric string) string {
+	if name, ok := d.Metrics[metric]; ok {
+		return name + d.Selector
+	}
+	return metric + d.Selector
+}
+
+// withLabels returns a copy of the dialect whose queries only read series carrying every label of labels
+func (d promDialect) withLabels(labels map[string]string) promDialect {
+	if len(labels) == 0 {
+		return d
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matchers := make([]string, 0, len(names))
+	for _, name := range names {
+		matchers = append(matchers, name+"="+strconv.Quote(labels[name]))
+	}
+	d.Selector = "{" + strings.Join(matchers, ", ") + "}"
+
+	return d
+}
+
+// jobQuery sums metric by job and namespace across every allocation
+func (d promDialect) jobQuery(metric string) string {
+	return "sum by (" + d.Job + ", " + d.Namespace + ") (" + d.metric(metric) + ")"
+}
+
+// taskQuery sums metric by job, namespace, task group and task across every allocation
+func (d promDialect) taskQuery(metric string) string {
+	return "sum by (" + d.Job + ", " + d.Namespace + ", " + d.TaskGroup + ", " + d.Task + ") (" + d.metric(metric) + ")"
+}
+
+// allocQuery lists metric by allocation, which both tells which allocations have series and their usage
+func (d promDialect) allocQuery(metric string) string {
+	return "sum by (" + d.AllocID + ") (" + d.metric(metric) + ")"
+}
+
+// windowQuery applies function to metric summed by job and namespace, sampled every windowStep over window
+func (d promDialect) windowQuery(function, metric string, window time.Duration) string {
+	return function + d.jobQuery(metric) + fmt.Sprintf("[%ds:%s])", int(window.Seconds()), windowStep)
+}
+
+// allocSecondsQuery integrates metric by allocation over window, as the sum of its samples taken every windowStep
+func (d promDialect) allocSecondsQuery(metric string, window time.Duration) string {
+	return "sum by (" + d.AllocID + ") (sum_over_time(" + d.metric(metric) + fmt.Sprintf("[%ds:%s]))", int(window.Seconds()), windowStep)
+}
+
+// labels reads the labels of a series named in the dialect
+func (d promDialect) labels(metric map[string]string) MetricType {
+	return MetricType{metric[d.Job], metric[d.Namespace], metric[d.AllocID], metric[d.TaskGroup], metric[d.Task]}
+}
+
+func metricsQueryURL(metricsAddress, query string) string {
+	return "http://" + metricsAddress + "/api/v1/query?query=" + url.QueryEscape(query)
+}
+
+func metricsRangeURL(metricsAddress, query string, begin, end time.Time, step time.Duration) string {
+	return "http://" + metricsAddress + "/api/v1/query_range?query=" + url.QueryEscape(query) +
+		"&start=" + strconv.FormatInt(begin.Unix(), 10) + "&end=" + strconv.FormatInt(end.Unix(), 10) +
+		"&step=" + strconv.Itoa(int(step.Seconds())) + "s"
+}
+
+// promQLSource reads used resources from a metrics server implementing the Prometheus query API
+type promQLSource struct {
+	Address string
+	Dialect promDialect
+}
+
+// VictoriaMetrics reads used resources from the Nomad telemetry ingested by a VictoriaMetrics server
+type VictoriaMetrics struct {
+	promQLSource
+}
+
+// Prometheus reads used resources from the Nomad telemetry scraped by a Prometheus server
+type Prometheus struct {
+	promQLSource
+}
+
+func newVictoriaMetrics(address string) VictoriaMetrics {
+	return VictoriaMetrics{promQLSource{address, victoriaMetricsDialect}}
+}
+
+func newPrometheus(address string) Prometheus {
+	return Prometheus{promQLSource{address, prometheusDialect}}
+}
+
+// queryMetrics runs an instant query, from the cycle's cache when ctx carries one
+func (p promQLSource) queryMetrics(ctx context.Context, query string) (map[MetricType]float64, error) {
+	usage, err := cached(ctx, metricsQueryURL(p.Address, query), func() (interface{}, error) {
+		return p.getMetrics(ctx, query)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage.(map[MetricType]float64), nil
+}
+
+// getMetrics runs an instant query against the metrics server and sums its series by the labels of MetricType
+func (p promQLSource) getMetrics(ctx context.Context, query string) (map[MetricType]float64, error) {
+	usage := make(map[MetricType]float64)
+
+	response, err := metricsGet(ctx, metricsQueryURL(p.Address, query))
+	if err != nil {
+		reportUpstreamError(ctx, err)
+		return nil, metricsRequestError{err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Unexpected status %d from %s", response.StatusCode, p.Address)
+		reportUpstreamError(ctx, err)
+		return nil, metricsRequestError{err}
+	}
+
+	var VMStats RawAlloc
+	err = json.NewDecoder(response.Body).Decode(&VMStats)
+	if err != nil {
+		return nil, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+
+	for _, val := range VMStats.Data.Result {
+		labels := p.Dialect.labels(val.Metric)
+		// Series without a value are still listed
+		usage[labels] += 0
+		if len(val.Value) != 2 {
+			continue
+		}
+		str, ok := val.Value[1].(string)
+		if !ok {
+			continue
+		}
+		num, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Error in parsing float: %v", err)
+		}
+		usage[labels] += num
+	}
+
+	return usage, nil
+}
+
+// JobUsage returns metric summed over every allocation of a job
+func (p promQLSource) JobUsage(ctx context.Context, metric string, job MetricsJob) (float64, error) {
+	usage, err := p.queryMetrics(ctx, p.Dialect.jobQuery(metric))
+	if err != nil {
+		return 0, err
+	}
+
+	return jobValue(usage, job.Name, job.Namespace), nil
+}
+
+// WindowUsage returns the statistics of metric summed over a job's allocations across window
+func (p promQLSource) WindowUsage(ctx context.Context, metric string, job MetricsJob, window time.Duration) (UsageStats, error) {
+	var values [5]float64
+
+	for i, function := range windowFunctions {
+		usage, err := p.queryMetrics(ctx, p.Dialect.windowQuery(function, metric, window))
+		if err != nil {
+			return UsageStats{}, err
+		}
+		values[i] = jobValue(usage, job.Name, job.Namespace)
+	}
+
+	return UsageStats{values[0], values[1], values[2], values[3], values[4]}, nil
+}
+
+// jobValue looks a job up in a query grouped by job and namespace.
+// Series without a namespace label, scraped from Nomad versions without namespaces, match any namespace.
+func jobValue(usage map[MetricType]float64, jobName, namespace string) float64 {
+	if value, ok := usage[MetricType{Job: jobName, Namespace: namespace}]; ok {
+		return value
+	}
+	return usage[MetricType{Job: jobName}]
+}
+
+// TaskUsage returns metric of a job summed by task group and task
+func (p promQLSource) TaskUsage(ctx context.Context, metric string, job MetricsJob) (map[taskKey]float64, error) {
+	usage, err := p.queryMetrics(ctx, p.Dialect.taskQuery(metric))
+	if err != nil {
+		return nil, err
+	}
+
+	taskUsage := make(map[taskKey]float64)
+	for labels, value := range usage {
+		if labels.Job != job.Name || (labels.Namespace != job.Namespace && labels.Namespace != "") {
+			continue
+		}
+		taskUsage[taskKey{labels.Task_group, labels.Task}] += value
+	}
+
+	return taskUsage, nil
+}
+
+// AllocUsage returns metric by allocation ID for every allocation with series, of any job
+func (p promQLSource) AllocUsage(ctx context.Context, metric string, job MetricsJob) (map[string]float64, error) {
+	usage, err := p.queryMetrics(ctx, p.Dialect.allocQuery(metric))
+	if err != nil {
+		return nil, err
+	}
+
+	allocUsage := make(map[string]float64)
+	for labels, value := range usage {
+		allocUsage[labels.Alloc_id] += value
+	}
+
+	return allocUsage, nil
+}
+
+// AllocSeconds returns metric integrated over window by allocation ID for every allocation with series, of any job.
+// Each sample stands for the windowStep that follows it.
+func (p promQLSource) AllocSeconds(ctx context.Context, metric string, job MetricsJob, window time.Duration) (map[string]float64, error) {
+	usage, err := p.queryMetrics(ctx, p.Dialect.allocSecondsQuery(metric, window))
+	if err != nil {
+		return nil, err
+	}
+
+	allocSeconds := make(map[string]float64)
+	for labels, value := range usage {
+		allocSeconds[labels.Alloc_id] += value * windowStepSeconds
+	}
+
+	return allocSeconds, nil
+}
+
+// RangeSource reads the history of used resources, for backfilling the cycles NURD did not run
+type RangeSource interface {
+	// JobRangeUsage returns metric summed by job and namespace at every step from begin to end, by Unix time
+	JobRangeUsage(ctx context.Context, metric string, begin, end time.Time, step time.Duration) (map[MetricType]map[int64]float64, error)
+	// WindowRangeUsage returns the statistics of metric summed by job and namespace over the window
+	// ending at every step from begin to end, by Unix time
+	WindowRangeUsage(ctx context.Context, metric string, begin, end time.Time, step, window time.Duration) (map[MetricType]map[int64]UsageStats, error)
+}
+
+// RawRange is the response of a range query
+type RawRange struct {
+	Status string
+	Data   RangeDataMap
+}
+
+type RangeDataMap struct {
+	ResultType string
+	Result     []RangeVal
+}
+
+type RangeVal struct {
+	Metric map[string]string
+	Values [][]interface{}
+}
+
+// getRangeMetrics runs a range query against the metrics server and sums its series by the labels of MetricType
+// and Unix time. Steps without a sample are left out.
+func (p promQLSource) getRangeMetrics(ctx context.Context, query string, begin, end time.Time, step time.Duration) (map[MetricType]map[int64]float64, error) {
+	usage := make(map[MetricType]map[int64]float64)
+
+	response, err := metricsGet(ctx, metricsRangeURL(p.Address, query, begin, end, step))
+	if err != nil {
+		return nil, metricsRequestError{err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, metricsRequestError{fmt.Errorf("Unexpected status %d from %s", response.StatusCode, p.Address)}
+	}
+
+	var VMStats RawRange
+	err = json.NewDecoder(response.Body).Decode(&VMStats)
+	if err != nil {
+		return nil, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+
+	for _, val := range VMStats.Data.Result {
+		labels := p.Dialect.labels(val.Metric)
+		if usage[labels] == nil {
+			usage[labels] = make(map[int64]float64)
+		}
+		for _, sample := range val.Values {
+			if len(sample) != 2 {
+				continue
+			}
+			timestamp, ok := sample[0].(float64)
+			if !ok {
+				continue
+			}
+			str, ok := sample[1].(string)
+			if !ok {
+				continue
+			}
+			num, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Error in parsing float: %v", err)
+			}
+			usage[labels][int64(timestamp)] += num
+		}
+	}
+
+	return usage, nil
+}
+
+// JobRangeUsage returns metric summed by job and namespace at every step from begin to end, by Unix time
+func (p promQLSource) JobRangeUsage(ctx context.Context, metric string, begin, end time.Time, step time.Duration) (map[MetricType]map[int64]float64, error) {
+	return p.getRangeMetrics(ctx, p.Dialect.jobQuery(metric), begin, end, step)
+}
+
+// WindowRangeUsage returns the statistics of metric summed by job and namespace over the window ending at every step
+func (p promQLSource) WindowRangeUsage(ctx context.Context, metric string, begin, end time.Time, step, window time.Duration) (map[MetricType]map[int64]UsageStats, error) {
+	stats := make(map[MetricType]map[int64]UsageStats)
+
+	for i, function := range windowFunctions {
+		usage, err := p.getRangeMetrics(ctx, p.Dialect.windowQuery(function, metric, window), begin, end, step)
+		if err != nil {
+			return nil, err
+		}
+		for labels, values := range usage {
+			if stats[labels] == nil {
+				stats[labels] = make(map[int64]UsageStats)
+			}
+			for timestamp, value := range values {
+				current := stats[labels][timestamp]
+				fields := [5]float64{current.Avg, current.Max, current.P50, current.P95, current.P99}
+				fields[i] = value
+				stats[labels][timestamp] = UsageStats{fields[0], fields[1], fields[2], fields[3], fields[4]}
+			}
+		}
+	}
+
+	return stats, nil
+}
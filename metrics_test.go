@@ -0,0 +1,398 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSeries is a single allocation task series served by newFakeMetricsServer
+type fakeSeries struct {
+	Job, Namespace, AllocID, TaskGroup, Task string
+	Value                                   float64
+}
+
+// newFakeMetricsServer serves instant queries over jobs with allocsPerJob allocations each, answering both
+// the grouped queries and the per-job queries and full series listings they replaced, and counts requests.
+// Series are named and labelled in dialect, queries of other metrics return no series.
+func newFakeMetricsServer(dialect promDialect, jobs, allocsPerJob int) (*httptest.Server, *int32) {
+	var series []fakeSeries
+	for j := 0; j < jobs; j++ {
+		for a := 0; a < allocsPerJob; a++ {
+			series = append(series, fakeSeries{fmt.Sprintf("jobName%d", j), "default", fmt.Sprintf("alloc_id%d_%d", j, a), "TaskGroup1", "web", float64(1 + a)})
+		}
+	}
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		query := r.URL.Query().Get("query")
+		d := dialect
+
+		labels := func(s fakeSeries) map[string]string {
+			return map[string]string{d.Job: s.Job, d.Namespace: s.Namespace, d.AllocID: s.AllocID, d.TaskGroup: s.TaskGroup, d.Task: s.Task}
+		}
+		// Grouped queries end the metric with a parenthesis, per-job sums with a selector and listings with nothing
+		reads := func(metric string) bool {
+			return query == d.metric(metric) || strings.Contains(query, d.metric(metric)+")") || strings.Contains(query, d.metric(metric)+"{")
+		}
+		switch {
+		case !reads(rssMetric) && !reads(cacheMetric) && !reads(ticksMetric):
+			labels = func(s fakeSeries) map[string]string { return nil }
+		case strings.HasPrefix(query, "sum by ("+d.Job+", "+d.Namespace+") "):
+			labels = func(s fakeSeries) map[string]string { return map[string]string{d.Job: s.Job, d.Namespace: s.Namespace} }
+		case strings.HasPrefix(query, "sum by ("+d.Job+", "+d.Namespace+", "+d.TaskGroup+", "+d.Task+") "):
+			labels = func(s fakeSeries) map[string]string {
+				return map[string]string{d.Job: s.Job, d.Namespace: s.Namespace, d.TaskGroup: s.TaskGroup, d.Task: s.Task}
+			}
+		case strings.HasPrefix(query, "sum by ("+d.AllocID+") "):
+			labels = func(s fakeSeries) map[string]string { return map[string]string{d.AllocID: s.AllocID} }
+		case strings.HasPrefix(query, "sum("):
+			// sum(metric{job="jobName"}) by (job)
+			job := strings.SplitN(strings.SplitN(query, d.Job+`="`, 2)[1], `"`, 2)[0]
+			labels = func(s fakeSeries) map[string]string {
+				if s.Job != job {
+					return nil
+				}
+				return map[string]string{d.Job: s.Job}
+			}
+		}
+
+		grouped := make(map[string]float64)
+		groupLabels := make(map[string]map[string]string)
+		for _, s := range series {
+			l := labels(s)
+			if l == nil {
+				continue
+			}
+			key := fmt.Sprint(l)
+			grouped[key] += s.Value
+			groupLabels[key] = l
+		}
+
+		var result []map[string]interface{}
+		for key, value := range grouped {
+			result = append(result, map[string]interface{}{
+				"metric": groupLabels[key],
+				"value":  []interface{}{1597365496, fmt.Sprint(value)},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": result},
+		})
+	}))
+
+	return server, &requests
+}
+
+func TestQueryMetricsCache(t *testing.T) {
+	server, requests := newFakeMetricsServer(victoriaMetricsDialect, 3, 2)
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			used, err := newVictoriaMetrics(address).JobUsage(ctx, rssMetric, MetricsJob{Name: fmt.Sprintf("jobName%d", i), Namespace: "default"})
+			assert.Nil(t, err)
+			assert.Equal(t, 3.0, used)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	allocs := getMetricsAllocs(ctx, MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics(address)}}, rssMetric)
+	assert.Equal(t, 6, len(allocs))
+	assert.Contains(t, allocs, "alloc_id2_1")
+	getMetricsAllocs(ctx, MetricsJob{Cluster: &NomadCluster{Metrics: newVictoriaMetrics(address)}}, rssMetric)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+	// Without a cache every query is sent
+	newVictoriaMetrics(address).JobUsage(context.Background(), rssMetric, MetricsJob{Name: "jobName0", Namespace: "default"})
+	newVictoriaMetrics(address).JobUsage(context.Background(), rssMetric, MetricsJob{Name: "jobName1", Namespace: "default"})
+	assert.Equal(t, int32(4), atomic.LoadInt32(requests))
+}
+
+func TestQueryMetricsCacheError(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+	for i := 0; i < 3; i++ {
+		_, err := newVictoriaMetrics(address).JobUsage(ctx, rssMetric, MetricsJob{Name: "jobName", Namespace: "default"})
+		assert.IsType(t, metricsRequestError{}, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestGetJobUsageNamespaces(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`
+			{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {"job": "jobName", "namespace": "default"}, "value": [1597365496, "10"]},
+						{"metric": {"job": "jobName", "namespace": "batch"}, "value": [1597365496, "20"]},
+						{"metric": {"job": "legacyJob"}, "value": [1597365496, "30"]}
+					]
+				}
+			}`))
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	used, err := newVictoriaMetrics(address).JobUsage(context.Background(), rssMetric, MetricsJob{Name: "jobName", Namespace: "batch"})
+	assert.Nil(t, err)
+	assert.Equal(t, 20.0, used)
+	used, err = newVictoriaMetrics(address).JobUsage(context.Background(), rssMetric, MetricsJob{Name: "legacyJob", Namespace: "default"})
+	assert.Nil(t, err)
+	assert.Equal(t, 30.0, used)
+	used, err = newVictoriaMetrics(address).JobUsage(context.Background(), rssMetric, MetricsJob{Name: "missingJob", Namespace: "default"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, used)
+
+	tasks, err := newVictoriaMetrics(address).TaskUsage(context.Background(), rssMetric, MetricsJob{Name: "jobName", Namespace: "default"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[taskKey]float64{{"", ""}: 10}, tasks)
+}
+
+func TestGetJobUsageClusterLabels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := "30"
+		if strings.Contains(r.URL.Query().Get("query"), `{cluster="east"}`) {
+			value = "10"
+		} else if strings.Contains(r.URL.Query().Get("query"), `{cluster="west"}`) {
+			value = "20"
+		}
+		w.Write([]byte(`
+			{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {"job": "jobName", "namespace": "default"}, "value": [1597365496, "` + value + `"]}
+					]
+				}
+			}`))
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+	job := MetricsJob{Name: "jobName", Namespace: "default"}
+
+	// Clusters sharing a metrics server each read the jobs of their own series
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+	east, err := newMetricsSource(MetricsConfig{URL: "127.0.0.1", Port: strings.Split(address, ":")[1], Labels: map[string]string{"cluster": "east"}}, "")
+	assert.Nil(t, err)
+	west, err := newMetricsSource(MetricsConfig{URL: "127.0.0.1", Port: strings.Split(address, ":")[1], Labels: map[string]string{"cluster": "west"}}, "")
+	assert.Nil(t, err)
+	used, err := east.JobUsage(ctx, rssMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, 10.0, used)
+	used, err = west.JobUsage(ctx, rssMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, 20.0, used)
+	used, err = newVictoriaMetrics(address).JobUsage(ctx, rssMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, 30.0, used)
+
+	assert.Equal(t, `sum by (job, namespace) (nomad_client_allocs_memory_rss_value{cluster="east", region="us\"1"})`,
+		victoriaMetricsDialect.withLabels(map[string]string{"region": `us"1`, "cluster": "east"}).jobQuery(rssMetric))
+}
+
+func TestGetWindowUsage(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		value := map[string]string{
+			"avg_over_time(":            "10",
+			"max_over_time(":            "40",
+			"quantile_over_time(0.5, ":  "8",
+			"quantile_over_time(0.95, ": "30",
+			"quantile_over_time(0.99, ": "38",
+		}[strings.SplitN(query, "sum by", 2)[0]]
+		w.Write([]byte(`
+			{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {"job": "jobName", "namespace": "default"}, "value": [1597365496, "` + value + `"]}
+					]
+				}
+			}`))
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	stats, err := newVictoriaMetrics(address).WindowUsage(context.Background(), rssMetric, MetricsJob{Name: "jobName", Namespace: "default"}, 15*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, UsageStats{10, 40, 8, 30, 38}, stats)
+	assert.Equal(t, "quantile_over_time(0.95, sum by (job, namespace) (nomad_client_allocs_memory_rss_value)[900s:1m])", queries[3])
+
+	window := collectionWindow
+	collectionWindow = 15 * time.Minute
+	defer func() { collectionWindow = window }()
+	assert.Equal(t, UsageStats{5, 20, 4, 15, 19}, aggWindowUsage(context.Background(), &NomadCluster{Metrics: newVictoriaMetrics(address)}, rssMetric, "jobID", "jobName", "default", 2))
+	assert.Equal(t, UsageStats{}, aggWindowUsage(context.Background(), &NomadCluster{Metrics: newVictoriaMetrics("badAddress")}, rssMetric, "jobID", "jobName", "default", 2))
+}
+
+// legacyJobUsage is the per-job path replaced by the grouped queries: a sum over the job's series
+// followed by a listing of every series of the metric
+func legacyJobUsage(ctx context.Context, cluster *NomadCluster, metric, jobName string) (float64, map[string]struct{}, error) {
+	source := cluster.metrics().(VictoriaMetrics)
+	usage, err := source.getMetrics(ctx, "sum("+metric+`{job="`+jobName+`"}) by (job)`)
+	if err != nil {
+		return 0, nil, err
+	}
+	series, err := source.getMetrics(ctx, metric)
+	if err != nil {
+		return 0, nil, err
+	}
+	allocs := make(map[string]struct{})
+	for labels := range series {
+		allocs[labels.Alloc_id] = struct{}{}
+	}
+
+	return usage[MetricType{Job: jobName}], allocs, nil
+}
+
+// groupedJobUsage reads the same usage and allocation IDs as legacyJobUsage from the grouped queries
+func groupedJobUsage(ctx context.Context, cluster *NomadCluster, metric, jobName string) (float64, map[string]struct{}, error) {
+	job := MetricsJob{cluster, jobName, jobName, "default"}
+	usage, err := cluster.metrics().JobUsage(ctx, metric, job)
+	if err != nil {
+		return 0, nil, err
+	}
+	allocUsage, err := cluster.metrics().AllocUsage(ctx, metric, job)
+	if err != nil {
+		return 0, nil, err
+	}
+	allocs := make(map[string]struct{})
+	for allocID := range allocUsage {
+		allocs[allocID] = struct{}{}
+	}
+
+	return usage, allocs, nil
+}
+
+func benchmarkUsage(b *testing.B, usage func(ctx context.Context, cluster *NomadCluster, metric, jobName string) (float64, map[string]struct{}, error)) {
+	const jobs = 200
+	server, requests := newFakeMetricsServer(victoriaMetricsDialect, jobs, 5)
+	defer server.Close()
+	cluster := &NomadCluster{Namespace: "default", Metrics: newVictoriaMetrics(server.Listener.Addr().String())}
+
+	// Both paths read the same usage and allocations
+	used, allocs, err := usage(withMetricsCache(context.Background(), newMetricsCache()), cluster, rssMetric, "jobName1")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if used != 15 || len(allocs) != jobs*5 {
+		b.Fatalf("Unexpected usage %v of %d allocations", used, len(allocs))
+	}
+	atomic.StoreInt32(requests, 0)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := withMetricsCache(context.Background(), newMetricsCache())
+		for j := 0; j < jobs; j++ {
+			for _, metric := range []string{rssMetric, cacheMetric, ticksMetric} {
+				_, _, err := usage(ctx, cluster, metric, fmt.Sprintf("jobName%d", j))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(requests))/float64(b.N), "requests/cycle")
+}
+
+func BenchmarkUsagePerJob(b *testing.B) {
+	benchmarkUsage(b, legacyJobUsage)
+}
+
+func BenchmarkUsageGrouped(b *testing.B) {
+	benchmarkUsage(b, groupedJobUsage)
+}
+
+func TestRangeUsage(t *testing.T) {
+	begin := time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC)
+	end := begin.Add(15 * time.Minute)
+
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Equal(t, "/api/v1/query_range", r.URL.Path)
+		assert.Equal(t, fmt.Sprint(begin.Unix()), query.Get("start"))
+		assert.Equal(t, fmt.Sprint(end.Unix()), query.Get("end"))
+		assert.Equal(t, "900s", query.Get("step"))
+		queries = append(queries, query.Get("query"))
+
+		value := fmt.Sprint(len(queries))
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"job":"job1","namespace":"default"},"values":[[%d,"%s"],[%d,"%s"]]},
+			{"metric":{"job":"job2","namespace":"default"},"values":[[%d,"%s"]]}]}}`,
+			begin.Unix(), value, end.Unix(), value, end.Unix(), value)
+	}))
+	defer server.Close()
+
+	source := newVictoriaMetrics(strings.TrimPrefix(server.URL, "http://"))
+	usage, err := source.JobRangeUsage(context.Background(), rssMetric, begin, end, 15*time.Minute)
+	assert.Empty(t, err)
+	assert.Equal(t, map[MetricType]map[int64]float64{
+		{Job: "job1", Namespace: "default"}: {begin.Unix(): 1, end.Unix(): 1},
+		{Job: "job2", Namespace: "default"}: {end.Unix(): 1},
+	}, usage)
+	assert.Equal(t, []string{"sum by (job, namespace) (" + rssMetric + ")"}, queries)
+
+	stats, err := source.WindowRangeUsage(context.Background(), ticksMetric, begin, end, 15*time.Minute, 15*time.Minute)
+	assert.Empty(t, err)
+	assert.Equal(t, map[MetricType]map[int64]UsageStats{
+		{Job: "job1", Namespace: "default"}: {begin.Unix(): {2, 3, 4, 5, 6}, end.Unix(): {2, 3, 4, 5, 6}},
+		{Job: "job2", Namespace: "default"}: {end.Unix(): {2, 3, 4, 5, 6}},
+	}, stats)
+	assert.Equal(t, "avg_over_time(sum by (job, namespace) ("+ticksMetric+")[900s:1m])", queries[1])
+	assert.Equal(t, "quantile_over_time(0.99, sum by (job, namespace) ("+ticksMetric+")[900s:1m])", queries[5])
+
+	server.Close()
+	_, err = source.JobRangeUsage(context.Background(), rssMetric, begin, end, 15*time.Minute)
+	_, ok := err.(metricsRequestError)
+	assert.True(t, ok)
+}
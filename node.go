@@ -0,0 +1,233 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NodeData holds the inventory and schedulable resources of a single Nomad client node
+type NodeData struct {
+	NodeID                string
+	Name                  string
+	Cluster               string
+	Region                string
+	Datacenter            string
+	NodeClass             string
+	Status                string
+	SchedulingEligibility string
+	Drain                 bool
+	CPU                   float64
+	MemoryMB              float64
+	DiskMB                float64
+	ReservedCPU           float64
+	ReservedMemoryMB      float64
+	ReservedDiskMB        float64
+}
+
+// CapacityData summarizes how full a cluster is in a single collection cycle.
+// Node resources only cover ready nodes, allocated resources are requested by the cluster's jobs.
+type CapacityData struct {
+	Cluster           string
+	Nodes             int
+	ReadyNodes        int
+	CPU               float64
+	MemoryMB          float64
+	DiskMB            float64
+	ReservedCPU       float64
+	ReservedMemoryMB  float64
+	ReservedDiskMB    float64
+	AllocatedCPU      float64
+	AllocatedMemoryMB float64
+	AllocatedDiskMB   float64
+	UsedCPU           float64
+	UsedMemoryMB      float64
+}
+
+type NomadNode struct {
+	ID                    string
+	Name                  string
+	Datacenter            string
+	NodeClass             string
+	Status                string
+	SchedulingEligibility string
+	Drain                 bool
+	Attributes            map[string]string
+	NodeResources         NodeResources
+	ReservedResources     NodeResources
+}
+
+type NodeResources struct {
+	Cpu    NodeCPU
+	Memory NodeMemory
+	Disk   NodeDisk
+}
+
+type NodeCPU struct {
+	CpuShares     float64
+	TotalCpuCores float64
+}
+
+type NodeMemory struct {
+	MemoryMB float64
+}
+
+type NodeDisk struct {
+	DiskMB float64
+}
+
+func getNodes(ctx context.Context, cluster *NomadCluster) ([]NomadNode, error) {
+	response, err := cluster.get(ctx, "/v1/nodes")
+	if err != nil {
+		return nil, fmt.Errorf("Error in getting API response: %v", err)
+	}
+	defer response.Body.Close()
+
+	var nodes []NomadNode
+	err = json.NewDecoder(response.Body).Decode(&nodes)
+	if err != nil {
+		return nil, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+
+	return nodes, nil
+}
+
+func getNode(ctx context.Context, cluster *NomadCluster, nodeID string) (NomadNode, error) {
+	var node NomadNode
+
+	response, err := cluster.get(ctx, "/v1/node/" + nodeID)
+	if err != nil {
+		return node, fmt.Errorf("Error in getting API response: %v", err)
+	}
+	defer response.Body.Close()
+
+	err = json.NewDecoder(response.Body).Decode(&node)
+	if err != nil {
+		return node, fmt.Errorf("Error in decoding JSON: %v", err)
+	}
+
+	return node, nil
+}
+
+// getNodeCoreMHz returns the MHz of a single CPU core of a node, read from its cpu.frequency attribute
+// or derived from its total CPU shares and core count
+func getNodeCoreMHz(ctx context.Context, cluster *NomadCluster, nodeID string) (float64, error) {
+	node, err := getNode(ctx, cluster, nodeID)
+	if err != nil {
+		return 0, err
+	}
+
+	if frequency, err := strconv.ParseFloat(node.Attributes["cpu.frequency"], 64); err == nil && frequency > 0 {
+		return frequency, nil
+	}
+
+	numCores := node.NodeResources.Cpu.TotalCpuCores
+	if numCores == 0 {
+		numCores, _ = strconv.ParseFloat(node.Attributes["cpu.numcores"], 64)
+	}
+	if numCores == 0 {
+		return 0, fmt.Errorf("No CPU core information for node %s", nodeID)
+	}
+
+	return node.NodeResources.Cpu.CpuShares / numCores, nil
+}
+
+// reachNodes collects the node inventory of every region of the cluster.
+// Nodes whose details cannot be read, or that are left when ctx ends, are skipped.
+func reachNodes(ctx context.Context, cluster *NomadCluster, c chan<- []NodeData) {
+	var nodeData []NodeData
+
+	defer wg.Done()
+
+	log.SetLevel(log.TraceLevel)
+	log.SetReportCaller(true)
+
+	for _, region := range getRegions(ctx, cluster) {
+		regionCluster := cluster.withRegion(region)
+		nodes, err := getNodes(ctx, regionCluster)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error in listing nodes in region %s: %v", region, err))
+			continue
+		}
+
+		for _, stub := range nodes {
+			if ctx.Err() != nil {
+				break
+			}
+			node, err := getNode(ctx, regionCluster, stub.ID)
+			if err != nil {
+				log.Error(fmt.Sprintf("Error in getting node %s: %v", stub.ID, err))
+				continue
+			}
+
+			nodeData = append(nodeData, NodeData{
+				node.ID,
+				node.Name,
+				cluster.Name,
+				region,
+				node.Datacenter,
+				node.NodeClass,
+				node.Status,
+				node.SchedulingEligibility,
+				node.Drain,
+				node.NodeResources.Cpu.CpuShares,
+				node.NodeResources.Memory.MemoryMB,
+				node.NodeResources.Disk.DiskMB,
+				node.ReservedResources.Cpu.CpuShares,
+				node.ReservedResources.Memory.MemoryMB,
+				node.ReservedResources.Disk.DiskMB,
+			})
+		}
+	}
+
+	c <- nodeData
+}
+
+// aggCapacity sums the node inventory and job data collected from a cluster in one cycle
+func aggCapacity(cluster string, nodes []NodeData, jobs []JobData) CapacityData {
+	capacity := CapacityData{Cluster: cluster}
+
+	for _, node := range nodes {
+		capacity.Nodes++
+		if node.Status != "ready" {
+			continue
+		}
+		capacity.ReadyNodes++
+		capacity.CPU += node.CPU
+		capacity.MemoryMB += node.MemoryMB
+		capacity.DiskMB += node.DiskMB
+		capacity.ReservedCPU += node.ReservedCPU
+		capacity.ReservedMemoryMB += node.ReservedMemoryMB
+		capacity.ReservedDiskMB += node.ReservedDiskMB
+	}
+
+	for _, job := range jobs {
+		capacity.AllocatedCPU += job.RCPU + job.RCoresMHz
+		capacity.AllocatedMemoryMB += job.RMemoryMB
+		capacity.AllocatedDiskMB += job.RdiskMB
+		capacity.UsedCPU += job.UTicks
+		capacity.UsedMemoryMB += job.URSS
+	}
+
+	return capacity
+}
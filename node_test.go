@@ -0,0 +1,208 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNodes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/nodes",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "node_id1",
+					"Name": "node1",
+					"Datacenter": "DC1",
+					"NodeClass": "web",
+					"Status": "ready",
+					"SchedulingEligibility": "eligible",
+					"Drain": false
+				}
+			]`,
+		),
+	)
+	nodes, err := getNodes(context.Background(), &NomadCluster{Address: "clusterAddress"})
+	assert.Empty(t, err)
+	assert.Equal(t, []NomadNode{{ID: "node_id1", Name: "node1", Datacenter: "DC1", NodeClass: "web", Status: "ready", SchedulingEligibility: "eligible"}}, nodes)
+
+	nodes, err = getNodes(context.Background(), &NomadCluster{Address: "badAddress"})
+	assert.NotNil(t, err)
+	assert.Empty(t, nodes)
+}
+
+func TestGetNodeCoreMHz(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id1",
+		httpmock.NewStringResponder(200, `{"ID": "node_id1", "Attributes": {"cpu.frequency": "2500", "cpu.numcores": "4"}}`),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id2",
+		httpmock.NewStringResponder(200, `{"ID": "node_id2", "Attributes": {"cpu.numcores": "4"}, "NodeResources": {"Cpu": {"CpuShares": 12000}}}`),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id3",
+		httpmock.NewStringResponder(200, `{"ID": "node_id3", "NodeResources": {"Cpu": {"CpuShares": 12000}}}`),
+	)
+	cluster := &NomadCluster{Address: "clusterAddress"}
+
+	coreMHz, err := getNodeCoreMHz(context.Background(), cluster, "node_id1")
+	assert.Empty(t, err)
+	assert.Equal(t, 2500.0, coreMHz)
+
+	coreMHz, err = getNodeCoreMHz(context.Background(), cluster, "node_id2")
+	assert.Empty(t, err)
+	assert.Equal(t, 3000.0, coreMHz)
+
+	coreMHz, err = getNodeCoreMHz(context.Background(), cluster, "node_id3")
+	assert.NotNil(t, err)
+	assert.Equal(t, 0.0, coreMHz)
+
+	_, err = getNodeCoreMHz(context.Background(), cluster, "node_id4")
+	assert.NotNil(t, err)
+}
+
+func TestReachNodes(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/nodes",
+		httpmock.NewStringResponder(200, `
+			[
+				{
+					"ID": "node_id1"
+				},
+				{
+					"ID": "node_id2"
+				},
+				{
+					"ID": "node_id3"
+				}
+			]`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id1",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "node_id1",
+				"Name": "node1",
+				"Datacenter": "DC1",
+				"NodeClass": "web",
+				"Status": "ready",
+				"SchedulingEligibility": "eligible",
+				"Drain": false,
+				"NodeResources": {
+					"Cpu": {
+						"CpuShares": 8000
+					},
+					"Memory": {
+						"MemoryMB": 16384
+					},
+					"Disk": {
+						"DiskMB": 100000
+					}
+				},
+				"ReservedResources": {
+					"Cpu": {
+						"CpuShares": 500
+					},
+					"Memory": {
+						"MemoryMB": 1024
+					},
+					"Disk": {
+						"DiskMB": 5000
+					}
+				}
+			}`,
+		),
+	)
+	httpmock.RegisterResponder("GET", "http://clusterAddress/v1/node/node_id2",
+		httpmock.NewStringResponder(200, `
+			{
+				"ID": "node_id2",
+				"Name": "node2",
+				"Datacenter": "DC2",
+				"Status": "down",
+				"SchedulingEligibility": "ineligible",
+				"Drain": true,
+				"NodeResources": {
+					"Cpu": {
+						"CpuShares": 4000
+					},
+					"Memory": {
+						"MemoryMB": 8192
+					},
+					"Disk": {
+						"DiskMB": 50000
+					}
+				}
+			}`,
+		),
+	)
+
+	wg.Add(1)
+	c := make(chan []NodeData, 1)
+	reachNodes(context.Background(), &NomadCluster{Name: "cluster1", Address: "clusterAddress"}, c)
+	wg.Wait()
+	close(c)
+
+	expectedNodes := []NodeData{
+		{"node_id1", "node1", "cluster1", "", "DC1", "web", "ready", "eligible", false, 8000, 16384, 100000, 500, 1024, 5000},
+		{"node_id2", "node2", "cluster1", "", "DC2", "", "down", "ineligible", true, 4000, 8192, 50000, 0, 0, 0},
+	}
+	assert.Equal(t, expectedNodes, <-c)
+}
+
+func TestAggCapacity(t *testing.T) {
+	nodes := []NodeData{
+		{"node_id1", "node1", "cluster1", "", "DC1", "web", "ready", "eligible", false, 8000, 16384, 100000, 500, 1024, 5000},
+		{"node_id2", "node2", "cluster1", "", "DC1", "web", "ready", "ineligible", true, 4000, 8192, 50000, 0, 0, 0},
+		{"node_id3", "node3", "cluster1", "", "DC2", "", "down", "eligible", false, 4000, 8192, 50000, 0, 0, 0},
+	}
+	jobs := []JobData{
+		{JobID: "jobID1", RCPU: 1000, RMemoryMB: 2048, RdiskMB: 300, UTicks: 250.5, URSS: 100},
+		{JobID: "jobID2", RCPU: 500, RMemoryMB: 256, RdiskMB: 150, UTicks: 20, URSS: 10},
+		{JobID: "jobID3", RCores: 2, RCoresMHz: 4000, UTicks: 3000},
+	}
+
+	expected := CapacityData{
+		Cluster:           "cluster1",
+		Nodes:             3,
+		ReadyNodes:        2,
+		CPU:               12000,
+		MemoryMB:          24576,
+		DiskMB:            150000,
+		ReservedCPU:       500,
+		ReservedMemoryMB:  1024,
+		ReservedDiskMB:    5000,
+		AllocatedCPU:      5500,
+		AllocatedMemoryMB: 2304,
+		AllocatedDiskMB:   450,
+		UsedCPU:           3270.5,
+		UsedMemoryMB:      110,
+	}
+	assert.Equal(t, expected, aggCapacity("cluster1", nodes, jobs))
+	assert.Equal(t, CapacityData{Cluster: "cluster2"}, aggCapacity("cluster2", nil, nil))
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+)
+
+// Provenance of a used metric of a job
+const (
+	// Every measured allocation was read from the cluster's metrics server
+	fromMetrics = "metrics"
+	// Every measured allocation was read from the allocation stats of Nomad clients
+	fromNomad = "nomad"
+	// Measured allocations were read from both the metrics server and Nomad,
+	// or rows summed together were measured from different sources or not at all
+	fromMixed = "mixed"
+	// No running allocation was measured
+	fromMissing = "missing"
+	// The job had no running allocation to measure
+	fromNone = "none"
+)
+
+// UsageProvenance records where the used RSS, cache and ticks of a job were read from,
+// and how many of its running allocations were measured for all three.
+type UsageProvenance struct {
+	RSSSource      string
+	CacheSource    string
+	TicksSource    string
+	MeasuredAllocs float64
+	TotalAllocs    float64
+}
+
+// getUsageProvenance works out where each used metric of a job's running allocations was read from,
+// given its allocations or nil when they could not be listed, the remainders left to Nomad by the metrics source
+// and the allocations whose stats Nomad returned. Clusters in Nomad-only mode read every allocation from Nomad.
+func getUsageProvenance(ctx context.Context, cluster *NomadCluster, jobID, jobName string, allocs []Alloc, remainders map[string][]string, read map[string]struct{}) UsageProvenance {
+	if allocs == nil {
+		return UsageProvenance{fromMissing, fromMissing, fromMissing, 0, 0}
+	}
+
+	var running []string
+	for _, alloc := range allocs {
+		if alloc.ClientStatus == "running" {
+			running = append(running, alloc.ID)
+		}
+	}
+
+	source := fromMetrics
+	if cluster.nomadOnly() {
+		source = fromNomad
+	}
+
+	job := MetricsJob{cluster, jobID, jobName, cluster.Namespace}
+	measured := make(map[string]int)
+	provenance := func(metric, name string) string {
+		var bySource, byNomad int
+
+		metricsAllocs := getMetricsAllocs(ctx, job, metric)
+		for _, allocID := range running {
+			if _, ok := metricsAllocs[allocID]; ok {
+				bySource++
+				measured[allocID]++
+				continue
+			}
+			if _, ok := read[allocID]; ok && contains(remainders[allocID], name) {
+				byNomad++
+				measured[allocID]++
+			}
+		}
+
+		return sourceOf(source, bySource, byNomad, len(running))
+	}
+
+	usage := UsageProvenance{
+		RSSSource:   provenance(rssMetric, "rss"),
+		CacheSource: provenance(cacheMetric, "cache"),
+		TicksSource: provenance(ticksMetric, "ticks"),
+		TotalAllocs: float64(len(running)),
+	}
+	for _, count := range measured {
+		if count == 3 {
+			usage.MeasuredAllocs++
+		}
+	}
+
+	return usage
+}
+
+// sourceOf names the provenance of a metric measured on bySource allocations by source and byNomad allocations
+// by the Nomad fallback, out of total running allocations
+func sourceOf(source string, bySource, byNomad, total int) string {
+	switch {
+	case total == 0:
+		return fromNone
+	case bySource > 0 && byNomad > 0 && source != fromNomad:
+		return fromMixed
+	case bySource > 0:
+		return source
+	case byNomad > 0:
+		return fromNomad
+	}
+	return fromMissing
+}
+
+// mergeSource returns the provenance of a metric summed over two jobs.
+// A sum of measured and unmeasured jobs is mixed rather than measured.
+func mergeSource(source, other string) string {
+	switch {
+	case source == other || other == fromNone || other == "":
+		return source
+	case source == fromNone || source == "":
+		return other
+	}
+	return fromMixed
+}
+
+// completeness returns the fraction of running allocations that were measured, 1 when none were running
+func completeness(measured, total float64) float64 {
+	if total == 0 {
+		return 1
+	}
+	return measured / total
+}
+
+func contains(slice []string, value string) bool {
+	for _, val := range slice {
+		if val == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageProvenanceNomadOnly(t *testing.T) {
+	server, _, _ := newFakeNomadServer("jobID")
+	defer server.Close()
+	cluster := &NomadCluster{Address: server.Listener.Addr().String(), Metrics: NomadOnly{}}
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+
+	// alloc4 is running but its stats cannot be read
+	_, _, _, provenance := aggUsed(ctx, cluster, "jobID", "jobName", listAllocs(cluster, "jobID"))
+	assert.Equal(t, UsageProvenance{"nomad", "nomad", "nomad", 2, 3}, provenance)
+}
+
+func TestUsageProvenanceMixed(t *testing.T) {
+	metricsServer, _ := newFakeMetricsServer(victoriaMetricsDialect, 1, 2)
+	defer metricsServer.Close()
+
+	// alloc_id0_0 is measured by the metrics server, alloc_id0_1 has completed, alloc_id0_2 falls back to Nomad
+	// and alloc_id0_3 cannot be read from either
+	nomadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/job/jobID/allocations":
+			w.Write([]byte(`[
+				{"ID": "alloc_id0_0", "ClientStatus": "running"},
+				{"ID": "alloc_id0_1", "ClientStatus": "complete"},
+				{"ID": "alloc_id0_2", "ClientStatus": "running"},
+				{"ID": "alloc_id0_3", "ClientStatus": "running"}
+			]`))
+		case r.URL.Path == "/v1/client/allocation/alloc_id0_2/stats":
+			fmt.Fprint(w, `{"ResourceUsage": {"MemoryStats": {"RSS": 1049000, "Cache": 1049000}, "CpuStats": {"TotalTicks": 100}}}`)
+		case strings.HasPrefix(r.URL.Path, "/v1/client/allocation/"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer nomadServer.Close()
+
+	cluster := &NomadCluster{
+		Address:   nomadServer.Listener.Addr().String(),
+		Namespace: "default",
+		Metrics:   newVictoriaMetrics(metricsServer.Listener.Addr().String()),
+	}
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+
+	rss, _, _, provenance := aggUsed(ctx, cluster, "jobID", "jobName0", listAllocs(cluster, "jobID"))
+	assert.InDelta(t, 3/1.049e6+1, rss, 1e-9)
+	assert.Equal(t, UsageProvenance{"mixed", "mixed", "mixed", 2, 3}, provenance)
+
+	// Without the metrics server only the Nomad fallback is left
+	metricsServer.Close()
+	_, _, _, provenance = aggUsed(withMetricsCache(context.Background(), newMetricsCache()), cluster, "jobID", "jobName0", listAllocs(cluster, "jobID"))
+	assert.Equal(t, UsageProvenance{"nomad", "nomad", "nomad", 1, 3}, provenance)
+
+	// Without Nomad nothing can be measured
+	nomadServer.Close()
+	_, _, _, provenance = aggUsed(withMetricsCache(context.Background(), newMetricsCache()), cluster, "jobID", "jobName0", listAllocs(cluster, "jobID"))
+	assert.Equal(t, UsageProvenance{"missing", "missing", "missing", 0, 0}, provenance)
+}
+
+func TestUsageProvenanceBadMetricsAnswer(t *testing.T) {
+	// The metrics server answers, but with a body that cannot be decoded
+	metricsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`invalid JSON`))
+	}))
+	defer metricsServer.Close()
+	nomadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/job/jobID/allocations":
+			w.Write([]byte(`[{"ID": "alloc_id0_0", "ClientStatus": "running"}, {"ID": "alloc_id0_1", "ClientStatus": "running"}]`))
+		case r.URL.Path == "/v1/client/allocation/alloc_id0_0/stats":
+			fmt.Fprint(w, `{"ResourceUsage": {"MemoryStats": {"RSS": 1049000, "Cache": 1049000}, "CpuStats": {"TotalTicks": 100}}}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer nomadServer.Close()
+
+	cluster := &NomadCluster{
+		Address:   nomadServer.Listener.Addr().String(),
+		Namespace: "default",
+		Metrics:   newVictoriaMetrics(metricsServer.Listener.Addr().String()),
+	}
+
+	// Every allocation falls back to Nomad rather than pass for measured by the metrics server
+	rss, ticks, _, provenance := aggUsed(withMetricsCache(context.Background(), newMetricsCache()), cluster, "jobID", "jobName0", listAllocs(cluster, "jobID"))
+	assert.InDelta(t, 1, rss, 1e-9)
+	assert.Equal(t, 100.0, ticks)
+	assert.Equal(t, UsageProvenance{"nomad", "nomad", "nomad", 1, 2}, provenance)
+}
+
+func TestSourceOf(t *testing.T) {
+	assert.Equal(t, "none", sourceOf(fromMetrics, 0, 0, 0))
+	assert.Equal(t, "metrics", sourceOf(fromMetrics, 12, 0, 15))
+	assert.Equal(t, "nomad", sourceOf(fromMetrics, 0, 12, 15))
+	assert.Equal(t, "mixed", sourceOf(fromMetrics, 10, 2, 15))
+	assert.Equal(t, "nomad", sourceOf(fromNomad, 12, 0, 15))
+	assert.Equal(t, "missing", sourceOf(fromMetrics, 0, 0, 15))
+}
+
+func TestMergeSource(t *testing.T) {
+	assert.Equal(t, "metrics", mergeSource("metrics", "metrics"))
+	assert.Equal(t, "metrics", mergeSource("", "metrics"))
+	assert.Equal(t, "nomad", mergeSource("none", "nomad"))
+	assert.Equal(t, "nomad", mergeSource("nomad", "none"))
+	assert.Equal(t, "mixed", mergeSource("missing", "metrics"))
+	assert.Equal(t, "mixed", mergeSource("nomad", "missing"))
+	assert.Equal(t, "missing", mergeSource("missing", "missing"))
+	assert.Equal(t, "mixed", mergeSource("metrics", "nomad"))
+	assert.Equal(t, "mixed", mergeSource("mixed", "metrics"))
+	assert.Equal(t, "missing", mergeSource("missing", "none"))
+}
+
+func TestCompleteness(t *testing.T) {
+	assert.Equal(t, 0.8, completeness(12, 15))
+	assert.Equal(t, 1.0, completeness(0, 0))
+	assert.Equal(t, 0.0, completeness(0, 3))
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Outcome of a collection run or of a cluster within it
+const (
+	// Every cluster was collected and stored without errors
+	runSucceeded = "succeeded"
+	// Upstream errors, DB write errors or the cycle deadline left some data uncollected or unstored
+	runPartial = "partial"
+	// Nothing was stored because of errors or the cycle deadline, or no cluster is configured
+	runFailed = "failed"
+)
+
+// CollectionRun records the outcome of one aggregation cycle, stored in collection_runs
+type CollectionRun struct {
+	ID              int
+	Begin           string
+	End             string
+	DurationSeconds float64
+	Status          string
+	Clusters        []ClusterRun
+}
+
+// ClusterRun records the outcome of collecting one cluster during an aggregation cycle, stored in
+// collection_run_clusters. JobsSeen counts the jobs listed for collection, with periodic and dispatched children
+// counted once under their parent like they are stored. Errors counts the requests to Nomad or the metrics server
+// and the writes to the DB that failed.
+type ClusterRun struct {
+	Cluster    string
+	Status     string
+	JobsSeen   int
+	JobsStored int
+	Errors     int
+	FirstError string
+	TimedOut   bool
+}
+
+// status tells whether a cluster was collected in full, in part or not at all
+func (c ClusterRun) status() string {
+	switch {
+	case c.Errors == 0 && !c.TimedOut && c.JobsStored >= c.JobsSeen:
+		return runSucceeded
+	case c.JobsStored == 0:
+		return runFailed
+	}
+	return runPartial
+}
+
+// runStatus is succeeded or failed when every cluster was, partial otherwise.
+// A run over no cluster collected nothing and failed.
+func runStatus(clusters []ClusterRun) string {
+	status := runFailed
+	for i, cluster := range clusters {
+		clusterStatus := cluster.status()
+		if i == 0 {
+			status = clusterStatus
+		} else if clusterStatus != status {
+			return runPartial
+		}
+	}
+	return status
+}
+
+type clusterRecorderKey struct{}
+
+// clusterRecorder counts what happened while collecting a cluster during a cycle
+type clusterRecorder struct {
+	lock sync.Mutex
+	run  ClusterRun
+}
+
+func newClusterRecorder(cluster string) *clusterRecorder {
+	return &clusterRecorder{run: ClusterRun{Cluster: cluster}}
+}
+
+// withClusterRecorder returns a copy of ctx whose upstream errors and listed jobs are recorded by recorder
+func withClusterRecorder(ctx context.Context, recorder *clusterRecorder) context.Context {
+	return context.WithValue(ctx, clusterRecorderKey{}, recorder)
+}
+
+// reportUpstreamError records a failed request to Nomad or the metrics server, when ctx records them.
+// Requests abandoned because ctx ended are left to TimedOut.
+func reportUpstreamError(ctx context.Context, err error) {
+	recorder, ok := ctx.Value(clusterRecorderKey{}).(*clusterRecorder)
+	if !ok || ctx.Err() != nil {
+		return
+	}
+
+	recorder.failed(err)
+}
+
+// reportJobsSeen records that count jobs were listed, when ctx records them
+func reportJobsSeen(ctx context.Context, count int) {
+	recorder, ok := ctx.Value(clusterRecorderKey{}).(*clusterRecorder)
+	if !ok {
+		return
+	}
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.run.JobsSeen += count
+}
+
+// failed records an error that left data of the cluster uncollected or unstored
+func (r *clusterRecorder) failed(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.run.Errors++
+	if r.run.FirstError == "" {
+		r.run.FirstError = err.Error()
+	}
+}
+
+// stored records that a job of the cluster was stored
+func (r *clusterRecorder) stored() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.run.JobsStored++
+}
+
+// result returns what was recorded, along with the resulting status
+func (r *clusterRecorder) result(timedOut bool) ClusterRun {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	run := r.run
+	run.TimedOut = timedOut
+	run.Status = run.status()
+
+	return run
+}
+
+// CollectScope restricts an on-demand collection run to a single cluster and/or job, collecting everything when empty
+type CollectScope struct {
+	Cluster string
+	Job     string
+}
+
+type jobScopeKey struct{}
+
+type scheduledKey struct{}
+
+// cycleSlot is held by the running aggregation cycle, cycles never run concurrently
+var cycleSlot = make(chan struct{}, 1)
+
+// clusters returns the configured clusters within the scope, or an error when its cluster is not configured
+func (s CollectScope) clusters() ([]*NomadCluster, error) {
+	if s.Cluster == "" {
+		return nomadClusters, nil
+	}
+	for _, cluster := range nomadClusters {
+		if cluster.Name == s.Cluster {
+			return []*NomadCluster{cluster}, nil
+		}
+	}
+	return nil, fmt.Errorf("No cluster named %s is configured", s.Cluster)
+}
+
+// withScheduled returns a copy of ctx collecting the cycle scheduled at scheduled, the insertTime of its rows
+func withScheduled(ctx context.Context, scheduled time.Time) context.Context {
+	return context.WithValue(ctx, scheduledKey{}, scheduled)
+}
+
+// scheduledTime returns the time the cycle of ctx was scheduled at, or now outside of a cycle
+func scheduledTime(ctx context.Context) time.Time {
+	if scheduled, ok := ctx.Value(scheduledKey{}).(time.Time); ok {
+		return scheduled
+	}
+	return time.Now()
+}
+
+// withJobScope returns a copy of ctx collecting job alone, along with its periodic and dispatched children
+func withJobScope(ctx context.Context, job string) context.Context {
+	return context.WithValue(ctx, jobScopeKey{}, job)
+}
+
+// scopedJobs returns the jobs within the job scope of ctx
+func scopedJobs(ctx context.Context, jobs []JobDesc) []JobDesc {
+	job, ok := ctx.Value(jobScopeKey{}).(string)
+	if !ok {
+		return jobs
+	}
+
+	var scoped []JobDesc
+	for _, desc := range jobs {
+		if desc.ID == job || desc.ParentID == job {
+			scoped = append(scoped, desc)
+		}
+	}
+	return scoped
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/jobs":
+			w.Write([]byte(`[{"ID": "job1"}, {"ID": "job2"}]`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	cluster := &NomadCluster{Name: "cluster1", Address: server.Listener.Addr().String()}
+
+	recorder := newClusterRecorder("cluster1")
+	ctx := withClusterRecorder(context.Background(), recorder)
+
+	jobs, err := getJobs(ctx, cluster)
+	assert.Nil(t, err)
+	reportJobsSeen(ctx, len(jobs))
+	_, err = getAllocs(ctx, cluster, "job1")
+	assert.Error(t, err)
+	_, err = getAllocs(ctx, cluster, "job2")
+	assert.Error(t, err)
+	recorder.stored()
+
+	run := recorder.result(false)
+	assert.Equal(t, "cluster1", run.Cluster)
+	assert.Equal(t, 2, run.JobsSeen)
+	assert.Equal(t, 1, run.JobsStored)
+	assert.Equal(t, 2, run.Errors)
+	assert.Equal(t, "Unexpected status 403 from "+cluster.Address+"/v1/job/job1/allocations", run.FirstError)
+	assert.Equal(t, runPartial, run.Status)
+
+	// Requests abandoned at the end of the cycle are not errors of the upstream
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	reportUpstreamError(cancelled, errors.New("context canceled"))
+	assert.Equal(t, 2, recorder.result(false).Errors)
+
+	// Writes to the DB that failed are errors too
+	recorder.failed(errors.New("Error in inserting job2: connection reset"))
+	run = recorder.result(false)
+	assert.Equal(t, 3, run.Errors)
+	assert.Equal(t, "Unexpected status 403 from "+cluster.Address+"/v1/job/job1/allocations", run.FirstError)
+
+	// Nothing is recorded without a recorder
+	reportUpstreamError(context.Background(), errors.New("error"))
+	reportJobsSeen(context.Background(), 1)
+}
+
+func TestRunStatus(t *testing.T) {
+	succeeded := ClusterRun{Cluster: "cluster1", JobsSeen: 2, JobsStored: 2}
+	partial := ClusterRun{Cluster: "cluster2", JobsSeen: 2, JobsStored: 1, Errors: 1}
+	timedOut := ClusterRun{Cluster: "cluster3", JobsSeen: 2, TimedOut: true}
+	failed := ClusterRun{Cluster: "cluster4", Errors: 3}
+	unstored := ClusterRun{Cluster: "cluster5", JobsSeen: 2, JobsStored: 1}
+
+	assert.Equal(t, runSucceeded, succeeded.status())
+	assert.Equal(t, runPartial, partial.status())
+	assert.Equal(t, runFailed, timedOut.status())
+	assert.Equal(t, runFailed, failed.status())
+	assert.Equal(t, runPartial, unstored.status())
+
+	assert.Equal(t, runFailed, runStatus(nil))
+	assert.Equal(t, runSucceeded, runStatus([]ClusterRun{succeeded, succeeded}))
+	assert.Equal(t, runFailed, runStatus([]ClusterRun{timedOut, failed}))
+	assert.Equal(t, runPartial, runStatus([]ClusterRun{succeeded, failed}))
+	assert.Equal(t, runPartial, runStatus([]ClusterRun{partial}))
+}
+
+func TestCollectScope(t *testing.T) {
+	clusters := nomadClusters
+	defer func() { nomadClusters = clusters }()
+	nomadClusters = []*NomadCluster{{Name: "cluster1"}, {Name: "cluster2"}}
+
+	actual, err := CollectScope{}.clusters()
+	assert.Empty(t, err)
+	assert.Equal(t, nomadClusters, actual)
+
+	actual, err = CollectScope{Cluster: "cluster2"}.clusters()
+	assert.Empty(t, err)
+	assert.Equal(t, []*NomadCluster{nomadClusters[1]}, actual)
+
+	_, err = CollectScope{Cluster: "cluster3"}.clusters()
+	assert.EqualError(t, err, "No cluster named cluster3 is configured")
+
+	jobs := []JobDesc{{ID: "job1"}, {ID: "job1/periodic-1594143300", ParentID: "job1"}, {ID: "job2"}}
+	assert.Equal(t, jobs, scopedJobs(context.Background(), jobs))
+	assert.Equal(t, jobs[:2], scopedJobs(withJobScope(context.Background(), "job1"), jobs))
+	assert.Empty(t, scopedJobs(withJobScope(context.Background(), "job3"), jobs))
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule tells when aggregation cycles start
+type Schedule interface {
+	// next returns the first start strictly after t
+	next(t time.Time) time.Time
+}
+
+// Overrun policies, applied when a cycle is still running at the start of the next one
+const (
+	// Wait for the first start after the cycle finished
+	overrunSkip = "skip"
+	// Start the latest missed cycle as soon as the cycle finishes
+	overrunQueue = "queue"
+)
+
+// everySchedule starts cycles at every multiple of interval since the zero time, so a 15m interval
+// starts cycles at :00, :15, :30 and :45 of every hour
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (e everySchedule) next(t time.Time) time.Time {
+	return t.Truncate(e.interval).Add(e.interval)
+}
+
+// cronSchedule starts cycles at the minutes matching a five field cron expression, in the time zone of the
+// times it is given. Like cron, a time matches when both day of month and day of week match, or either of
+// them when both are restricted.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+	anyDay, anyWeekday                     bool
+}
+
+// cronFields are the bounds of each field of a cron expression, day of week 7 being Sunday like 0
+var cronFields = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses minute, hour, day of month, month and day of week, each one of *, a value, a range a-b
+// or a comma separated list of them, optionally stepped with /n
+func parseCron(expression string) (cronSchedule, error) {
+	var schedule cronSchedule
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return schedule, fmt.Errorf("Cron expression %q must have 5 fields, has %d", expression, len(fields))
+	}
+
+	var sets [5]map[int]bool
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i][0], cronFields[i][1])
+		if err != nil {
+			return schedule, fmt.Errorf("Error in parsing cron expression %q: %v", expression, err)
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+
+	schedule = cronSchedule{sets[0], sets[1], sets[2], sets[3], sets[4], fields[2] == "*", fields[4] == "*"}
+	return schedule, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("Invalid step in %s", part)
+			}
+			part = part[:i]
+		}
+
+		begin, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			begin, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value %s", bounds[0])
+			}
+			end = begin
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("Invalid value %s", bounds[1])
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if begin < min || end > max || begin > end {
+			return nil, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+
+		for value := begin; value <= end; value += step {
+			set[value] = true
+		}
+	}
+
+	return set, nil
+}
+
+func (c cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Cron expressions matching no day, like February 30, never start a cycle
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (c cronSchedule) matchDay(t time.Time) bool {
+	day, weekday := c.days[t.Day()], c.weekdays[int(t.Weekday())]
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// plan returns when to start the cycle following the one scheduled at scheduled which finished at finished,
+// and how many starts were skipped because the cycle overran them
+func plan(schedule Schedule, overrun string, scheduled, finished time.Time) (time.Time, int) {
+	next := schedule.next(scheduled)
+	if next.IsZero() || next.After(finished) {
+		return next, 0
+	}
+
+	// Every start up to finished was missed, queue keeps only the latest of them
+	skipped := 0
+	for following := schedule.next(next); !following.IsZero() && !following.After(finished); following = schedule.next(next) {
+		next = following
+		skipped++
+	}
+	if overrun == overrunQueue {
+		return next, skipped
+	}
+
+	return schedule.next(finished), skipped + 1
+}
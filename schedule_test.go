@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEverySchedule(t *testing.T) {
+	schedule := everySchedule{15 * time.Minute}
+
+	assert.Equal(t, time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 7, 17, 34, 53, 0, time.UTC)))
+	assert.Equal(t, time.Date(2020, 7, 7, 18, 0, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2020, 7, 8, 0, 0, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 7, 23, 59, 59, 0, time.UTC)))
+}
+
+func TestParseCron(t *testing.T) {
+	schedule, err := parseCron("*/15 8-17 * * 1-5")
+	assert.Nil(t, err)
+
+	// Tuesday
+	assert.Equal(t, time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 7, 17, 34, 53, 0, time.UTC)))
+	// Friday evening to Monday morning
+	assert.Equal(t, time.Date(2020, 7, 13, 8, 0, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 10, 17, 45, 0, 0, time.UTC)))
+
+	schedule, err = parseCron("30 2 1,15 * 0")
+	assert.Nil(t, err)
+	// Either day of month or day of week matches when both are restricted
+	assert.Equal(t, time.Date(2020, 7, 12, 2, 30, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 7, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2020, 7, 15, 2, 30, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 12, 2, 30, 0, 0, time.UTC)))
+
+	schedule, err = parseCron("0 0 29 2 *")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), schedule.next(time.Date(2020, 7, 7, 0, 0, 0, 0, time.UTC)))
+
+	schedule, err = parseCron("0 0 30 2 *")
+	assert.Nil(t, err)
+	assert.True(t, schedule.next(time.Date(2020, 7, 7, 0, 0, 0, 0, time.UTC)).IsZero())
+
+	schedule, err = parseCron("5/20 * * * 7")
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]bool{5: true, 25: true, 45: true}, schedule.minutes)
+	assert.True(t, schedule.weekdays[0])
+
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *", "* * * * * *"} {
+		_, err = parseCron(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	schedule := everySchedule{15 * time.Minute}
+	scheduled := time.Date(2020, 7, 7, 17, 30, 0, 0, time.UTC)
+
+	next, skipped := plan(schedule, overrunSkip, scheduled, time.Date(2020, 7, 7, 17, 36, 30, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC), next)
+	assert.Equal(t, 0, skipped)
+
+	// The 17:45 cycle is skipped
+	next, skipped = plan(schedule, overrunSkip, scheduled, time.Date(2020, 7, 7, 17, 50, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 7, 7, 18, 0, 0, 0, time.UTC), next)
+	assert.Equal(t, 1, skipped)
+
+	// The 17:45 cycle starts late
+	next, skipped = plan(schedule, overrunQueue, scheduled, time.Date(2020, 7, 7, 17, 50, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 7, 7, 17, 45, 0, 0, time.UTC), next)
+	assert.Equal(t, 0, skipped)
+
+	// Only the latest of the 17:45, 18:00 and 18:15 cycles starts late
+	next, skipped = plan(schedule, overrunQueue, scheduled, time.Date(2020, 7, 7, 18, 20, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 7, 7, 18, 15, 0, 0, time.UTC), next)
+	assert.Equal(t, 2, skipped)
+
+	next, skipped = plan(schedule, overrunSkip, scheduled, time.Date(2020, 7, 7, 18, 20, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2020, 7, 7, 18, 30, 0, 0, time.UTC), next)
+	assert.Equal(t, 3, skipped)
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricsSource reads the resources used by the jobs of a Nomad cluster, see rssMetric, cacheMetric and ticksMetric
+type MetricsSource interface {
+	// JobUsage returns metric summed over every allocation of a job
+	JobUsage(ctx context.Context, metric string, job MetricsJob) (float64, error)
+	// TaskUsage returns metric of a job summed by task group and task
+	TaskUsage(ctx context.Context, metric string, job MetricsJob) (map[taskKey]float64, error)
+	// AllocUsage returns metric by allocation ID, for at least every allocation of a job the source has data for
+	AllocUsage(ctx context.Context, metric string, job MetricsJob) (map[string]float64, error)
+	// WindowUsage returns the statistics of metric summed over a job's allocations across window
+	WindowUsage(ctx context.Context, metric string, job MetricsJob, window time.Duration) (UsageStats, error)
+	// AllocSeconds returns metric integrated over window by allocation ID, in metric-seconds,
+	// or nil when the source keeps no history of usage
+	AllocSeconds(ctx context.Context, metric string, job MetricsJob, window time.Duration) (map[string]float64, error)
+}
+
+// MetricsJob is a job whose used resources are read. Nomad looks jobs up by ID in the namespace and region of
+// Cluster while metrics servers label series with the job's name and namespace.
+type MetricsJob struct {
+	Cluster   *NomadCluster
+	ID        string
+	Name      string
+	Namespace string
+}
+
+// NomadOnly reads used resources from the allocation stats of Nomad clients, for clusters without a metrics server.
+// Nomad keeps no history of usage so statistics over the collection window are always zero
+// and resource-seconds are never measured.
+type NomadOnly struct{}
+
+// JobUsage returns metric summed over every allocation of a job
+func (NomadOnly) JobUsage(ctx context.Context, metric string, job MetricsJob) (float64, error) {
+	var used float64
+
+	series, err := getNomadSeries(ctx, job)
+	if err != nil {
+		return 0, err
+	}
+	for _, value := range series[metric] {
+		used += value
+	}
+
+	return used, nil
+}
+
+// TaskUsage returns metric of a job summed by task group and task
+func (NomadOnly) TaskUsage(ctx context.Context, metric string, job MetricsJob) (map[taskKey]float64, error) {
+	series, err := getNomadSeries(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	taskUsage := make(map[taskKey]float64)
+	for labels, value := range series[metric] {
+		taskUsage[taskKey{labels.Task_group, labels.Task}] += value
+	}
+
+	return taskUsage, nil
+}
+
+// AllocUsage returns metric by allocation ID for every allocation of a job
+func (NomadOnly) AllocUsage(ctx context.Context, metric string, job MetricsJob) (map[string]float64, error) {
+	series, err := getNomadSeries(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	allocUsage := make(map[string]float64)
+	for labels, value := range series[metric] {
+		allocUsage[labels.Alloc_id] += value
+	}
+
+	return allocUsage, nil
+}
+
+// WindowUsage always returns zero statistics, Nomad only reports current usage
+func (NomadOnly) WindowUsage(ctx context.Context, metric string, job MetricsJob, window time.Duration) (UsageStats, error) {
+	return UsageStats{}, nil
+}
+
+// AllocSeconds always returns nil, Nomad only reports current usage
+func (NomadOnly) AllocSeconds(ctx context.Context, metric string, job MetricsJob, window time.Duration) (map[string]float64, error) {
+	return nil, nil
+}
+
+// getNomadSeries reads the stats of every running allocation of a job once per cycle, as series by task of each
+// metric labelled like those of a metrics server. Allocations that are not running are listed without usage,
+// allocations whose stats cannot be read are left out.
+func getNomadSeries(ctx context.Context, job MetricsJob) (map[string]map[MetricType]float64, error) {
+	cluster := job.Cluster
+	key := cluster.upstream() + "/" + cluster.Region + "/" + cluster.Namespace + "/" + job.ID
+	series, err := cached(ctx, key, func() (interface{}, error) {
+		allocs, err := getAllocs(ctx, cluster, job.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		var running []string
+		for _, alloc := range allocs {
+			if alloc.ClientStatus == "running" {
+				running = append(running, alloc.ID)
+			}
+		}
+		stats := getAllocStatsFanOut(ctx, cluster, running)
+
+		series := map[string]map[MetricType]float64{
+			rssMetric:   make(map[MetricType]float64),
+			cacheMetric: make(map[MetricType]float64),
+			ticksMetric: make(map[MetricType]float64),
+		}
+		add := func(labels MetricType, usage MemCPU) {
+			series[rssMetric][labels] += usage.MemoryStats.RSS
+			series[cacheMetric][labels] += usage.MemoryStats.Cache
+			series[ticksMetric][labels] += usage.CpuStats.TotalTicks
+		}
+
+		for _, alloc := range allocs {
+			labels := MetricType{job.Name, cluster.Namespace, alloc.ID, alloc.TaskGroup, ""}
+			if alloc.ClientStatus != "running" {
+				add(labels, MemCPU{})
+				continue
+			}
+			nomadAlloc, ok := stats[alloc.ID]
+			if !ok {
+				continue
+			}
+			if len(nomadAlloc.Tasks) == 0 {
+				add(labels, nomadAlloc.ResourceUsage)
+				continue
+			}
+			for name, task := range nomadAlloc.Tasks {
+				labels.Task = name
+				add(labels, task.ResourceUsage)
+			}
+		}
+
+		return series, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return series.(map[string]map[MetricType]float64), nil
+}
+
+// getAllocStatsFanOut reads the stats of allocations in parallel, at most the cluster's StatsWorkers (4 by default)
+// at once. Allocations whose stats cannot be read are logged, reported as unreachable and left out.
+func getAllocStatsFanOut(ctx context.Context, cluster *NomadCluster, allocIDs []string) map[string]NomadAlloc {
+	stats := make(map[string]NomadAlloc)
+
+	workers := cluster.StatsWorkers
+	if workers < 1 {
+		workers = 4
+	}
+
+	var lock sync.Mutex
+	var statsWG sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	for _, allocID := range allocIDs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			statsWG.Wait()
+			return stats
+		}
+		statsWG.Add(1)
+		go func(allocID string) {
+			defer statsWG.Done()
+			defer func() { <-slots }()
+
+			nomadAlloc, err := getAllocStats(ctx, cluster, allocID)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			lock.Lock()
+			stats[allocID] = nomadAlloc
+			lock.Unlock()
+		}(allocID)
+	}
+	statsWG.Wait()
+
+	return stats
+}
+
+type unreachableKey struct{}
+
+// UnreachableAlloc is an allocation whose stats could not be read from Nomad during a cycle
+type UnreachableAlloc struct {
+	Cluster string
+	AllocID string
+	Error   string
+}
+
+// unreachableAllocs collects the allocations of a cycle whose stats could not be read
+type unreachableAllocs struct {
+	lock   sync.Mutex
+	allocs map[string]UnreachableAlloc
+}
+
+func newUnreachableAllocs() *unreachableAllocs {
+	return &unreachableAllocs{allocs: make(map[string]UnreachableAlloc)}
+}
+
+// withUnreachableAllocs returns a copy of ctx whose allocations that cannot be reached are reported to unreachable
+func withUnreachableAllocs(ctx context.Context, unreachable *unreachableAllocs) context.Context {
+	return context.WithValue(ctx, unreachableKey{}, unreachable)
+}
+
+// reportUnreachable records that the stats of an allocation could not be read, when ctx collects them
+func reportUnreachable(ctx context.Context, cluster *NomadCluster, allocID string, err error) {
+	unreachable, ok := ctx.Value(unreachableKey{}).(*unreachableAllocs)
+	if !ok {
+		return
+	}
+
+	unreachable.lock.Lock()
+	defer unreachable.lock.Unlock()
+	unreachable.allocs[cluster.Name+"/"+allocID] = UnreachableAlloc{cluster.Name, allocID, err.Error()}
+}
+
+// list returns the unreachable allocations sorted by cluster and ID
+func (u *unreachableAllocs) list() []UnreachableAlloc {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	allocs := []UnreachableAlloc{}
+	for _, alloc := range u.allocs {
+		allocs = append(allocs, alloc)
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		if allocs[i].Cluster != allocs[j].Cluster {
+			return allocs[i].Cluster < allocs[j].Cluster
+		}
+		return allocs[i].AllocID < allocs[j].AllocID
+	})
+
+	return allocs
+}
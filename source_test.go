@@ -0,0 +1,217 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusSource(t *testing.T) {
+	server, requests := newFakeMetricsServer(prometheusDialect, 2, 2)
+	defer server.Close()
+	source := newPrometheus(server.Listener.Addr().String())
+
+	ctx := withMetricsCache(context.Background(), newMetricsCache())
+	job := MetricsJob{Name: "jobName1", Namespace: "default"}
+
+	used, err := source.JobUsage(ctx, rssMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, used)
+
+	tasks, err := source.TaskUsage(ctx, ticksMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, map[taskKey]float64{{"TaskGroup1", "web"}: 3}, tasks)
+
+	allocs, err := source.AllocUsage(ctx, cacheMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"alloc_id0_0": 1, "alloc_id0_1": 2, "alloc_id1_0": 1, "alloc_id1_1": 2}, allocs)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+
+	assert.Equal(t, "sum by (exported_job, namespace) (nomad_client_allocs_memory_rss)", prometheusDialect.jobQuery(rssMetric))
+
+	// Series named as in VictoriaMetrics are not found
+	used, err = newVictoriaMetrics(server.Listener.Addr().String()).JobUsage(ctx, rssMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, used)
+}
+
+func TestPrometheusSourceWindowUsage(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		w.Write([]byte(`
+			{
+				"status": "success",
+				"data": {
+					"resultType": "vector",
+					"result": [
+						{"metric": {"exported_job": "jobName", "namespace": "default"}, "value": [1597365496, "10"]}
+					]
+				}
+			}`))
+	}))
+	defer server.Close()
+
+	stats, err := newPrometheus(server.Listener.Addr().String()).WindowUsage(context.Background(), ticksMetric, MetricsJob{Name: "jobName", Namespace: "default"}, 5*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, UsageStats{10, 10, 10, 10, 10}, stats)
+	assert.Equal(t, "max_over_time(sum by (exported_job, namespace) (nomad_client_allocs_cpu_total_ticks)[300s:1m])", queries[1])
+}
+
+// newFakeNomadServer serves the allocations of jobID and the stats of those running, counting stats requests
+func newFakeNomadServer(jobID string) (*httptest.Server, *int32, *int32) {
+	var statsRequests, listRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/job/"+jobID:
+			w.Write([]byte(`{"TaskGroups": [{"Name": "TaskGroup1"}, {"Name": "TaskGroup2"}]}`))
+		case r.URL.Path == "/v1/job/"+jobID+"/allocations":
+			atomic.AddInt32(&listRequests, 1)
+			w.Write([]byte(`[
+				{"ID": "alloc1", "TaskGroup": "TaskGroup1", "ClientStatus": "running"},
+				{"ID": "alloc2", "TaskGroup": "TaskGroup1", "ClientStatus": "running"},
+				{"ID": "alloc3", "TaskGroup": "TaskGroup2", "ClientStatus": "complete"},
+				{"ID": "alloc4", "TaskGroup": "TaskGroup2", "ClientStatus": "running"}
+			]`))
+		case strings.HasPrefix(r.URL.Path, "/v1/client/allocation/"):
+			atomic.AddInt32(&statsRequests, 1)
+			allocID := strings.Split(r.URL.Path, "/")[4]
+			if allocID == "alloc4" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, `{
+				"Tasks": {
+					"web": {"ResourceUsage": {"MemoryStats": {"RSS": 1049000, "Cache": 2098000}, "CpuStats": {"TotalTicks": 100}}},
+					"sidecar": {"ResourceUsage": {"MemoryStats": {"RSS": 2098000, "Cache": 0}, "CpuStats": {"TotalTicks": 50}}}
+				}
+			}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return server, &statsRequests, &listRequests
+}
+
+func TestNomadOnlySource(t *testing.T) {
+	server, statsRequests, listRequests := newFakeNomadServer("jobID")
+	defer server.Close()
+	cluster := &NomadCluster{Address: server.Listener.Addr().String(), Metrics: NomadOnly{}}
+
+	unreachable := newUnreachableAllocs()
+	ctx := withUnreachableAllocs(withMetricsCache(context.Background(), newMetricsCache()), unreachable)
+	job := MetricsJob{cluster, "jobID", "jobName", "default"}
+
+	_, err := getAllocs(ctx, cluster, "jobID")
+	assert.Nil(t, err)
+
+	used, err := NomadOnly{}.JobUsage(ctx, ticksMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, 300.0, used)
+
+	tasks, err := NomadOnly{}.TaskUsage(ctx, rssMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, map[taskKey]float64{{"TaskGroup1", "web"}: 2098000, {"TaskGroup1", "sidecar"}: 4196000, {"TaskGroup2", ""}: 0}, tasks)
+
+	allocs, err := NomadOnly{}.AllocUsage(ctx, cacheMetric, job)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]float64{"alloc1": 2098000, "alloc2": 2098000, "alloc3": 0}, allocs)
+
+	stats, err := NomadOnly{}.WindowUsage(ctx, rssMetric, job, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, UsageStats{}, stats)
+
+	seconds, err := NomadOnly{}.AllocSeconds(ctx, rssMetric, job, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, seconds)
+
+	// Stats are read once per cycle, from the allocations listed once per cycle
+	assert.Equal(t, int32(3), atomic.LoadInt32(statsRequests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(listRequests))
+
+	// Nothing is left to fall back to
+	rss, ticks, cache, _ := aggUsed(ctx, cluster, "jobID", "jobName", listAllocs(cluster, "jobID"))
+	assert.Equal(t, 6.0, rss)
+	assert.Equal(t, 300.0, ticks)
+	assert.Equal(t, 4.0, cache)
+	allocData := aggAllocs(ctx, cluster, "jobID", "jobName", jobSpecOf(cluster, "jobID"), listAllocs(cluster, "jobID"))
+	assert.Equal(t, 3, len(allocData))
+	assert.Equal(t, "alloc4", allocData[2].AllocID)
+	assert.Equal(t, 0.0, allocData[2].URSS)
+	assert.Equal(t, int32(3), atomic.LoadInt32(statsRequests))
+
+	unreachableAllocs := unreachable.list()
+	assert.Equal(t, 1, len(unreachableAllocs))
+	assert.Equal(t, "alloc4", unreachableAllocs[0].AllocID)
+
+	_, err = NomadOnly{}.JobUsage(ctx, rssMetric, MetricsJob{cluster, "missingJob", "missingJob", "default"})
+	assert.Error(t, err)
+}
+
+func TestGetAllocStatsFanOut(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if strings.Contains(r.URL.Path, "unreachable") {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"ResourceUsage": {"MemoryStats": {"RSS": 1049000}}}`))
+	}))
+	defer server.Close()
+	cluster := &NomadCluster{Name: "cluster1", Address: server.Listener.Addr().String(), StatsWorkers: 3}
+
+	var allocIDs []string
+	for i := 0; i < 10; i++ {
+		allocIDs = append(allocIDs, fmt.Sprintf("alloc%d", i))
+	}
+	allocIDs = append(allocIDs, "unreachable1", "unreachable2")
+
+	unreachable := newUnreachableAllocs()
+	stats := getAllocStatsFanOut(withUnreachableAllocs(context.Background(), unreachable), cluster, allocIDs)
+	assert.Equal(t, 10, len(stats))
+	assert.Equal(t, 1049000.0, stats["alloc9"].ResourceUsage.MemoryStats.RSS)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxInFlight))
+
+	unreachableAllocs := unreachable.list()
+	assert.Equal(t, 2, len(unreachableAllocs))
+	assert.Equal(t, UnreachableAlloc{"cluster1", "unreachable1", unreachableAllocs[0].Error}, unreachableAllocs[0])
+	assert.Equal(t, "unreachable2", unreachableAllocs[1].AllocID)
+
+	// Without a collector nothing is reported
+	reportUnreachable(context.Background(), cluster, "alloc1", fmt.Errorf("Error"))
+	assert.Equal(t, 2, len(unreachable.list()))
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// SpecCache holds the parsed spec of every job across cycles. A spec is only fetched again once the job's
+// JobModifyIndex, listed by /v1/jobs or the event stream, passes the X-Nomad-Index the spec was read at.
+// Only the first lookup of a job after each listing counts towards the hit ratio.
+type SpecCache struct {
+	lock    sync.Mutex
+	entries map[string]*specEntry
+	hits    uint64
+	misses  uint64
+}
+
+type specEntry struct {
+	spec JobSpec
+	// index is the X-Nomad-Index the spec was read at, zero until it is read
+	index uint64
+	// modifyIndex is the JobModifyIndex the job was last listed with, zero until it is listed
+	modifyIndex uint64
+	seen        time.Time
+	// counted is set once a lookup since the job was last listed counted as a hit or miss
+	counted bool
+}
+
+// CacheStats reports how often a cache answered without a request to Nomad
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	HitRatio float64
+	Entries  int
+}
+
+var specCache = newSpecCache()
+
+func newSpecCache() *SpecCache {
+	return &SpecCache{entries: make(map[string]*specEntry)}
+}
+
+// specKey names a job across clusters, regions and namespaces
+func specKey(cluster *NomadCluster, jobID string) string {
+	return cluster.upstream() + "/" + cluster.Region + "/" + namespaceOf(cluster.Namespace) + "/" + jobID
+}
+
+// observe records the JobModifyIndex of the jobs listed in the cluster's namespace, and drops the specs of jobs
+// not listed for two collection windows
+func (c *SpecCache) observe(cluster *NomadCluster, jobs []JobDesc) {
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, job := range jobs {
+		key := specKey(cluster, job.ID)
+		entry, ok := c.entries[key]
+		if !ok {
+			entry = &specEntry{}
+			c.entries[key] = entry
+		}
+		entry.modifyIndex = job.JobModifyIndex
+		entry.seen = now
+		entry.counted = false
+	}
+
+	for key, entry := range c.entries {
+		if now.Sub(entry.seen) > 2*collectionWindow {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// get returns the cached spec of a job when it was read at or after the job's last listed modification
+func (c *SpecCache) get(key string) (JobSpec, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	hit := ok && entry.index != 0 && entry.modifyIndex != 0 && entry.index >= entry.modifyIndex
+	switch {
+	case ok && entry.counted:
+	case hit:
+		c.hits++
+	default:
+		c.misses++
+	}
+	if ok {
+		entry.counted = true
+	}
+	if !hit {
+		return JobSpec{}, false
+	}
+
+	return entry.spec, true
+}
+
+// put caches the spec of a job read at index, specs read without an index are not cached
+func (c *SpecCache) put(key string, spec JobSpec, index uint64) {
+	if index == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &specEntry{seen: time.Now()}
+		c.entries[key] = entry
+	}
+	entry.spec = spec
+	entry.index = index
+}
+
+func (c *SpecCache) stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{c.hits, c.misses, hitRatio(c.hits, c.misses), len(c.entries)}
+}
+
+func hitRatio(hits, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
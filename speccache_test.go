@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Roblox Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+	
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecCache(t *testing.T) {
+	saved := specCache
+	specCache = newSpecCache()
+	defer func() { specCache = saved }()
+
+	var modifyIndex, specRequests int32 = 5, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index := atomic.LoadInt32(&modifyIndex)
+		switch r.URL.Path {
+		case "/v1/jobs":
+			w.Header().Set("X-Nomad-Index", "100")
+			w.Write([]byte(`[{"ID": "jobID", "Name": "jobID", "Type": "service", "JobModifyIndex": ` + fmt.Sprint(index) + `}]`))
+		case "/v1/job/jobID":
+			atomic.AddInt32(&specRequests, 1)
+			w.Header().Set("X-Nomad-Index", fmt.Sprint(index))
+			w.Write([]byte(`{"TaskGroups": [{"Name": "TaskGroup1", "Count": ` + fmt.Sprint(index) + `}]}`))
+		case "/v1/job/unindexed":
+			atomic.AddInt32(&specRequests, 1)
+			w.Write([]byte(`{"TaskGroups": []}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	cluster := &NomadCluster{Name: "cluster1", Address: strings.TrimPrefix(server.URL, "http://"), Namespace: "default"}
+
+	// Specs of jobs not listed yet are always read
+	getJobSpec(context.Background(), cluster, "jobID")
+	jobs, err := getJobs(context.Background(), cluster)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), jobs[0].JobModifyIndex)
+
+	for i := 0; i < 3; i++ {
+		jobSpec, err := getJobSpec(context.Background(), cluster, "jobID")
+		assert.Nil(t, err)
+		assert.Equal(t, 5.0, jobSpec.TaskGroups[0].Count)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&specRequests))
+
+	// A modified job is read again once listed
+	atomic.StoreInt32(&modifyIndex, 7)
+	jobSpec, _ := getJobSpec(context.Background(), cluster, "jobID")
+	assert.Equal(t, 5.0, jobSpec.TaskGroups[0].Count)
+	getJobs(context.Background(), cluster)
+	jobSpec, _ = getJobSpec(context.Background(), cluster, "jobID")
+	assert.Equal(t, 7.0, jobSpec.TaskGroups[0].Count)
+	getJobSpec(context.Background(), cluster, "jobID")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&specRequests))
+
+	// Specs read without X-Nomad-Index are not cached
+	getJobSpec(context.Background(), cluster, "unindexed")
+	getJobSpec(context.Background(), cluster, "unindexed")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&specRequests))
+
+	// Repeated lookups between two listings are counted once
+	stats := specCache.stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(4), stats.Misses)
+	assert.Equal(t, 1.0/5, stats.HitRatio)
+	assert.Equal(t, 1, stats.Entries)
+
+	// Jobs no longer listed are dropped
+	window := collectionWindow
+	collectionWindow = time.Millisecond
+	defer func() { collectionWindow = window }()
+	time.Sleep(5 * time.Millisecond)
+	specCache.observe(cluster, nil)
+	assert.Equal(t, 0, specCache.stats().Entries)
+}
+
+func TestSpecCacheHitRatio(t *testing.T) {
+	saved := specCache
+	specCache = newSpecCache()
+	defer func() { specCache = saved }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/jobs":
+			w.Write([]byte(`[{"ID": "jobID", "Name": "jobID", "Type": "service", "JobModifyIndex": 5}, {"ID": "other", "Name": "other", "Type": "service", "JobModifyIndex": 5}]`))
+		case "/v1/job/jobID", "/v1/job/other":
+			w.Header().Set("X-Nomad-Index", "5")
+			w.Write([]byte(`{"TaskGroups": []}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	cluster := &NomadCluster{Name: "cluster1", Address: strings.TrimPrefix(server.URL, "http://"), Namespace: "default"}
+
+	// Every job misses in the first cycle and hits in the second, however often it is looked up
+	for cycle := 0; cycle < 2; cycle++ {
+		jobs, err := getJobs(context.Background(), cluster)
+		assert.Nil(t, err)
+		for _, job := range jobs {
+			for i := 0; i < 3; i++ {
+				getJobSpec(context.Background(), cluster, job.ID)
+			}
+		}
+	}
+
+	stats := specCache.stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 0.5, stats.HitRatio)
+}